@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStaleDays is how long a grant may go unused before an access review flags it
+const DefaultStaleDays = 90
+
+// AccessReviewOptions selects what an access review covers
+type AccessReviewOptions struct {
+	// Types limits the review to objects of these types, every type when empty
+	Types []string
+	// StaleDays flags grants older than this many days that no allowed decision used within
+	// them, DefaultStaleDays when 0
+	StaleDays int
+	// Now is when the review is taken, time.Now when zero
+	Now time.Time
+	// Decisions are read for usage instead of the engine's decision log when not nil, so
+	// a review can cover decisions recorded before a restart or beyond the log's size
+	Decisions []Decision
+}
+
+// Query encodes the options as /reports/access query parameters; Decisions go in the body
+func (o AccessReviewOptions) Query() url.Values {
+	q := url.Values{}
+	if len(o.Types) > 0 {
+		q.Set("types", strings.Join(o.Types, ","))
+	}
+	if o.StaleDays != 0 {
+		q.Set("stale_days", strconv.Itoa(o.StaleDays))
+	}
+	return q
+}
+
+// ParseAccessReviewOptions reads AccessReviewOptions from /reports/access query parameters
+func ParseAccessReviewOptions(q url.Values) (AccessReviewOptions, error) {
+	var opts AccessReviewOptions
+	for _, typ := range strings.Split(q.Get("types"), ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			opts.Types = append(opts.Types, typ)
+		}
+	}
+	if v := q.Get("stale_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return opts, fmt.Errorf("invalid stale_days %q", v)
+		}
+		opts.StaleDays = days
+	}
+	return opts, nil
+}
+
+// AccessGrant is a subject's access to a resource through one tuple. GrantedAt and
+// GrantedBy describe the tuple on the resource, for a group that is the grant to the group.
+type AccessGrant struct {
+	Resource string `json:"resource"`
+	Relation string `json:"relation"`
+	Subject  string `json:"subject"`
+	// Via lists the usersets the subject holds the relation through, outermost first;
+	// empty for a direct tuple
+	Via       []string   `json:"via,omitempty"`
+	GrantedAt time.Time  `json:"granted_at"`
+	GrantedBy string     `json:"granted_by,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Stale     bool       `json:"stale"`
+	// StaleUnknown is set instead of Stale for an old grant without use in the log when
+	// the log does not reach back StaleDays
+	StaleUnknown bool `json:"stale_unknown,omitempty"`
+}
+
+// AccessReview lists every subject holding a relation on the reviewed objects
+type AccessReview struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	StaleDays   int       `json:"stale_days"`
+	// DecisionsSince is the oldest decision read, nil when there were none; use before it
+	// is unknown, so grants that may have been used only then are StaleUnknown
+	DecisionsSince *time.Time    `json:"decisions_since,omitempty"`
+	Grants         []AccessGrant `json:"grants"`
+}
+
+// reviewSkipsRelation reports relations that wire up the engine rather than grant access
+func reviewSkipsRelation(t RelationTuple) bool {
+	return t.Relation == relationHasPolicy || t.Relation == RelationParent || t.Subject == resourceMarker
+}
+
+// AccessReview lists, for every object of the selected types, the subjects holding each
+// relation directly or through usersets, when and by whom the granting tuple was written and
+// when an allowed decision last used it. Usage comes from opts.Decisions, or from the
+// decision log when they are nil, in which case only the engine's recent decisions count.
+func (e *Engine) AccessReview(opts AccessReviewOptions) *AccessReview {
+	if opts.StaleDays == 0 {
+		opts.StaleDays = DefaultStaleDays
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	review := &AccessReview{GeneratedAt: opts.Now, StaleDays: opts.StaleDays, Grants: []AccessGrant{}}
+
+	type usageKey struct {
+		resource, subject ObjectRef
+		action            string
+	}
+	decisions := opts.Decisions
+	if decisions == nil && e.decisions != nil {
+		decisions = e.decisions.Snapshot()
+	}
+	lastUsed := make(map[usageKey]time.Time)
+	for _, d := range decisions {
+		if review.DecisionsSince == nil || d.Time.Before(*review.DecisionsSince) {
+			since := d.Time
+			review.DecisionsSince = &since
+		}
+		k := usageKey{resource: d.Resource, subject: d.Subject, action: d.Action}
+		if d.Allowed && d.Time.After(lastUsed[k]) {
+			lastUsed[k] = d.Time
+		}
+	}
+
+	var grants []RelationTuple
+	metas := make(map[RelationTuple]TupleMeta)
+	_ = e.graph.ForEachTupleMeta(func(t RelationTuple, meta TupleMeta) error {
+		if reviewSkipsRelation(t) || (len(opts.Types) > 0 && !containsString(opts.Types, t.Object.Type)) {
+			return nil
+		}
+		grants = append(grants, t)
+		metas[t] = meta
+		return nil
+	})
+
+	cutoff := opts.Now.AddDate(0, 0, -opts.StaleDays)
+	// a log that starts after the cutoff may have dropped the use that keeps a grant fresh
+	logCovers := review.DecisionsSince != nil && !review.DecisionsSince.After(cutoff)
+	maxDepth := e.checkOpts.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxCheckDepth
+	}
+	for _, t := range grants {
+		meta := metas[t]
+		for _, m := range e.reviewMembers(t.Subject, nil, maxDepth) {
+			g := AccessGrant{
+				Resource:  t.Object.String(),
+				Relation:  t.Relation,
+				Subject:   m.subject.String(),
+				Via:       m.via,
+				GrantedAt: meta.CreatedAt,
+				GrantedBy: meta.CreatedBy,
+			}
+			if used, ok := lastUsed[usageKey{resource: t.Object, subject: m.subject, action: t.Relation}]; ok {
+				g.LastUsed = &used
+			}
+			if g.GrantedAt.Before(cutoff) && (g.LastUsed == nil || g.LastUsed.Before(cutoff)) {
+				g.Stale, g.StaleUnknown = logCovers, !logCovers
+			}
+			review.Grants = append(review.Grants, g)
+		}
+	}
+	sort.Slice(review.Grants, func(i, j int) bool {
+		a, b := review.Grants[i], review.Grants[j]
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		if a.Relation != b.Relation {
+			return a.Relation < b.Relation
+		}
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		return strings.Join(a.Via, ">") < strings.Join(b.Via, ">")
+	})
+	return review
+}
+
+// reviewMember is a concrete subject reached from a grant, with the usersets on the way
+type reviewMember struct {
+	subject ObjectRef
+	via     []string
+}
+
+// reviewMembers expands a granted subject into the concrete subjects behind it; a userset
+// already on the path is a cycle and is not followed again
+func (e *Engine) reviewMembers(s SubjectRef, via []string, depth int) []reviewMember {
+	if s.Relation == "" {
+		return []reviewMember{{subject: s.Object, via: via}}
+	}
+	userset := s.String()
+	if depth == 0 || containsString(via, userset) {
+		return nil
+	}
+	path := append(append([]string(nil), via...), userset)
+	subjects := e.graph.GetSubjects(s.Object, s.Relation)
+	sort.Slice(subjects, func(i, j int) bool { return subjects[i].String() < subjects[j].String() })
+	var members []reviewMember
+	for _, sub := range subjects {
+		members = append(members, e.reviewMembers(sub, path, depth-1)...)
+	}
+	return members
+}
+
+// WriteCSV writes the grants with a header row, times in RFC 3339, Via joined by " > "
+// and stale as true, false or unknown
+func (r *AccessReview) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"resource", "relation", "subject", "via", "granted_at", "granted_by", "last_used", "stale"}); err != nil {
+		return err
+	}
+	for _, g := range r.Grants {
+		grantedAt, lastUsed := "", ""
+		if !g.GrantedAt.IsZero() {
+			grantedAt = g.GrantedAt.UTC().Format(time.RFC3339)
+		}
+		if g.LastUsed != nil {
+			lastUsed = g.LastUsed.UTC().Format(time.RFC3339)
+		}
+		stale := strconv.FormatBool(g.Stale)
+		if g.StaleUnknown {
+			stale = "unknown"
+		}
+		row := []string{g.Resource, g.Relation, g.Subject, strings.Join(g.Via, " > "), grantedAt, g.GrantedBy, lastUsed, stale}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var reviewNow = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func daysAgo(days int) time.Time {
+	return reviewNow.AddDate(0, 0, -days)
+}
+
+func reviewEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	doc := engine.CreateResource("document", "plan")
+	require.NoError(t, engine.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(doc, "p"))
+	require.NoError(t, engine.SetParent(doc, ObjectRef{Type: "folder", ObjectID: "eng"}))
+	for line, meta := range map[string]TupleMeta{
+		"document:plan#read@user:alice":         {CreatedAt: daysAgo(200), CreatedBy: "user:root"},
+		"document:plan#read@group:eng#member":   {CreatedAt: daysAgo(200), CreatedBy: "user:root"},
+		"document:plan#write@user:dave":         {CreatedAt: daysAgo(5), CreatedBy: "user:bob"},
+		"group:eng#member@user:bob":             {CreatedAt: daysAgo(300)},
+		"group:eng#member@team:frontend#member": {CreatedAt: daysAgo(300)},
+		"team:frontend#member@user:carol":       {CreatedAt: daysAgo(300)},
+		"team:frontend#member@group:eng#member": {CreatedAt: daysAgo(300)}, // a cycle
+	} {
+		tuple, err := ParseTuple(line)
+		require.NoError(t, err)
+		engine.graph.WriteWithMeta(tuple, meta)
+	}
+	alice := ObjectRef{Type: "user", ObjectID: "alice"}
+	engine.decisions.Record(Decision{Time: daysAgo(10), Resource: doc, Subject: alice, Action: "read", Allowed: true})
+	// denied and old decisions do not count as use
+	engine.decisions.Record(Decision{Time: daysAgo(1), Resource: doc, Subject: ObjectRef{Type: "user", ObjectID: "bob"}, Action: "read"})
+	engine.decisions.Record(Decision{Time: daysAgo(120), Resource: doc, Subject: ObjectRef{Type: "user", ObjectID: "carol"}, Action: "read", Allowed: true})
+	return engine
+}
+
+func TestEngine_AccessReview(t *testing.T) {
+	engine := reviewEngine(t)
+	review := engine.AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow})
+	assert.Equal(t, DefaultStaleDays, review.StaleDays)
+	require.NotNil(t, review.DecisionsSince)
+	assert.Equal(t, daysAgo(120), *review.DecisionsSince, "the oldest decision, whatever order they were recorded in")
+
+	used := daysAgo(10)
+	carolUsed := daysAgo(120)
+	assert.Equal(t, []AccessGrant{
+		{Resource: "document:plan", Relation: "read", Subject: "user:alice", GrantedAt: daysAgo(200), GrantedBy: "user:root", LastUsed: &used},
+		{Resource: "document:plan", Relation: "read", Subject: "user:bob", Via: []string{"group:eng#member"}, GrantedAt: daysAgo(200), GrantedBy: "user:root", Stale: true},
+		{Resource: "document:plan", Relation: "read", Subject: "user:carol", Via: []string{"group:eng#member", "team:frontend#member"}, GrantedAt: daysAgo(200), GrantedBy: "user:root", LastUsed: &carolUsed, Stale: true},
+		{Resource: "document:plan", Relation: "write", Subject: "user:dave", GrantedAt: daysAgo(5), GrantedBy: "user:bob"},
+	}, review.Grants)
+
+	// without a type filter group memberships are reviewed too
+	review = engine.AccessReview(AccessReviewOptions{StaleDays: 365, Now: reviewNow})
+	var resources []string
+	for _, g := range review.Grants {
+		resources = append(resources, g.Resource)
+		assert.False(t, g.Stale, "%+v", g)
+	}
+	assert.Contains(t, resources, "group:eng")
+	assert.Contains(t, resources, "team:frontend")
+	assert.NotContains(t, resources, "folder:eng")
+}
+
+func TestEngine_AccessReviewTruncatedLog(t *testing.T) {
+	engine := reviewEngine(t)
+	// a short log that has overwritten everything older than a day
+	engine.decisions = NewDecisionLog(2)
+	engine.decisions.Record(Decision{Time: daysAgo(1), Resource: plan, Subject: ObjectRef{Type: "user", ObjectID: "bob"}, Action: "read"})
+	engine.decisions.Record(Decision{Time: daysAgo(1), Resource: plan, Subject: ObjectRef{Type: "user", ObjectID: "dave"}, Action: "write", Allowed: true})
+
+	review := engine.AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow})
+	require.NotNil(t, review.DecisionsSince)
+	assert.Equal(t, daysAgo(1), *review.DecisionsSince)
+	require.Len(t, review.Grants, 4)
+	for _, g := range review.Grants {
+		assert.False(t, g.Stale, "%+v", g)
+		assert.Equal(t, g.Subject != "user:dave", g.StaleUnknown, "%+v", g)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, review.WriteCSV(&buf))
+	assert.Contains(t, buf.String(), ",user:root,,unknown\n")
+
+	// an empty log says nothing about use either
+	engine.decisions = NewDecisionLog(2)
+	review = engine.AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow})
+	assert.Nil(t, review.DecisionsSince)
+	assert.True(t, review.Grants[0].StaleUnknown)
+
+	// a log reaching past the cutoff does flag the grant
+	engine.decisions.Record(Decision{Time: daysAgo(91), Resource: plan, Subject: ObjectRef{Type: "user", ObjectID: "erin"}, Action: "read"})
+	review = engine.AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow})
+	assert.True(t, review.Grants[0].Stale)
+	assert.False(t, review.Grants[0].StaleUnknown)
+}
+
+func TestEngine_AccessReviewGivenDecisions(t *testing.T) {
+	engine := reviewEngine(t)
+	// as after a restart: the log is empty, the decisions were kept elsewhere
+	engine.decisions = NewDecisionLog(2)
+	bob := ObjectRef{Type: "user", ObjectID: "bob"}
+	decisions := []Decision{
+		{Time: daysAgo(180), Resource: plan, Subject: bob, Action: "write"},
+		{Time: daysAgo(30), Resource: plan, Subject: bob, Action: "read", Allowed: true},
+	}
+	review := engine.AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow, Decisions: decisions})
+	require.NotNil(t, review.DecisionsSince)
+	assert.Equal(t, daysAgo(180), *review.DecisionsSince)
+	require.Len(t, review.Grants, 4)
+	byUser := map[string]AccessGrant{}
+	for _, g := range review.Grants {
+		byUser[g.Subject] = g
+		assert.False(t, g.StaleUnknown, "%+v", g)
+	}
+	require.NotNil(t, byUser["user:bob"].LastUsed)
+	assert.Equal(t, daysAgo(30), *byUser["user:bob"].LastUsed)
+	assert.False(t, byUser["user:bob"].Stale)
+	assert.True(t, byUser["user:alice"].Stale, "alice's use was only in the engine's old log")
+
+	// an empty list is no use at all, not the decision log
+	review = engine.AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow, Decisions: []Decision{}})
+	assert.Nil(t, review.DecisionsSince)
+}
+
+func TestReadDecisions(t *testing.T) {
+	decisions, err := ReadDecisions(strings.NewReader(`{"time":"2026-09-01T00:00:00Z","resource":{"Type":"document","ObjectID":"plan"},"subject":{"Type":"user","ObjectID":"bob"},"action":"read","allowed":true}
+{"time":"2026-09-02T00:00:00Z","resource":{"Type":"document","ObjectID":"plan"},"subject":{"Type":"user","ObjectID":"eve"},"action":"read"}
+`))
+	require.NoError(t, err)
+	require.Len(t, decisions, 2)
+	assert.Equal(t, plan, decisions[0].Resource)
+	assert.True(t, decisions[0].Allowed)
+	assert.False(t, decisions[1].Allowed)
+
+	decisions, err = ReadDecisions(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.NotNil(t, decisions, "an empty file still replaces the decision log")
+
+	_, err = ReadDecisions(strings.NewReader(`{"time":"2026-09-01T00:00:00Z"}` + "\n{"))
+	assert.ErrorContains(t, err, "decision 2")
+}
+
+func TestAccessReview_WriteCSV(t *testing.T) {
+	review := reviewEngine(t).AccessReview(AccessReviewOptions{Types: []string{"document"}, Now: reviewNow})
+	var buf bytes.Buffer
+	require.NoError(t, review.WriteCSV(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, "resource,relation,subject,via,granted_at,granted_by,last_used,stale", lines[0])
+	assert.Equal(t, "document:plan,read,user:carol,group:eng#member > team:frontend#member,2026-03-15T12:00:00Z,user:root,2026-06-03T12:00:00Z,true", lines[3])
+	assert.Equal(t, "document:plan,write,user:dave,,2026-09-26T12:00:00Z,user:bob,,false", lines[4])
+}
+
+func TestService_AccessReviewRecordsWriter(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	service := NewService(engine)
+	service.Auth = NewAPIKeyAuthenticator(map[string]ObjectRef{"root": {Type: "user", ObjectID: "root"}})
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	require.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/relation", "root", AddRelationQueryRequest{Query: "document:plan user:alice->read"}))
+
+	get := func(query string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/reports/access?"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set(APIKeyHeader, "root")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := get("types=document")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var review AccessReview
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+	require.Len(t, review.Grants, 1)
+	assert.Equal(t, "user:root", review.Grants[0].GrantedBy)
+	assert.False(t, review.Grants[0].Stale)
+
+	resp = get("types=document&format=csv&stale_days=30")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	assert.Equal(t, http.StatusBadRequest, get("stale_days=soon").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, get("format=xlsx").StatusCode)
+
+	// posted decisions take the place of the decision log
+	used := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	body, err := json.Marshal(AccessReviewRequest{Decisions: []Decision{
+		{Time: used, Resource: ObjectRef{Type: "document", ObjectID: "plan"}, Subject: ObjectRef{Type: "user", ObjectID: "alice"}, Action: "read", Allowed: true},
+	}})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/reports/access?types=document", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set(APIKeyHeader, "root")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	review = AccessReview{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+	require.Len(t, review.Grants, 1)
+	require.NotNil(t, review.Grants[0].LastUsed)
+	assert.True(t, used.Equal(*review.Grants[0].LastUsed))
+	require.NotNil(t, review.DecisionsSince)
+	assert.True(t, used.Equal(*review.DecisionsSince))
+}
+
+func TestCLI_AccessReview(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "graph.ndjson")
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"write", "-data", data, "document:x#read@group:eng#member"}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "group:eng#member@user:bob"}, nil, &out))
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"report", "access", "-data", data, "-types", "document"}, nil, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[1], "document:x,read,user:bob,group:eng#member,"), lines[1])
+	assert.True(t, strings.HasSuffix(lines[1], ",false"), "a grant written just now is not stale")
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"report", "access", "-data", data, "-format", "json"}, nil, &out))
+	var review AccessReview
+	require.NoError(t, json.Unmarshal(out.Bytes(), &review))
+	assert.Len(t, review.Grants, 2)
+	assert.Nil(t, review.DecisionsSince, "a snapshot has no decision log")
+
+	decisions := filepath.Join(t.TempDir(), "decisions.jsonl")
+	require.NoError(t, os.WriteFile(decisions, []byte(`{"time":"2026-09-01T00:00:00Z","resource":{"Type":"document","ObjectID":"x"},"subject":{"Type":"user","ObjectID":"bob"},"action":"read","allowed":true}`+"\n"), 0o644))
+	out.Reset()
+	require.NoError(t, runCLI([]string{"report", "access", "-data", data, "-types", "document", "-decisions", decisions}, nil, &out))
+	assert.Contains(t, out.String(), ",2026-09-01T00:00:00Z,false\n")
+	assert.Error(t, runCLI([]string{"report", "access", "-data", data, "-decisions", filepath.Join(t.TempDir(), "missing.jsonl")}, nil, &out))
+
+	assert.Error(t, runCLI([]string{"report", "usage", "-data", data}, nil, &out))
+}
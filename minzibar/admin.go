@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// AdminPermission is an administrative capability. Who holds it is itself stored as
+// relation tuples in an admin Engine, so admin access is managed like any other access:
+//
+//	service:minzibar#write_policies@role:authz-admin#member
+//	role:authz-admin#member@user:alice
+type AdminPermission string
+
+const (
+	// PermWritePolicies allows adding, attaching and dry-running policies and registering templates
+	PermWritePolicies AdminPermission = "write_policies"
+	// PermWriteRelations allows creating resources and writing or importing tuples
+	PermWriteRelations AdminPermission = "write_relations"
+	// PermExport allows dumping a whole snapshot and inspecting indexes
+	PermExport AdminPermission = "export"
+	// PermManageTenants allows creating, deleting and setting quotas of tenants
+	PermManageTenants AdminPermission = "manage_tenants"
+)
+
+// AdminPermissions lists every permission, in the order they are granted by NewAdminEngine
+var AdminPermissions = []AdminPermission{PermWritePolicies, PermWriteRelations, PermExport, PermManageTenants}
+
+// AdminObject is the object admin permissions are checked on. With tenants, a permission
+// on tenant:<id> covers that tenant only.
+var AdminObject = ObjectRef{Type: "service", ObjectID: "minzibar"}
+
+// AdminRole is the role granted every admin permission by NewAdminEngine
+var AdminRole = SubjectRef{Object: ObjectRef{Type: "role", ObjectID: "authz-admin"}, Relation: "member"}
+
+// NewAdminEngine returns an engine granting every admin permission to role:authz-admin#member
+// and making each of admins a member of it. More tuples can be imported into it, e.g.
+// "service:minzibar#write_relations@role:writer#member".
+func NewAdminEngine(admins ...ObjectRef) *Engine {
+	e := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	for _, perm := range AdminPermissions {
+		e.graph.Write(RelationTuple{Object: AdminObject, Relation: string(perm), Subject: AdminRole})
+	}
+	for _, admin := range admins {
+		e.graph.Write(RelationTuple{Object: AdminRole.Object, Relation: AdminRole.Relation, Subject: SubjectRef{Object: admin}})
+	}
+	return e
+}
+
+// AuthorizeAdmin reports whether subject holds perm on the whole service or, when tenant
+// is set, on tenant:<tenant>
+func (e *Engine) AuthorizeAdmin(ctx context.Context, subject ObjectRef, perm AdminPermission, tenant string) (bool, error) {
+	ok, err := e.graph.CheckDeep(ctx, AdminObject, string(perm), SubjectRef{Object: subject}, e.checkOpts)
+	if ok || err != nil || tenant == "" {
+		return ok, err
+	}
+	ok, err = e.graph.CheckDeep(ctx, ObjectRef{Type: "tenant", ObjectID: tenant}, string(perm), SubjectRef{Object: subject}, e.checkOpts)
+	if err != nil {
+		return false, fmt.Errorf("tenant %s: %w", tenant, err)
+	}
+	return ok, nil
+}
+
+// TenantMember is the relation on tenant:<id> that lets a caller use that tenant, e.g.
+// "tenant:acme#member@user:alice"
+const TenantMember = "member"
+
+// AuthorizeTenant reports whether subject may use tenant: as a member of tenant:<tenant>,
+// as one of its admins, or as an admin of the whole service
+func (e *Engine) AuthorizeTenant(ctx context.Context, subject ObjectRef, tenant string) (bool, error) {
+	ok, err := e.graph.CheckDeep(ctx, ObjectRef{Type: "tenant", ObjectID: tenant}, TenantMember, SubjectRef{Object: subject}, e.checkOpts)
+	if ok || err != nil {
+		return ok, err
+	}
+	for _, perm := range AdminPermissions {
+		if ok, err := e.AuthorizeAdmin(ctx, subject, perm, tenant); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
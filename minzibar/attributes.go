@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AttributeProvider supplies the attributes of an object, such as the department of
+// user:alice. Verify asks providers for the subject.* and resource.* keys a policy
+// references and the caller did not pass. An object without attributes is an empty map,
+// an error fails the check.
+type AttributeProvider interface {
+	Attributes(ctx context.Context, obj ObjectRef) (map[string]string, error)
+}
+
+const (
+	// SubjectAttributePrefix prefixes subject attributes in a policy, e.g. subject.department
+	SubjectAttributePrefix = "subject."
+	// ResourceAttributePrefix prefixes resource attributes in a policy, e.g. resource.classification
+	ResourceAttributePrefix = "resource."
+)
+
+// AddAttributeProvider registers a provider. Providers are asked in the order they were
+// added and an earlier provider's value wins; a key passed by the caller always wins.
+func (e *Engine) AddAttributeProvider(p AttributeProvider) {
+	e.attributes = append(e.attributes, p)
+}
+
+// enrichContext fills the subject.* and resource.* keys the policies reference and ctx
+// lacks. Providers are only asked about an object when such a key is missing.
+func (e *Engine) enrichContext(reqCtx context.Context, policies []EffectivePolicy, resource, subject ObjectRef, ctx map[string]string, tracef func(string, ...interface{})) error {
+	if len(e.attributes) == 0 {
+		return nil
+	}
+	var needSubject, needResource bool
+	for _, ep := range policies {
+		for _, rule := range ep.Policy.Rules {
+			walkExpr(rule.Expr, func(x expr) {
+				var key string
+				switch n := x.(type) {
+				case *comparisonExpr:
+					key = n.Identifier
+				case *funcExpr:
+					if len(n.Args) > 0 {
+						key = n.Args[0]
+					}
+				}
+				if _, ok := ctx[key]; ok {
+					return
+				}
+				needSubject = needSubject || strings.HasPrefix(key, SubjectAttributePrefix)
+				needResource = needResource || strings.HasPrefix(key, ResourceAttributePrefix)
+			})
+		}
+	}
+	fill := func(obj ObjectRef, prefix string) error {
+		var filled []string
+		for _, p := range e.attributes {
+			attrs, err := p.Attributes(reqCtx, obj)
+			if err != nil {
+				return fmt.Errorf("attributes of %s: %w", obj, err)
+			}
+			for k, v := range attrs {
+				if _, ok := ctx[prefix+k]; !ok {
+					ctx[prefix+k] = v
+					filled = append(filled, prefix+k)
+				}
+			}
+		}
+		if len(filled) > 0 {
+			sort.Strings(filled)
+			tracef("attributes of %s filled %s", obj, strings.Join(filled, ", "))
+		}
+		return nil
+	}
+	if needSubject {
+		if err := fill(subject, SubjectAttributePrefix); err != nil {
+			return err
+		}
+	}
+	if needResource {
+		if err := fill(resource, ResourceAttributePrefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributeValue renders a decoded JSON or YAML value as a context string; lists become
+// comma separated, the form contains() and all() read
+func attributeValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := attributeValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported attribute value %v", v)
+}
+
+func attributeMap(raw map[string]interface{}) (map[string]string, error) {
+	attrs := make(map[string]string, len(raw))
+	for k, v := range raw {
+		s, err := attributeValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		attrs[k] = s
+	}
+	return attrs, nil
+}
+
+// StaticAttributes serves attributes from a directory file, see LoadAttributeFile
+type StaticAttributes struct {
+	objects map[ObjectRef]map[string]string
+}
+
+// ParseAttributes reads a directory of attributes keyed by object, in YAML or JSON:
+//
+//	user:alice:
+//	  department: eng
+//	  roles: [admin, oncall]
+//	document:plan:
+//	  classification: internal
+func ParseAttributes(data []byte) (*StaticAttributes, error) {
+	var raw map[string]map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	s := &StaticAttributes{objects: make(map[ObjectRef]map[string]string, len(raw))}
+	for key, values := range raw {
+		obj, err := parseObjectRef(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		attrs, err := attributeMap(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		s.objects[obj] = attrs
+	}
+	return s, nil
+}
+
+// LoadAttributeFile reads a directory file with ParseAttributes
+func LoadAttributeFile(path string) (*StaticAttributes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseAttributes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Attributes returns the object's entry of the file
+func (s *StaticAttributes) Attributes(_ context.Context, obj ObjectRef) (map[string]string, error) {
+	return s.objects[obj], nil
+}
+
+// AttributeValueType is the subject type of tuples holding attribute values, as in
+// user:alice#department@attr:eng
+const AttributeValueType = "attr"
+
+// TupleAttributes reads attributes stored as tuples on the object: each
+// obj#<name>@attr:<value> tuple is one value, several values of a name are joined
+// with commas in sorted order
+type TupleAttributes struct {
+	graph *RelationGraph
+}
+
+// NewTupleAttributes reads attribute tuples from graph
+func NewTupleAttributes(graph *RelationGraph) *TupleAttributes {
+	return &TupleAttributes{graph: graph}
+}
+
+// Attributes collects the attr tuples of the object
+func (t *TupleAttributes) Attributes(_ context.Context, obj ObjectRef) (map[string]string, error) {
+	values := make(map[string][]string)
+	for _, tuple := range t.graph.ReadTuples(obj, "") {
+		if tuple.Subject.Object.Type == AttributeValueType && tuple.Subject.Relation == "" {
+			values[tuple.Relation] = append(values[tuple.Relation], tuple.Subject.Object.ObjectID)
+		}
+	}
+	attrs := make(map[string]string, len(values))
+	for name, vs := range values {
+		sort.Strings(vs)
+		attrs[name] = strings.Join(vs, ",")
+	}
+	return attrs, nil
+}
+
+const (
+	// DefaultAttributeTTL is how long HTTPAttributes keeps an answer
+	DefaultAttributeTTL = time.Minute
+	// DefaultAttributeCacheSize bounds the objects HTTPAttributes keeps answers for
+	DefaultAttributeCacheSize = 10000
+)
+
+// HTTPAttributes asks a service for attributes, e.g. an HR directory, and caches the
+// answers. The service answers a GET with a JSON object of attributes; 404 means none.
+type HTTPAttributes struct {
+	// URL is requested with {type}, {id} and {object} replaced by the escaped object,
+	// e.g. https://hr.internal/people/{id}; without placeholders ?object=type:id is added
+	URL string
+	// Header is sent with every request, e.g. an Authorization header
+	Header http.Header
+	// Client is http.DefaultClient when nil; bound callouts with its Timeout
+	Client *http.Client
+	// Types limits the callout to objects of these types, all when empty
+	Types []string
+	// TTL is DefaultAttributeTTL when 0; a negative TTL disables the cache
+	TTL time.Duration
+	// MaxEntries is DefaultAttributeCacheSize when 0
+	MaxEntries int
+
+	mu    sync.Mutex
+	cache map[ObjectRef]cachedAttributes
+}
+
+type cachedAttributes struct {
+	attrs   map[string]string
+	expires time.Time
+}
+
+// Attributes returns the cached answer for obj or asks the service. Failed callouts are
+// not cached.
+func (h *HTTPAttributes) Attributes(ctx context.Context, obj ObjectRef) (map[string]string, error) {
+	if len(h.Types) > 0 && !containsString(h.Types, obj.Type) {
+		return nil, nil
+	}
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = DefaultAttributeTTL
+	}
+	now := time.Now()
+	if ttl > 0 {
+		h.mu.Lock()
+		entry, ok := h.cache[obj]
+		h.mu.Unlock()
+		if ok && now.Before(entry.expires) {
+			return entry.attrs, nil
+		}
+	}
+	attrs, err := h.fetch(ctx, obj)
+	if err != nil || ttl < 0 {
+		return attrs, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limit := h.MaxEntries
+	if limit <= 0 {
+		limit = DefaultAttributeCacheSize
+	}
+	if h.cache == nil {
+		h.cache = make(map[ObjectRef]cachedAttributes)
+	}
+	if _, ok := h.cache[obj]; !ok && len(h.cache) >= limit {
+		// make room: drop what has expired, else an arbitrary entry
+		for k, v := range h.cache {
+			if !now.Before(v.expires) {
+				delete(h.cache, k)
+			}
+		}
+		for k := range h.cache {
+			if len(h.cache) < limit {
+				break
+			}
+			delete(h.cache, k)
+		}
+	}
+	h.cache[obj] = cachedAttributes{attrs: attrs, expires: now.Add(ttl)}
+	return attrs, nil
+}
+
+func (h *HTTPAttributes) url(obj ObjectRef) string {
+	if !strings.ContainsAny(h.URL, "{") {
+		sep := "?"
+		if strings.Contains(h.URL, "?") {
+			sep = "&"
+		}
+		return h.URL + sep + "object=" + url.QueryEscape(obj.String())
+	}
+	return strings.NewReplacer(
+		"{type}", url.PathEscape(obj.Type),
+		"{id}", url.PathEscape(obj.ObjectID),
+		"{object}", url.PathEscape(obj.String()),
+	).Replace(h.URL)
+}
+
+func (h *HTTPAttributes) fetch(ctx context.Context, obj ObjectRef) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url(obj), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range h.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Accept", "application/json")
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return map[string]string{}, nil
+	default:
+		return nil, fmt.Errorf("attribute service returned %s", resp.Status)
+	}
+	var raw map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSnapshotLine)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("attribute service: %v", err)
+	}
+	return attributeMap(raw)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const directoryYAML = `
+user:alice:
+  department: eng
+  roles: [admin, oncall]
+  level: 3
+user:bob:
+  department: sales
+document:plan:
+  classification: internal
+`
+
+// countingAttributes records which objects it was asked about
+type countingAttributes struct {
+	attrs map[ObjectRef]map[string]string
+	asked []ObjectRef
+}
+
+func (c *countingAttributes) Attributes(_ context.Context, obj ObjectRef) (map[string]string, error) {
+	c.asked = append(c.asked, obj)
+	return c.attrs[obj], nil
+}
+
+var (
+	alice = ObjectRef{Type: "user", ObjectID: "alice"}
+	bob   = ObjectRef{Type: "user", ObjectID: "bob"}
+	plan  = ObjectRef{Type: "document", ObjectID: "plan"}
+)
+
+func attributeEngine(t *testing.T, policy string) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read user:bob->read"))
+	require.NoError(t, engine.AddPolicy("p", policy))
+	require.NoError(t, engine.AddPolicyToResource(plan, "p"))
+	return engine
+}
+
+func TestParseAttributes(t *testing.T) {
+	static, err := ParseAttributes([]byte(directoryYAML))
+	require.NoError(t, err)
+	attrs, err := static.Attributes(context.Background(), alice)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"department": "eng", "roles": "admin,oncall", "level": "3"}, attrs)
+	attrs, err = static.Attributes(context.Background(), ObjectRef{Type: "user", ObjectID: "nobody"})
+	require.NoError(t, err)
+	assert.Empty(t, attrs)
+
+	// json is read the same way
+	static, err = ParseAttributes([]byte(`{"user:alice": {"department": "eng", "active": true}}`))
+	require.NoError(t, err)
+	attrs, _ = static.Attributes(context.Background(), alice)
+	assert.Equal(t, map[string]string{"department": "eng", "active": "true"}, attrs)
+
+	_, err = ParseAttributes([]byte("alice:\n  department: eng\n"))
+	assert.Error(t, err, "keys are objects")
+	_, err = ParseAttributes([]byte("user:alice:\n  manager: {name: carol}\n"))
+	assert.Error(t, err, "values are scalars or lists")
+
+	path := filepath.Join(t.TempDir(), "directory.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(directoryYAML), 0o644))
+	_, err = LoadAttributeFile(path)
+	assert.NoError(t, err)
+}
+
+func TestEngine_AttributeProviders(t *testing.T) {
+	engine := attributeEngine(t, `allow read if subject.department == "eng" and resource.classification == "internal"`)
+	static, err := ParseAttributes([]byte(directoryYAML))
+	require.NoError(t, err)
+	engine.AddAttributeProvider(static)
+
+	ok, err := engine.Verify(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = engine.Verify(plan, bob, "read", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// what the caller passes wins over the providers
+	ok, err = engine.Verify(plan, bob, "read", map[string]string{"subject.department": "eng"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = engine.Verify(plan, alice, "read", map[string]string{"subject.department": "sales"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// the decision log keeps what the caller passed, replays look attributes up again
+	decisions := engine.decisions.Snapshot()
+	assert.Nil(t, decisions[0].Context)
+	assert.Equal(t, map[string]string{"subject.department": "eng"}, decisions[2].Context)
+
+	_, trace, err := engine.VerifyTrace(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.Contains(t, trace, "attributes of user:alice filled subject.department, subject.level, subject.roles")
+}
+
+func TestEngine_AttributeProviderOrder(t *testing.T) {
+	engine := attributeEngine(t, `allow read if subject.department == "eng"`)
+	first := &countingAttributes{attrs: map[ObjectRef]map[string]string{alice: {"department": "eng"}}}
+	second := &countingAttributes{attrs: map[ObjectRef]map[string]string{alice: {"department": "sales"}, bob: {"department": "eng"}}}
+	engine.AddAttributeProvider(first)
+	engine.AddAttributeProvider(second)
+
+	ok, err := engine.Verify(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok, "the first provider's value wins")
+	ok, err = engine.Verify(plan, bob, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok, "later providers fill what earlier ones lack")
+	assert.Equal(t, []ObjectRef{alice, bob}, first.asked, "resource attributes are not referenced, so never asked for")
+
+	// nothing is looked up when the caller passed every referenced key
+	_, err = engine.Verify(plan, alice, "read", map[string]string{"subject.department": "eng"})
+	require.NoError(t, err)
+	assert.Len(t, first.asked, 2)
+}
+
+func TestTupleAttributes(t *testing.T) {
+	engine := attributeEngine(t, `allow read if contains(subject.roles, "admin")`)
+	engine.AddAttributeProvider(NewTupleAttributes(engine.graph))
+	for _, line := range []string{
+		"user:alice#roles@attr:oncall",
+		"user:alice#roles@attr:admin",
+		"user:alice#manager@user:carol",
+		"user:bob#roles@attr:viewer",
+	} {
+		tuple, err := ParseTuple(line)
+		require.NoError(t, err)
+		require.NoError(t, engine.writeTuple(tuple))
+	}
+	attrs, err := NewTupleAttributes(engine.graph).Attributes(context.Background(), alice)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"roles": "admin,oncall"}, attrs, "only attr subjects are attributes")
+
+	ok, err := engine.Verify(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = engine.Verify(plan, bob, "read", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestHTTPAttributes(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		switch {
+		case failing.Load():
+			w.WriteHeader(http.StatusBadGateway)
+		case r.URL.Path == "/people/user/alice":
+			w.Write([]byte(`{"department": "eng", "teams": ["infra", "sre"], "manager": null}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	provider := &HTTPAttributes{
+		URL:    srv.URL + "/people/{type}/{id}",
+		Header: http.Header{"Authorization": {"secret"}},
+		Types:  []string{"user"},
+	}
+	engine := attributeEngine(t, `allow read if subject.department == "eng"`)
+	engine.AddAttributeProvider(provider)
+
+	ok, err := engine.Verify(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = engine.Verify(plan, bob, "read", nil)
+	require.NoError(t, err)
+	assert.False(t, ok, "404 means no attributes")
+	assert.Equal(t, int32(2), calls.Load())
+
+	// answers are cached, misses included, and other types are never asked about
+	failing.Store(true)
+	ok, err = engine.Verify(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, err = engine.Verify(plan, bob, "read", nil)
+	require.NoError(t, err)
+	attrs, err := provider.Attributes(context.Background(), plan)
+	require.NoError(t, err)
+	assert.Empty(t, attrs)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// a failed callout fails the check instead of denying quietly
+	uncached := &HTTPAttributes{URL: srv.URL + "/people", Header: provider.Header, TTL: -1}
+	engine = attributeEngine(t, `allow read if subject.department == "eng"`)
+	engine.AddAttributeProvider(uncached)
+	_, err = engine.Verify(plan, alice, "read", nil)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "attributes of user:alice:"), err.Error())
+
+	failing.Store(false)
+	attrs, err = uncached.Attributes(context.Background(), alice)
+	require.NoError(t, err)
+	assert.Empty(t, attrs, "without placeholders the object is a query parameter")
+	assert.Equal(t, srv.URL+"/people?object=user%3Aalice", uncached.url(alice))
+}
+
+func TestHTTPAttributes_CacheBounds(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"department": "eng"}`))
+	}))
+	defer srv.Close()
+
+	provider := &HTTPAttributes{URL: srv.URL + "/{object}", MaxEntries: 2, TTL: 20 * time.Millisecond}
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c", "a", "b", "c"} {
+		_, err := provider.Attributes(ctx, ObjectRef{Type: "user", ObjectID: id})
+		require.NoError(t, err)
+	}
+	assert.Len(t, provider.cache, 2)
+	assert.GreaterOrEqual(t, calls.Load(), int32(4), "evicted entries are fetched again")
+
+	calls.Store(0)
+	time.Sleep(30 * time.Millisecond)
+	_, err := provider.Attributes(ctx, ObjectRef{Type: "user", ObjectID: "c"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load(), "expired entries are fetched again")
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Subject ObjectRef `json:"subject"`
+	// Method is how the caller authenticated: api_key, jwt or mtls
+	Method string `json:"method"`
+}
+
+// ErrUnauthenticated is returned (wrapped) for credentials that were presented but are not valid
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator identifies the caller of a request. It returns nil, nil when the request
+// carries no credentials it understands, so several authenticators can be chained.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthChain tries each authenticator in order and returns the first principal found
+type AuthChain []Authenticator
+
+func (chain AuthChain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range chain {
+		p, err := a.Authenticate(r)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+// principalSubject turns a name from a credential into a subject: "service:ci" is used as
+// is, a bare "alice" becomes user:alice
+func principalSubject(name string) (ObjectRef, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ObjectRef{}, errors.New("empty subject")
+	}
+	if !strings.Contains(name, ":") {
+		return ObjectRef{Type: "user", ObjectID: name}, nil
+	}
+	return parseObjectRef(name)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// APIKeyHeader carries a static api key, an "Authorization: Bearer <key>" header works too
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator accepts static api keys. Only sha256 hashes of the keys are kept.
+type APIKeyAuthenticator struct {
+	keys map[[sha256.Size]byte]ObjectRef
+}
+
+// NewAPIKeyAuthenticator maps each key to the subject it authenticates as
+func NewAPIKeyAuthenticator(keys map[string]ObjectRef) *APIKeyAuthenticator {
+	a := &APIKeyAuthenticator{keys: make(map[[sha256.Size]byte]ObjectRef, len(keys))}
+	for key, subject := range keys {
+		a.keys[sha256.Sum256([]byte(key))] = subject
+	}
+	return a
+}
+
+// LoadAPIKeys reads a key file with one "<key> <subject>" pair per line, e.g.
+// "k3y-for-ci service:ci"; blank lines and # comments are skipped
+func LoadAPIKeys(path string) (*APIKeyAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[string]ObjectRef)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want '<key> <subject>'", path, lineNo)
+		}
+		subject, err := principalSubject(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		keys[fields[0]] = subject
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewAPIKeyAuthenticator(keys), nil
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		key = bearerToken(r)
+		if key == "" || strings.Count(key, ".") == 2 {
+			// no key, or a jwt for the next authenticator
+			return nil, nil
+		}
+	}
+	subject, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+	}
+	return &Principal{Subject: subject, Method: "api_key"}, nil
+}
+
+// JWTAuthenticator verifies bearer JWTs against keys from a local JWKS file.
+// RS256, ES256 and EdDSA are supported; the sub claim names the principal.
+type JWTAuthenticator struct {
+	keys map[string]crypto.PublicKey // kid -> key
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew on exp and nbf
+	Leeway time.Duration
+	now    func() time.Time
+}
+
+// jwk is the subset of RFC 7517 needed for the supported algorithms
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads a JWKS document ({"keys": [...]}) from disk
+func LoadJWKS(path string) (*JWTAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	a := &JWTAuthenticator{keys: make(map[string]crypto.PublicKey), now: time.Now}
+	for i, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d (%s): %v", path, i, k.Kid, err)
+		}
+		a.keys[k.Kid] = key
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return a, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %v", err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %v", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31 {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %v", err)
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" || strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	sub, err := a.Verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	subject, err := principalSubject(sub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: sub: %v", ErrUnauthenticated, err)
+	}
+	return &Principal{Subject: subject, Method: "jwt"}, nil
+}
+
+// jwtClaims are the registered claims that are checked; aud may be a string or a list
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *int64          `json:"exp"`
+	Nbf *int64          `json:"nbf"`
+}
+
+// Verify checks the signature and claims of a compact JWT and returns its sub claim
+func (a *JWTAuthenticator) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	b64 := base64.RawURLEncoding
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("malformed header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", errors.New("malformed header")
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok {
+		return "", fmt.Errorf("unknown key id %q", header.Kid)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed payload")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("malformed payload")
+	}
+	now := a.now()
+	if claims.Exp == nil {
+		return "", errors.New("token has no exp")
+	}
+	if now.After(time.Unix(*claims.Exp, 0).Add(a.Leeway)) {
+		return "", errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Add(a.Leeway).Before(time.Unix(*claims.Nbf, 0)) {
+		return "", errors.New("token not valid yet")
+	}
+	if a.Issuer != "" && claims.Iss != a.Issuer {
+		return "", fmt.Errorf("unexpected issuer %q", claims.Iss)
+	}
+	if a.Audience != "" && !audienceContains(claims.Aud, a.Audience) {
+		return "", errors.New("token is not for this audience")
+	}
+	if claims.Sub == "" {
+		return "", errors.New("token has no sub")
+	}
+	return claims.Sub, nil
+}
+
+func audienceContains(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, aud := range many {
+			if aud == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks sig over signed; the algorithm must match the key type
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(sig) != 64 {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q does not match the key", alg)
+}
+
+// MTLSAuthenticator authenticates callers by a verified client certificate; the
+// certificate's common name names the principal. The server must request client
+// certificates, see ClientCATLSConfig.
+type MTLSAuthenticator struct{}
+
+func (MTLSAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	subject, err := principalSubject(cn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client certificate: %v", ErrUnauthenticated, err)
+	}
+	return &Principal{Subject: subject, Method: "mtls"}, nil
+}
+
+// ClientCATLSConfig builds a server TLS config from a certificate and key. With a client
+// CA bundle, client certificates signed by it are verified when presented; callers
+// without one can still use api keys or JWTs.
+func ClientCATLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authRequest posts body to path with an optional bearer token and returns the status
+func authRequest(t *testing.T, client *http.Client, url, token string, body interface{}) int {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestService_APIKeysAndAdminPermissions(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(keyFile, []byte("# ci and people\nadmin-key alice\nwriter-key service:ci\nreader-key bob\n"), 0o600))
+	keys, err := LoadAPIKeys(keyFile)
+	require.NoError(t, err)
+
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	service := NewService(engine)
+	service.Auth = AuthChain{keys}
+	service.Admin = NewAdminEngine(ObjectRef{Type: "user", ObjectID: "alice"})
+	// the admin engine is managed with tuples like any other
+	_, err = service.Admin.Import(bytes.NewBufferString("service:minzibar#write_relations@role:writer#member\nrole:writer#member@service:ci\n"), SnapshotText)
+	require.NoError(t, err)
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	policy := AddPolicyRequest{PolicyID: "p_read", PolicyText: `allow read if department == "eng"`}
+	relation := AddRelationQueryRequest{Query: "document:plan user:bob->read"}
+	check := CheckQueryRequest{Query: "can user:bob read document:plan", Direct: true}
+
+	assert.Equal(t, http.StatusUnauthorized, authRequest(t, http.DefaultClient, srv.URL+"/check", "", check))
+	assert.Equal(t, http.StatusUnauthorized, authRequest(t, http.DefaultClient, srv.URL+"/check", "wrong-key", check))
+
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/policy", "reader-key", policy))
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/relation", "reader-key", relation))
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/check", "reader-key", check), "reads only need a caller")
+
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/policy", "writer-key", policy))
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/relation", "writer-key", relation))
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/policy", "admin-key", policy))
+
+	// X-API-Key works as well as a bearer token; listings name as much as an export does
+	for key, status := range map[string]int{"reader-key": http.StatusForbidden, "admin-key": http.StatusOK} {
+		for _, path := range []string{"/objects", "/expand?object=document:plan&relation=read"} {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+			req.Header.Set(APIKeyHeader, key)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode, "%s %s", key, path)
+		}
+	}
+}
+
+func TestService_TenantAdmins(t *testing.T) {
+	service := NewService(nil)
+	service.Tenants = NewTenants(TenantQuota{})
+	for _, id := range []string{"acme", "globex"} {
+		engine, err := service.Tenants.Create(id, nil)
+		require.NoError(t, err)
+		engine.CreateResource("document", "plan")
+	}
+	service.Auth = NewAPIKeyAuthenticator(map[string]ObjectRef{
+		"root": {Type: "user", ObjectID: "root"},
+		"bob":  {Type: "user", ObjectID: "bob"},
+	})
+	service.Admin = NewAdminEngine(ObjectRef{Type: "user", ObjectID: "root"})
+	require.NoError(t, service.Admin.AddRelation(ObjectRef{Type: "tenant", ObjectID: "acme"}, string(PermWritePolicies), SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}))
+	require.NoError(t, service.Admin.AddRelation(ObjectRef{Type: "tenant", ObjectID: "acme"}, string(PermManageTenants), SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}))
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	policy := AddPolicyRequest{PolicyID: "p", PolicyText: `allow read if department == "eng"`}
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants/acme/policy", "bob", policy))
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/tenants/globex/policy", "bob", policy))
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants/globex/policy", "root", policy))
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/tenants", "bob", CreateTenantRequest{ID: "initech"}),
+		"tenant admins cannot manage tenants")
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants", "root", CreateTenantRequest{ID: "initech"}))
+}
+
+func TestService_CrossTenant(t *testing.T) {
+	service := NewService(nil)
+	service.Tenants = NewTenants(TenantQuota{})
+	for _, id := range []string{"acme", "globex"} {
+		engine, err := service.Tenants.Create(id, nil)
+		require.NoError(t, err)
+		engine.CreateResource("document", "plan")
+		require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read"))
+	}
+	service.Auth = NewAPIKeyAuthenticator(map[string]ObjectRef{
+		"root":  {Type: "user", ObjectID: "root"},
+		"alice": alice,
+		"ci":    {Type: "service", ObjectID: "ci"},
+	})
+	service.Admin = NewAdminEngine(ObjectRef{Type: "user", ObjectID: "root"})
+	_, err := service.Admin.Import(bytes.NewBufferString("tenant:acme#member@user:alice\nservice:minzibar#write_relations@service:ci\n"), SnapshotText)
+	require.NoError(t, err)
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	check := CheckQueryRequest{Query: "can user:alice read document:plan", Direct: true}
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants/acme/check", "alice", check))
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/tenants/globex/check", "alice", check),
+		"a member of acme cannot read globex")
+	assert.Equal(t, http.StatusForbidden, authRequest(t, http.DefaultClient, srv.URL+"/tenants/initech/check", "alice", check),
+		"nor learn whether a tenant exists")
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/check", bytes.NewBufferString(`{"query": "can user:alice read document:plan", "direct": true}`))
+	require.NoError(t, err)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("Authorization", "Bearer alice")
+	req.Header.Set(TenantHeader, "globex")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the header is checked as the path is")
+
+	// admins of the service reach every tenant
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants/globex/check", "root", check))
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants/globex/check", "ci", check))
+}
+
+// jwtSigner signs test tokens with one key
+type jwtSigner struct {
+	alg, kid string
+	sign     func(signed []byte) []byte
+	jwk      map[string]string
+}
+
+func (s jwtSigner) token(t *testing.T, claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	return signed + "." + b64.EncodeToString(s.sign([]byte(signed)))
+}
+
+func testSigners(t *testing.T) []jwtSigner {
+	b64 := base64.RawURLEncoding
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return []jwtSigner{
+		{
+			alg: "RS256", kid: "rsa",
+			sign: func(signed []byte) []byte {
+				digest := sha256.Sum256(signed)
+				sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+				require.NoError(t, err)
+				return sig
+			},
+			jwk: map[string]string{"kty": "RSA", "kid": "rsa", "n": b64.EncodeToString(rsaKey.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		},
+		{
+			alg: "ES256", kid: "ec",
+			sign: func(signed []byte) []byte {
+				digest := sha256.Sum256(signed)
+				r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+				require.NoError(t, err)
+				sig := make([]byte, 64)
+				r.FillBytes(sig[:32])
+				s.FillBytes(sig[32:])
+				return sig
+			},
+			jwk: map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), "y": b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+		},
+		{
+			alg: "EdDSA", kid: "ed",
+			sign: func(signed []byte) []byte { return ed25519.Sign(edKey, signed) },
+			jwk:  map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(edPub)},
+		},
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	signers := testSigners(t)
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, os.WriteFile(jwksFile, data, 0o600))
+
+	auth, err := LoadJWKS(jwksFile)
+	require.NoError(t, err)
+	auth.Issuer = "https://idp.example.com"
+	auth.Audience = "minzibar"
+	now := time.Unix(1_700_000_000, 0)
+	auth.now = func() time.Time { return now }
+
+	valid := map[string]interface{}{"sub": "alice", "iss": "https://idp.example.com", "aud": []string{"other", "minzibar"}, "exp": now.Add(time.Hour).Unix()}
+	for _, s := range signers {
+		t.Run(s.alg, func(t *testing.T) {
+			sub, err := auth.Verify(s.token(t, valid))
+			require.NoError(t, err)
+			assert.Equal(t, "alice", sub)
+
+			tampered := s.token(t, valid)
+			tampered = tampered[:len(tampered)-4] + "AAAA"
+			_, err = auth.Verify(tampered)
+			assert.Error(t, err)
+		})
+	}
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	for name, claims := range map[string]map[string]interface{}{
+		"expired":      with("exp", now.Add(-time.Minute).Unix()),
+		"no exp":       with("exp", nil),
+		"not yet":      with("nbf", now.Add(time.Minute).Unix()),
+		"wrong issuer": with("iss", "https://evil.example.com"),
+		"wrong aud":    with("aud", "other"),
+		"no sub":       with("sub", nil),
+	} {
+		_, err := auth.Verify(signers[0].token(t, claims))
+		assert.Error(t, err, name)
+	}
+
+	// a token signed with one key type but claiming another algorithm is rejected
+	confused := signers[1]
+	confused.alg = "RS256"
+	_, err = auth.Verify(confused.token(t, valid))
+	assert.Error(t, err)
+
+	// through the service, with a service:name subject
+	service := NewService(NewEngine(NewRelationGraph(), map[string]*Policy{}))
+	service.Auth = AuthChain{NewAPIKeyAuthenticator(nil), auth}
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+	auth.now = time.Now
+	token := signers[2].token(t, with("exp", time.Now().Add(time.Hour).Unix()))
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/check", token, CheckQueryRequest{Query: "can user:x read doc:y", Direct: true}))
+	assert.Equal(t, http.StatusUnauthorized, authRequest(t, http.DefaultClient, srv.URL+"/check", signers[0].token(t, valid), CheckQueryRequest{Query: "can user:x read doc:y", Direct: true}))
+}
+
+// testCert issues a certificate for cn, self signed when parent is nil
+func testCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func TestService_MTLS(t *testing.T) {
+	ca, caKey, _ := testCert(t, "test ca", nil, nil, true)
+	_, _, serverCert := testCert(t, "localhost", ca, caKey, false)
+	_, _, clientCert := testCert(t, "service:ci", ca, caKey, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	service := NewService(NewEngine(NewRelationGraph(), map[string]*Policy{}))
+	service.Auth = AuthChain{MTLSAuthenticator{}}
+	service.Admin = NewAdminEngine(ObjectRef{Type: "service", ObjectID: "ci"})
+	srv := httptest.NewUnstartedServer(service.Echo())
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+	withoutCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resource := CreateResourceRequest{Type: "document", ID: "plan"}
+	assert.Equal(t, http.StatusOK, authRequest(t, withCert, srv.URL+"/resource", "", resource))
+	assert.Equal(t, http.StatusUnauthorized, authRequest(t, withoutCert, srv.URL+"/resource", "", resource))
+}
@@ -0,0 +1,1005 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CedarOptions tunes how Cedar names map onto minzibar
+type CedarOptions struct {
+	// MemberRelation is the relation `principal in Group::"eng"` becomes, group:eng#member by default
+	MemberRelation string `json:"member_relation,omitempty"`
+	// Types renames Cedar entity types, e.g. {"App::User": "user"}; unlisted types are
+	// lowercased with "::" replaced by "_"
+	Types map[string]string `json:"types,omitempty"`
+}
+
+func (o CedarOptions) memberRelation() string {
+	if o.MemberRelation == "" {
+		return "member"
+	}
+	return o.MemberRelation
+}
+
+func (o CedarOptions) typeName(cedarType string) string {
+	if name, ok := o.Types[cedarType]; ok {
+		return name
+	}
+	return strings.ToLower(strings.ReplaceAll(cedarType, "::", "_"))
+}
+
+// CedarScope is the resource part of a Cedar policy head
+type CedarScope struct {
+	// Op is "==" for one resource, "in" for an object and its children, "is" for every
+	// resource of Type, empty for every resource
+	Op     string    `json:"op,omitempty"`
+	Object ObjectRef `json:"object"`
+	Type   string    `json:"type,omitempty"`
+}
+
+func (s CedarScope) String() string {
+	switch s.Op {
+	case "==", "in":
+		return "resource " + s.Op + " " + s.Object.String()
+	case "is":
+		return "resource is " + s.Type
+	}
+	return "every resource"
+}
+
+// overlaps reports whether two scopes may cover the same resource
+func (s CedarScope) overlaps(other CedarScope) bool {
+	if s.Op == "" || s.Op == "in" || other.Op == "" || other.Op == "in" {
+		return true
+	}
+	typeOf := func(c CedarScope) string {
+		if c.Op == "is" {
+			return c.Type
+		}
+		return c.Object.Type
+	}
+	if s.Op == "==" && other.Op == "==" {
+		return s.Object == other.Object
+	}
+	return typeOf(s) == typeOf(other)
+}
+
+// CedarPolicy is one permit policy translated: a minzibar policy holding its conditions and
+// the relation Subject is granted for each action on the resources in scope
+type CedarPolicy struct {
+	ID       string     `json:"id"`
+	Line     int        `json:"line"`
+	Text     string     `json:"text"`
+	Subject  SubjectRef `json:"subject"`
+	Actions  []string   `json:"actions"`
+	Resource CedarScope `json:"resource"`
+
+	condition string // the minzibar condition, empty when the policy has none
+}
+
+// CedarIssue is a Cedar construct that was not translated, or a translation that may grant
+// more than the original; Line and Column are 1-based
+type CedarIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Policy  string `json:"policy,omitempty"`
+	Message string `json:"message"`
+}
+
+func (i CedarIssue) Error() string {
+	if i.Policy != "" {
+		return fmt.Sprintf("line %d:%d: %s: %s", i.Line, i.Column, i.Policy, i.Message)
+	}
+	return fmt.Sprintf("line %d:%d: %s", i.Line, i.Column, i.Message)
+}
+
+// CedarTranslation is the minzibar form of a Cedar policy set. A policy using anything
+// outside the supported subset is left out whole and listed in Unsupported.
+type CedarTranslation struct {
+	Policies    []CedarPolicy `json:"policies"`
+	Unsupported []CedarIssue  `json:"unsupported,omitempty"`
+	Warnings    []CedarIssue  `json:"warnings,omitempty"`
+}
+
+// TranslateCedar converts the supported subset of Cedar into minzibar policies and grants:
+//
+//	@id("eng_read")
+//	permit(principal in Group::"eng", action in [Action::"read", Action::"list"], resource is Document)
+//	when { context.department == "eng" && context.tags.contains("public") };
+//
+// principal must be == an entity or in a group, action == an action or in a list of them,
+// and resource ==, in or is, or left open. Conditions may compare context attributes with
+// literals, call contains on them and combine that with &&, || and !. forbid, unscoped
+// principals and actions, entity attributes, ordering operators, like, has and if are
+// reported as unsupported. An error is returned only when the source cannot be tokenized.
+func TranslateCedar(src string, opts CedarOptions) (*CedarTranslation, error) {
+	tokens, err := tokenizeCedar(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &cedarParser{tokens: tokens, opts: opts}
+	t := &CedarTranslation{Policies: []CedarPolicy{}}
+	for index := 0; p.peek().kind != cedarEOF; index++ {
+		policy, err := p.policy(index)
+		if err != nil {
+			var issue CedarIssue
+			if !errors.As(err, &issue) {
+				return nil, err
+			}
+			t.Unsupported = append(t.Unsupported, issue)
+			p.skipPolicy()
+			continue
+		}
+		t.Policies = append(t.Policies, policy)
+	}
+	t.Warnings = cedarOverlaps(t.Policies)
+	return t, nil
+}
+
+// cedarOverlaps warns about policies that grant the same action on the same resources under
+// different conditions. minzibar checks a policy's condition and the relation separately, so
+// a principal granted by one policy is let in when the other's condition holds.
+func cedarOverlaps(policies []CedarPolicy) []CedarIssue {
+	var warnings []CedarIssue
+	for j := range policies {
+		for i := 0; i < j; i++ {
+			a, b := policies[i], policies[j]
+			if a.condition == b.condition || a.Subject == b.Subject || !a.Resource.overlaps(b.Resource) {
+				continue
+			}
+			for _, action := range b.Actions {
+				if containsString(a.Actions, action) {
+					warnings = append(warnings, CedarIssue{
+						Line:    b.Line,
+						Column:  1,
+						Policy:  b.ID,
+						Message: fmt.Sprintf("grants %s on resources %s also covers under a different condition; %s may %s when either condition holds", action, a.ID, a.Subject, action),
+					})
+					break
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	cedarEOF = iota
+	cedarIdent
+	cedarString
+	cedarNumber
+	cedarPunct
+)
+
+type cedarToken struct {
+	kind      int
+	text      string // unquoted for strings
+	line, col int
+}
+
+// cedarPunctuation lists the two character operators first so they win over single characters
+var cedarPunctuation = []string{"::", "==", "!=", "&&", "||", "<=", ">=", "(", ")", "[", "]", "{", "}", ",", ";", ".", "@", "!", "<", ">", "+", "-", "*"}
+
+func tokenizeCedar(src string) ([]cedarToken, error) {
+	var tokens []cedarToken
+	line, lineStart := 1, 0
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		col := i - lineStart + 1
+		switch {
+		case c == '\n':
+			line++
+			i++
+			lineStart = i
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, CedarIssue{Line: line, Column: col, Message: "unterminated string"}
+			}
+			text, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, CedarIssue{Line: line, Column: col, Message: fmt.Sprintf("invalid string %s", src[i:j+1])}
+			}
+			tokens = append(tokens, cedarToken{kind: cedarString, text: text, line: line, col: col})
+			i = j + 1
+		case c == '_' || isAlphaNum(c):
+			j := i
+			for j < len(src) && (src[j] == '_' || isAlphaNum(src[j])) {
+				j++
+			}
+			kind := cedarIdent
+			if c >= '0' && c <= '9' {
+				kind = cedarNumber
+			}
+			tokens = append(tokens, cedarToken{kind: kind, text: src[i:j], line: line, col: col})
+			i = j
+		default:
+			matched := ""
+			for _, p := range cedarPunctuation {
+				if strings.HasPrefix(src[i:], p) {
+					matched = p
+					break
+				}
+			}
+			if matched == "" {
+				return nil, CedarIssue{Line: line, Column: col, Message: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, cedarToken{kind: cedarPunct, text: matched, line: line, col: col})
+			i += len(matched)
+		}
+	}
+	return append(tokens, cedarToken{kind: cedarEOF, line: line, col: len(src) - lineStart + 1}), nil
+}
+
+type cedarParser struct {
+	tokens  []cedarToken
+	pos     int
+	opts    CedarOptions
+	current string // id of the policy being parsed, for issues
+}
+
+func (p *cedarParser) peek() cedarToken {
+	return p.tokens[p.pos]
+}
+
+func (p *cedarParser) next() cedarToken {
+	t := p.tokens[p.pos]
+	if t.kind != cedarEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the keyword or punctuation text
+func (p *cedarParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == cedarIdent || t.kind == cedarPunct) && t.text == text
+}
+
+func (p *cedarParser) expect(text string) error {
+	if !p.is(text) {
+		return p.errorf(p.peek(), "expected %q, found %s", text, describeCedarToken(p.peek()))
+	}
+	p.next()
+	return nil
+}
+
+func (p *cedarParser) errorf(t cedarToken, format string, args ...interface{}) error {
+	return CedarIssue{Line: t.line, Column: t.col, Policy: p.current, Message: fmt.Sprintf(format, args...)}
+}
+
+func describeCedarToken(t cedarToken) string {
+	switch t.kind {
+	case cedarEOF:
+		return "end of input"
+	case cedarString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// skipPolicy moves past the ';' ending the policy an issue was found in
+func (p *cedarParser) skipPolicy() {
+	for {
+		t := p.next()
+		if t.kind == cedarEOF || (t.kind == cedarPunct && t.text == ";") {
+			return
+		}
+	}
+}
+
+func (p *cedarParser) policy(index int) (CedarPolicy, error) {
+	start := p.peek()
+	policy := CedarPolicy{ID: fmt.Sprintf("cedar_policy%d", index), Line: start.line}
+	p.current = policy.ID
+	for p.is("@") {
+		p.next()
+		name := p.next()
+		if err := p.expect("("); err != nil {
+			return policy, err
+		}
+		value := p.next()
+		if value.kind != cedarString {
+			return policy, p.errorf(value, "annotation value must be a string")
+		}
+		if err := p.expect(")"); err != nil {
+			return policy, err
+		}
+		if name.text == "id" {
+			policy.ID = cedarPolicyID(value.text)
+			p.current = policy.ID
+		}
+	}
+	effect := p.next()
+	switch {
+	case effect.kind == cedarIdent && effect.text == "forbid":
+		return policy, p.errorf(effect, "forbid is not supported: minzibar has no deny that overrides an allow")
+	case effect.kind != cedarIdent || effect.text != "permit":
+		return policy, p.errorf(effect, "expected permit or forbid, found %s", describeCedarToken(effect))
+	}
+	var err error
+	if err = p.expect("("); err != nil {
+		return policy, err
+	}
+	if policy.Subject, err = p.principalScope(); err != nil {
+		return policy, err
+	}
+	if err = p.expect(","); err != nil {
+		return policy, err
+	}
+	if policy.Actions, err = p.actionScope(); err != nil {
+		return policy, err
+	}
+	if err = p.expect(","); err != nil {
+		return policy, err
+	}
+	if policy.Resource, err = p.resourceScope(); err != nil {
+		return policy, err
+	}
+	if err = p.expect(")"); err != nil {
+		return policy, err
+	}
+	var cond cedarCond
+	for p.is("when") || p.is("unless") {
+		keyword := p.next()
+		if err := p.expect("{"); err != nil {
+			return policy, err
+		}
+		c, err := p.orExpr()
+		if err != nil {
+			return policy, err
+		}
+		if err := p.expect("}"); err != nil {
+			return policy, err
+		}
+		if keyword.text == "unless" {
+			if c, err = p.negate(keyword, c); err != nil {
+				return policy, err
+			}
+		}
+		cond = joinCedarConds(cond, "and", c)
+	}
+	if err := p.expect(";"); err != nil {
+		return policy, err
+	}
+	policy.condition = cond.text
+	rules := make([]string, len(policy.Actions))
+	for i, action := range policy.Actions {
+		condition := cond.text
+		if condition == "" {
+			// verify always puts the action in the context, so this holds for every request
+			condition = fmt.Sprintf("action == %q", action)
+		}
+		rules[i] = fmt.Sprintf("allow %s if %s", action, condition)
+	}
+	policy.Text = strings.Join(rules, "\n")
+	if _, err := ParsePolicies(policy.Text); err != nil {
+		return policy, p.errorf(start, "translated policy does not parse: %v", err)
+	}
+	return policy, nil
+}
+
+// cedarPolicyID keeps the characters of an @id annotation that are safe in a policy id
+func cedarPolicyID(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || (r < 128 && isAlphaNum(byte(r))) {
+			return r
+		}
+		return '_'
+	}, id)
+}
+
+func (p *cedarParser) principalScope() (SubjectRef, error) {
+	if err := p.expect("principal"); err != nil {
+		return SubjectRef{}, err
+	}
+	op := p.peek()
+	switch {
+	case p.is("=="):
+		p.next()
+		obj, err := p.entity()
+		return SubjectRef{Object: obj}, err
+	case p.is("in"):
+		p.next()
+		obj, err := p.entity()
+		return SubjectRef{Object: obj, Relation: p.opts.memberRelation()}, err
+	case p.is("is"):
+		return SubjectRef{}, p.errorf(op, "principal is <type> is not supported: grants name a principal or a group")
+	}
+	return SubjectRef{}, p.errorf(op, "a policy for every principal is not supported: grants need a subject")
+}
+
+func (p *cedarParser) actionScope() ([]string, error) {
+	if err := p.expect("action"); err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch {
+	case p.is("=="):
+		p.next()
+		action, err := p.action()
+		if err != nil {
+			return nil, err
+		}
+		return []string{action}, nil
+	case p.is("in"):
+		p.next()
+		if !p.is("[") {
+			return nil, p.errorf(p.peek(), "action groups are not supported, list the actions in [...]")
+		}
+		p.next()
+		var actions []string
+		for !p.is("]") {
+			action, err := p.action()
+			if err != nil {
+				return nil, err
+			}
+			if !containsString(actions, action) {
+				actions = append(actions, action)
+			}
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		if len(actions) == 0 {
+			return nil, p.errorf(op, "empty action list")
+		}
+		return actions, nil
+	}
+	return nil, p.errorf(op, "a policy for every action is not supported: name the actions")
+}
+
+// action parses Action::"read" into read
+func (p *cedarParser) action() (string, error) {
+	start := p.peek()
+	path, id, err := p.entityParts()
+	if err != nil {
+		return "", err
+	}
+	if path[len(path)-1] != "Action" {
+		return "", p.errorf(start, "%s::%q is not an action", strings.Join(path, "::"), id)
+	}
+	if id == "" || strings.Contains(id, "if") || strings.ContainsAny(id, " \t\"#@:") {
+		return "", p.errorf(start, "action %q cannot be named in a minzibar rule", id)
+	}
+	return id, nil
+}
+
+func (p *cedarParser) resourceScope() (CedarScope, error) {
+	if err := p.expect("resource"); err != nil {
+		return CedarScope{}, err
+	}
+	switch {
+	case p.is("=="), p.is("in"):
+		op := p.next().text
+		obj, err := p.entity()
+		return CedarScope{Op: op, Object: obj}, err
+	case p.is("is"):
+		p.next()
+		path, err := p.path()
+		if err != nil {
+			return CedarScope{}, err
+		}
+		if p.is("in") {
+			return CedarScope{}, p.errorf(p.peek(), "resource is <type> in <entity> is not supported")
+		}
+		return CedarScope{Op: "is", Type: p.opts.typeName(strings.Join(path, "::"))}, nil
+	}
+	return CedarScope{}, nil
+}
+
+// entity parses Type::"id", with a namespaced type such as App::Document::"id"
+func (p *cedarParser) entity() (ObjectRef, error) {
+	path, id, err := p.entityParts()
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	return ObjectRef{Type: p.opts.typeName(strings.Join(path, "::")), ObjectID: id}, nil
+}
+
+func (p *cedarParser) entityParts() ([]string, string, error) {
+	start := p.peek()
+	if start.kind != cedarIdent {
+		return nil, "", p.errorf(start, "expected an entity, found %s", describeCedarToken(start))
+	}
+	path := []string{p.next().text}
+	for {
+		if err := p.expect("::"); err != nil {
+			return nil, "", err
+		}
+		t := p.next()
+		switch t.kind {
+		case cedarString:
+			if t.text == "" {
+				return nil, "", p.errorf(t, "entity id is empty")
+			}
+			return path, t.text, nil
+		case cedarIdent:
+			path = append(path, t.text)
+		default:
+			return nil, "", p.errorf(t, "expected an entity id, found %s", describeCedarToken(t))
+		}
+	}
+}
+
+// path parses a possibly namespaced type name
+func (p *cedarParser) path() ([]string, error) {
+	t := p.next()
+	if t.kind != cedarIdent {
+		return nil, p.errorf(t, "expected a type, found %s", describeCedarToken(t))
+	}
+	path := []string{t.text}
+	for p.is("::") {
+		p.next()
+		t = p.next()
+		if t.kind != cedarIdent {
+			return nil, p.errorf(t, "expected a type, found %s", describeCedarToken(t))
+		}
+		path = append(path, t.text)
+	}
+	return path, nil
+}
+
+// cedarCond is a condition in minzibar syntax. An empty text always holds; binary marks an
+// and/or, which needs parentheses inside another expression since minzibar has no precedence.
+type cedarCond struct {
+	text   string
+	binary bool
+}
+
+func (c cedarCond) operand() string {
+	if c.binary {
+		return "(" + c.text + ")"
+	}
+	return c.text
+}
+
+func joinCedarConds(left cedarCond, op string, right cedarCond) cedarCond {
+	if left.text == "" || right.text == "" {
+		if op == "or" {
+			return cedarCond{}
+		}
+		if left.text == "" {
+			return right
+		}
+		return left
+	}
+	return cedarCond{text: left.operand() + " " + op + " " + right.operand(), binary: true}
+}
+
+func (p *cedarParser) negate(at cedarToken, c cedarCond) (cedarCond, error) {
+	if c.text == "" {
+		return c, p.errorf(at, "condition is always false")
+	}
+	return cedarCond{text: "not " + c.operand()}, nil
+}
+
+func (p *cedarParser) orExpr() (cedarCond, error) {
+	left, err := p.andExpr()
+	for err == nil && p.is("||") {
+		p.next()
+		var right cedarCond
+		if right, err = p.andExpr(); err == nil {
+			left = joinCedarConds(left, "or", right)
+		}
+	}
+	return left, err
+}
+
+func (p *cedarParser) andExpr() (cedarCond, error) {
+	left, err := p.unaryExpr()
+	for err == nil && p.is("&&") {
+		p.next()
+		var right cedarCond
+		if right, err = p.unaryExpr(); err == nil {
+			left = joinCedarConds(left, "and", right)
+		}
+	}
+	return left, err
+}
+
+func (p *cedarParser) unaryExpr() (cedarCond, error) {
+	if p.is("!") {
+		bang := p.next()
+		inner, err := p.unaryExpr()
+		if err != nil {
+			return inner, err
+		}
+		return p.negate(bang, inner)
+	}
+	return p.primaryExpr()
+}
+
+func (p *cedarParser) primaryExpr() (cedarCond, error) {
+	t := p.peek()
+	switch {
+	case p.is("("):
+		p.next()
+		c, err := p.orExpr()
+		if err != nil {
+			return c, err
+		}
+		return c, p.expect(")")
+	case p.is("true"):
+		p.next()
+		return cedarCond{}, nil
+	case p.is("false"):
+		return cedarCond{}, p.errorf(t, "condition is always false")
+	case p.is("context"):
+		attr, method, err := p.contextAttr()
+		if err != nil {
+			return cedarCond{}, err
+		}
+		if method != "" {
+			return p.contextMethod(attr, method)
+		}
+		op := p.peek()
+		if !p.is("==") && !p.is("!=") {
+			return cedarCond{}, p.errorf(op, "operator %s is not supported, only == and !=", describeCedarToken(op))
+		}
+		p.next()
+		value, err := p.literal()
+		if err != nil {
+			return cedarCond{}, err
+		}
+		return cedarCond{text: fmt.Sprintf("%s %s %s", attr, op.text, value)}, nil
+	case t.kind == cedarString || t.kind == cedarNumber || p.is("-"):
+		// "eng" == context.department
+		value, err := p.literal()
+		if err != nil {
+			return cedarCond{}, err
+		}
+		op := p.peek()
+		if !p.is("==") && !p.is("!=") {
+			return cedarCond{}, p.errorf(op, "operator %s is not supported, only == and !=", describeCedarToken(op))
+		}
+		p.next()
+		if !p.is("context") {
+			return cedarCond{}, p.errorf(p.peek(), "only context attributes can be compared")
+		}
+		attr, method, err := p.contextAttr()
+		if err != nil {
+			return cedarCond{}, err
+		}
+		if method != "" {
+			return cedarCond{}, p.errorf(op, "only context attributes can be compared")
+		}
+		return cedarCond{text: fmt.Sprintf("%s %s %s", attr, op.text, value)}, nil
+	case p.is("principal"), p.is("resource"), p.is("action"):
+		return cedarCond{}, p.errorf(t, "%s in conditions is not supported, only context attributes", t.text)
+	case p.is("if"):
+		return cedarCond{}, p.errorf(t, "if-then-else is not supported")
+	}
+	return cedarCond{}, p.errorf(t, "unsupported expression %s", describeCedarToken(t))
+}
+
+// contextAttr parses context.a.b into the attribute a.b, and the method called on it if any
+func (p *cedarParser) contextAttr() (string, string, error) {
+	start := p.next()
+	if !p.is(".") {
+		return "", "", p.errorf(p.peek(), "%s after context is not supported, only context.<attribute>", describeCedarToken(p.peek()))
+	}
+	var parts []string
+	for p.is(".") {
+		p.next()
+		t := p.next()
+		if t.kind != cedarIdent {
+			return "", "", p.errorf(t, "expected an attribute name, found %s", describeCedarToken(t))
+		}
+		if p.is("(") {
+			if len(parts) == 0 {
+				return "", "", p.errorf(t, "context has no methods")
+			}
+			return strings.Join(parts, "."), t.text, nil
+		}
+		parts = append(parts, t.text)
+	}
+	attr := strings.Join(parts, ".")
+	switch attr {
+	case "subject", "action", "resource", "and", "or", "not", "all", "contains":
+		return "", "", p.errorf(start, "context.%s clashes with a name minzibar reserves", attr)
+	}
+	if !isAlphaNum(attr[0]) {
+		return "", "", p.errorf(start, "context.%s cannot be named in a minzibar condition", attr)
+	}
+	return attr, "", nil
+}
+
+func (p *cedarParser) contextMethod(attr, method string) (cedarCond, error) {
+	at := p.peek()
+	if method != "contains" {
+		return cedarCond{}, p.errorf(at, "method %s is not supported, only contains", method)
+	}
+	p.next() // (
+	value, err := p.literal()
+	if err != nil {
+		return cedarCond{}, err
+	}
+	if err := p.expect(")"); err != nil {
+		return cedarCond{}, err
+	}
+	return cedarCond{text: fmt.Sprintf("contains(%s, %s)", attr, value)}, nil
+}
+
+// literal parses a string, number or boolean into a quoted minzibar value; the context
+// minzibar evaluates holds strings, so 3 and true compare as "3" and "true"
+func (p *cedarParser) literal() (string, error) {
+	t := p.next()
+	value := t.text
+	switch {
+	case t.kind == cedarPunct && t.text == "-":
+		n := p.next()
+		if n.kind != cedarNumber {
+			return "", p.errorf(n, "expected a number, found %s", describeCedarToken(n))
+		}
+		value = "-" + n.text
+	case t.kind == cedarString, t.kind == cedarNumber:
+	case t.kind == cedarIdent && (t.text == "true" || t.text == "false"):
+	default:
+		return "", p.errorf(t, "expected a string, number or boolean, found %s", describeCedarToken(t))
+	}
+	if strings.ContainsAny(value, "\"\\") {
+		return "", p.errorf(t, "%s cannot be quoted in a minzibar condition", describeCedarToken(t))
+	}
+	return `"` + value + `"`, nil
+}
+
+// CedarImportStats reports what ApplyCedar wrote
+type CedarImportStats struct {
+	Policies  int `json:"policies"`
+	Resources int `json:"resources"`
+	Roles     int `json:"roles,omitempty"`
+	Tuples    int `json:"tuples"`
+}
+
+// resourceMarker is the subject of the tuple CreateResource marks resources with
+var resourceMarker = SubjectRef{Object: ObjectRef{Type: "system", ObjectID: "resource_marker"}}
+
+// ApplyCedar registers the translated policies, attaches each to the resources in its scope
+// and grants its subject the actions there. A resource named with == is created when
+// missing, and an in scope covers the resources in the graph now. is and open scopes are
+// attached to whole types, with the actions granted through the role cedar_<policy id>
+// on <type>:*, so they cover resources created later; an open scope covers the types the
+// graph has resources of now, and none when it has no resources yet. A role named
+// cedar_<policy id> that an earlier import did not define is never replaced.
+func (e *Engine) ApplyCedar(t *CedarTranslation) (CedarImportStats, error) {
+	var stats CedarImportStats
+	for _, p := range t.Policies {
+		policy, err := ParsePolicies(p.Text)
+		if err != nil {
+			return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+		}
+		if err := e.putPolicy(p.ID, policy); err != nil {
+			return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+		}
+		stats.Policies++
+		if p.Resource.Op == "==" && !e.isResource(p.Resource.Object) {
+			if _, err := e.AddResource(p.Resource.Object.Type, p.Resource.Object.ObjectID); err != nil {
+				return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+			}
+			stats.Resources++
+		}
+		if p.Resource.Op == "is" || p.Resource.Op == "" {
+			types := e.cedarTypes(p.Resource)
+			if len(types) == 0 {
+				continue
+			}
+			role := Role{Name: "cedar_" + p.ID, Permissions: p.Actions, Description: "granted by Cedar policy " + p.ID}
+			// a role of the same name is only replaced when an earlier import defined it
+			if existing, ok := e.role(role.Name); ok && existing.Description != role.Description {
+				return stats, fmt.Errorf("policy %s: role %s already exists", p.ID, role.Name)
+			}
+			if err := e.DefineRole(role); err != nil {
+				return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+			}
+			stats.Roles++
+			for _, typ := range types {
+				if err := e.AddPolicyToType(typ, p.ID); err != nil {
+					return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+				}
+				if err := e.GrantRole(ObjectRef{Type: typ, ObjectID: TypeWildcard}, role.Name, p.Subject); err != nil {
+					return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+				}
+				stats.Tuples++
+			}
+			continue
+		}
+		for _, resource := range e.cedarTargets(p.Resource) {
+			if err := e.AddPolicyToResource(resource, p.ID); err != nil {
+				return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+			}
+			for _, action := range p.Actions {
+				if err := e.AddRelation(resource, action, p.Subject); err != nil {
+					return stats, fmt.Errorf("policy %s: %w", p.ID, err)
+				}
+				stats.Tuples++
+			}
+		}
+	}
+	return stats, nil
+}
+
+func (e *Engine) isResource(obj ObjectRef) bool {
+	return e.graph.HasDirectRelation(obj, "resource", resourceMarker)
+}
+
+// cedarTypes lists the types an is or open scope covers, sorted: the one named, or every
+// type with a resource in the graph
+func (e *Engine) cedarTypes(scope CedarScope) []string {
+	if scope.Op == "is" {
+		return []string{scope.Type}
+	}
+	seen := map[string]bool{}
+	var types []string
+	for _, obj := range e.graph.ListAllObjects() {
+		if !seen[obj.Type] && e.isResource(obj) {
+			seen[obj.Type] = true
+			types = append(types, obj.Type)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// cedarTargets lists the resources an == or in scope covers, sorted
+func (e *Engine) cedarTargets(scope CedarScope) []ObjectRef {
+	var targets []ObjectRef
+	switch scope.Op {
+	case "==":
+		return []ObjectRef{scope.Object}
+	case "in":
+		// the object itself and everything below it through parent links
+		seen := map[ObjectRef]struct{}{scope.Object: {}}
+		level := []ObjectRef{scope.Object}
+		for depth := 0; len(level) > 0 && depth <= maxParentDepth; depth++ {
+			var next []ObjectRef
+			for _, obj := range level {
+				if e.isResource(obj) {
+					targets = append(targets, obj)
+				}
+				for _, child := range e.graph.GetObjects(obj, RelationParent) {
+					if _, ok := seen[child]; !ok {
+						seen[child] = struct{}{}
+						next = append(next, child)
+					}
+				}
+			}
+			level = next
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].String() < targets[j].String() })
+	return targets
+}
+
+// CedarDecision is a decision taken by a Cedar deployment, read one JSON object per line:
+//
+//	{"principal": "User::\"alice\"", "action": "Action::\"read\"", "resource": "Document::\"plan\"",
+//	 "context": {"department": "eng"}, "decision": "allow"}
+type CedarDecision struct {
+	Principal string                 `json:"principal"`
+	Action    string                 `json:"action"`
+	Resource  string                 `json:"resource"`
+	Context   map[string]interface{} `json:"context,omitempty"`
+	Decision  string                 `json:"decision"`
+}
+
+// CedarMismatch is a recorded Cedar decision minzibar decided differently
+type CedarMismatch struct {
+	Cedar    CedarDecision `json:"cedar"`
+	Query    string        `json:"query"`
+	Minzibar string        `json:"minzibar"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (m CedarMismatch) String() string {
+	if m.Error != "" {
+		return fmt.Sprintf("%s: cedar %s, minzibar error: %s", m.Query, m.Cedar.Decision, m.Error)
+	}
+	return fmt.Sprintf("%s: cedar %s, minzibar %s", m.Query, m.Cedar.Decision, m.Minzibar)
+}
+
+// ReadCedarDecisions decodes recorded decisions, one JSON object per line
+func ReadCedarDecisions(r io.Reader) ([]CedarDecision, error) {
+	var decisions []CedarDecision
+	dec := json.NewDecoder(r)
+	for {
+		var d CedarDecision
+		if err := dec.Decode(&d); err == io.EOF {
+			return decisions, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("decision %d: %v", len(decisions)+1, err)
+		}
+		decisions = append(decisions, d)
+	}
+}
+
+// CompareCedar replays recorded Cedar decisions through check, which answers a
+// "can <subject> <action> <resource>" query, and returns those minzibar decides differently
+func CompareCedar(decisions []CedarDecision, opts CedarOptions, check func(query string, ctx map[string]string) (bool, error)) ([]CedarMismatch, error) {
+	var mismatches []CedarMismatch
+	for i, d := range decisions {
+		query, err := cedarDecisionQuery(d, opts)
+		if err != nil {
+			return nil, fmt.Errorf("decision %d: %v", i+1, err)
+		}
+		var want bool
+		switch strings.ToLower(d.Decision) {
+		case "allow":
+			want = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("decision %d: decision must be allow or deny, got %q", i+1, d.Decision)
+		}
+		ctx := make(map[string]string, len(d.Context))
+		for k, v := range d.Context {
+			ctx[k] = fmt.Sprint(v)
+		}
+		got, err := check(query, ctx)
+		m := CedarMismatch{Cedar: d, Query: query, Minzibar: "deny"}
+		if got {
+			m.Minzibar = "allow"
+		}
+		if err != nil {
+			m.Error = err.Error()
+		}
+		if err != nil || got != want {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
+
+func cedarDecisionQuery(d CedarDecision, opts CedarOptions) (string, error) {
+	var refs [3]ObjectRef
+	var action string
+	for i, s := range []string{d.Principal, d.Action, d.Resource} {
+		tokens, err := tokenizeCedar(s)
+		if err != nil {
+			return "", err
+		}
+		p := &cedarParser{tokens: tokens, opts: opts}
+		if i == 1 {
+			action, err = p.action()
+		} else {
+			refs[i], err = p.entity()
+		}
+		if err == nil && p.peek().kind != cedarEOF {
+			err = fmt.Errorf("unexpected %s after entity", describeCedarToken(p.peek()))
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", s, err)
+		}
+	}
+	return fmt.Sprintf("%s %s %s %s", KeyWordCan, refs[0], action, refs[2]), nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const cedarPolicies = `
+// engineers read and list everything during working hours
+@id("eng_read")
+permit(principal in Group::"eng", action in [Action::"read", Action::"list"], resource)
+when { context.department == "eng" && (context.shift == "day" || context.oncall == true) };
+
+permit(principal == User::"carol", action == Action::"write", resource == Document::"plan")
+unless { context.tags.contains("frozen") };
+
+forbid(principal, action, resource) when { context.ip == "10.0.0.1" };
+
+permit(principal in Group::"eng", action == Action::"delete", resource in Folder::"eng")
+when { principal.level > 3 };
+`
+
+func TestTranslateCedar(t *testing.T) {
+	tr, err := TranslateCedar(cedarPolicies, CedarOptions{})
+	require.NoError(t, err)
+	require.Len(t, tr.Policies, 2)
+
+	eng := tr.Policies[0]
+	assert.Equal(t, "eng_read", eng.ID)
+	assert.Equal(t, 3, eng.Line)
+	assert.Equal(t, SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "eng"}, Relation: "member"}, eng.Subject)
+	assert.Equal(t, []string{"read", "list"}, eng.Actions)
+	assert.Equal(t, CedarScope{}, eng.Resource)
+	assert.Equal(t, "allow read if department == \"eng\" and (shift == \"day\" or oncall == \"true\")\n"+
+		"allow list if department == \"eng\" and (shift == \"day\" or oncall == \"true\")", eng.Text)
+
+	carol := tr.Policies[1]
+	assert.Equal(t, "cedar_policy1", carol.ID)
+	assert.Equal(t, CedarScope{Op: "==", Object: ObjectRef{Type: "document", ObjectID: "plan"}}, carol.Resource)
+	assert.Equal(t, `allow write if not contains(tags, "frozen")`, carol.Text)
+
+	require.Len(t, tr.Unsupported, 2)
+	assert.Equal(t, CedarIssue{Line: 10, Column: 1, Policy: "cedar_policy2", Message: "forbid is not supported: minzibar has no deny that overrides an allow"}, tr.Unsupported[0])
+	assert.Equal(t, 13, tr.Unsupported[1].Line)
+	assert.Equal(t, "principal in conditions is not supported, only context attributes", tr.Unsupported[1].Message)
+	assert.Empty(t, tr.Warnings)
+}
+
+func TestTranslateCedar_Unsupported(t *testing.T) {
+	for src, msg := range map[string]string{
+		`permit(principal, action == Action::"read", resource);`:                                                    "a policy for every principal",
+		`permit(principal is User, action == Action::"read", resource);`:                                            "principal is <type>",
+		`permit(principal == User::"a", action, resource);`:                                                         "a policy for every action",
+		`permit(principal == User::"a", action in Action::"readers", resource);`:                                    "action groups",
+		`permit(principal == User::"a", action == Action::"modify", resource);`:                                     `action "modify" cannot be named`,
+		`permit(principal == User::"a", action == Action::"read", resource) when { context.age > 3 };`:              "operator",
+		`permit(principal == User::"a", action == Action::"read", resource) when { context has age };`:              "after context",
+		`permit(principal == User::"a", action == Action::"read", resource) when { context.action == "x" };`:        "reserves",
+		`permit(principal == User::"a", action == Action::"read", resource) when { false };`:                        "always false",
+		`permit(principal == User::"a", action == Action::"read", resource) when { if true then true else false };`: "if-then-else",
+		`permit(principal == User::"a", action == Action::"read" resource);`:                                        `expected ","`,
+	} {
+		tr, err := TranslateCedar(src, CedarOptions{})
+		require.NoError(t, err, src)
+		assert.Empty(t, tr.Policies, src)
+		require.Len(t, tr.Unsupported, 1, src)
+		assert.Contains(t, tr.Unsupported[0].Message, msg, src)
+	}
+
+	_, err := TranslateCedar(`permit(principal == User::"a`, CedarOptions{})
+	assert.EqualError(t, err, "line 1:27: unterminated string")
+}
+
+func TestTranslateCedar_OptionsAndWarnings(t *testing.T) {
+	tr, err := TranslateCedar(`
+permit(principal in App::Team::"eng", action == App::Action::"read", resource is App::Document);
+permit(principal == App::User::"bob", action == App::Action::"read", resource == App::Document::"x")
+when { context.department == "sales" };
+`, CedarOptions{MemberRelation: "members", Types: map[string]string{"App::User": "user"}})
+	require.NoError(t, err)
+	require.Len(t, tr.Policies, 2)
+	assert.Equal(t, SubjectRef{Object: ObjectRef{Type: "app_team", ObjectID: "eng"}, Relation: "members"}, tr.Policies[0].Subject)
+	assert.Equal(t, CedarScope{Op: "is", Type: "app_document"}, tr.Policies[0].Resource)
+	assert.Equal(t, `allow read if action == "read"`, tr.Policies[0].Text)
+	assert.Equal(t, ObjectRef{Type: "user", ObjectID: "bob"}, tr.Policies[1].Subject.Object)
+	// bob's grant on app_document:x would pass the team's unconditional policy
+	require.Len(t, tr.Warnings, 1)
+	assert.Equal(t, "cedar_policy1", tr.Warnings[0].Policy)
+}
+
+func cedarEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	for _, id := range []string{"plan", "notes"} {
+		doc := engine.CreateResource("document", id)
+		require.NoError(t, engine.SetParent(doc, ObjectRef{Type: "folder", ObjectID: "eng"}))
+	}
+	engine.CreateResource("report", "q3")
+	require.NoError(t, engine.AddRelation(ObjectRef{Type: "group", ObjectID: "eng"}, "member", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}))
+	return engine
+}
+
+func TestEngine_ApplyCedar(t *testing.T) {
+	engine := cedarEngine(t)
+	tr, err := TranslateCedar(cedarPolicies+`
+permit(principal == User::"dave", action == Action::"comment", resource in Folder::"eng");
+`, CedarOptions{})
+	require.NoError(t, err)
+	stats, err := engine.ApplyCedar(tr)
+	require.NoError(t, err)
+	// eng_read on the document and report types through one role, carol on plan, dave on
+	// the two documents in the folder
+	assert.Equal(t, CedarImportStats{Policies: 3, Roles: 1, Tuples: 5}, stats)
+
+	// open and is scopes cover resources created after the import
+	engine.CreateResource("report", "q4")
+	tr, err = TranslateCedar(`permit(principal == User::"erin", action == Action::"read", resource is Document);`, CedarOptions{})
+	require.NoError(t, err)
+	_, err = engine.ApplyCedar(tr)
+	require.NoError(t, err)
+	engine.CreateResource("document", "roadmap")
+	// applying the same policies again replaces the roles the import defined
+	_, err = engine.ApplyCedar(tr)
+	require.NoError(t, err)
+
+	require.NoError(t, engine.DefineRole(Role{Name: "cedar_taken", Permissions: []string{"read"}}))
+	tr, err = TranslateCedar(`@id("taken")
+permit(principal == User::"erin", action == Action::"write", resource is Document);`, CedarOptions{})
+	require.NoError(t, err)
+	_, err = engine.ApplyCedar(tr)
+	assert.EqualError(t, err, "policy taken: role cedar_taken already exists")
+
+	for _, tc := range []struct {
+		query   string
+		ctx     map[string]string
+		allowed bool
+	}{
+		{"can user:alice read report:q3", map[string]string{"department": "eng", "shift": "day"}, true},
+		{"can user:alice list document:plan", map[string]string{"department": "eng", "oncall": "true"}, true},
+		{"can user:alice read report:q3", map[string]string{"department": "eng", "shift": "night"}, false},
+		{"can user:alice read report:q3", map[string]string{"department": "sales", "shift": "day"}, false},
+		{"can user:bob read report:q3", map[string]string{"department": "eng", "shift": "day"}, false},
+		{"can user:carol write document:plan", nil, true},
+		{"can user:carol write document:plan", map[string]string{"tags": "frozen,q3"}, false},
+		{"can user:dave comment document:notes", nil, true},
+		{"can user:dave comment report:q3", nil, false},
+		{"can user:alice read report:q4", map[string]string{"department": "eng", "shift": "day"}, true},
+		{"can user:erin read document:roadmap", nil, true},
+		{"can user:erin read report:q4", nil, false},
+	} {
+		allowed, err := engine.VerifyQuery(tc.query, tc.ctx)
+		require.NoError(t, err, tc.query)
+		assert.Equal(t, tc.allowed, allowed, "%s %v", tc.query, tc.ctx)
+	}
+}
+
+func TestCompareCedar(t *testing.T) {
+	engine := cedarEngine(t)
+	tr, err := TranslateCedar(cedarPolicies, CedarOptions{})
+	require.NoError(t, err)
+	_, err = engine.ApplyCedar(tr)
+	require.NoError(t, err)
+
+	decisions, err := ReadCedarDecisions(strings.NewReader(`
+{"principal": "User::\"alice\"", "action": "Action::\"read\"", "resource": "Report::\"q3\"", "context": {"department": "eng", "oncall": true}, "decision": "allow"}
+{"principal": "User::\"alice\"", "action": "Action::\"read\"", "resource": "Report::\"q3\"", "context": {"department": "eng", "ip": "10.0.0.1", "shift": "day"}, "decision": "deny"}
+{"principal": "User::\"carol\"", "action": "Action::\"write\"", "resource": "Document::\"plan\"", "decision": "Allow"}
+`))
+	require.NoError(t, err)
+	require.Len(t, decisions, 3)
+
+	check := func(query string, ctx map[string]string) (bool, error) {
+		return engine.VerifyQuery(query, ctx)
+	}
+	mismatches, err := CompareCedar(decisions, CedarOptions{}, check)
+	require.NoError(t, err)
+	// the forbid policy was not translated
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, "can user:alice read report:q3: cedar deny, minzibar allow", mismatches[0].String())
+
+	_, err = CompareCedar([]CedarDecision{{Principal: `User::"a"`, Action: `Action::"read"`, Resource: `Doc::"x"`, Decision: "maybe"}}, CedarOptions{}, check)
+	assert.ErrorContains(t, err, "allow or deny")
+	_, err = CompareCedar([]CedarDecision{{Principal: `User::"a"`, Action: `Verb::"read"`, Resource: `Doc::"x"`, Decision: "deny"}}, CedarOptions{}, check)
+	assert.ErrorContains(t, err, "is not an action")
+}
+
+func TestService_ImportCedar(t *testing.T) {
+	service := NewService(cedarEngine(t))
+	e := service.Echo()
+	body := `{"source": "permit(principal == User::\"carol\", action == Action::\"write\", resource == Document::\"spec\");", "dry_run": true}`
+	req := httptest.NewRequest(http.MethodPost, "/policy/import/cedar", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"text":"allow write if action == \"write\""`)
+	assert.False(t, service.Engine.isResource(ObjectRef{Type: "document", ObjectID: "spec"}))
+
+	req = httptest.NewRequest(http.MethodPost, "/policy/import/cedar", strings.NewReader(strings.Replace(body, "true", "false", 1)))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"imported":{"policies":1,"resources":1,"tuples":1}`)
+	allowed, err := service.Engine.VerifyQuery("can user:carol write document:spec", nil)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestCLI_ImportCedar(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "graph.ndjson")
+	policies := filepath.Join(dir, "policies.cedar")
+	decisions := filepath.Join(dir, "decisions.jsonl")
+	require.NoError(t, os.WriteFile(policies, []byte(cedarPolicies), 0o644))
+	require.NoError(t, os.WriteFile(decisions, []byte(`{"principal": "User::\"carol\"", "action": "Action::\"write\"", "resource": "Document::\"plan\"", "decision": "allow"}`+"\n"), 0o644))
+
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"policy", "import-cedar", "-data", data, "-compare", decisions, policies}, nil, &out))
+	assert.Contains(t, out.String(), "policy eng_read (line 3): group:eng#member may read, list on every resource\n")
+	assert.Contains(t, out.String(), "unsupported: line 10:1: cedar_policy2: forbid is not supported")
+	assert.Contains(t, out.String(), "imported 2 policies, 1 resources, 0 roles, 1 tuples\n")
+	assert.Contains(t, out.String(), "all 1 decisions match\n")
+
+	saved, err := os.ReadFile(data)
+	require.NoError(t, err)
+	assert.Contains(t, string(saved), "eng_read")
+
+	require.NoError(t, os.WriteFile(decisions, []byte(`{"principal": "User::\"carol\"", "action": "Action::\"write\"", "resource": "Document::\"plan\"", "decision": "deny"}`+"\n"), 0o644))
+	out.Reset()
+	err = runCLI([]string{"policy", "import-cedar", "-data", data, "-dry-run", "-compare", decisions, policies}, nil, &out)
+	assert.EqualError(t, err, "1 of 1 decision(s) differ")
+	assert.Contains(t, out.String(), "differs: can user:carol write document:plan: cedar deny, minzibar allow\n")
+	assert.NotContains(t, out.String(), "imported")
+}
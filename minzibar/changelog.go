@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChangeOp is the kind of a Change
+type ChangeOp string
+
+const (
+	ChangeWrite  ChangeOp = "write"
+	ChangeDelete ChangeOp = "delete"
+	ChangePolicy ChangeOp = "policy"
+	ChangeFlag   ChangeOp = "flag"
+	// ChangeRole defines or redefines a role, ChangeRoleDelete removes one
+	ChangeRole       ChangeOp = "role"
+	ChangeRoleDelete ChangeOp = "role_delete"
+)
+
+// Change is one entry of an engine's change log: a tuple written or deleted, a policy
+// registered, a flag changed or a role defined or deleted. Revision is the engine revision right after the change.
+type Change struct {
+	Revision uint64         `json:"revision"`
+	Op       ChangeOp       `json:"op"`
+	Tuple    *RelationTuple `json:"tuple,omitempty"`
+	// CreatedAt and CreatedBy carry the TupleMeta of a written tuple
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	PolicyID   string     `json:"policy_id,omitempty"`
+	PolicyText string     `json:"policy_text,omitempty"`
+	// Flag is the whole flag after the change, kill switch included
+	Flag *FeatureFlag `json:"flag,omitempty"`
+	// Role is the role defined, or only the name of the role deleted
+	Role *Role `json:"role,omitempty"`
+}
+
+// DefaultChangeLogSize is the number of changes serve keeps for followers
+const DefaultChangeLogSize = 10000
+
+// ErrChangesTruncated is returned for a revision older than the oldest change kept; the
+// reader has to start over from a snapshot
+var ErrChangesTruncated = errors.New("changes no longer in the change log")
+
+// ErrNoChangeLog is returned when changes are asked of an engine that does not log them
+var ErrNoChangeLog = errors.New("change log is not enabled")
+
+// ChangeLog keeps the most recent changes of an engine in the order they were applied.
+// Writes to the engine hold its lock while they apply, so revisions in the log only grow.
+type ChangeLog struct {
+	mu      sync.Mutex
+	size    int
+	changes []Change
+	// start is the revision before the oldest change kept, head the newest revision
+	start, head uint64
+	// appended is closed and replaced whenever changes are added
+	appended chan struct{}
+}
+
+// NewChangeLog returns a log keeping size changes, starting at revision rev
+func NewChangeLog(size int, rev uint64) *ChangeLog {
+	if size <= 0 {
+		size = DefaultChangeLogSize
+	}
+	return &ChangeLog{size: size, start: rev, head: rev, appended: make(chan struct{})}
+}
+
+// appendLocked adds c; the caller holds l.mu
+func (l *ChangeLog) appendLocked(c Change) {
+	l.changes = append(l.changes, c)
+	l.head = c.Revision
+	// trim in bulk so appends stay cheap
+	if len(l.changes) >= 2*l.size {
+		drop := len(l.changes) - l.size
+		l.start = l.changes[drop-1].Revision
+		l.changes = append([]Change(nil), l.changes[drop:]...)
+	}
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Head returns the revision of the newest change
+func (l *ChangeLog) Head() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// Oldest returns the oldest revision a reader can still ask for changes after
+func (l *ChangeLog) Oldest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.start
+}
+
+// Since returns up to limit changes after revision after, oldest first, and the newest
+// revision of the log. An after older than the oldest change kept is ErrChangesTruncated.
+func (l *ChangeLog) Since(after uint64, limit int) ([]Change, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if after < l.start {
+		return nil, l.head, fmt.Errorf("%w: revision %d, oldest kept is %d", ErrChangesTruncated, after, l.start+1)
+	}
+	i := sort.Search(len(l.changes), func(i int) bool { return l.changes[i].Revision > after })
+	end := len(l.changes)
+	if limit > 0 && end-i > limit {
+		end = i + limit
+	}
+	return append([]Change(nil), l.changes[i:end]...), l.head, nil
+}
+
+// Wait blocks until the log holds a change after revision after or ctx is done
+func (l *ChangeLog) Wait(ctx context.Context, after uint64) {
+	l.mu.Lock()
+	head, appended := l.head, l.appended
+	l.mu.Unlock()
+	if head > after {
+		return
+	}
+	select {
+	case <-appended:
+	case <-ctx.Done():
+	}
+}
+
+// EnableChangeLog makes the engine keep its last size changes for followers, see Changes
+func (e *Engine) EnableChangeLog(size int) {
+	e.changes = NewChangeLog(size, e.graph.Revision())
+}
+
+// ChangeLog returns the engine's change log, nil unless enabled
+func (e *Engine) ChangeLog() *ChangeLog {
+	return e.changes
+}
+
+// logChange runs apply and records the change it reports, nil when nothing changed.
+// With a change log apply runs under its lock, so the log order is the apply order and
+// the revision read afterwards is the change's own.
+func (e *Engine) logChange(apply func() (*Change, error)) error {
+	if e.store != nil {
+		return e.storeChange(apply)
+	}
+	if e.changes == nil {
+		_, err := apply()
+		return err
+	}
+	e.changes.mu.Lock()
+	defer e.changes.mu.Unlock()
+	c, err := apply()
+	if err != nil || c == nil {
+		return err
+	}
+	c.Revision = e.graph.Revision()
+	e.changes.appendLocked(*c)
+	return nil
+}
+
+// deleteTuple removes a tuple, reporting whether it existed
+func (e *Engine) deleteTuple(t RelationTuple) bool {
+	deleted := false
+	_ = e.logChange(func() (*Change, error) {
+		if deleted = e.graph.Delete(t); !deleted {
+			return nil, nil
+		}
+		return &Change{Op: ChangeDelete, Tuple: &t}, nil
+	})
+	return deleted
+}
+
+// applyChange replays a change read from another engine's log and moves the revision to
+// the change's, so consistency tokens of the source hold here too. A change at or before
+// the engine's revision is already applied and skipped. Quotas are not checked: the
+// source already did.
+func (e *Engine) applyChange(c Change) error {
+	if c.Revision <= e.graph.Revision() {
+		return nil
+	}
+	if err := e.replayChange(c); err != nil {
+		return err
+	}
+	e.graph.advanceRevision(c.Revision)
+	return nil
+}
+
+// replayChange applies c whatever the engine's revision, leaving the revision to the caller
+func (e *Engine) replayChange(c Change) error {
+	switch c.Op {
+	case ChangeWrite, ChangeDelete:
+		if c.Tuple == nil {
+			return fmt.Errorf("revision %d: %s without tuple", c.Revision, c.Op)
+		}
+		if c.Op == ChangeDelete {
+			e.graph.Delete(*c.Tuple)
+			break
+		}
+		meta := TupleMeta{CreatedBy: c.CreatedBy}
+		if c.CreatedAt != nil {
+			meta.CreatedAt = *c.CreatedAt
+		}
+		e.graph.WriteWithMeta(*c.Tuple, meta)
+	case ChangePolicy:
+		policy, err := ParsePolicies(c.PolicyText)
+		if err != nil {
+			return fmt.Errorf("revision %d: policy %s: %v", c.Revision, c.PolicyID, err)
+		}
+		e.setPolicy(c.PolicyID, policy)
+	case ChangeFlag:
+		if c.Flag == nil {
+			return fmt.Errorf("revision %d: flag change without flag", c.Revision)
+		}
+		flag := *c.Flag
+		if err := flag.normalize(); err != nil {
+			return fmt.Errorf("revision %d: %v", c.Revision, err)
+		}
+		e.setFlag(&flag)
+	case ChangeRole, ChangeRoleDelete:
+		if c.Role == nil {
+			return fmt.Errorf("revision %d: %s without role", c.Revision, c.Op)
+		}
+		if c.Op == ChangeRoleDelete {
+			e.setRole(c.Role.Name, nil)
+			break
+		}
+		role := *c.Role
+		if err := role.normalize(); err != nil {
+			return fmt.Errorf("revision %d: %v", c.Revision, err)
+		}
+		e.setRole(role.Name, &role)
+	default:
+		return fmt.Errorf("revision %d: unknown change %q", c.Revision, c.Op)
+	}
+	return nil
+}
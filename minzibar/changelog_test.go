@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeLog_Since(t *testing.T) {
+	l := NewChangeLog(2, 10)
+	for rev := uint64(11); rev <= 13; rev++ {
+		l.mu.Lock()
+		l.appendLocked(Change{Revision: rev, Op: ChangeWrite})
+		l.mu.Unlock()
+	}
+	changes, head, err := l.Since(10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(13), head)
+	assert.Len(t, changes, 3, "trimmed only once twice the size")
+
+	changes, _, err = l.Since(11, 1)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, uint64(12), changes[0].Revision)
+
+	l.mu.Lock()
+	l.appendLocked(Change{Revision: 14, Op: ChangeWrite})
+	l.mu.Unlock()
+	assert.Equal(t, uint64(12), l.Oldest())
+	_, _, err = l.Since(11, 0)
+	assert.ErrorIs(t, err, ErrChangesTruncated)
+	changes, _, err = l.Since(14, 0)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestChangeLog_Wait(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.EnableChangeLog(0)
+	log := engine.ChangeLog()
+	engine.CreateResource("document", "plan")
+
+	// nothing to wait for when the log is past the revision already
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read"))
+	log.Wait(context.Background(), 0)
+
+	done := make(chan struct{})
+	go func() {
+		log.Wait(context.Background(), log.Head())
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, engine.AddRelationQuery("document:plan user:bob->read"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after a write")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	log.Wait(ctx, log.Head())
+	assert.Error(t, ctx.Err())
+}
+
+func TestEngine_ChangeLogReplay(t *testing.T) {
+	leader := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	leader.EnableChangeLog(0)
+	leader.CreateResource("document", "plan")
+	require.NoError(t, leader.WithActor("user:admin").AddRelationQuery("document:plan user:alice->read user:bob->read"))
+	require.NoError(t, leader.AddRelationQuery("document:plan user:alice->read"), "a duplicate write")
+	require.NoError(t, leader.RemoveRelation(plan, "read", SubjectRef{Object: bob}))
+	require.NoError(t, leader.AddPolicy("p", `allow read if subject.department == "eng"`))
+	require.NoError(t, leader.RegisterFlag(dashboardFlag))
+	require.NoError(t, leader.SetFlagKilled("new-dashboard", true))
+
+	changes, head, err := leader.ChangeLog().Since(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, leader.graph.Revision(), head)
+	var ops []ChangeOp
+	for i, c := range changes {
+		ops = append(ops, c.Op)
+		if i > 0 {
+			assert.Greater(t, c.Revision, changes[i-1].Revision)
+		}
+	}
+	assert.Equal(t, []ChangeOp{ChangeWrite, ChangeWrite, ChangeWrite, ChangeDelete, ChangePolicy, ChangeWrite, ChangeFlag, ChangeFlag}, ops,
+		"the duplicate is not logged; the flag's resource is a write")
+	assert.Equal(t, "user:admin", changes[1].CreatedBy)
+
+	follower := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	for _, c := range changes {
+		require.NoError(t, follower.applyChange(c))
+	}
+	// replaying again changes nothing, not even the revision
+	for _, c := range changes {
+		require.NoError(t, follower.applyChange(c))
+	}
+	assert.Equal(t, head, follower.graph.Revision())
+	assert.Equal(t, leader.graph.ReadTuples(plan, ""), follower.graph.ReadTuples(plan, ""))
+	assert.Equal(t, leader.Flags(), follower.Flags())
+	assert.Equal(t, leader.policyRepo["p"].Text, follower.policyRepo["p"].Text)
+	meta, ok := follower.graph.TupleMeta(RelationTuple{Object: plan, Relation: "read", Subject: SubjectRef{Object: alice}})
+	require.True(t, ok)
+	assert.Equal(t, "user:admin", meta.CreatedBy)
+
+	assert.NoError(t, follower.applyChange(Change{Revision: head, Op: "rename"}), "already applied")
+	assert.Error(t, follower.applyChange(Change{Revision: 99, Op: "rename"}))
+	assert.Error(t, follower.applyChange(Change{Revision: 99, Op: ChangeWrite}))
+}
+
+// run with -race: a follower replays policies, flags and roles while checks read them
+func TestApplyChange_ConcurrentReads(t *testing.T) {
+	follower := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	follower.CreateResource("document", "plan")
+	require.NoError(t, follower.AddRelationQuery("document:plan user:alice->read"))
+	require.NoError(t, follower.AddPolicy("p0", `allow read if department == "eng"`))
+	require.NoError(t, follower.AddPolicyToResource(plan, "p0"))
+	require.NoError(t, follower.RegisterFlag(dashboardFlag))
+
+	ctx := context.Background()
+	var stop atomic.Bool
+	var reads atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ; !stop.Load(); reads.Add(1) {
+			_, err := follower.Verify(plan, alice, "read", map[string]string{"department": "eng"})
+			assert.NoError(t, err)
+			_, err = follower.EvaluateFlag(ctx, dashboardFlag.Name, alice)
+			assert.NoError(t, err)
+			follower.Roles()
+			follower.Flags()
+		}
+	}()
+
+	rev := follower.graph.Revision()
+	// keep replaying until the reader went round a few times
+	for i := 0; i < 200 || reads.Load() < 50; i++ {
+		rev++
+		flag := dashboardFlag
+		flag.Killed = i%2 == 0
+		role := &Role{Name: fmt.Sprintf("r%d", i%5), Permissions: []string{"read"}}
+		var c Change
+		switch i % 4 {
+		case 0:
+			c = Change{Op: ChangePolicy, PolicyID: "p0", PolicyText: fmt.Sprintf(`allow read if department == "eng%d"`, i%2)}
+		case 1:
+			c = Change{Op: ChangeFlag, Flag: &flag}
+		case 2:
+			c = Change{Op: ChangeRole, Role: role}
+		case 3:
+			c = Change{Op: ChangeRoleDelete, Role: role}
+		}
+		c.Revision = rev
+		require.NoError(t, follower.applyChange(c))
+	}
+	stop.Store(true)
+	<-done
+}
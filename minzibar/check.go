@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMaxCheckDepth is how many userset hops a deep check follows unless told otherwise
+const DefaultMaxCheckDepth = 32
+
+// ErrMaxDepthExceeded is returned (wrapped) when a deep check ran out of depth before
+// finding the subject; the answer is unknown rather than a deny
+var ErrMaxDepthExceeded = errors.New("max check depth exceeded")
+
+// CheckOptions tunes a single CheckDeep call, zero values pick the defaults
+type CheckOptions struct {
+	// MaxDepth bounds the number of userset hops, DefaultMaxCheckDepth when 0
+	MaxDepth int
+	// Concurrency bounds how many branches are walked at once, GOMAXPROCS when 0
+	Concurrency int
+}
+
+func (o CheckOptions) withDefaults() CheckOptions {
+	if o.MaxDepth <= 0 {
+		o.MaxDepth = DefaultMaxCheckDepth
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	return o
+}
+
+// CheckDeep reports whether subject has relation to object, following userset chains.
+// Userset branches are walked concurrently and the walk stops at the first match.
+// A cancelled or expired ctx aborts the walk with ctx.Err(); when no match is found and
+// some branch was cut off by opts.MaxDepth the error wraps ErrMaxDepthExceeded.
+// The walk sees the graph as of the revision it started at, while writers go on.
+func (g *RelationGraph) CheckDeep(ctx context.Context, object ObjectRef, relation string, subject SubjectRef, opts CheckOptions) (bool, error) {
+	t := g.telemetry.Load()
+	if t == nil {
+		ok, _, err := g.checkDeep(ctx, object, relation, subject, opts)
+		return ok, err
+	}
+	ctx, span := t.startCheck(ctx, object, relation, subject)
+	ok, stats, err := g.checkDeep(ctx, object, relation, subject, opts)
+	t.endCheck(span, ok, stats, err)
+	return ok, err
+}
+
+// checkStats describes how much of the graph one deep check walked
+type checkStats struct {
+	// depth is the deepest userset hop expanded
+	depth int
+	// indexHits and indexMisses count pairs answered from the membership index and
+	// pairs walked by hand while the index was on
+	indexHits, indexMisses int
+}
+
+func (g *RelationGraph) checkDeep(ctx context.Context, object ObjectRef, relation string, subject SubjectRef, opts CheckOptions) (bool, checkStats, error) {
+	if err := ctx.Err(); err != nil {
+		return false, checkStats{}, err
+	}
+	n, ok := g.lookupNode(object)
+	if !ok {
+		return false, checkStats{}, nil
+	}
+	rel, ok := g.strings.lookup(relation)
+	if !ok {
+		return false, checkStats{}, nil
+	}
+	subj, ok := g.lookupSubject(subject)
+	if !ok {
+		return false, checkStats{}, nil
+	}
+	opts = opts.withDefaults()
+
+	var c *deepCheck
+	for {
+		rev := g.beginSnapshot()
+		c = &deepCheck{
+			g: g,
+			// loaded after the revision: an index replaced later stops taking changes
+			// only after rev, so its changedAt still tells whether it can answer
+			members:   g.membership.Load(),
+			cancelled: ctx.Done(),
+			rev:       rev,
+			subject:   subj,
+			maxDepth:  opts.MaxDepth,
+			// the calling goroutine is one of the workers
+			sem:     make(chan struct{}, opts.Concurrency-1),
+			visited: make(map[objectRelation]int),
+		}
+		c.walk(objectRelation{object: n, rel: rel}, 0)
+		c.wg.Wait()
+		g.endSnapshot(c.rev)
+		// the tuples were replaced wholesale while walking, start over on the new ones
+		if g.replaced.Load() <= c.rev || ctx.Err() != nil {
+			break
+		}
+	}
+
+	stats := checkStats{depth: c.deepest, indexHits: int(c.indexHits.Load()), indexMisses: int(c.indexMisses.Load())}
+	switch {
+	case c.found.Load():
+		return true, stats, nil
+	case ctx.Err() != nil:
+		return false, stats, ctx.Err()
+	case c.exceeded.Load():
+		return false, stats, fmt.Errorf("%w: %s#%s not resolved within %d hops", ErrMaxDepthExceeded, object, relation, opts.MaxDepth)
+	}
+	return false, stats, nil
+}
+
+// deepCheck is the state shared by the branches of one CheckDeep walk
+type deepCheck struct {
+	g       *RelationGraph
+	members *membershipIndexes // nil when the membership index is off
+	// rev is the revision the walk reads at; locked is set when the caller holds every
+	// lock, so lookups take none and see the graph as it is
+	rev    uint64
+	locked bool
+	// cancelled is the caller's ctx.Done(), nil for contexts that never end
+	cancelled <-chan struct{}
+	subject   subjectKey
+	maxDepth  int
+	sem       chan struct{}
+	wg        sync.WaitGroup
+
+	found    atomic.Bool
+	exceeded atomic.Bool
+
+	indexHits, indexMisses atomic.Int64
+
+	mu sync.Mutex
+	// visited holds the shallowest depth each pair was expanded at; a pair reached
+	// again at the same or a greater depth cannot find anything new
+	visited map[objectRelation]int
+	// deepest is the greatest depth claimed
+	deepest int
+}
+
+// done reports whether the walk can stop: a branch matched or the caller gave up
+func (c *deepCheck) done() bool {
+	if c.found.Load() {
+		return true
+	}
+	if c.cancelled == nil {
+		return false
+	}
+	select {
+	case <-c.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// claim marks a pair as expanded at depth, false if it already was at that depth or shallower
+func (c *deepCheck) claim(at objectRelation, depth int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d, ok := c.visited[at]; ok && d <= depth {
+		return false
+	}
+	c.visited[at] = depth
+	if depth > c.deepest {
+		c.deepest = depth
+	}
+	return true
+}
+
+// walk expands one (object, relation) pair, answering from the membership index
+// when the relation is indexed and walking the usersets below it otherwise
+func (c *deepCheck) walk(at objectRelation, depth int) {
+	if c.done() || !c.claim(at, depth) {
+		return
+	}
+	if depth > c.maxDepth {
+		c.exceeded.Store(true)
+		return
+	}
+	if c.members != nil && c.subject.rel == 0 {
+		if mi := c.members.byRel[at.rel]; mi != nil && c.walkIndexed(mi, at, depth) {
+			c.indexHits.Add(1)
+			return
+		}
+		c.indexMisses.Add(1)
+	}
+	has, usersets := c.subjectsOf(at)
+	if has {
+		c.found.Store(true)
+		return
+	}
+	for _, k := range usersets {
+		if c.done() {
+			return
+		}
+		c.branch(objectRelation{object: k.node, rel: k.rel}, depth+1)
+	}
+}
+
+// walkIndexed checks a concrete subject against an indexed pair: the subject is in it
+// when one of the subject's direct groups is the object or nested below it.
+// Usersets of other relations inside the closure are still walked. It returns false,
+// having done nothing, when the index changed after the walk's revision.
+func (c *deepCheck) walkIndexed(mi *membershipIndex, at objectRelation, depth int) bool {
+	// writers lock shards before the index, so the shard is read before the index is locked
+	groups := c.groupsOf(mi.rel)
+	if !c.locked {
+		c.members.mu.RLock()
+	}
+	usable := mi.changedAt <= c.rev
+	var escapes []nodeID
+	if usable {
+		for _, h := range groups {
+			if mi.contains(at.object, h) {
+				c.found.Store(true)
+			}
+		}
+		for e := range mi.escapes {
+			if mi.contains(at.object, e) {
+				escapes = append(escapes, e)
+			}
+		}
+	}
+	if !c.locked {
+		c.members.mu.RUnlock()
+	}
+	if !usable {
+		return false
+	}
+	for _, e := range escapes {
+		_, usersets := c.subjectsOf(objectRelation{object: e, rel: mi.rel})
+		for _, k := range usersets {
+			if c.done() {
+				return true
+			}
+			if k.rel != mi.rel {
+				c.branch(objectRelation{object: k.node, rel: k.rel}, depth+1)
+			}
+		}
+	}
+	return true
+}
+
+// subjectsOf reports whether the walk's subject was in a pair at the walk's revision and
+// returns the usersets that were
+func (c *deepCheck) subjectsOf(at objectRelation) (has bool, usersets []subjectKey) {
+	sh := c.g.shardFor(at.object)
+	if !c.locked {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+	var set *compactSet[subjectKey]
+	if adj := sh.objectIndex[at.object]; adj != nil {
+		set = adj.get(at.rel)
+	}
+	was := revertedAt(sh.history.objects[at], c.rev)
+	if in, changed := was[c.subject]; changed {
+		has = in
+	} else {
+		has = set != nil && set.has(c.subject)
+	}
+	if has {
+		return true, nil
+	}
+	if set != nil {
+		set.each(func(k subjectKey) bool {
+			if in, changed := was[k]; k.rel != 0 && (!changed || in) {
+				if usersets == nil {
+					usersets = make([]subjectKey, 0, min(set.len(), smallSetMax))
+				}
+				usersets = append(usersets, k)
+			}
+			return true
+		})
+	}
+	for k, in := range was {
+		if in && k.rel != 0 && (set == nil || !set.has(k)) {
+			usersets = append(usersets, k)
+		}
+	}
+	return false, usersets
+}
+
+// groupsOf returns the objects the walk's subject held rel on directly at the walk's revision
+func (c *deepCheck) groupsOf(rel uint32) []nodeID {
+	sh := c.g.shardFor(c.subject.node)
+	if !c.locked {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+	var set *compactSet[nodeID]
+	if adj := sh.subjectIndex[c.subject.node]; adj != nil {
+		set = adj.get(rel)
+	}
+	was := revertedAt(sh.history.subjects[objectRelation{object: c.subject.node, rel: rel}], c.rev)
+	var groups []nodeID
+	if set != nil {
+		set.each(func(h nodeID) bool {
+			if in, changed := was[h]; !changed || in {
+				groups = append(groups, h)
+			}
+			return true
+		})
+	}
+	for h, in := range was {
+		if in && (set == nil || !set.has(h)) {
+			groups = append(groups, h)
+		}
+	}
+	return groups
+}
+
+// branch walks a userset in a new goroutine while there is spare concurrency, inline otherwise
+func (c *deepCheck) branch(next objectRelation, depth int) {
+	select {
+	case c.sem <- struct{}{}:
+		c.wg.Add(1)
+		go func() {
+			defer func() {
+				<-c.sem
+				c.wg.Done()
+			}()
+			c.walk(next, depth)
+		}()
+	default:
+		c.walk(next, depth)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// groupChain writes doc#viewer@group:g1#member, group:g1#member@group:g2#member, ...
+// with the user as a member of the last group, so the user is n hops away
+func groupChain(g *RelationGraph, doc ObjectRef, user SubjectRef, n int) {
+	prev := SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "g1"}, Relation: "member"}
+	g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: prev})
+	for i := 2; i <= n; i++ {
+		next := SubjectRef{Object: ObjectRef{Type: "group", ObjectID: fmt.Sprintf("g%d", i)}, Relation: "member"}
+		g.Write(RelationTuple{Object: prev.Object, Relation: "member", Subject: next})
+		prev = next
+	}
+	g.Write(RelationTuple{Object: prev.Object, Relation: "member", Subject: user})
+}
+
+func TestCheckDeep_MaxDepth(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	groupChain(g, doc, alice, 5)
+
+	ok, err := g.CheckDeep(context.Background(), doc, "viewer", alice, CheckOptions{MaxDepth: 5})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = g.CheckDeep(context.Background(), doc, "viewer", alice, CheckOptions{MaxDepth: 4})
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, ErrMaxDepthExceeded)
+
+	// a plain miss within the limit is not a depth error
+	bob := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}
+	g.Write(RelationTuple{Object: doc, Relation: "owner", Subject: bob})
+	ok, err = g.CheckDeep(context.Background(), doc, "viewer", bob, CheckOptions{})
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// walkAt runs a single goroutine check reading the graph at rev
+func walkAt(g *RelationGraph, rev uint64, object ObjectRef, relation string, subject SubjectRef) bool {
+	n, _ := g.lookupNode(object)
+	rel, _ := g.strings.lookup(relation)
+	subj, _ := g.lookupSubject(subject)
+	c := &deepCheck{
+		g:        g,
+		members:  g.membership.Load(),
+		rev:      rev,
+		subject:  subj,
+		maxDepth: DefaultMaxCheckDepth,
+		sem:      make(chan struct{}),
+		visited:  make(map[objectRelation]int),
+	}
+	c.walk(objectRelation{object: n, rel: rel}, 0)
+	return c.found.Load()
+}
+
+func TestCheckDeep_ReadsAtItsRevision(t *testing.T) {
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	eng := ObjectRef{Type: "group", ObjectID: "eng"}
+	ops := ObjectRef{Type: "group", ObjectID: "ops"}
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	bob := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}
+	for _, indexed := range []bool{false, true} {
+		g := NewRelationGraph()
+		if indexed {
+			g.EnableMembershipIndex("member")
+		}
+		g.Write(RelationTuple{Object: doc, Relation: "editor", Subject: SubjectRef{Object: eng, Relation: "member"}})
+		g.Write(RelationTuple{Object: eng, Relation: "member", Subject: alice})
+
+		rev := g.beginSnapshot()
+		// after the check started: the document moves from eng to ops, alice leaves eng
+		// and bob joins ops
+		g.Delete(RelationTuple{Object: doc, Relation: "editor", Subject: SubjectRef{Object: eng, Relation: "member"}})
+		g.Delete(RelationTuple{Object: eng, Relation: "member", Subject: alice})
+		g.Write(RelationTuple{Object: doc, Relation: "editor", Subject: SubjectRef{Object: ops, Relation: "member"}})
+		g.Write(RelationTuple{Object: ops, Relation: "member", Subject: bob})
+		g.Write(RelationTuple{Object: eng, Relation: "member", Subject: bob})
+
+		assert.True(t, walkAt(g, rev, doc, "editor", alice), "indexed %v", indexed)
+		assert.False(t, walkAt(g, rev, doc, "editor", bob), "indexed %v", indexed)
+		assert.False(t, walkAt(g, rev, eng, "member", bob), "indexed %v", indexed)
+		g.endSnapshot(rev)
+
+		assert.False(t, g.HasDeepRelationship(doc, "editor", alice))
+		assert.True(t, g.HasDeepRelationship(doc, "editor", bob))
+	}
+}
+
+func TestCheckDeep_HistoryIsTrimmed(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	sh := g.shardFor(g.internNode(doc))
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: fmt.Sprint(i)}}})
+		}
+	}
+
+	old := g.beginSnapshot()
+	write(0, 1000)
+	assert.GreaterOrEqual(t, sh.history.size, 1000, "changes are kept while a check runs")
+	newer := g.beginSnapshot()
+	g.endSnapshot(old)
+	write(1000, 2500)
+	for _, changes := range sh.history.objects {
+		for _, ch := range changes {
+			require.Greater(t, ch.rev, newer, "changes the running check cannot need are dropped")
+		}
+	}
+	assert.True(t, walkAt(g, newer, doc, "viewer", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "999"}}))
+	assert.False(t, walkAt(g, newer, doc, "viewer", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "1000"}}))
+
+	g.endSnapshot(newer)
+	write(2500, 2501)
+	assert.Zero(t, sh.history.size, "nothing is kept without a running check")
+}
+
+func TestCheckDeep_ShorterPathWinsOverDeepClaim(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	target := SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "target"}, Relation: "member"}
+	// a long detour to the target group first, then a direct edge to it
+	groupChain(g, doc, target, 3)
+	g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: target})
+	g.Write(RelationTuple{Object: target.Object, Relation: "member", Subject: alice})
+
+	for i := 0; i < 20; i++ {
+		ok, err := g.CheckDeep(context.Background(), doc, "viewer", alice, CheckOptions{MaxDepth: 2, Concurrency: 1 + i%4})
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
+
+func TestCheckDeep_CyclesAndFanOut(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	a := SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "a"}, Relation: "member"}
+	b := SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "b"}, Relation: "member"}
+	g.Write(RelationTuple{Object: a.Object, Relation: "member", Subject: b})
+	g.Write(RelationTuple{Object: b.Object, Relation: "member", Subject: a})
+	for i := 0; i < 100; i++ {
+		group := SubjectRef{Object: ObjectRef{Type: "group", ObjectID: fmt.Sprintf("wide%d", i)}, Relation: "member"}
+		g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: group})
+		g.Write(RelationTuple{Object: group.Object, Relation: "member", Subject: a})
+	}
+
+	ok, err := g.CheckDeep(context.Background(), doc, "viewer", alice, CheckOptions{Concurrency: 8})
+	require.NoError(t, err)
+	assert.False(t, ok, "a cycle ends the walk without a depth error")
+
+	g.Write(RelationTuple{Object: b.Object, Relation: "member", Subject: alice})
+	ok, err = g.CheckDeep(context.Background(), doc, "viewer", alice, CheckOptions{Concurrency: 8})
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestCheckDeep_Cancelled(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	groupChain(g, doc, alice, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok, err := g.CheckDeep(ctx, doc, "viewer", alice, CheckOptions{})
+	assert.False(t, ok)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestService_VerifyDepthExceeded(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	doc := engine.CreateResource("document", "plan")
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	groupChain(engine.graph, doc, alice, 10)
+	require.NoError(t, engine.AddPolicy("p_view", `allow viewer if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(doc, "p_view"))
+
+	verify := func(t *testing.T, service *Service) *http.Response {
+		srv := httptest.NewServer(service.Echo())
+		t.Cleanup(srv.Close)
+		body, _ := json.Marshal(VerifyRequest{
+			ResourceType: "document", ResourceID: "plan",
+			SubjectType: "user", SubjectID: "alice",
+			Action: "viewer", Context: map[string]string{"department": "eng"},
+		})
+		resp, err := http.Post(srv.URL+"/verify", echo.MIMEApplicationJSON, bytes.NewReader(body))
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := verify(t, NewService(engine))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var out struct {
+		Allowed bool `json:"allowed"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.True(t, out.Allowed, "verify follows group membership")
+
+	engine.SetCheckOptions(CheckOptions{MaxDepth: 3})
+	resp = verify(t, NewService(engine))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
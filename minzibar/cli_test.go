@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCLI_LocalDataFile(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "graph.txt")
+	var out bytes.Buffer
+
+	require.NoError(t, runCLI([]string{"write", "-data", data, "document:x#read@user:alice"}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "document:x group:eng#member->read"}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "group:eng#member@user:bob"}, nil, &out))
+
+	saved, err := os.ReadFile(data)
+	require.NoError(t, err)
+	assert.Contains(t, string(saved), "document:x#read@user:alice")
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"check", "-data", data, "-direct", "can user:alice read document:x"}, nil, &out))
+	assert.Equal(t, "allow\n", out.String())
+
+	out.Reset()
+	err = runCLI([]string{"check", "-data", data, "can", "user:alice", "write", "document:x"}, nil, &out)
+	assert.ErrorIs(t, err, errDenied)
+	assert.Equal(t, "deny\n", out.String())
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"expand", "-data", data, "document:x", "read"}, nil, &out))
+	assert.Equal(t, "document:x#read\n  group:eng#member\n    user:bob\n  user:alice\n", out.String())
+
+	assert.Error(t, runCLI([]string{"frobnicate"}, nil, &out))
+}
+
+func TestCLI_RemoteServer(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "x")
+	require.NoError(t, engine.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(ObjectRef{Type: "document", ObjectID: "x"}, "p"))
+	srv := httptest.NewServer(NewService(engine).Echo())
+	defer srv.Close()
+
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"write", "-server", srv.URL, "document:x user:alice->read"}, nil, &out))
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"check", "-server", srv.URL, "-ctx", "department=eng", "can user:alice read document:x"}, nil, &out))
+	assert.Equal(t, "allow\n", out.String())
+
+	out.Reset()
+	err := runCLI([]string{"check", "-server", srv.URL, "-ctx", "department=sales", "can user:alice read document:x"}, nil, &out)
+	assert.ErrorIs(t, err, errDenied)
+
+	err = runCLI([]string{"check", "-server", srv.URL, "can user:alice"}, nil, &out)
+	assert.ErrorContains(t, err, "invalid query format")
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"export", "-server", srv.URL, "-format", "text"}, nil, &out))
+	assert.Contains(t, out.String(), "document:x#read@user:alice")
+
+	out.Reset()
+	snapshot := "document:y#owner@user:carol\n"
+	require.NoError(t, runCLI([]string{"import", "-server", srv.URL, "-format", "text"}, strings.NewReader(snapshot), &out))
+	assert.Equal(t, "imported 1 tuples, 0 policies\n", out.String())
+	assert.True(t, engine.CheckRelation(ObjectRef{Type: "document", ObjectID: "y"}, "owner", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "carol"}}))
+}
+
+func TestCLI_PolicyLint(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.policy")
+	bad := filepath.Join(dir, "bad.policy")
+	require.NoError(t, os.WriteFile(good, []byte("allow read if department == \"eng\"\n"), 0o644))
+	require.NoError(t, os.WriteFile(bad, []byte("allow read if department == \"eng\"\npermit all\n"), 0o644))
+
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"policy", "lint", good}, nil, &out))
+	assert.Empty(t, out.String())
+
+	err := runCLI([]string{"policy", "lint", good, bad}, nil, &out)
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "bad.policy:2:")
+}
+
+func TestREPL(t *testing.T) {
+	backend, err := openLocalBackend(filepath.Join(t.TempDir(), "graph.ndjson"))
+	require.NoError(t, err)
+	backend.engine.CreateResource("document", "x")
+	require.NoError(t, backend.engine.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, backend.engine.AddPolicyToResource(ObjectRef{Type: "document", ObjectID: "x"}, "p"))
+
+	script := strings.Join([]string{
+		"# comment lines are skipped",
+		"write document:x user:alice->read",
+		"can user:alice read document:x",
+		"set department=eng",
+		"can user:alice read document:x",
+		"can user:alice read document:x department=sales",
+		"has user:alice read document:x",
+		"ctx",
+		"bogus",
+		"quit",
+		"can user:alice read document:x",
+	}, "\n")
+	var out bytes.Buffer
+	r := &repl{backend: backend, ctx: map[string]string{}, out: &out}
+	require.NoError(t, r.run(strings.NewReader(script)))
+
+	assert.Equal(t, []string{
+		"ok",
+		"deny",
+		"allow",
+		"deny",
+		"allow",
+		"department=eng",
+		`error: unknown command "bogus", try help`,
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+}
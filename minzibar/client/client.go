@@ -0,0 +1,500 @@
+// Package client talks to a minzibar server: typed calls for its endpoints, retries,
+// batched checks and consistency tokens, plus middleware that guards net/http and Echo
+// handlers with access checks.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header names shared with the server
+const (
+	revisionHeader    = "X-Minzibar-Revision"
+	consistencyHeader = "X-Minzibar-At-Least"
+)
+
+// MaxBatchChecks is the most checks the server answers in one batch; VerifyBatch splits
+// longer lists
+const MaxBatchChecks = 100
+
+// ObjectRef names an object or subject, document:plan is {Type: "document", ID: "plan"}.
+// It is encoded the way the server encodes its objects.
+type ObjectRef struct {
+	Type string `json:"Type"`
+	ID   string `json:"ObjectID"`
+}
+
+func (o ObjectRef) String() string {
+	return o.Type + ":" + o.ID
+}
+
+// ParseObjectRef parses "type:id"
+func ParseObjectRef(s string) (ObjectRef, error) {
+	typ, id, ok := strings.Cut(s, ":")
+	if !ok || typ == "" || id == "" {
+		return ObjectRef{}, fmt.Errorf("invalid object %q, expected type:id", s)
+	}
+	return ObjectRef{Type: typ, ID: id}, nil
+}
+
+// CheckRequest asks whether Subject may perform Action on Resource
+type CheckRequest struct {
+	Resource ObjectRef
+	Subject  ObjectRef
+	Action   string
+	// Context holds the attributes policies are evaluated against
+	Context map[string]string
+}
+
+// CheckResult is the answer to one check of a batch
+type CheckResult struct {
+	Allowed bool
+	// Err is set when the check has no answer, e.g. it ran out of depth
+	Err error
+}
+
+// Authorizer answers access checks. Client does it over http and AuthorizerFunc from a
+// function. The engine-backed EmbeddedClient lives in the server's main package, so only
+// tests inside the minzibar module can use it.
+type Authorizer interface {
+	Verify(ctx context.Context, req CheckRequest) (bool, error)
+	VerifyBatch(ctx context.Context, reqs []CheckRequest) ([]CheckResult, error)
+}
+
+// AuthorizerFunc answers checks with a function, e.g. a fake in tests of guarded handlers
+type AuthorizerFunc func(ctx context.Context, req CheckRequest) (bool, error)
+
+// Verify calls f
+func (f AuthorizerFunc) Verify(ctx context.Context, req CheckRequest) (bool, error) {
+	return f(ctx, req)
+}
+
+// VerifyBatch calls f for each check in turn
+func (f AuthorizerFunc) VerifyBatch(ctx context.Context, reqs []CheckRequest) ([]CheckResult, error) {
+	results := make([]CheckResult, len(reqs))
+	for i, req := range reqs {
+		results[i].Allowed, results[i].Err = f(ctx, req)
+	}
+	return results, nil
+}
+
+// Token is a consistency token: the revision a write produced. Reads made with AtLeast
+// see that write or get retried until they do.
+type Token string
+
+type tokenKey struct{}
+
+// AtLeast returns a context whose reads must see the state at token or later
+func AtLeast(ctx context.Context, token Token) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// Error is a response the server refused
+type Error struct {
+	Status  int
+	Message string
+	// RetryAfter is the wait the server asked for with Retry-After, 0 when it did not
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("minzibar: %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("minzibar: %d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// retryable reports whether the same request may succeed later: the server is not there
+// yet, overloaded, or behind the requested revision
+func (e *Error) retryable() bool {
+	switch e.Status {
+	case http.StatusPreconditionFailed, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// rejected reports whether the server turned the request away before acting on it: it
+// was throttled or the engine was behind the requested revision
+func (e *Error) rejected() bool {
+	return e.Status == http.StatusPreconditionFailed || e.Status == http.StatusTooManyRequests
+}
+
+// Client calls a minzibar server. The zero value is not usable, see New.
+type Client struct {
+	// BaseURL is the server address, e.g. http://localhost:8080
+	BaseURL string
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Token, when set, is sent as a bearer token
+	Token string
+	// Tenant, when set, scopes every call to one tenant of a multi-tenant server
+	Tenant string
+	// MaxRetries is how many times a failed call is retried
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled for each further one
+	Backoff time.Duration
+}
+
+// New returns a client for the server at baseURL that retries 3 times
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), MaxRetries: 3, Backoff: 50 * time.Millisecond}
+}
+
+// verifyBody is the server's VerifyRequest
+type verifyBody struct {
+	ResourceType string            `json:"resource_type"`
+	ResourceID   string            `json:"resource_id"`
+	SubjectType  string            `json:"subject_type"`
+	SubjectID    string            `json:"subject_id"`
+	Action       string            `json:"action"`
+	Context      map[string]string `json:"context"`
+}
+
+func newVerifyBody(req CheckRequest) verifyBody {
+	return verifyBody{
+		ResourceType: req.Resource.Type,
+		ResourceID:   req.Resource.ID,
+		SubjectType:  req.Subject.Type,
+		SubjectID:    req.Subject.ID,
+		Action:       req.Action,
+		Context:      req.Context,
+	}
+}
+
+// Verify evaluates the policies of a resource for one access
+func (c *Client) Verify(ctx context.Context, req CheckRequest) (bool, error) {
+	var out struct {
+		Allowed bool `json:"allowed"`
+	}
+	_, err := c.do(ctx, readCall, http.MethodPost, "/verify", newVerifyBody(req), &out)
+	return out.Allowed, err
+}
+
+// VerifyBatch evaluates many accesses, MaxBatchChecks per request. A check without an
+// answer has its Err set; the error return is for calls that failed as a whole.
+func (c *Client) VerifyBatch(ctx context.Context, reqs []CheckRequest) ([]CheckResult, error) {
+	results := make([]CheckResult, 0, len(reqs))
+	for start := 0; start < len(reqs); start += MaxBatchChecks {
+		end := min(start+MaxBatchChecks, len(reqs))
+		body := struct {
+			Checks []verifyBody `json:"checks"`
+		}{}
+		for _, req := range reqs[start:end] {
+			body.Checks = append(body.Checks, newVerifyBody(req))
+		}
+		var out struct {
+			Results []struct {
+				Allowed bool   `json:"allowed"`
+				Error   string `json:"error"`
+			} `json:"results"`
+		}
+		if _, err := c.do(ctx, readCall, http.MethodPost, "/verify/batch", body, &out); err != nil {
+			return nil, err
+		}
+		if len(out.Results) != end-start {
+			return nil, fmt.Errorf("minzibar: %d results for %d checks", len(out.Results), end-start)
+		}
+		for _, r := range out.Results {
+			result := CheckResult{Allowed: r.Allowed}
+			if r.Error != "" {
+				result.Err = errors.New(r.Error)
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// Check evaluates "can <subject> <action> <resource>"; direct skips policies and only
+// looks for the relation tuple
+func (c *Client) Check(ctx context.Context, query string, attrs map[string]string, direct bool) (bool, error) {
+	var out struct {
+		Allowed bool `json:"allowed"`
+	}
+	body := struct {
+		Query   string            `json:"query"`
+		Context map[string]string `json:"context"`
+		Direct  bool              `json:"direct"`
+	}{query, attrs, direct}
+	_, err := c.do(ctx, readCall, http.MethodPost, "/check", body, &out)
+	return out.Allowed, err
+}
+
+// FindTuples lists the tuples matching a query like "find object.type = document and
+// relation = owner" in the text form; truncated is set when more matched than its limit
+func (c *Client) FindTuples(ctx context.Context, query string) (tuples []string, truncated bool, err error) {
+	var out struct {
+		Tuples    []string `json:"tuples"`
+		Truncated bool     `json:"truncated"`
+	}
+	body := struct {
+		Query string `json:"query"`
+	}{query}
+	_, err = c.do(ctx, readCall, http.MethodPost, "/tuples/find", body, &out)
+	return out.Tuples, out.Truncated, err
+}
+
+// CreateResource registers a resource so relations can be written to it
+func (c *Client) CreateResource(ctx context.Context, resource ObjectRef) (Token, error) {
+	body := struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}{resource.Type, resource.ID}
+	return c.do(ctx, writeCall, http.MethodPost, "/resource", body, nil)
+}
+
+// WriteRelations adds the relations of a query like "document:x user:alice,bob->read"
+func (c *Client) WriteRelations(ctx context.Context, query string) (Token, error) {
+	body := struct {
+		Query string `json:"query"`
+	}{query}
+	return c.do(ctx, writeCall, http.MethodPost, "/relation", body, nil)
+}
+
+// AddPolicy registers or replaces a policy written in the policy language
+func (c *Client) AddPolicy(ctx context.Context, id, text string) (Token, error) {
+	body := struct {
+		PolicyID   string `json:"policy_id"`
+		PolicyText string `json:"policy_text"`
+	}{id, text}
+	return c.do(ctx, writeCall, http.MethodPost, "/policy", body, nil)
+}
+
+// AttachPolicy applies a policy to a resource, or to every resource of its type when the id is "*"
+func (c *Client) AttachPolicy(ctx context.Context, resource ObjectRef, policyID string) (Token, error) {
+	body := struct {
+		ResourceType string `json:"resource_type"`
+		ResourceID   string `json:"resource_id"`
+		PolicyID     string `json:"policy_id"`
+	}{resource.Type, resource.ID, policyID}
+	return c.do(ctx, writeCall, http.MethodPost, "/policy/attach", body, nil)
+}
+
+// FlagEvaluation is the variant a feature flag serves to a subject; Reason is killed,
+// target, rollout or default
+type FlagEvaluation struct {
+	Flag    string `json:"flag"`
+	Subject string `json:"subject"`
+	Variant string `json:"variant"`
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason"`
+	Target  string `json:"target,omitempty"`
+}
+
+// EvaluateFlags returns the variant of each named flag for subject, of every flag when
+// none are named
+func (c *Client) EvaluateFlags(ctx context.Context, subject ObjectRef, flags ...string) ([]FlagEvaluation, error) {
+	body := struct {
+		Subject string   `json:"subject"`
+		Flags   []string `json:"flags,omitempty"`
+	}{subject.String(), flags}
+	var out struct {
+		Evaluations []FlagEvaluation `json:"evaluations"`
+	}
+	_, err := c.do(ctx, readCall, http.MethodPost, "/flags/evaluate", body, &out)
+	return out.Evaluations, err
+}
+
+// SubjectRef is a subject or, with a Relation, a userset like group:eng#member
+type SubjectRef struct {
+	Object   ObjectRef
+	Relation string
+}
+
+// ExpandNode is one level of a userset tree, see Expand
+type ExpandNode struct {
+	Subject  SubjectRef    `json:"subject"`
+	Children []*ExpandNode `json:"children,omitempty"`
+}
+
+// Expand returns the tree of subjects holding relation on object
+func (c *Client) Expand(ctx context.Context, object ObjectRef, relation string) (*ExpandNode, error) {
+	q := url.Values{"object": {object.String()}, "relation": {relation}}
+	var node ExpandNode
+	if _, err := c.do(ctx, readCall, http.MethodGet, "/expand?"+q.Encode(), nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// ListObjects returns every resource the server knows
+func (c *Client) ListObjects(ctx context.Context) ([]ObjectRef, error) {
+	var objects []ObjectRef
+	if _, err := c.do(ctx, readCall, http.MethodGet, "/objects", nil, &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Import loads tuples in the text format, one "object#relation@subject" per line
+func (c *Client) Import(ctx context.Context, tuples string) (Token, error) {
+	return c.send(ctx, writeCall, http.MethodPost, "/import?format=text", "text/plain", []byte(tuples), nil)
+}
+
+// Export dumps every tuple in the text format
+func (c *Client) Export(ctx context.Context) (string, error) {
+	var out bytes.Buffer
+	_, err := c.send(ctx, readCall, http.MethodGet, "/export?format=text", "", nil, &out)
+	return out.String(), err
+}
+
+// callKind says which failed calls may be sent again
+type callKind int
+
+const (
+	// readCall changes nothing on the server, any failure may be retried
+	readCall callKind = iota
+	// writeCall is only retried when the server cannot have applied it, unless its
+	// context comes from RetryWrites
+	writeCall
+)
+
+type retryWritesKey struct{}
+
+// RetryWrites returns a context whose writes are retried like reads. Use it for writes
+// that are safe to apply twice, such as writing the same tuples again.
+func RetryWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryWritesKey{}, true)
+}
+
+// do sends body as JSON and decodes a JSON response into out when out is non-nil
+func (c *Client) do(ctx context.Context, kind callKind, method, path string, body, out interface{}) (Token, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return "", err
+		}
+	}
+	var raw bytes.Buffer
+	token, err := c.send(ctx, kind, method, path, "application/json", payload, &raw)
+	if err != nil || out == nil {
+		return token, err
+	}
+	if err := json.Unmarshal(raw.Bytes(), out); err != nil {
+		return token, fmt.Errorf("minzibar: decoding %s response: %w", path, err)
+	}
+	return token, nil
+}
+
+// send makes the call, retrying transport errors and retryable statuses with backoff,
+// and copies a successful response body into out. A write is only retried when it never
+// reached the server or the server turned it away, so it is not applied twice.
+func (c *Client) send(ctx context.Context, kind callKind, method, path, contentType string, payload []byte, out io.Writer) (Token, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if retry, _ := ctx.Value(retryWritesKey{}).(bool); retry {
+		kind = readCall
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		var sent bool
+		token, err := c.attempt(ctx, httpClient, method, path, contentType, payload, out, &sent)
+		if err == nil || attempt >= c.MaxRetries || !retryable(err, kind == readCall || !sent) {
+			return token, err
+		}
+		wait := backoff
+		// a throttled call waits as long as the server asks
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > wait {
+			wait = e.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// attempt makes the call once; sent is set once a connection was made, from when the
+// server may have received the request
+func (c *Client) attempt(ctx context.Context, httpClient *http.Client, method, path, contentType string, payload []byte, out io.Writer, sent *bool) (Token, error) {
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { *sent = true }})
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return "", err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if token, ok := ctx.Value(tokenKey{}).(Token); ok {
+		req.Header.Set(consistencyHeader, string(token))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return "", &Error{Status: resp.StatusCode, Message: e.Error, RetryAfter: time.Duration(retryAfter) * time.Second}
+	}
+	if out != nil {
+		// read the whole body first, so a body cut short leaves nothing in out for the retry
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if _, err := out.Write(data); err != nil {
+			return "", err
+		}
+	}
+	return Token(resp.Header.Get(revisionHeader)), nil
+}
+
+func (c *Client) url(path string) string {
+	base := strings.TrimRight(c.BaseURL, "/")
+	if c.Tenant != "" {
+		base += "/tenants/" + url.PathEscape(c.Tenant)
+	}
+	return base + path
+}
+
+// retryable reports whether a failed call is worth repeating; cancellation never is.
+// repeatable is whether the call may be applied twice: without it, only calls the server
+// turned away and transport errors before a connection are retried.
+func retryable(err error, repeatable bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		if !repeatable {
+			return e.rejected()
+		}
+		return e.retryable()
+	}
+	// transport errors: connection refused or reset
+	return repeatable
+}
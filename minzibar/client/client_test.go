@@ -0,0 +1,300 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testClient(url string) *Client {
+	c := New(url)
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set(revisionHeader, "7")
+		w.Write([]byte(`{"allowed": true}`))
+	}))
+	defer srv.Close()
+
+	ok, err := testClient(srv.URL).Verify(context.Background(), CheckRequest{Action: "read"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), calls.Load())
+
+	calls.Store(0)
+	c := testClient(srv.URL)
+	c.MaxRetries = 1
+	_, err = c.Verify(context.Background(), CheckRequest{Action: "read"})
+	var e *Error
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, http.StatusServiceUnavailable, e.Status)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestClient_RetryTruncatedBody(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// promise more than is sent, the client sees the body cut short
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte(`{"allowed":`))
+			return
+		}
+		w.Write([]byte(`{"allowed": true}`))
+	}))
+	defer srv.Close()
+
+	ok, err := testClient(srv.URL).Verify(context.Background(), CheckRequest{Action: "read"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	var first time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		assert.GreaterOrEqual(t, time.Since(first), time.Second, "the retry waits as asked")
+		w.Write([]byte(`{"allowed": true}`))
+	}))
+	defer srv.Close()
+
+	ok, err := testClient(srv.URL).Verify(context.Background(), CheckRequest{Action: "read"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestClient_NoRetryOnClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "missing permission write_relations"}`))
+	}))
+	defer srv.Close()
+
+	_, err := testClient(srv.URL).WriteRelations(context.Background(), "document:x user:alice->read")
+	var e *Error
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, http.StatusForbidden, e.Status)
+	assert.Equal(t, "missing permission write_relations", e.Message)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestClient_WriteRetries(t *testing.T) {
+	var calls atomic.Int32
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	c := testClient(srv.URL)
+
+	_, err := c.WriteRelations(context.Background(), "document:x user:alice->read")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load(), "the server may have applied the write")
+
+	calls.Store(0)
+	_, err = c.WriteRelations(RetryWrites(context.Background()), "document:x user:alice->read")
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), calls.Load(), "retried when asked to")
+
+	calls.Store(0)
+	status = http.StatusTooManyRequests
+	_, err = c.WriteRelations(context.Background(), "document:x user:alice->read")
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), calls.Load(), "a throttled write was not applied")
+
+	// a connection dropped after the request was sent is not retried, a refused one is
+	calls.Store(0)
+	drop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer drop.Close()
+	_, err = testClient(drop.URL).WriteRelations(context.Background(), "document:x user:alice->read")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+	_, err = testClient(drop.URL).Verify(context.Background(), CheckRequest{Action: "read"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(5), calls.Load(), "reads are retried")
+
+	var dials atomic.Int32
+	refused := testClient("http://minzibar.invalid")
+	refused.HTTPClient = &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("connection refused")
+	}}}
+	_, err = refused.WriteRelations(context.Background(), "document:x user:alice->read")
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Equal(t, int32(4), dials.Load(), "nothing was sent, the write is retried")
+}
+
+func TestClient_ConsistencyAndTenant(t *testing.T) {
+	var seen http.Header
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, path = r.Header.Clone(), r.URL.Path
+		w.Header().Set(revisionHeader, "42")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := testClient(srv.URL)
+	c.Tenant = "acme"
+	c.Token = "secret"
+	token, err := c.WriteRelations(context.Background(), "document:x user:alice->read")
+	require.NoError(t, err)
+	assert.Equal(t, Token("42"), token)
+	assert.Equal(t, "/tenants/acme/relation", path)
+	assert.Equal(t, "Bearer secret", seen.Get("Authorization"))
+	assert.Empty(t, seen.Get(consistencyHeader))
+
+	_, err = c.Verify(AtLeast(context.Background(), token), CheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "42", seen.Get(consistencyHeader))
+}
+
+func TestClient_VerifyBatchSplits(t *testing.T) {
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Checks []verifyBody `json:"checks"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		sizes = append(sizes, len(body.Checks))
+		results := make([]map[string]interface{}, len(body.Checks))
+		for i, check := range body.Checks {
+			results[i] = map[string]interface{}{"allowed": check.SubjectID == "alice"}
+			if check.SubjectID == "deep" {
+				results[i]["error"] = "max check depth exceeded"
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	}))
+	defer srv.Close()
+
+	reqs := make([]CheckRequest, MaxBatchChecks+50)
+	for i := range reqs {
+		reqs[i] = CheckRequest{Subject: ObjectRef{Type: "user", ID: "bob"}, Action: "read"}
+	}
+	reqs[0].Subject.ID = "alice"
+	reqs[len(reqs)-1].Subject.ID = "deep"
+	results, err := testClient(srv.URL).VerifyBatch(context.Background(), reqs)
+	require.NoError(t, err)
+	assert.Equal(t, []int{MaxBatchChecks, 50}, sizes)
+	require.Len(t, results, len(reqs))
+	assert.True(t, results[0].Allowed)
+	assert.False(t, results[1].Allowed)
+	assert.NoError(t, results[1].Err)
+	assert.EqualError(t, results[len(results)-1].Err, "max check depth exceeded")
+}
+
+// fakeAuthorizer allows alice to read anything and fails for carol
+func fakeAuthorizer(got *CheckRequest) AuthorizerFunc {
+	return func(_ context.Context, req CheckRequest) (bool, error) {
+		*got = req
+		if req.Subject.ID == "carol" {
+			return false, &Error{Status: http.StatusGatewayTimeout}
+		}
+		return req.Subject.ID == "alice" && req.Action == "read", nil
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var got CheckRequest
+	guard := Guard{
+		Authorizer: fakeAuthorizer(&got),
+		Subject:    SubjectFromHeader("X-User", "user"),
+		Resource:   ResourceFromPath("document", "id"),
+		Context:    ContextFromHeaders(map[string]string{"department": "X-Department"}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/documents/{id}", Middleware(guard)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plan"))
+	})))
+
+	e := echo.New()
+	e.Any("/documents/:id", func(c echo.Context) error { return c.String(http.StatusOK, "plan") }, EchoMiddleware(guard))
+
+	for name, handler := range map[string]http.Handler{"net/http": mux, "echo": e} {
+		t.Run(name, func(t *testing.T) {
+			do := func(method, user string) int {
+				req := httptest.NewRequest(method, "/documents/plan", nil)
+				if user != "" {
+					req.Header.Set("X-User", user)
+				}
+				req.Header.Set("X-Department", "eng")
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return rec.Code
+			}
+			assert.Equal(t, http.StatusOK, do(http.MethodGet, "alice"))
+			assert.Equal(t, CheckRequest{
+				Resource: ObjectRef{Type: "document", ID: "plan"},
+				Subject:  ObjectRef{Type: "user", ID: "alice"},
+				Action:   "read",
+				Context:  map[string]string{"department": "eng"},
+			}, got)
+			assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "alice"))
+			assert.Equal(t, "write", got.Action)
+			assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "bob"))
+			assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, ""))
+			assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodGet, "carol"))
+		})
+	}
+
+	results, err := fakeAuthorizer(&got).VerifyBatch(context.Background(), []CheckRequest{
+		{Subject: ObjectRef{Type: "user", ID: "alice"}, Action: "read"},
+		{Subject: ObjectRef{Type: "user", ID: "bob"}, Action: "read"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []CheckResult{{Allowed: true}, {Allowed: false}}, results)
+}
+
+func TestClient_EvaluateFlags(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/flags/evaluate", r.URL.Path)
+		var body struct {
+			Subject string   `json:"subject"`
+			Flags   []string `json:"flags"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "user:alice", body.Subject)
+		assert.Equal(t, []string{"new-dashboard"}, body.Flags)
+		w.Write([]byte(`{"evaluations": [{"flag": "new-dashboard", "subject": "user:alice", "variant": "on", "enabled": true, "reason": "rollout"}]}`))
+	}))
+	defer srv.Close()
+
+	evals, err := testClient(srv.URL).EvaluateFlags(context.Background(), ObjectRef{Type: "user", ID: "alice"}, "new-dashboard")
+	require.NoError(t, err)
+	assert.Equal(t, []FlagEvaluation{{Flag: "new-dashboard", Subject: "user:alice", Variant: "on", Enabled: true, Reason: "rollout"}}, evals)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrNoSubject is returned by a subject extractor for a request without a caller;
+// the middleware answers it with 401 rather than 400
+var ErrNoSubject = errors.New("no subject")
+
+// Guard describes how to turn a request into an access check. Extractors get the request
+// after routing: with Go 1.22 patterns and in EchoMiddleware, path parameters are
+// available through r.PathValue.
+type Guard struct {
+	// Authorizer answers the checks, a *Client or an embedded engine
+	Authorizer Authorizer
+	// Subject returns the caller; return ErrNoSubject when there is none
+	Subject func(r *http.Request) (ObjectRef, error)
+	// Resource returns the object the request acts on
+	Resource func(r *http.Request) (ObjectRef, error)
+	// Action returns the action checked, ActionByMethod when nil
+	Action func(r *http.Request) (string, error)
+	// Context returns the attributes policies see, none when nil
+	Context func(r *http.Request) (map[string]string, error)
+}
+
+// check builds the request's access check and asks the authorizer, answering with the
+// status to reject the request with, or 0 when it may proceed
+func (g Guard) check(r *http.Request) (int, error) {
+	req, err := g.request(r)
+	if errors.Is(err, ErrNoSubject) {
+		return http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	allowed, err := g.Authorizer.Verify(r.Context(), req)
+	switch {
+	case err != nil:
+		return http.StatusServiceUnavailable, fmt.Errorf("access check failed: %w", err)
+	case !allowed:
+		return http.StatusForbidden, fmt.Errorf("%s may not %s %s", req.Subject, req.Action, req.Resource)
+	}
+	return 0, nil
+}
+
+func (g Guard) request(r *http.Request) (CheckRequest, error) {
+	var req CheckRequest
+	var err error
+	if req.Subject, err = g.Subject(r); err != nil {
+		return req, err
+	}
+	if req.Resource, err = g.Resource(r); err != nil {
+		return req, err
+	}
+	action := g.Action
+	if action == nil {
+		action = ActionByMethod
+	}
+	if req.Action, err = action(r); err != nil {
+		return req, err
+	}
+	if g.Context != nil {
+		if req.Context, err = g.Context(r); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// Middleware guards a net/http handler: a request without a subject gets 401, one that
+// cannot be turned into a check 400, a denied one 403 and one whose check failed 503
+func Middleware(g Guard) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status, err := g.check(r); status != 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// EchoMiddleware is Middleware for Echo routes; route parameters are copied into the
+// request's path values so the same extractors work for both
+func EchoMiddleware(g Guard) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			for i, name := range c.ParamNames() {
+				r.SetPathValue(name, c.ParamValues()[i])
+			}
+			if status, err := g.check(r); status != 0 {
+				return c.JSON(status, map[string]string{"error": err.Error()})
+			}
+			return next(c)
+		}
+	}
+}
+
+// SubjectFromHeader reads the caller's id from a header set by an authenticating proxy,
+// e.g. SubjectFromHeader("X-User", "user")
+func SubjectFromHeader(header, subjectType string) func(*http.Request) (ObjectRef, error) {
+	return func(r *http.Request) (ObjectRef, error) {
+		id := strings.TrimSpace(r.Header.Get(header))
+		if id == "" {
+			return ObjectRef{}, fmt.Errorf("%w: %s header missing", ErrNoSubject, header)
+		}
+		return ObjectRef{Type: subjectType, ID: id}, nil
+	}
+}
+
+// ResourceFromPath reads the resource id from a path parameter,
+// e.g. ResourceFromPath("document", "id") for /documents/{id}
+func ResourceFromPath(resourceType, param string) func(*http.Request) (ObjectRef, error) {
+	return func(r *http.Request) (ObjectRef, error) {
+		id := r.PathValue(param)
+		if id == "" {
+			return ObjectRef{}, fmt.Errorf("path parameter %s missing", param)
+		}
+		return ObjectRef{Type: resourceType, ID: id}, nil
+	}
+}
+
+// ActionByMethod maps safe methods to "read" and everything else to "write"
+func ActionByMethod(r *http.Request) (string, error) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "read", nil
+	}
+	return "write", nil
+}
+
+// Action checks the same action for every request
+func Action(action string) func(*http.Request) (string, error) {
+	return func(*http.Request) (string, error) {
+		return action, nil
+	}
+}
+
+// ContextFromHeaders passes request headers to policies, keyed by attribute name,
+// e.g. ContextFromHeaders(map[string]string{"department": "X-Department"})
+func ContextFromHeaders(headers map[string]string) func(*http.Request) (map[string]string, error) {
+	return func(r *http.Request) (map[string]string, error) {
+		attrs := make(map[string]string, len(headers))
+		for attr, header := range headers {
+			if v := r.Header.Get(header); v != "" {
+				attrs[attr] = v
+			}
+		}
+		return attrs, nil
+	}
+}
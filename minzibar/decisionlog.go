@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultDecisionLogSize is how many recent decisions an engine keeps by default
+const defaultDecisionLogSize = 10000
+
+// Decision is one recorded Verify call
+type Decision struct {
+	Time     time.Time         `json:"time"`
+	Resource ObjectRef         `json:"resource"`
+	Subject  ObjectRef         `json:"subject"`
+	Action   string            `json:"action"`
+	Context  map[string]string `json:"context,omitempty"`
+	Allowed  bool              `json:"allowed"`
+}
+
+// DecisionLog is a bounded in-memory audit log of recent decisions; once full
+// the oldest entries are overwritten
+type DecisionLog struct {
+	mu      sync.Mutex
+	entries []Decision
+	next    int
+	full    bool
+}
+
+// NewDecisionLog returns a log holding at most size decisions
+func NewDecisionLog(size int) *DecisionLog {
+	if size <= 0 {
+		size = defaultDecisionLogSize
+	}
+	return &DecisionLog{entries: make([]Decision, size)}
+}
+
+// Record appends a decision, stamping it with the current time if unset
+func (l *DecisionLog) Record(d Decision) {
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = d
+	l.next++
+	if l.next == len(l.entries) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Snapshot returns the recorded decisions, oldest first
+func (l *DecisionLog) Snapshot() []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Decision(nil), l.entries[:l.next]...)
+	}
+	out := make([]Decision, 0, len(l.entries))
+	out = append(out, l.entries[l.next:]...)
+	return append(out, l.entries[:l.next]...)
+}
+
+// ReadDecisions decodes recorded decisions, one JSON object per line as a Decision encodes
+func ReadDecisions(r io.Reader) ([]Decision, error) {
+	decisions := []Decision{}
+	dec := json.NewDecoder(r)
+	for {
+		var d Decision
+		if err := dec.Decode(&d); err == io.EOF {
+			return decisions, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("decision %d: %v", len(decisions)+1, err)
+		}
+		decisions = append(decisions, d)
+	}
+}
+
+// copyContext returns a shallow copy of a verify context, nil stays nil
+func copyContext(ctx map[string]string) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	out := make(map[string]string, len(ctx))
+	for k, v := range ctx {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"minzibar/client"
+)
+
+// EmbeddedClient answers client.Authorizer checks from a local engine, without a server.
+// Handlers guarded by client.Middleware can be tested against it with tuples and policies
+// set up in process. Like the engine it is in package main, so other modules cannot import
+// it; they test with client.AuthorizerFunc or a server started from the binary.
+type EmbeddedClient struct {
+	Engine *Engine
+}
+
+var _ client.Authorizer = EmbeddedClient{}
+
+// Verify is Engine.VerifyContext
+func (e EmbeddedClient) Verify(ctx context.Context, req client.CheckRequest) (bool, error) {
+	return e.Engine.VerifyContext(ctx, objectRef(req.Resource), objectRef(req.Subject), req.Action, copyContext(req.Context))
+}
+
+// VerifyBatch verifies each check in turn
+func (e EmbeddedClient) VerifyBatch(ctx context.Context, reqs []client.CheckRequest) ([]client.CheckResult, error) {
+	results := make([]client.CheckResult, len(reqs))
+	for i, req := range reqs {
+		results[i].Allowed, results[i].Err = e.Verify(ctx, req)
+	}
+	return results, nil
+}
+
+func objectRef(o client.ObjectRef) ObjectRef {
+	return ObjectRef{Type: o.Type, ObjectID: o.ID}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"minzibar/client"
+)
+
+func TestClient_AgainstService(t *testing.T) {
+	service := NewService(NewEngine(NewRelationGraph(), map[string]*Policy{}))
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+	c := client.New(srv.URL)
+	c.Backoff = time.Millisecond
+	ctx := context.Background()
+
+	doc := client.ObjectRef{Type: "document", ID: "plan"}
+	_, err := c.CreateResource(ctx, doc)
+	require.NoError(t, err)
+	_, err = c.AddPolicy(ctx, "p_read", `allow read if department == "eng"`)
+	require.NoError(t, err)
+	_, err = c.AttachPolicy(ctx, doc, "p_read")
+	require.NoError(t, err)
+	token, err := c.WriteRelations(ctx, "document:plan user:alice->read")
+	require.NoError(t, err)
+	assert.Equal(t, revisionToken(service.Engine.graph.Revision()), token)
+
+	eng := map[string]string{"department": "eng"}
+	alice := client.CheckRequest{Resource: doc, Subject: client.ObjectRef{Type: "user", ID: "alice"}, Action: "read", Context: eng}
+	ok, err := c.Verify(client.AtLeast(ctx, token), alice)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	bob := alice
+	bob.Subject.ID = "bob"
+	results, err := c.VerifyBatch(ctx, []client.CheckRequest{alice, bob})
+	require.NoError(t, err)
+	assert.Equal(t, []client.CheckResult{{Allowed: true}, {Allowed: false}}, results)
+
+	ok, err = c.Check(ctx, "can user:alice read document:plan", nil, true)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// a token from the future is retried, then reported
+	_, err = c.Verify(client.AtLeast(ctx, token+"0"), alice)
+	var e *client.Error
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, http.StatusPreconditionFailed, e.Status)
+
+	tree, err := c.Expand(ctx, doc, "read")
+	require.NoError(t, err)
+	require.Len(t, tree.Children, 1)
+	assert.Equal(t, client.ObjectRef{Type: "user", ID: "alice"}, tree.Children[0].Subject.Object)
+
+	objects, err := c.ListObjects(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, objects, doc)
+
+	_, err = c.Import(ctx, "document:plan#read@user:bob\n")
+	require.NoError(t, err)
+	dump, err := c.Export(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, dump, "document:plan#read@user:bob")
+}
+
+// revisionToken turns a revision into the token the server hands out
+func revisionToken(revision uint64) client.Token {
+	return client.Token(strconv.FormatUint(revision, 10))
+}
+
+func TestEmbeddedClient_GuardsHandlers(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	doc := engine.CreateResource("document", "plan")
+	require.NoError(t, engine.AddPolicy("p_read", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(doc, "p_read"))
+	require.NoError(t, engine.AddRelation(doc, "read", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}))
+
+	mux := http.NewServeMux()
+	guard := client.Guard{
+		Authorizer: EmbeddedClient{Engine: engine},
+		Subject:    client.SubjectFromHeader("X-User", "user"),
+		Resource:   client.ResourceFromPath("document", "id"),
+		Context:    client.ContextFromHeaders(map[string]string{"department": "X-Department"}),
+	}
+	mux.Handle("GET /documents/{id}", client.Middleware(guard)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("the plan"))
+	})))
+
+	do := func(user, department string) int {
+		req := httptest.NewRequest(http.MethodGet, "/documents/plan", nil)
+		req.Header.Set("X-User", user)
+		req.Header.Set("X-Department", department)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, do("alice", "eng"))
+	assert.Equal(t, http.StatusForbidden, do("alice", "sales"))
+	assert.Equal(t, http.StatusForbidden, do("bob", "eng"))
+
+	// the engine records the decisions like any other
+	assert.Equal(t, 3, len(engine.decisions.Snapshot()))
+}
@@ -1,22 +1,55 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // engine is the main policy engine struct and implements the asserter interface.
 type Engine struct {
 	graph      *RelationGraph
-	policyRepo map[string]*Policy // policyID -> Policy
+	policyRepo map[string]*Policy           // policyID -> Policy
+	decisions  *DecisionLog                 // recent Verify decisions, used for impact analysis
+	templates  map[string]*ResourceTemplate // template name -> template, see CreateFromTemplate
+	flags      map[string]*FeatureFlag      // flag name -> flag, see EvaluateFlag
+	roles      map[string]*Role             // role name -> role, see DefineRole
+	checkOpts  CheckOptions                 // depth and concurrency of graph walks in Verify
+	tenant     string                       // owning tenant, empty for a single tenant engine
+	quota      *tenantQuota                 // limits on what the tenant may store, shared by views
+	telemetry  *Telemetry                   // metrics and spans of checks, nil when off
+	actor      string                       // who writes through this engine, see WithActor
+	attributes []AttributeProvider          // fill subject.* and resource.* context keys
+	changes    *ChangeLog                   // recent changes for followers, nil when off
+	mu         *sync.RWMutex                // guards policyRepo, templates, flags and roles, shared by views
+	store      *storeLink                   // the TupleStore writes go through, nil when off
+}
+
+// withactor returns a view of the engine that records actor as the writer of new tuples;
+// it shares everything else with e
+func (e *Engine) WithActor(actor string) *Engine {
+	view := *e
+	view.actor = actor
+	return &view
+}
 
-	// TODO: add stubs map for frequent resource creation [user/group/orgs/featur_flag]
-	// That way someone can just  select the stab and create on.
-	// so select feature flag and produce a feature_name and then the resource will be "feature_flag_feature_name"
+// setcheckoptions changes the depth and concurrency limits used by Verify
+func (e *Engine) SetCheckOptions(opts CheckOptions) {
+	e.checkOpts = opts
 }
 
 // addpolicy attaches a policy to a resource via the relation graph
 func (e *Engine) AddPolicyToResource(resource ObjectRef, policyID string) error {
+	if resource.ObjectID == TypeWildcard {
+		return e.AddPolicyToType(resource.Type, policyID)
+	}
+	resource, err := e.localRef(resource)
+	if err != nil {
+		return err
+	}
 	// validate resource existence: must have at least one relation tuple
 	exists := false
 	for _, t := range e.graph.ReadTuples(resource, "") {
@@ -30,31 +63,71 @@ func (e *Engine) AddPolicyToResource(resource ObjectRef, policyID string) error
 	}
 	tuple := RelationTuple{
 		Object:   resource,
-		Relation: "has_policy",
+		Relation: relationHasPolicy,
 		Subject:  SubjectRef{Object: ObjectRef{Type: "policy", ObjectID: policyID}},
 	}
-	e.graph.Write(tuple)
-	return nil
+	return e.writeTuple(tuple)
+}
+
+// policy returns a registered policy
+func (e *Engine) policy(id string) (*Policy, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	p, ok := e.policyRepo[id]
+	return p, ok
+}
+
+// policies returns a copy of the registered policies by id
+func (e *Engine) policies() map[string]*Policy {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	out := make(map[string]*Policy, len(e.policyRepo))
+	for id, p := range e.policyRepo {
+		out[id] = p
+	}
+	return out
+}
+
+// policyCount returns the number of registered policies
+func (e *Engine) policyCount() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.policyRepo)
+}
+
+// setPolicy registers or replaces a policy; a follower does so while checks read them
+func (e *Engine) setPolicy(id string, p *Policy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.policyRepo[id] = p
 }
 
 // addpolicy registers a new policy in the policyRepo
 func (e *Engine) AddPolicy(policyID string, policyText string) error {
 	policy := NewPolicy(policyText)
-	e.policyRepo[policyID] = policy
-	return nil
+	return e.putPolicy(policyID, policy)
 }
 
-// createresource returns an objectref for a new resource and adds a marker relation to the graph
+// createresource returns an objectref for a new resource and adds a marker relation to the graph.
+// a write rejected by the tenant is dropped, use AddResource to see the error
 func (e *Engine) CreateResource(resourceType, resourceID string) ObjectRef {
-	obj := ObjectRef{Type: resourceType, ObjectID: resourceID}
+	obj, _ := e.AddResource(resourceType, resourceID)
+	return obj
+}
+
+// addresource is CreateResource reporting cross-tenant references and quota errors
+func (e *Engine) AddResource(resourceType, resourceID string) (ObjectRef, error) {
+	obj, err := e.localRef(ObjectRef{Type: resourceType, ObjectID: resourceID})
+	if err != nil {
+		return obj, err
+	}
 	// add a marker relation so resource exists in graph
 	tuple := RelationTuple{
 		Object:   obj,
 		Relation: "resource",
-		Subject:  SubjectRef{Object: ObjectRef{Type: "system", ObjectID: "resource_marker"}},
+		Subject:  resourceMarker,
 	}
-	e.graph.Write(tuple)
-	return obj
+	return obj, e.writeTuple(tuple)
 }
 
 // createsubject returns a subjectref for a new subject/userset
@@ -70,8 +143,7 @@ func (e *Engine) AddRelation(object ObjectRef, relation string, subject SubjectR
 		Relation: relation,
 		Subject:  subject,
 	}
-	e.graph.Write(tuple)
-	return nil
+	return e.writeTuple(tuple)
 }
 
 // removerelation removes a relationship tuple from the graph
@@ -81,7 +153,7 @@ func (e *Engine) RemoveRelation(object ObjectRef, relation string, subject Subje
 		Relation: relation,
 		Subject:  subject,
 	}
-	if !e.graph.Delete(tuple) {
+	if !e.deleteTuple(tuple) {
 		return fmt.Errorf("relation does not exist")
 	}
 	return nil
@@ -98,9 +170,10 @@ func (e *Engine) GetRelation(object ObjectRef, subject SubjectRef) []string {
 	return relations
 }
 
-// checkrelation checks if a specific relation exists between object and subject
+// checkrelation checks if a specific relation exists between object and subject, or a
+// role granting it does on the object or its type
 func (e *Engine) CheckRelation(object ObjectRef, relation string, subject SubjectRef) bool {
-	return e.graph.HasDirectRelation(object, relation, subject)
+	return e.hasDirectPermission(object, relation, subject)
 }
 
 // getresources returns all resources a subject has a given relation to
@@ -120,6 +193,9 @@ func (e *Engine) AddRelationQuery(query string) error {
 	if err != nil {
 		return fmt.Errorf("invalid resource: %v", err)
 	}
+	if resource, err = e.localRef(resource); err != nil {
+		return err
+	}
 	// validate resource existence: must have at least one tuple
 	exists := false
 	for _, t := range e.graph.ReadTuples(resource, "") {
@@ -137,11 +213,14 @@ func (e *Engine) AddRelationQuery(query string) error {
 			return fmt.Errorf("invalid subject/action pair: %v", err)
 		}
 		for _, action := range parsed.Actions {
-			e.graph.Write(RelationTuple{
+			err := e.writeTuple(RelationTuple{
 				Object:   resource,
 				Relation: action,
 				Subject:  parsed.Subject,
 			})
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -166,32 +245,87 @@ func (e *Engine) ListAllResources() []ObjectRef {
 func (e *Engine) DeletePolicy(resource ObjectRef, policyID string) error {
 	tuple := RelationTuple{
 		Object:   resource,
-		Relation: "has_policy",
+		Relation: relationHasPolicy,
 		Subject:  SubjectRef{Object: ObjectRef{Type: "policy", ObjectID: policyID}},
 	}
-	e.graph.Delete(tuple)
+	e.deleteTuple(tuple)
 	return nil
 }
 
-// getpolicies returns all policies attached to a resource
+// getpolicies returns the effective policies for a resource: attached directly,
+// to its type, or inherited from its parents, nearest first
 func (e *Engine) GetPolicies(resource ObjectRef) ([]*Policy, error) {
-	tuples := e.graph.ReadTuples(resource, "has_policy")
 	var policies []*Policy
-	for _, t := range tuples {
-		pid := t.Subject.Object.ObjectID
-		if p, ok := e.policyRepo[pid]; ok {
-			policies = append(policies, p)
-		}
+	for _, ep := range e.effectivePolicies(resource, nil) {
+		policies = append(policies, ep.Policy)
 	}
 	return policies, nil
 }
 
 // verify checks if a subject has access to a resource for a given action, using provided context
 func (e *Engine) Verify(resource ObjectRef, subject ObjectRef, action string, ctx map[string]string) (bool, error) {
-	policies, err := e.GetPolicies(resource)
+	return e.VerifyContext(context.Background(), resource, subject, action, ctx)
+}
+
+// verifycontext is verify bounded by reqCtx: the graph walk stops with reqCtx.Err() once it is done,
+// or with an error wrapping ErrMaxDepthExceeded when usersets nest deeper than the configured depth
+func (e *Engine) VerifyContext(reqCtx context.Context, resource ObjectRef, subject ObjectRef, action string, ctx map[string]string) (bool, error) {
+	resource, err := e.localRef(resource)
 	if err != nil {
 		return false, err
 	}
+	if subject, err = e.localRef(subject); err != nil {
+		return false, err
+	}
+	// keep the caller's context before verify adds subject, action and resource to it
+	recorded := copyContext(ctx)
+	var allowed bool
+	if t := e.telemetry; t != nil {
+		start := time.Now()
+		spanCtx, span := t.startVerify(reqCtx, e.tenant, resource, subject, action)
+		allowed, err = e.verify(resource, subject, action, ctx, verifyOptions{reqCtx: spanCtx})
+		t.endVerify(span, e.tenant, start, allowed, err)
+	} else {
+		allowed, err = e.verify(resource, subject, action, ctx, verifyOptions{reqCtx: reqCtx})
+	}
+	if err == nil && e.decisions != nil {
+		e.decisions.Record(Decision{Resource: resource, Subject: subject, Action: action, Context: recorded, Allowed: allowed})
+	}
+	return allowed, err
+}
+
+// verifytrace is verify that also returns the steps which led to the decision
+func (e *Engine) VerifyTrace(resource ObjectRef, subject ObjectRef, action string, ctx map[string]string) (bool, []string, error) {
+	var trace []string
+	allowed, err := e.verify(resource, subject, action, ctx, verifyOptions{trace: &trace})
+	return allowed, trace, err
+}
+
+// verifyoptions tweaks a single verify call
+type verifyOptions struct {
+	trace     *[]string          // when set, every evaluation step is appended
+	overrides map[string]*Policy // policies to use in place of the registered ones
+	reqCtx    context.Context    // bounds graph walks, context.Background when nil
+}
+
+func (e *Engine) verify(resource ObjectRef, subject ObjectRef, action string, ctx map[string]string, opts verifyOptions) (bool, error) {
+	tracef := func(format string, args ...interface{}) {
+		if opts.trace != nil {
+			*opts.trace = append(*opts.trace, fmt.Sprintf(format, args...))
+		}
+	}
+	if opts.reqCtx == nil {
+		opts.reqCtx = context.Background()
+	}
+	policies := e.effectivePolicies(resource, opts.overrides)
+	if len(policies) == 0 {
+		tracef("no policies attached to %s", resource)
+	}
+	for _, ep := range policies {
+		if ep.Via != PolicyViaDirect {
+			tracef("policy %s applies via %s %s", ep.ID, ep.Via, ep.Source)
+		}
+	}
 	// always ensure subject, action, resource are present in context
 	if ctx == nil {
 		ctx = map[string]string{}
@@ -199,23 +333,63 @@ func (e *Engine) Verify(resource ObjectRef, subject ObjectRef, action string, ct
 	ctx["subject"] = subject.ObjectID
 	ctx["action"] = action
 	ctx["resource"] = resource.String()
+	if err := e.enrichContext(opts.reqCtx, policies, resource, subject, ctx, tracef); err != nil {
+		return false, err
+	}
 
 	// check each policy for allow
-	for _, p := range policies {
-		for _, rule := range p.Rules {
-			if (rule.Action == "*" || rule.Action == action) && rule.Expr.Eval(ctx) {
-				if rule.Action == "*" {
-					return true, nil
-				}
-				// for specific action, require graph relation
-				hasRel := e.graph.HasDirectRelation(resource, action, SubjectRef{Object: subject})
-				if hasRel {
-					return true, nil
-				}
-			}
+	for _, ap := range policies {
+		allowed, err := e.evaluatePolicy(opts.reqCtx, ap, resource, subject, action, ctx, tracef)
+		if allowed || err != nil {
+			return allowed, err
 		}
 	}
 
+	tracef("no rule allowed %s to %s %s, denied", subject, action, resource)
+	return false, nil
+}
+
+// evaluatepolicy runs the rules of one policy, true once a rule allows the action
+func (e *Engine) evaluatePolicy(reqCtx context.Context, ap EffectivePolicy, resource, subject ObjectRef, action string, ctx map[string]string, tracef func(string, ...interface{})) (bool, error) {
+	if t := e.telemetry; t != nil {
+		start := time.Now()
+		spanCtx, span := t.startPolicy(reqCtx, ap)
+		allowed, err := e.evaluateRules(spanCtx, ap, resource, subject, action, ctx, tracef)
+		t.endPolicy(span, start, allowed, err)
+		return allowed, err
+	}
+	return e.evaluateRules(reqCtx, ap, resource, subject, action, ctx, tracef)
+}
+
+func (e *Engine) evaluateRules(reqCtx context.Context, ap EffectivePolicy, resource, subject ObjectRef, action string, ctx map[string]string, tracef func(string, ...interface{})) (bool, error) {
+	for i, rule := range ap.Policy.Rules {
+		if rule.Action != "*" && rule.Action != action {
+			continue
+		}
+		if !rule.Expr.Eval(ctx) {
+			tracef("policy %s rule %d (%s %s): condition false", ap.ID, i+1, rule.Effect, rule.Action)
+			continue
+		}
+		if rule.Action == "*" {
+			tracef("policy %s rule %d (%s *): condition true, allowed", ap.ID, i+1, rule.Effect)
+			return true, nil
+		}
+		// for specific action, require graph relation, directly, through usersets or a role
+		hasRel, via, err := e.hasPermission(reqCtx, resource, action, subject)
+		if err != nil {
+			tracef("policy %s rule %d (%s %s): relation check failed: %v", ap.ID, i+1, rule.Effect, rule.Action, err)
+			return false, err
+		}
+		if hasRel && via != "" {
+			tracef("policy %s rule %d (%s %s): condition true and %s holds %s, allowed", ap.ID, i+1, rule.Effect, rule.Action, subject, via)
+			return true, nil
+		}
+		if hasRel {
+			tracef("policy %s rule %d (%s %s): condition true and %s#%s@%s exists, allowed", ap.ID, i+1, rule.Effect, rule.Action, resource, action, subject)
+			return true, nil
+		}
+		tracef("policy %s rule %d (%s %s): condition true but %s#%s@%s is missing", ap.ID, i+1, rule.Effect, rule.Action, resource, action, subject)
+	}
 	return false, nil
 }
 
@@ -224,22 +398,9 @@ const KeyWordCan = "can"
 // checkrelationquery parses a string query and checks if a direct relation exists (no policy evaluation)
 // expected format: "can <subject> <relation> <resource>"
 func (e *Engine) CheckRelationQuery(query string) (bool, error) {
-	query = strings.TrimSpace(query)
-	parts := strings.Fields(query)
-	if len(parts) < 4 || strings.ToLower(parts[0]) != KeyWordCan {
-		return false, fmt.Errorf("invalid query format")
-	}
-	subjectStr := parts[1]
-	relation := parts[2]
-	resourceStr := parts[3]
-
-	subject, err := parseObjectRef(subjectStr)
-	if err != nil {
-		return false, fmt.Errorf("invalid subject: %v", err)
-	}
-	resource, err := parseObjectRef(resourceStr)
+	resource, subject, relation, err := parseCanQuery(query)
 	if err != nil {
-		return false, fmt.Errorf("invalid resource: %v", err)
+		return false, err
 	}
 	// direct relation check (no policy)
 	return e.CheckRelation(resource, relation, SubjectRef{Object: subject}), nil
@@ -248,30 +409,90 @@ func (e *Engine) CheckRelationQuery(query string) (bool, error) {
 // verifyquery parses a string query and checks access using provided context
 // expected format: "can <subject> <action> <resource>"
 func (e *Engine) VerifyQuery(query string, ctx map[string]string) (bool, error) {
+	resource, subject, action, err := parseCanQuery(query)
+	if err != nil {
+		return false, err
+	}
+	return e.Verify(resource, subject, action, ctx)
+}
+
+// verifyquerycontext is VerifyQuery bounded by reqCtx, see VerifyContext
+func (e *Engine) VerifyQueryContext(reqCtx context.Context, query string, ctx map[string]string) (bool, error) {
+	resource, subject, action, err := parseCanQuery(query)
+	if err != nil {
+		return false, err
+	}
+	return e.VerifyContext(reqCtx, resource, subject, action, ctx)
+}
+
+// parsecanquery splits "can <subject> <action> <resource>" into its parts
+func parseCanQuery(query string) (resource ObjectRef, subject ObjectRef, action string, err error) {
 	query = strings.TrimSpace(query)
 	parts := strings.Fields(query)
 	if len(parts) < 4 || strings.ToLower(parts[0]) != KeyWordCan {
-		return false, fmt.Errorf("invalid query format")
+		return resource, subject, "", fmt.Errorf("invalid query format")
 	}
 	subjectStr := parts[1]
-	action := parts[2]
+	action = parts[2]
 	resourceStr := parts[3]
 
-	subject, err := parseObjectRef(subjectStr)
+	subject, err = parseObjectRef(subjectStr)
 	if err != nil {
-		return false, fmt.Errorf("invalid subject: %v", err)
+		return resource, subject, "", fmt.Errorf("invalid subject: %v", err)
 	}
-	resource, err := parseObjectRef(resourceStr)
+	resource, err = parseObjectRef(resourceStr)
 	if err != nil {
-		return false, fmt.Errorf("invalid resource: %v", err)
+		return resource, subject, "", fmt.Errorf("invalid resource: %v", err)
 	}
-	return e.Verify(resource, subject, action, ctx)
+	return resource, subject, action, nil
 }
 
 // newengine creates a new engine instance
 func NewEngine(graph *RelationGraph, policyRepo map[string]*Policy) *Engine {
-	return &Engine{
+	e := &Engine{
 		graph:      graph,
 		policyRepo: policyRepo,
+		decisions:  NewDecisionLog(defaultDecisionLogSize),
+		templates:  make(map[string]*ResourceTemplate),
+		flags:      make(map[string]*FeatureFlag),
+		roles:      make(map[string]*Role),
+		mu:         new(sync.RWMutex),
+		quota:      new(tenantQuota),
+	}
+	for _, t := range defaultTemplates {
+		tmpl := t
+		e.templates[t.Name] = &tmpl
+	}
+	return e
+}
+
+// ExpandNode is one level of an expanded userset tree
+type ExpandNode struct {
+	Subject  SubjectRef    `json:"subject"`
+	Children []*ExpandNode `json:"children,omitempty"`
+}
+
+// expand returns the tree of subjects holding relation on object, following usersets
+func (e *Engine) Expand(object ObjectRef, relation string) *ExpandNode {
+	visited := make(map[SubjectRef]struct{})
+	return e.expand(SubjectRef{Object: object, Relation: relation}, visited)
+}
+
+func (e *Engine) expand(userset SubjectRef, visited map[SubjectRef]struct{}) *ExpandNode {
+	node := &ExpandNode{Subject: userset}
+	if _, ok := visited[userset]; ok {
+		// cycle, leave this userset unexpanded
+		return node
+	}
+	visited[userset] = struct{}{}
+	subjects := e.graph.GetSubjects(userset.Object, userset.Relation)
+	sort.Slice(subjects, func(i, j int) bool { return subjects[i].String() < subjects[j].String() })
+	for _, s := range subjects {
+		if s.Relation != "" {
+			node.Children = append(node.Children, e.expand(s, visited))
+			continue
+		}
+		node.Children = append(node.Children, &ExpandNode{Subject: s})
 	}
+	return node
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+)
+
+// FlagObjectType is the type of the object every flag is backed by, so tuples such as
+// feature_flag:new-dashboard#enabled@group:beta#member can target it
+const FlagObjectType = "feature_flag"
+
+// ErrUnknownFlag is returned when evaluating or changing a flag that was never registered
+var ErrUnknownFlag = errors.New("unknown flag")
+
+// FeatureFlag serves one of its variants to each subject: the off variant while killed,
+// else the variant of the first target the subject matches, else the variant of its
+// rollout bucket, else the off variant
+type FeatureFlag struct {
+	Name string `json:"name"`
+	// Variants are the values the flag can take, "off" and "on" when empty
+	Variants []string `json:"variants,omitempty"`
+	// OffVariant is served while killed and to subjects nothing else matches,
+	// "off" or the first variant when empty
+	OffVariant string `json:"off_variant,omitempty"`
+	// Killed is the kill switch, it turns the flag off for everyone
+	Killed bool `json:"killed,omitempty"`
+	// Targets are checked in order, the first one the subject matches wins
+	Targets []FlagTarget `json:"targets,omitempty"`
+	// Rollout splits the subjects no target matched by percentage
+	Rollout []FlagAllocation `json:"rollout,omitempty"`
+}
+
+// FlagTarget serves Variant to subjects holding Relation on Object, directly or through
+// usersets. An empty Object is the flag's own feature_flag:<name> object.
+type FlagTarget struct {
+	Object   string `json:"object,omitempty"`
+	Relation string `json:"relation"`
+	Variant  string `json:"variant"`
+}
+
+// FlagAllocation serves Variant to Percent of the subjects, e.g. 12.5
+type FlagAllocation struct {
+	Variant string  `json:"variant"`
+	Percent float64 `json:"percent"`
+}
+
+// flagBuckets is the resolution of a rollout, a bucket is a hundredth of a percent
+const flagBuckets = 10000
+
+// FlagReason says why an evaluation served its variant
+type FlagReason string
+
+const (
+	FlagReasonKilled  FlagReason = "killed"
+	FlagReasonTarget  FlagReason = "target"
+	FlagReasonRollout FlagReason = "rollout"
+	FlagReasonDefault FlagReason = "default"
+)
+
+// FlagEvaluation is the variant a flag serves to a subject and why
+type FlagEvaluation struct {
+	Flag    string `json:"flag"`
+	Subject string `json:"subject"`
+	Variant string `json:"variant"`
+	// Enabled is set for any variant but the off variant
+	Enabled bool       `json:"enabled"`
+	Reason  FlagReason `json:"reason"`
+	// Target is the matched target for reason target, e.g. group:beta#member
+	Target string `json:"target,omitempty"`
+	// Bucket is the subject's rollout bucket in [0, 10000) when the flag has a rollout
+	Bucket *int `json:"bucket,omitempty"`
+}
+
+// Object is the object the flag is backed by
+func (f *FeatureFlag) Object() ObjectRef {
+	return ObjectRef{Type: FlagObjectType, ObjectID: f.Name}
+}
+
+// normalize fills in the default variants and checks that every variant named is declared
+func (f *FeatureFlag) normalize() error {
+	if f.Name == "" || strings.ContainsAny(f.Name, ":#@ ") || f.Name == TypeWildcard {
+		return fmt.Errorf("invalid flag name %q", f.Name)
+	}
+	if len(f.Variants) == 0 {
+		f.Variants = []string{"off", "on"}
+	}
+	seen := make(map[string]struct{}, len(f.Variants))
+	for _, v := range f.Variants {
+		if v == "" {
+			return fmt.Errorf("flag %s: empty variant", f.Name)
+		}
+		if _, ok := seen[v]; ok {
+			return fmt.Errorf("flag %s: duplicate variant %q", f.Name, v)
+		}
+		seen[v] = struct{}{}
+	}
+	if f.OffVariant == "" {
+		f.OffVariant = f.Variants[0]
+		if containsString(f.Variants, "off") {
+			f.OffVariant = "off"
+		}
+	}
+	declared := func(v string) error {
+		if _, ok := seen[v]; !ok {
+			return fmt.Errorf("flag %s: undeclared variant %q", f.Name, v)
+		}
+		return nil
+	}
+	if err := declared(f.OffVariant); err != nil {
+		return err
+	}
+	for i, t := range f.Targets {
+		if t.Relation == "" {
+			return fmt.Errorf("flag %s: target %d has no relation", f.Name, i)
+		}
+		if t.Object != "" {
+			if _, err := parseObjectRef(t.Object); err != nil {
+				return fmt.Errorf("flag %s: target %d: %v", f.Name, i, err)
+			}
+		}
+		if err := declared(t.Variant); err != nil {
+			return err
+		}
+	}
+	total := 0
+	for _, a := range f.Rollout {
+		if a.Percent < 0 || a.Percent > 100 {
+			return fmt.Errorf("flag %s: percent %v out of range", f.Name, a.Percent)
+		}
+		if err := declared(a.Variant); err != nil {
+			return err
+		}
+		total += allocationBuckets(a.Percent)
+	}
+	if total > flagBuckets {
+		return fmt.Errorf("flag %s: rollout adds up to more than 100%%", f.Name)
+	}
+	return nil
+}
+
+func allocationBuckets(percent float64) int {
+	return int(math.Round(percent * flagBuckets / 100))
+}
+
+// flagBucket places a subject in [0, flagBuckets); the same subject always lands in the
+// same bucket of a flag, and buckets of different flags are independent
+func flagBucket(flag string, subject ObjectRef) int {
+	h := fnv.New32a()
+	h.Write([]byte(flag))
+	h.Write([]byte{0})
+	h.Write([]byte(subject.String()))
+	return int(h.Sum32() % flagBuckets)
+}
+
+// RegisterFlag adds or replaces a flag and creates its feature_flag object. Replacing a
+// killed flag keeps it killed, only SetFlagKilled turns it back on.
+func (e *Engine) RegisterFlag(f FeatureFlag) error {
+	flag := f
+	flag.Variants = append([]string(nil), f.Variants...)
+	flag.Targets = append([]FlagTarget(nil), f.Targets...)
+	flag.Rollout = append([]FlagAllocation(nil), f.Rollout...)
+	if err := flag.normalize(); err != nil {
+		return err
+	}
+	if old, ok := e.flag(flag.Name); ok && old.Killed {
+		flag.Killed = true
+	}
+	if !e.isResource(flag.Object()) {
+		if _, err := e.AddResource(FlagObjectType, flag.Name); err != nil {
+			return err
+		}
+	}
+	return e.putFlag(&flag)
+}
+
+// putFlag stores a normalized flag and logs it
+func (e *Engine) putFlag(flag *FeatureFlag) error {
+	return e.logChange(func() (*Change, error) {
+		e.setFlag(flag)
+		e.graph.revision.Add(1)
+		logged := *flag
+		return &Change{Op: ChangeFlag, Flag: &logged}, nil
+	})
+}
+
+// flag returns a registered flag
+func (e *Engine) flag(name string) (*FeatureFlag, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	f, ok := e.flags[name]
+	return f, ok
+}
+
+// setFlag stores a normalized flag; a follower does so while evaluations read them
+func (e *Engine) setFlag(f *FeatureFlag) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.flags[f.Name] = f
+}
+
+// Flags returns the registered flags sorted by name
+func (e *Engine) Flags() []FeatureFlag {
+	e.mu.RLock()
+	out := make([]FeatureFlag, 0, len(e.flags))
+	for _, f := range e.flags {
+		out = append(out, *f)
+	}
+	e.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// SetFlagKilled flips a flag's kill switch
+func (e *Engine) SetFlagKilled(name string, killed bool) error {
+	f, ok := e.flag(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownFlag, name)
+	}
+	flag := *f
+	flag.Killed = killed
+	return e.putFlag(&flag)
+}
+
+// EvaluateFlag returns the variant flag serves to subject. Targets are relation checks
+// bounded by ctx and the engine's CheckOptions; a check that fails fails the evaluation
+// rather than falling through to the rollout.
+func (e *Engine) EvaluateFlag(ctx context.Context, name string, subject ObjectRef) (FlagEvaluation, error) {
+	f, ok := e.flag(name)
+	if !ok {
+		return FlagEvaluation{}, fmt.Errorf("%w: %s", ErrUnknownFlag, name)
+	}
+	subject, err := e.localRef(subject)
+	if err != nil {
+		return FlagEvaluation{}, err
+	}
+	eval := FlagEvaluation{Flag: f.Name, Subject: subject.String(), Variant: f.OffVariant, Reason: FlagReasonDefault}
+	if f.Killed {
+		eval.Reason = FlagReasonKilled
+		return eval, nil
+	}
+	for _, t := range f.Targets {
+		object := f.Object()
+		if t.Object != "" {
+			if object, err = parseObjectRef(t.Object); err != nil {
+				return eval, err
+			}
+			if object, err = e.localRef(object); err != nil {
+				return eval, err
+			}
+		}
+		ok, err := e.graph.CheckDeep(ctx, object, t.Relation, SubjectRef{Object: subject}, e.checkOpts)
+		if err != nil {
+			return eval, fmt.Errorf("flag %s: target %s#%s: %w", f.Name, object, t.Relation, err)
+		}
+		if ok {
+			eval.Variant, eval.Reason = t.Variant, FlagReasonTarget
+			eval.Target = object.String() + "#" + t.Relation
+			eval.Enabled = eval.Variant != f.OffVariant
+			return eval, nil
+		}
+	}
+	if len(f.Rollout) > 0 {
+		bucket := flagBucket(f.Name, subject)
+		eval.Bucket = &bucket
+		upper := 0
+		for _, a := range f.Rollout {
+			upper += allocationBuckets(a.Percent)
+			if bucket < upper {
+				eval.Variant, eval.Reason = a.Variant, FlagReasonRollout
+				break
+			}
+		}
+	}
+	eval.Enabled = eval.Variant != f.OffVariant
+	return eval, nil
+}
+
+// EvaluateFlags evaluates the named flags, every registered flag when names is empty
+func (e *Engine) EvaluateFlags(ctx context.Context, names []string, subject ObjectRef) ([]FlagEvaluation, error) {
+	if len(names) == 0 {
+		for _, f := range e.Flags() {
+			names = append(names, f.Name)
+		}
+	}
+	evals := make([]FlagEvaluation, 0, len(names))
+	for _, name := range names {
+		eval, err := e.EvaluateFlag(ctx, name, subject)
+		if err != nil {
+			return nil, err
+		}
+		evals = append(evals, eval)
+	}
+	return evals, nil
+}
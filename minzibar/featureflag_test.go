@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dashboardFlag is on for subjects holding enabled on the flag, for the beta group and for
+// a quarter of everyone else
+var dashboardFlag = FeatureFlag{
+	Name: "new-dashboard",
+	Targets: []FlagTarget{
+		{Relation: "enabled", Variant: "on"},
+		{Object: "group:beta", Relation: "member", Variant: "on"},
+	},
+	Rollout: []FlagAllocation{{Variant: "on", Percent: 25}},
+}
+
+func flagEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	require.NoError(t, engine.RegisterFlag(dashboardFlag))
+	for _, line := range []string{
+		"feature_flag:new-dashboard#enabled@user:user1",
+		"group:beta#member@team:qa#member",
+		"team:qa#member@user:bob",
+	} {
+		tuple, err := ParseTuple(line)
+		require.NoError(t, err)
+		require.NoError(t, engine.writeTuple(tuple))
+	}
+	return engine
+}
+
+func TestFeatureFlag_Register(t *testing.T) {
+	engine := flagEngine(t)
+	flags := engine.Flags()
+	require.Len(t, flags, 1)
+	assert.Equal(t, []string{"off", "on"}, flags[0].Variants)
+	assert.Equal(t, "off", flags[0].OffVariant)
+	assert.True(t, engine.isResource(ObjectRef{Type: FlagObjectType, ObjectID: "new-dashboard"}))
+
+	for _, bad := range []FeatureFlag{
+		{},
+		{Name: "a:b"},
+		{Name: "x", Variants: []string{"a", "a"}},
+		{Name: "x", OffVariant: "dark"},
+		{Name: "x", Targets: []FlagTarget{{Variant: "on"}}},
+		{Name: "x", Targets: []FlagTarget{{Relation: "member", Object: "nope", Variant: "on"}}},
+		{Name: "x", Targets: []FlagTarget{{Relation: "member", Variant: "blue"}}},
+		{Name: "x", Rollout: []FlagAllocation{{Variant: "on", Percent: 60}, {Variant: "off", Percent: 50}}},
+		{Name: "x", Rollout: []FlagAllocation{{Variant: "on", Percent: -1}}},
+	} {
+		assert.Error(t, engine.RegisterFlag(bad), "%+v", bad)
+	}
+	assert.Len(t, engine.Flags(), 1, "rejected flags are not registered")
+}
+
+func TestFeatureFlag_Evaluate(t *testing.T) {
+	engine := flagEngine(t)
+	ctx := context.Background()
+	eval := func(subject string) FlagEvaluation {
+		obj, err := parseObjectRef(subject)
+		require.NoError(t, err)
+		ev, err := engine.EvaluateFlag(ctx, "new-dashboard", obj)
+		require.NoError(t, err)
+		return ev
+	}
+
+	ev := eval("user:user1")
+	assert.Equal(t, FlagEvaluation{Flag: "new-dashboard", Subject: "user:user1", Variant: "on", Enabled: true, Reason: FlagReasonTarget, Target: "feature_flag:new-dashboard#enabled"}, ev)
+	ev = eval("user:bob")
+	assert.Equal(t, FlagReasonTarget, ev.Reason)
+	assert.Equal(t, "group:beta#member", ev.Target)
+
+	// everyone else is bucketed, the same way every time
+	on := 0
+	for i := 0; i < 4000; i++ {
+		subject := fmt.Sprintf("user:u%d", i)
+		ev := eval(subject)
+		require.NotNil(t, ev.Bucket)
+		assert.Equal(t, ev, eval(subject))
+		if ev.Enabled {
+			assert.Equal(t, FlagReasonRollout, ev.Reason)
+			assert.Less(t, *ev.Bucket, 2500)
+			on++
+		} else {
+			assert.Equal(t, FlagReasonDefault, ev.Reason)
+		}
+	}
+	assert.InDelta(t, 1000, on, 100, "about a quarter of subjects are in the rollout")
+
+	_, err := engine.EvaluateFlag(ctx, "missing", ObjectRef{Type: "user", ObjectID: "bob"})
+	assert.ErrorIs(t, err, ErrUnknownFlag)
+}
+
+func TestFeatureFlag_Variants(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	require.NoError(t, engine.RegisterFlag(FeatureFlag{
+		Name:     "checkout",
+		Variants: []string{"control", "one-page", "wizard"},
+		Rollout:  []FlagAllocation{{Variant: "one-page", Percent: 50}, {Variant: "wizard", Percent: 50}},
+	}))
+	assert.Equal(t, "control", engine.Flags()[0].OffVariant)
+	seen := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ev, err := engine.EvaluateFlag(context.Background(), "checkout", ObjectRef{Type: "user", ObjectID: fmt.Sprint(i)})
+		require.NoError(t, err)
+		assert.True(t, ev.Enabled)
+		seen[ev.Variant]++
+	}
+	assert.Len(t, seen, 2)
+	assert.InDelta(t, 500, seen["wizard"], 75)
+
+	// buckets depend on the flag, so rollouts of different flags are independent
+	alice := ObjectRef{Type: "user", ObjectID: "alice"}
+	assert.NotEqual(t, flagBucket("checkout", alice), flagBucket("new-dashboard", alice))
+}
+
+func TestFeatureFlag_KillSwitch(t *testing.T) {
+	engine := flagEngine(t)
+	user1 := ObjectRef{Type: "user", ObjectID: "user1"}
+	require.NoError(t, engine.SetFlagKilled("new-dashboard", true))
+	ev, err := engine.EvaluateFlag(context.Background(), "new-dashboard", user1)
+	require.NoError(t, err)
+	assert.Equal(t, "off", ev.Variant)
+	assert.Equal(t, FlagReasonKilled, ev.Reason)
+	assert.False(t, ev.Enabled)
+
+	// redeploying the definition does not undo the kill switch
+	require.NoError(t, engine.RegisterFlag(dashboardFlag))
+	assert.True(t, engine.Flags()[0].Killed)
+
+	require.NoError(t, engine.SetFlagKilled("new-dashboard", false))
+	ev, err = engine.EvaluateFlag(context.Background(), "new-dashboard", user1)
+	require.NoError(t, err)
+	assert.True(t, ev.Enabled)
+
+	assert.ErrorIs(t, engine.SetFlagKilled("missing", true), ErrUnknownFlag)
+}
+
+func TestFeatureFlag_Snapshot(t *testing.T) {
+	engine := flagEngine(t)
+	require.NoError(t, engine.SetFlagKilled("new-dashboard", true))
+	var buf bytes.Buffer
+	require.NoError(t, engine.Export(&buf, SnapshotNDJSON))
+
+	restored := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	stats, err := restored.Import(&buf, SnapshotNDJSON)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Flags)
+	assert.Equal(t, engine.Flags(), restored.Flags())
+}
+
+func TestService_Flags(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	e := NewService(engine).Echo()
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, post("/flags", dashboardFlag).Code)
+	assert.Equal(t, http.StatusBadRequest, post("/flags", FeatureFlag{Name: "x", OffVariant: "dark"}).Code)
+	require.Equal(t, http.StatusOK, post("/relation", AddRelationQueryRequest{Query: "feature_flag:new-dashboard user:user1->enabled"}).Code)
+
+	rec := post("/flags/evaluate", EvaluateFlagsRequest{Subject: "user:user1"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp EvaluateFlagsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Evaluations, 1)
+	assert.Equal(t, "on", resp.Evaluations[0].Variant)
+	assert.Equal(t, FlagReasonTarget, resp.Evaluations[0].Reason)
+
+	require.Equal(t, http.StatusOK, post("/flags/new-dashboard/kill", KillFlagRequest{Killed: true}).Code)
+	rec = post("/flags/evaluate", EvaluateFlagsRequest{Subject: "user:user1", Flags: []string{"new-dashboard"}})
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, FlagReasonKilled, resp.Evaluations[0].Reason)
+
+	assert.Equal(t, http.StatusNotFound, post("/flags/missing/kill", KillFlagRequest{Killed: true}).Code)
+	assert.Equal(t, http.StatusNotFound, post("/flags/evaluate", EvaluateFlagsRequest{Subject: "user:user1", Flags: []string{"missing"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, post("/flags/evaluate", EvaluateFlagsRequest{Subject: "nobody"}).Code)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/flags", nil))
+	var flags []FeatureFlag
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &flags))
+	require.Len(t, flags, 1)
+	assert.True(t, flags[0].Killed)
+}
+
+func TestCLI_Flag(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "graph.ndjson")
+	def, err := json.Marshal(dashboardFlag)
+	require.NoError(t, err)
+	defFile := filepath.Join(dir, "flag.json")
+	require.NoError(t, os.WriteFile(defFile, def, 0o644))
+
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"flag", "set", "-data", data, defFile}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "feature_flag:new-dashboard#enabled@user:user1"}, nil, &out))
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"flag", "eval", "-data", data, "user:user1"}, nil, &out))
+	assert.Equal(t, "new-dashboard\ton\ttarget\tfeature_flag:new-dashboard#enabled\n", out.String())
+
+	require.NoError(t, runCLI([]string{"flag", "kill", "-data", data, "new-dashboard"}, nil, &out))
+	out.Reset()
+	require.NoError(t, runCLI([]string{"flag", "list", "-data", data}, nil, &out))
+	assert.Equal(t, "new-dashboard\tkilled\toff,on\n", out.String())
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"flag", "eval", "-data", data, "-flags", "new-dashboard", "-json", "user:user1"}, nil, &out))
+	var evals []FlagEvaluation
+	require.NoError(t, json.Unmarshal(out.Bytes(), &evals))
+	assert.Equal(t, FlagReasonKilled, evals[0].Reason)
+
+	assert.Error(t, runCLI([]string{"flag", "revive", "-data", data, "missing"}, nil, &out))
+	assert.Error(t, runCLI([]string{"flag", "set", "-data", filepath.Join(dir, "graph.txt"), defFile}, nil, &out))
+	err = runCLI([]string{"flag", "eval", "-data", data}, nil, &out)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "usage:"))
+}
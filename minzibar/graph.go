@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ObjectRef represents a resource in the system
@@ -45,100 +48,340 @@ func (r RelationTuple) String() string {
 	return fmt.Sprintf("(%s, %s, %s)", r.Object, r.Relation, r.Subject)
 }
 
-// tupleKey is used for fast lookup of relation tuples
-type tupleKey struct {
-	object   string
-	relation string
-	subject  string
-}
-
-func makeTupleKey(tuple RelationTuple) tupleKey {
-	return tupleKey{
-		object:   tuple.Object.String(),
-		relation: tuple.Relation,
-		subject:  tuple.Subject.String(),
-	}
-}
+// graphShardCount is the number of lock stripes; a power of two so the hash can be masked
+const graphShardCount = 32
 
-// RelationGraph stores and queries relationship tuples
-type RelationGraph struct {
+// graphShard holds the indexes for the objects and subjects that hash to it.
+// A tuple lives in the shard of its object; its subjectIndex or usersetIndex entry lives
+// in the shard of its subject, which may be a different one.
+type graphShard struct {
 	mu sync.RWMutex
 
-	// tuples stores all relation tuples by their unique key
-	tuples map[tupleKey]RelationTuple
-
 	// objectIndex maps (object, relation) -> set of subjects
 	// allows fast lookup of "who has relation R to object O?"
-	objectIndex map[ObjectRef]map[string]map[SubjectRef]struct{}
+	objectIndex map[nodeID]*adjacency[subjectKey]
 
 	// subjectIndex maps (subject, relation) -> set of objects
 	// allows fast lookup of "what objects does subject S have relation R to?"
 	// only indexes concrete subjects (not usersets)
-	subjectIndex map[ObjectRef]map[string]map[ObjectRef]struct{}
+	subjectIndex map[nodeID]*adjacency[nodeID]
+
+	// usersetIndex maps (userset object, userset relation) -> set of (object, relation)
+	// granted to the userset, the tuples subjectIndex leaves out
+	usersetIndex map[nodeID]*adjacency[objectRelation]
+
+	// meta holds when and by whom each tuple in objectIndex was first written
+	meta map[tupleKey]tupleMeta
+
+	// history holds the changes running deep checks may need to revert, see snapshot.go
+	history shardHistory
+}
+
+// tupleKey is an interned tuple
+type tupleKey struct {
+	object  nodeID
+	rel     uint32
+	subject subjectKey
+}
+
+// tupleMeta is TupleMeta with the writer interned
+type tupleMeta struct {
+	createdAt int64 // unix nanoseconds
+	createdBy uint32
+}
+
+// TupleMeta is when and by whom a tuple was first written; writing it again keeps it
+type TupleMeta struct {
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// RelationGraph stores and queries relationship tuples.
+// Types, object ids and relations are interned to integers and indexed in compact
+// adjacency lists, so each tuple costs a few dozen bytes however long its strings are.
+// Indexes are striped over graphShardCount shards, each with its own lock, so
+// writes to unrelated objects do not contend and single lookups only lock one shard.
+// Deep checks see the graph as of the revision they started at, but only lock a shard
+// for each lookup, so writers never wait for a whole walk.
+type RelationGraph struct {
+	strings *internTable
+	shards  [graphShardCount]graphShard
+	// membership is the optional nested group index, see EnableMembershipIndex
+	membership atomic.Pointer[membershipIndexes]
+	// count is the number of tuples
+	count atomic.Int64
+	// revision counts changes, it only grows; see Revision
+	revision atomic.Uint64
+	// snapshots are the revisions running deep checks read at
+	snapshots snapshotSet
+	// replaced is the revision UnmarshalJSON last swapped in new tuples at; the shard
+	// histories do not reach back past it
+	replaced atomic.Uint64
+	// telemetry, when set, traces and measures deep checks, see Engine.SetTelemetry
+	telemetry atomic.Pointer[Telemetry]
+}
+
+// shardIndex spreads interned nodes over the shards
+func shardIndex(n nodeID) int {
+	h := uint64(n.typ)<<32 | uint64(n.id)
+	h *= 0x9E3779B97F4A7C15
+	return int((h >> 32) & (graphShardCount - 1))
+}
+
+func (g *RelationGraph) shardFor(n nodeID) *graphShard {
+	return &g.shards[shardIndex(n)]
+}
+
+// internNode returns the ids for an object, assigning them if needed
+func (g *RelationGraph) internNode(o ObjectRef) nodeID {
+	return nodeID{typ: g.strings.intern(o.Type), id: g.strings.intern(o.ObjectID)}
+}
+
+// lookupNode returns the ids for an object; false means it was never written
+func (g *RelationGraph) lookupNode(o ObjectRef) (nodeID, bool) {
+	typ, ok := g.strings.lookup(o.Type)
+	if !ok {
+		return nodeID{}, false
+	}
+	id, ok := g.strings.lookup(o.ObjectID)
+	if !ok {
+		return nodeID{}, false
+	}
+	return nodeID{typ: typ, id: id}, true
+}
+
+// lookupSubject returns the ids for a subject; false means it was never written
+func (g *RelationGraph) lookupSubject(s SubjectRef) (subjectKey, bool) {
+	n, ok := g.lookupNode(s.Object)
+	if !ok {
+		return subjectKey{}, false
+	}
+	rel, ok := g.strings.lookup(s.Relation)
+	if !ok {
+		return subjectKey{}, false
+	}
+	return subjectKey{node: n, rel: rel}, true
+}
+
+func (g *RelationGraph) objectRef(n nodeID) ObjectRef {
+	return ObjectRef{Type: g.strings.str(n.typ), ObjectID: g.strings.str(n.id)}
+}
+
+func (g *RelationGraph) subjectRef(k subjectKey) SubjectRef {
+	return SubjectRef{Object: g.objectRef(k.node), Relation: g.strings.str(k.rel)}
+}
+
+// lockPair write-locks the shards of an object and a subject in index order, so two
+// writers and CheckMembershipIndex (which read-locks all shards in order) cannot deadlock
+func (g *RelationGraph) lockPair(object, subject nodeID) func() {
+	i, j := shardIndex(object), shardIndex(subject)
+	if i == j {
+		g.shards[i].mu.Lock()
+		return g.shards[i].mu.Unlock
+	}
+	if i > j {
+		i, j = j, i
+	}
+	g.shards[i].mu.Lock()
+	g.shards[j].mu.Lock()
+	return func() {
+		g.shards[j].mu.Unlock()
+		g.shards[i].mu.Unlock()
+	}
+}
+
+// rlockAll read-locks every shard in index order
+func (g *RelationGraph) rlockAll() {
+	for i := range g.shards {
+		g.shards[i].mu.RLock()
+	}
+}
+
+func (g *RelationGraph) runlockAll() {
+	for i := len(g.shards) - 1; i >= 0; i-- {
+		g.shards[i].mu.RUnlock()
+	}
 }
 
 // ListAllObjects returns all ObjectRef instances referenced in the graph
 func (g *RelationGraph) ListAllObjects() []ObjectRef {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-	objects := make([]ObjectRef, 0, len(g.objectIndex))
-	for obj := range g.objectIndex {
-		objects = append(objects, obj)
+	objects := []ObjectRef{}
+	for i := range g.shards {
+		sh := &g.shards[i]
+		sh.mu.RLock()
+		for n := range sh.objectIndex {
+			objects = append(objects, g.objectRef(n))
+		}
+		sh.mu.RUnlock()
 	}
 	return objects
 }
 
+// Len returns the number of tuples in the graph
+func (g *RelationGraph) Len() int {
+	return int(g.count.Load())
+}
+
+// Revision increases with every tuple added or removed. A read that sees revision n
+// sees every change up to n.
+func (g *RelationGraph) Revision() uint64 {
+	return g.revision.Load()
+}
+
+// advanceRevision moves the revision forward to rev, a replica's way of following the
+// revisions of the graph it copies
+func (g *RelationGraph) advanceRevision(rev uint64) {
+	for {
+		cur := g.revision.Load()
+		if cur >= rev || g.revision.CompareAndSwap(cur, rev) {
+			return
+		}
+	}
+}
+
+// CountByType returns the number of tuples per object type
+func (g *RelationGraph) CountByType() map[string]int {
+	counts := make(map[uint32]int)
+	for i := range g.shards {
+		sh := &g.shards[i]
+		sh.mu.RLock()
+		for n, adj := range sh.objectIndex {
+			for j := range adj.relations {
+				counts[n.typ] += adj.relations[j].members.len()
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	byType := make(map[string]int, len(counts))
+	for typ, count := range counts {
+		byType[g.strings.str(typ)] = count
+	}
+	return byType
+}
+
 // NewRelationGraph returns an empty RelationGraph
 func NewRelationGraph() *RelationGraph {
-	return &RelationGraph{
-		tuples:       make(map[tupleKey]RelationTuple),
-		objectIndex:  make(map[ObjectRef]map[string]map[SubjectRef]struct{}),
-		subjectIndex: make(map[ObjectRef]map[string]map[ObjectRef]struct{}),
+	g := &RelationGraph{strings: newInternTable()}
+	for i := range g.shards {
+		g.shards[i].objectIndex = make(map[nodeID]*adjacency[subjectKey])
+		g.shards[i].subjectIndex = make(map[nodeID]*adjacency[nodeID])
+		g.shards[i].usersetIndex = make(map[nodeID]*adjacency[objectRelation])
+		g.shards[i].meta = make(map[tupleKey]tupleMeta)
 	}
+	return g
 }
 
-// Write adds or updates a relation tuple in the graph
+// Write adds or updates a relation tuple in the graph, a new one is stamped with the time
 func (g *RelationGraph) Write(tuple RelationTuple) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+	g.WriteWithMeta(tuple, TupleMeta{})
+}
+
+// WriteWithMeta is Write recording meta for a new tuple, a zero CreatedAt is now; it
+// reports whether the tuple is new
+func (g *RelationGraph) WriteWithMeta(tuple RelationTuple, meta TupleMeta) bool {
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now()
+	}
+	by := g.strings.intern(meta.CreatedBy)
+	object := g.internNode(tuple.Object)
+	rel := g.strings.intern(tuple.Relation)
+	subject := subjectKey{node: g.internNode(tuple.Subject.Object), rel: g.strings.intern(tuple.Subject.Relation)}
 
-	key := makeTupleKey(tuple)
-	g.tuples[key] = tuple
+	unlock := g.lockPair(object, subject.node)
+	defer unlock()
 
 	// update objectIndex
-	if g.objectIndex[tuple.Object] == nil {
-		g.objectIndex[tuple.Object] = make(map[string]map[SubjectRef]struct{})
+	objShard := g.shardFor(object)
+	adj := objShard.objectIndex[object]
+	if adj == nil {
+		adj = &adjacency[subjectKey]{}
+		objShard.objectIndex[object] = adj
 	}
-	if g.objectIndex[tuple.Object][tuple.Relation] == nil {
-		g.objectIndex[tuple.Object][tuple.Relation] = make(map[SubjectRef]struct{})
+	added := adj.getOrCreate(rel).add(subject)
+	var rev uint64
+	if added {
+		objShard.meta[tupleKey{object: object, rel: rel, subject: subject}] = tupleMeta{createdAt: meta.CreatedAt.UnixNano(), createdBy: by}
+		g.count.Add(1)
+		rev = g.indexWrite(object, rel, subject)
 	}
-	g.objectIndex[tuple.Object][tuple.Relation][tuple.Subject] = struct{}{}
 
 	// update subjectIndex (only for concrete subjects)
-	if tuple.Subject.Relation == "" {
-		subjectObj := tuple.Subject.Object
-		if g.subjectIndex[subjectObj] == nil {
-			g.subjectIndex[subjectObj] = make(map[string]map[ObjectRef]struct{})
+	if subject.rel == 0 {
+		subShard := g.shardFor(subject.node)
+		subAdj := subShard.subjectIndex[subject.node]
+		if subAdj == nil {
+			subAdj = &adjacency[nodeID]{}
+			subShard.subjectIndex[subject.node] = subAdj
 		}
-		if g.subjectIndex[subjectObj][tuple.Relation] == nil {
-			g.subjectIndex[subjectObj][tuple.Relation] = make(map[ObjectRef]struct{})
+		subAdj.getOrCreate(rel).add(object)
+	} else {
+		subShard := g.shardFor(subject.node)
+		usAdj := subShard.usersetIndex[subject.node]
+		if usAdj == nil {
+			usAdj = &adjacency[objectRelation]{}
+			subShard.usersetIndex[subject.node] = usAdj
 		}
-		g.subjectIndex[subjectObj][tuple.Relation][tuple.Object] = struct{}{}
+		usAdj.getOrCreate(subject.rel).add(objectRelation{object: object, rel: rel})
+	}
+	if added {
+		g.remember(object, rel, subject, true, rev)
 	}
+	return added
 }
 
 // MarshalJSON  implements [JSON MarshalJSON]
 func (g *RelationGraph) MarshalJSON() ([]byte, error) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-	tuples := make([]RelationTuple, 0, len(g.tuples))
-	for _, t := range g.tuples {
+	tuples := make([]RelationTuple, 0)
+	_ = g.ForEachTuple(func(t RelationTuple) error {
 		tuples = append(tuples, t)
-	}
+		return nil
+	})
 	type alias []RelationTuple
 	return json.Marshal(alias(tuples))
 }
 
+// ForEachTuple calls fn for every tuple in the graph and stops at the first error.
+// Shards are walked one at a time under their read lock, so each shard is seen
+// consistently and writes elsewhere are not blocked; fn must not write to the graph.
+func (g *RelationGraph) ForEachTuple(fn func(RelationTuple) error) error {
+	return g.ForEachTupleMeta(func(t RelationTuple, _ TupleMeta) error {
+		return fn(t)
+	})
+}
+
+// ForEachTupleMeta is ForEachTuple passing each tuple's metadata along; like it, fn must
+// not write to the graph
+func (g *RelationGraph) ForEachTupleMeta(fn func(RelationTuple, TupleMeta) error) error {
+	for i := range g.shards {
+		if err := g.forEachTupleInShard(&g.shards[i], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *RelationGraph) forEachTupleInShard(sh *graphShard, fn func(RelationTuple, TupleMeta) error) error {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	var err error
+	for n, adj := range sh.objectIndex {
+		object := g.objectRef(n)
+		for i := range adj.relations {
+			rel := adj.relations[i].rel
+			relation := g.strings.str(rel)
+			adj.relations[i].members.each(func(k subjectKey) bool {
+				meta := g.tupleMeta(sh.meta[tupleKey{object: n, rel: rel, subject: k}])
+				err = fn(RelationTuple{Object: object, Relation: relation, Subject: g.subjectRef(k)}, meta)
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // UnmarshalJSON loads the graph from a JSON array of relation tuples
 func (g *RelationGraph) UnmarshalJSON(data []byte) error {
 	type alias []RelationTuple
@@ -146,184 +389,308 @@ func (g *RelationGraph) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &tuples); err != nil {
 		return err
 	}
+	if g.strings == nil {
+		// zero value graph, nothing can be reading it yet
+		g.strings = newInternTable()
+	}
+	// build the new indexes against the same intern table, it is safe for concurrent use
 	newGraph := NewRelationGraph()
+	newGraph.strings = g.strings
 	for _, t := range tuples {
 		newGraph.Write(t)
 	}
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	g.tuples = newGraph.tuples
-	g.objectIndex = newGraph.objectIndex
-	g.subjectIndex = newGraph.subjectIndex
+	for i := range g.shards {
+		g.shards[i].mu.Lock()
+	}
+	for i := range g.shards {
+		g.shards[i].objectIndex = newGraph.shards[i].objectIndex
+		g.shards[i].subjectIndex = newGraph.shards[i].subjectIndex
+		g.shards[i].usersetIndex = newGraph.shards[i].usersetIndex
+		g.shards[i].meta = newGraph.shards[i].meta
+		g.shards[i].history.clear()
+	}
+	g.count.Store(newGraph.count.Load())
+	g.replaced.Store(g.revision.Add(1))
+	if old := g.membership.Load(); old != nil {
+		idx := &membershipIndexes{byRel: make(map[uint32]*membershipIndex, len(old.byRel))}
+		for rel := range old.byRel {
+			idx.byRel[rel] = newMembershipIndex(rel)
+		}
+		g.indexShards(idx)
+		g.membership.Store(idx)
+	}
+	for i := len(g.shards) - 1; i >= 0; i-- {
+		g.shards[i].mu.Unlock()
+	}
 	return nil
 }
 
 // Delete removes a relation tuple from the graph
 func (g *RelationGraph) Delete(tuple RelationTuple) bool {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-
-	key := makeTupleKey(tuple)
-	if _, exists := g.tuples[key]; !exists {
+	object, ok := g.lookupNode(tuple.Object)
+	if !ok {
+		return false
+	}
+	rel, ok := g.strings.lookup(tuple.Relation)
+	if !ok {
+		return false
+	}
+	subject, ok := g.lookupSubject(tuple.Subject)
+	if !ok {
 		return false
 	}
 
-	delete(g.tuples, key)
+	unlock := g.lockPair(object, subject.node)
+	defer unlock()
 
-	// update objectIndex
-	if relations := g.objectIndex[tuple.Object]; relations != nil {
-		if subjects := relations[tuple.Relation]; subjects != nil {
-			delete(subjects, tuple.Subject)
-		}
+	// update objectIndex, dropping entries that become empty
+	objShard := g.shardFor(object)
+	adj := objShard.objectIndex[object]
+	if adj == nil || !adj.removeMember(rel, subject) {
+		return false
+	}
+	if len(adj.relations) == 0 {
+		delete(objShard.objectIndex, object)
 	}
+	delete(objShard.meta, tupleKey{object: object, rel: rel, subject: subject})
+	g.count.Add(-1)
+	rev := g.indexDelete(object, rel, subject)
 
 	// update subjectIndex (only for concrete subjects)
-	if tuple.Subject.Relation == "" {
-		subjectObj := tuple.Subject.Object
-		if relations := g.subjectIndex[subjectObj]; relations != nil {
-			if objects := relations[tuple.Relation]; objects != nil {
-				delete(objects, tuple.Object)
+	if subject.rel == 0 {
+		subShard := g.shardFor(subject.node)
+		if subAdj := subShard.subjectIndex[subject.node]; subAdj != nil {
+			subAdj.removeMember(rel, object)
+			if len(subAdj.relations) == 0 {
+				delete(subShard.subjectIndex, subject.node)
+			}
+		}
+	} else {
+		subShard := g.shardFor(subject.node)
+		if usAdj := subShard.usersetIndex[subject.node]; usAdj != nil {
+			usAdj.removeMember(subject.rel, objectRelation{object: object, rel: rel})
+			if len(usAdj.relations) == 0 {
+				delete(subShard.usersetIndex, subject.node)
 			}
 		}
 	}
+	g.remember(object, rel, subject, false, rev)
 
 	return true
 }
 
 // ReadTuples returns all tuples for an object and relation (or all relations if relation is empty)
 func (g *RelationGraph) ReadTuples(object ObjectRef, relation string) []RelationTuple {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
+	n, ok := g.lookupNode(object)
+	if !ok {
+		return nil
+	}
+	sh := g.shardFor(n)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	var result []RelationTuple
+	adj := sh.objectIndex[n]
+	if adj == nil {
+		return nil
+	}
 
-	if relation == "" {
-		// return all relations for this object
-		if relations := g.objectIndex[object]; relations != nil {
-			for rel, subjects := range relations {
-				for subj := range subjects {
-					result = append(result, RelationTuple{
-						Object:   object,
-						Relation: rel,
-						Subject:  subj,
-					})
-				}
-			}
-		}
-	} else {
-		// return specific relation
-		if relations := g.objectIndex[object]; relations != nil {
-			if subjects := relations[relation]; subjects != nil {
-				for subj := range subjects {
-					result = append(result, RelationTuple{
-						Object:   object,
-						Relation: relation,
-						Subject:  subj,
-					})
-				}
-			}
+	var result []RelationTuple
+	for i := range adj.relations {
+		rel := g.strings.str(adj.relations[i].rel)
+		// empty relation returns all relations for this object
+		if relation != "" && rel != relation {
+			continue
 		}
+		adj.relations[i].members.each(func(k subjectKey) bool {
+			result = append(result, RelationTuple{Object: object, Relation: rel, Subject: g.subjectRef(k)})
+			return true
+		})
 	}
 
 	return result
 }
 
+// TupleMeta returns when and by whom a tuple was written, false when it does not exist
+func (g *RelationGraph) TupleMeta(tuple RelationTuple) (TupleMeta, bool) {
+	object, ok := g.lookupNode(tuple.Object)
+	if !ok {
+		return TupleMeta{}, false
+	}
+	rel, ok := g.strings.lookup(tuple.Relation)
+	if !ok {
+		return TupleMeta{}, false
+	}
+	subject, ok := g.lookupSubject(tuple.Subject)
+	if !ok {
+		return TupleMeta{}, false
+	}
+	sh := g.shardFor(object)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	m, ok := sh.meta[tupleKey{object: object, rel: rel, subject: subject}]
+	if !ok {
+		return TupleMeta{}, false
+	}
+	return g.tupleMeta(m), true
+}
+
+func (g *RelationGraph) tupleMeta(m tupleMeta) TupleMeta {
+	meta := TupleMeta{CreatedBy: g.strings.str(m.createdBy)}
+	if m.createdAt != 0 {
+		meta.CreatedAt = time.Unix(0, m.createdAt).UTC()
+	}
+	return meta
+}
+
 // HasDirectRelation returns true if the direct tuple (object, relation, subject) exists
 func (g *RelationGraph) HasDirectRelation(object ObjectRef, relation string, subject SubjectRef) bool {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-
-	key := makeTupleKey(RelationTuple{
-		Object:   object,
-		Relation: relation,
-		Subject:  subject,
-	})
+	n, ok := g.lookupNode(object)
+	if !ok {
+		return false
+	}
+	rel, ok := g.strings.lookup(relation)
+	if !ok {
+		return false
+	}
+	subj, ok := g.lookupSubject(subject)
+	if !ok {
+		return false
+	}
+	sh := g.shardFor(n)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.hasDirectRelation(n, rel, subj)
+}
 
-	_, exists := g.tuples[key]
-	return exists
+// hasDirectRelation is HasDirectRelation for a caller already holding the shard lock
+func (sh *graphShard) hasDirectRelation(object nodeID, rel uint32, subject subjectKey) bool {
+	adj := sh.objectIndex[object]
+	if adj == nil {
+		return false
+	}
+	set := adj.get(rel)
+	return set != nil && set.has(subject)
 }
 
 // GetSubjects returns all subjects with the given relation to the object
 func (g *RelationGraph) GetSubjects(object ObjectRef, relation string) []SubjectRef {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
+	n, ok := g.lookupNode(object)
+	if !ok {
+		return nil
+	}
+	rel, ok := g.strings.lookup(relation)
+	if !ok {
+		return nil
+	}
+	sh := g.shardFor(n)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
 	var result []SubjectRef
-
-	if relations := g.objectIndex[object]; relations != nil {
-		if subjects := relations[relation]; subjects != nil {
-			for subj := range subjects {
-				result = append(result, subj)
-			}
+	if adj := sh.objectIndex[n]; adj != nil {
+		if set := adj.get(rel); set != nil {
+			set.each(func(k subjectKey) bool {
+				result = append(result, g.subjectRef(k))
+				return true
+			})
 		}
 	}
 
 	return result
 }
 
-// HasDeepRelationship returns true if subject has the relation to object, following userset chains (transitive)
+// objectRelation is an interned (object, relation) pair, the unit of deep check traversal
+type objectRelation struct {
+	object nodeID
+	rel    uint32
+}
+
+// HasDeepRelationship returns true if subject has the relation to object, following userset chains (transitive).
+// It is CheckDeep without a deadline; a chain longer than DefaultMaxCheckDepth counts as no relation.
 func (g *RelationGraph) HasDeepRelationship(object ObjectRef, relation string, subject SubjectRef) bool {
-	var buf [256]byte
-	visited := make(map[string]struct{})
-	return g.hasDeepRelationshipHelper(object, relation, subject, visited, buf[:0])
-}
-
-// hasDeepRelationshipHelper is the recursive helper for HasDeepRelationship
-func (g *RelationGraph) hasDeepRelationshipHelper(object ObjectRef, relation string, subject SubjectRef, visited map[string]struct{}, buf []byte) bool {
-	// build a unique key for this check to avoid cycles, using the buffer to minimize allocations
-	buf = buf[:0]
-	buf = append(buf, object.Type...)
-	buf = append(buf, ':')
-	buf = append(buf, object.ObjectID...)
-	buf = append(buf, '|')
-	buf = append(buf, relation...)
-	buf = append(buf, '|')
-	buf = append(buf, subject.Object.Type...)
-	buf = append(buf, ':')
-	buf = append(buf, subject.Object.ObjectID...)
-	if subject.Relation != "" {
-		buf = append(buf, '#')
-		buf = append(buf, subject.Relation...)
-	}
-	key := string(buf)
-
-	if _, ok := visited[key]; ok {
-		// already visited this triple, avoid infinite loop
-		return false
-	}
-	visited[key] = struct{}{}
+	ok, _ := g.CheckDeep(context.Background(), object, relation, subject, CheckOptions{})
+	return ok
+}
 
-	if g.HasDirectRelation(object, relation, subject) {
-		return true
+// GetObjects returns all objects that the subject has the given relation to
+func (g *RelationGraph) GetObjects(subject ObjectRef, relation string) []ObjectRef {
+	n, ok := g.lookupNode(subject)
+	if !ok {
+		return nil
+	}
+	rel, ok := g.strings.lookup(relation)
+	if !ok {
+		return nil
 	}
+	sh := g.shardFor(n)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	subjects := g.GetSubjects(object, relation)
-	for _, subj := range subjects {
-		if subj.Relation != "" {
-			if g.hasDeepRelationshipHelper(subj.Object, subj.Relation, subject, visited, buf) {
+	var result []ObjectRef
+	if adj := sh.subjectIndex[n]; adj != nil {
+		if set := adj.get(rel); set != nil {
+			set.each(func(o nodeID) bool {
+				result = append(result, g.objectRef(o))
 				return true
-			}
+			})
 		}
 	}
 
-	return false
+	return result
 }
 
-// GetObjects returns all objects that the subject has the given relation to
-func (g *RelationGraph) GetObjects(subject ObjectRef, relation string) []ObjectRef {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-
-	var result []ObjectRef
+// ReadTuplesBySubject returns the tuples naming subject directly, for relation or every
+// relation when it is empty. Like GetObjects it only sees concrete subjects, not usersets.
+func (g *RelationGraph) ReadTuplesBySubject(subject ObjectRef, relation string) []RelationTuple {
+	n, ok := g.lookupNode(subject)
+	if !ok {
+		return nil
+	}
+	sh := g.shardFor(n)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	if relations := g.subjectIndex[subject]; relations != nil {
-		if objects := relations[relation]; objects != nil {
-			for obj := range objects {
-				result = append(result, obj)
-			}
+	adj := sh.subjectIndex[n]
+	if adj == nil {
+		return nil
+	}
+	var result []RelationTuple
+	for i := range adj.relations {
+		rel := g.strings.str(adj.relations[i].rel)
+		if relation != "" && rel != relation {
+			continue
 		}
+		adj.relations[i].members.each(func(o nodeID) bool {
+			result = append(result, RelationTuple{Object: g.objectRef(o), Relation: rel, Subject: SubjectRef{Object: subject}})
+			return true
+		})
+	}
+	return result
+}
+
+// ReadUsersetTuples returns the tuples whose subject is a userset of object, such as
+// document:x#read@group:eng#member for group:eng; ReadTuplesBySubject leaves them out
+func (g *RelationGraph) ReadUsersetTuples(object ObjectRef) []RelationTuple {
+	n, ok := g.lookupNode(object)
+	if !ok {
+		return nil
 	}
+	sh := g.shardFor(n)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
+	adj := sh.usersetIndex[n]
+	if adj == nil {
+		return nil
+	}
+	var result []RelationTuple
+	for i := range adj.relations {
+		subject := SubjectRef{Object: object, Relation: g.strings.str(adj.relations[i].rel)}
+		adj.relations[i].members.each(func(at objectRelation) bool {
+			result = append(result, RelationTuple{Object: g.objectRef(at.object), Relation: g.strings.str(at.rel), Subject: subject})
+			return true
+		})
+	}
 	return result
 }
 
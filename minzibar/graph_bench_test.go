@@ -1,7 +1,12 @@
 package main
 
 import (
+	"runtime"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // benchmark for hasdirectrelation with a large number of direct relationships
@@ -91,3 +96,252 @@ func BenchmarkHasDeepRelationship_DeepChain(b *testing.B) {
 		}
 	}
 }
+
+// benchmark for hasdeeprelationship under parallel readers with a concurrent writer
+func BenchmarkHasDeepRelationship_ParallelWithWrites(b *testing.B) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "benchdoc"}
+	group := ObjectRef{Type: "group", ObjectID: "benchgroup"}
+	user := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "benchuser"}}
+	g.Write(RelationTuple{Object: doc, Relation: "editor", Subject: SubjectRef{Object: group, Relation: "member"}})
+	g.Write(RelationTuple{Object: group, Relation: "member", Subject: user})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			g.Write(RelationTuple{
+				Object:   ObjectRef{Type: "document", ObjectID: strconv.Itoa(i % 10000)},
+				Relation: "viewer",
+				Subject:  SubjectRef{Object: ObjectRef{Type: "user", ObjectID: strconv.Itoa(i)}},
+			})
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !g.HasDeepRelationship(doc, "editor", user) {
+				b.Fatal("expected transitive relation to exist")
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// benchmark for writes while deep checks that walk thousands of usersets run next to them
+func BenchmarkWrite_DuringSlowChecks(b *testing.B) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "benchdoc"}
+	user := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "benchuser"}}
+	for i := 0; i < 5000; i++ {
+		group := ObjectRef{Type: "group", ObjectID: strconv.Itoa(i)}
+		g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: SubjectRef{Object: group, Relation: "member"}})
+		g.Write(RelationTuple{Object: group, Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: strconv.Itoa(i)}}})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// a miss walks every group
+			g.HasDeepRelationship(doc, "viewer", user)
+		}
+	}()
+
+	// a write waiting for a whole walk shows in the slowest writes, not the mean
+	took := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		g.Write(RelationTuple{
+			Object:   ObjectRef{Type: "folder", ObjectID: strconv.Itoa(i % 10000)},
+			Relation: "viewer",
+			Subject:  SubjectRef{Object: ObjectRef{Type: "user", ObjectID: strconv.Itoa(i)}},
+		})
+		took[i] = time.Since(start)
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+	slices.Sort(took)
+	b.ReportMetric(float64(took[len(took)*99/100].Nanoseconds()), "p99-ns/write")
+}
+
+// benchmark for parallel writers spread over many objects
+func BenchmarkWrite_Parallel(b *testing.B) {
+	g := NewRelationGraph()
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := n.Add(1)
+			g.Write(RelationTuple{
+				Object:   ObjectRef{Type: "document", ObjectID: strconv.FormatInt(i%50000, 10)},
+				Relation: "viewer",
+				Subject:  SubjectRef{Object: ObjectRef{Type: "user", ObjectID: strconv.FormatInt(i, 10)}},
+			})
+		}
+	})
+}
+
+// benchmark for parallel direct checks while another goroutine writes
+func BenchmarkHasDirectRelation_ParallelWithWrites(b *testing.B) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "benchdoc"}
+	user := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "benchuser"}}
+	g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: user})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			g.Write(RelationTuple{
+				Object:   ObjectRef{Type: "folder", ObjectID: strconv.Itoa(i % 10000)},
+				Relation: "viewer",
+				Subject:  SubjectRef{Object: ObjectRef{Type: "user", ObjectID: strconv.Itoa(i)}},
+			})
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !g.HasDirectRelation(doc, "viewer", user) {
+				b.Fatal("expected direct relation to exist")
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// benchmark for heap used per stored tuple, reported as the B/tuple metric
+func BenchmarkRelationGraph_MemoryPerTuple(b *testing.B) {
+	const docs, usersPerDoc = 20000, 10
+	tuples := make([]RelationTuple, 0, docs*(usersPerDoc+1))
+	for d := 0; d < docs; d++ {
+		// fresh strings per tuple, the way json decoding produces them
+		doc := ObjectRef{Type: "document", ObjectID: "document-" + strconv.Itoa(d)}
+		for u := 0; u < usersPerDoc; u++ {
+			tuples = append(tuples, RelationTuple{
+				Object:   ObjectRef{Type: string([]byte("document")), ObjectID: doc.ObjectID},
+				Relation: string([]byte("viewer")),
+				Subject:  SubjectRef{Object: ObjectRef{Type: string([]byte("user")), ObjectID: "user-" + strconv.Itoa((d*7+u)%5000)}},
+			})
+		}
+		tuples = append(tuples, RelationTuple{
+			Object:   doc,
+			Relation: "editor",
+			Subject:  SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "group-" + strconv.Itoa(d%100)}, Relation: "member"},
+		})
+	}
+
+	var perTuple float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		g := NewRelationGraph()
+		for _, t := range tuples {
+			g.Write(t)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		perTuple = float64(after.HeapAlloc-before.HeapAlloc) / float64(len(tuples))
+		runtime.KeepAlive(g)
+	}
+	b.ReportMetric(perTuple, "B/tuple")
+}
+
+// benchmark for direct checks against a graph with many objects and subjects
+func BenchmarkHasDirectRelation_LargeGraph(b *testing.B) {
+	g := NewRelationGraph()
+	for d := 0; d < 20000; d++ {
+		for u := 0; u < 10; u++ {
+			g.Write(RelationTuple{
+				Object:   ObjectRef{Type: "document", ObjectID: "document-" + strconv.Itoa(d)},
+				Relation: "viewer",
+				Subject:  SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "user-" + strconv.Itoa((d*7+u)%5000)}},
+			})
+		}
+	}
+	doc := ObjectRef{Type: "document", ObjectID: "document-1234"}
+	user := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "user-" + strconv.Itoa((1234*7+3)%5000)}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !g.HasDirectRelation(doc, "viewer", user) {
+			b.Fatal("expected direct relation to exist")
+		}
+	}
+}
+
+// nestedGroupGraph builds an org tree of groups: each group has fanout subgroups, depth
+// levels deep, and the user is a member of one leaf group only
+func nestedGroupGraph(fanout, depth int) (*RelationGraph, ObjectRef, SubjectRef) {
+	g := NewRelationGraph()
+	root := ObjectRef{Type: "group", ObjectID: "root"}
+	user := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "benchuser"}}
+	level := []ObjectRef{root}
+	for d := 0; d < depth; d++ {
+		var next []ObjectRef
+		for _, parent := range level {
+			for i := 0; i < fanout; i++ {
+				child := ObjectRef{Type: "group", ObjectID: parent.ObjectID + "." + strconv.Itoa(i)}
+				g.Write(RelationTuple{Object: parent, Relation: "member", Subject: SubjectRef{Object: child, Relation: "member"}})
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+	for i, leaf := range level {
+		g.Write(RelationTuple{Object: leaf, Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "u" + strconv.Itoa(i)}}})
+	}
+	g.Write(RelationTuple{Object: level[len(level)-1], Relation: "member", Subject: user})
+	return g, root, user
+}
+
+// benchmark for nested group membership walked level by level
+func BenchmarkHasDeepRelationship_NestedGroups(b *testing.B) {
+	g, root, user := nestedGroupGraph(4, 5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !g.HasDeepRelationship(root, "member", user) {
+			b.Fatal("expected nested membership")
+		}
+	}
+}
+
+// benchmark for nested group membership answered by the membership index
+func BenchmarkHasDeepRelationship_NestedGroupsIndexed(b *testing.B) {
+	g, root, user := nestedGroupGraph(4, 5)
+	g.EnableMembershipIndex("member")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !g.HasDeepRelationship(root, "member", user) {
+			b.Fatal("expected nested membership")
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -494,3 +497,116 @@ func TestParseSubjectPermissions_NonUserSubjects(t *testing.T) {
 	assert.Equal(t, "", parsed.Subject.Relation)
 	assert.Equal(t, []string{"read"}, parsed.Actions)
 }
+
+func TestRelationGraph_ConcurrentWritesAndDeepChecks(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "shared"}
+	group := ObjectRef{Type: "group", ObjectID: "eng"}
+	g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: SubjectRef{Object: group, Relation: "member"}})
+
+	const writers, perWriter = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				user := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: fmt.Sprintf("u%d-%d", w, i)}}
+				g.Write(RelationTuple{Object: group, Relation: "member", Subject: user})
+				// readers racing the writers must always see a tuple once its write returned
+				assert.True(t, g.HasDeepRelationship(doc, "viewer", user))
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				g.ListAllObjects()
+				g.GetSubjects(group, "member")
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, g.GetSubjects(group, "member"), writers*perWriter)
+	count := 0
+	assert.NoError(t, g.ForEachTuple(func(RelationTuple) error { count++; return nil }))
+	assert.Equal(t, writers*perWriter+1, count)
+}
+
+func TestReadUsersetTuples(t *testing.T) {
+	g := NewRelationGraph()
+	eng := ObjectRef{Type: "group", ObjectID: "eng"}
+	doc := ObjectRef{Type: "document", ObjectID: "readme"}
+	folder := ObjectRef{Type: "folder", ObjectID: "docs"}
+	members := SubjectRef{Object: eng, Relation: "member"}
+	admins := SubjectRef{Object: eng, Relation: "admin"}
+
+	g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: members})
+	g.Write(RelationTuple{Object: folder, Relation: "editor", Subject: admins})
+	g.Write(RelationTuple{Object: eng, Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}})
+
+	assert.ElementsMatch(t, []RelationTuple{
+		{Object: doc, Relation: "viewer", Subject: members},
+		{Object: folder, Relation: "editor", Subject: admins},
+	}, g.ReadUsersetTuples(eng))
+	assert.Empty(t, g.ReadTuplesBySubject(eng, ""), "concrete subjects only")
+
+	assert.True(t, g.Delete(RelationTuple{Object: folder, Relation: "editor", Subject: admins}))
+	assert.Equal(t, []RelationTuple{{Object: doc, Relation: "viewer", Subject: members}}, g.ReadUsersetTuples(eng))
+
+	// loading a snapshot rebuilds the index
+	data, err := json.Marshal(g)
+	assert.NoError(t, err)
+	g2 := NewRelationGraph()
+	assert.NoError(t, json.Unmarshal(data, g2))
+	assert.Equal(t, []RelationTuple{{Object: doc, Relation: "viewer", Subject: members}}, g2.ReadUsersetTuples(eng))
+
+	assert.True(t, g.Delete(RelationTuple{Object: doc, Relation: "viewer", Subject: members}))
+	assert.Empty(t, g.ReadUsersetTuples(eng))
+	assert.Empty(t, g.ReadUsersetTuples(ObjectRef{Type: "group", ObjectID: "nobody"}))
+}
+
+func TestDelete_DropsEmptyObjects(t *testing.T) {
+	g := NewRelationGraph()
+	doc := ObjectRef{Type: "document", ObjectID: "readme"}
+	alice := ObjectRef{Type: "user", ObjectID: "alice"}
+	tuple := RelationTuple{Object: doc, Relation: "viewer", Subject: SubjectRef{Object: alice}}
+
+	g.Write(tuple)
+	assert.Equal(t, []ObjectRef{doc}, g.ListAllObjects())
+	assert.True(t, g.Delete(tuple))
+	assert.Empty(t, g.ListAllObjects())
+	assert.Empty(t, g.GetObjects(alice, "viewer"))
+}
+
+func TestRelationGraph_TupleMeta(t *testing.T) {
+	g := NewRelationGraph()
+	tuple := RelationTuple{Object: ObjectRef{Type: "document", ObjectID: "readme"}, Relation: "viewer", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}}
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	g.WriteWithMeta(tuple, TupleMeta{CreatedAt: at, CreatedBy: "user:root"})
+	// writing it again keeps the original metadata
+	g.Write(tuple)
+	meta, ok := g.TupleMeta(tuple)
+	assert.True(t, ok)
+	assert.True(t, at.Equal(meta.CreatedAt))
+	assert.Equal(t, "user:root", meta.CreatedBy)
+
+	g.ForEachTupleMeta(func(got RelationTuple, m TupleMeta) error {
+		assert.Equal(t, tuple, got)
+		assert.Equal(t, meta, m)
+		return nil
+	})
+
+	assert.True(t, g.Delete(tuple))
+	_, ok = g.TupleMeta(tuple)
+	assert.False(t, ok)
+	before := time.Now()
+	g.Write(tuple)
+	meta, _ = g.TupleMeta(tuple)
+	assert.False(t, meta.CreatedAt.Before(before), "a rewritten tuple is new")
+	assert.Empty(t, meta.CreatedBy)
+}
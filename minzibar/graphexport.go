@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GraphDirection says which way ExportGraph walks from its root
+type GraphDirection string
+
+const (
+	// GraphToSubjects follows tuples from objects to their subjects: who holds what on the root
+	GraphToSubjects GraphDirection = "subjects"
+	// GraphToObjects follows tuples from subjects to their objects: what the root holds
+	GraphToObjects GraphDirection = "objects"
+	// GraphBoth follows tuples both ways
+	GraphBoth GraphDirection = "both"
+)
+
+const (
+	// DefaultGraphDepth is the depth of ExportGraph when none is given
+	DefaultGraphDepth = 3
+	// MaxGraphDepth bounds the depth an export may ask for
+	MaxGraphDepth = 10
+	// DefaultGraphMaxNodes caps the size of an export when GraphOptions.MaxNodes is 0
+	DefaultGraphMaxNodes = 500
+)
+
+// ErrUnknownObject is returned for a graph root no tuple has ever named
+var ErrUnknownObject = errors.New("object not in the graph")
+
+// GraphOptions selects the part of the relation graph ExportGraph returns
+type GraphOptions struct {
+	// Depth is the number of tuples walked from the root, DefaultGraphDepth when 0
+	Depth int
+	// Relations keeps only tuples with these relations, all when empty
+	Relations []string
+	// Direction is GraphBoth when empty
+	Direction GraphDirection
+	// MaxNodes stops the walk once reached, DefaultGraphMaxNodes when 0
+	MaxNodes int
+}
+
+// GraphNode is an object in an exported subgraph, Depth tuples away from the root
+type GraphNode struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	ObjectID string `json:"object_id"`
+	Depth    int    `json:"depth"`
+	// Resource marks objects created as resources
+	Resource bool `json:"resource,omitempty"`
+}
+
+// GraphEdge is a tuple, drawn from its subject to its object. SubjectRelation is set when
+// the subject is a userset, e.g. member for document:x#read@group:eng#member.
+type GraphEdge struct {
+	Source          string `json:"source"`
+	Target          string `json:"target"`
+	Relation        string `json:"relation"`
+	SubjectRelation string `json:"subject_relation,omitempty"`
+}
+
+func (e GraphEdge) label() string {
+	if e.SubjectRelation != "" {
+		return e.Relation + " via " + e.SubjectRelation
+	}
+	return e.Relation
+}
+
+// Subgraph is the neighbourhood of an object as nodes and edges, the JSON the UI draws
+type Subgraph struct {
+	Root  string      `json:"root"`
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	// Truncated is set when MaxNodes cut the walk short
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExportGraph walks the tuples around root, an object or a subject, breadth first up to
+// opts.Depth. Resource marker tuples are folded into GraphNode.Resource. Walking towards
+// objects also follows userset grants, such as those naming group:eng#member from group:eng.
+func (e *Engine) ExportGraph(root ObjectRef, opts GraphOptions) (*Subgraph, error) {
+	root, err := e.localRef(root)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case opts.Depth == 0:
+		opts.Depth = DefaultGraphDepth
+	case opts.Depth < 0 || opts.Depth > MaxGraphDepth:
+		return nil, fmt.Errorf("depth must be between 1 and %d", MaxGraphDepth)
+	}
+	if opts.MaxNodes <= 0 {
+		opts.MaxNodes = DefaultGraphMaxNodes
+	}
+	switch opts.Direction {
+	case "":
+		opts.Direction = GraphBoth
+	case GraphToSubjects, GraphToObjects, GraphBoth:
+	default:
+		return nil, fmt.Errorf("unknown direction %q", opts.Direction)
+	}
+	if _, ok := e.graph.lookupNode(root); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownObject, root)
+	}
+
+	keep := func(t RelationTuple) bool {
+		if t.Relation == "resource" && t.Subject == resourceMarker {
+			return false
+		}
+		return len(opts.Relations) == 0 || containsString(opts.Relations, t.Relation)
+	}
+
+	out := &Subgraph{Root: root.String(), Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	depths := map[ObjectRef]int{root: 0}
+	order := []ObjectRef{root}
+	seenEdge := make(map[RelationTuple]struct{})
+	level := []ObjectRef{root}
+	for depth := 0; depth < opts.Depth && len(level) > 0; depth++ {
+		var next []ObjectRef
+		for _, node := range level {
+			var tuples []RelationTuple
+			if opts.Direction != GraphToObjects {
+				tuples = append(tuples, e.graph.ReadTuples(node, "")...)
+			}
+			if opts.Direction != GraphToSubjects {
+				tuples = append(tuples, e.graph.ReadTuplesBySubject(node, "")...)
+				tuples = append(tuples, e.graph.ReadUsersetTuples(node)...)
+			}
+			sort.Slice(tuples, func(i, j int) bool { return FormatTuple(tuples[i]) < FormatTuple(tuples[j]) })
+			for _, t := range tuples {
+				if _, ok := seenEdge[t]; ok || !keep(t) {
+					continue
+				}
+				// the end of the tuple that is not this node
+				other := t.Object
+				if other == node {
+					other = t.Subject.Object
+				}
+				if _, ok := depths[other]; !ok {
+					if len(depths) >= opts.MaxNodes {
+						out.Truncated = true
+						continue
+					}
+					depths[other] = depth + 1
+					order = append(order, other)
+					next = append(next, other)
+				}
+				seenEdge[t] = struct{}{}
+				out.Edges = append(out.Edges, GraphEdge{
+					Source:          t.Subject.Object.String(),
+					Target:          t.Object.String(),
+					Relation:        t.Relation,
+					SubjectRelation: t.Subject.Relation,
+				})
+			}
+		}
+		level = next
+	}
+	for _, obj := range order {
+		out.Nodes = append(out.Nodes, GraphNode{
+			ID:       obj.String(),
+			Type:     obj.Type,
+			ObjectID: obj.ObjectID,
+			Depth:    depths[obj],
+			Resource: e.isResource(obj),
+		})
+	}
+	return out, nil
+}
+
+// Query encodes the options as /graph query parameters
+func (o GraphOptions) Query() url.Values {
+	q := url.Values{}
+	if o.Depth != 0 {
+		q.Set("depth", strconv.Itoa(o.Depth))
+	}
+	if len(o.Relations) > 0 {
+		q["relation"] = o.Relations
+	}
+	if o.Direction != "" {
+		q.Set("direction", string(o.Direction))
+	}
+	if o.MaxNodes != 0 {
+		q.Set("max_nodes", strconv.Itoa(o.MaxNodes))
+	}
+	return q
+}
+
+// ParseGraphOptions reads GraphOptions from /graph query parameters; relation may be
+// repeated or comma separated
+func ParseGraphOptions(q url.Values) (GraphOptions, error) {
+	var opts GraphOptions
+	var err error
+	if v := q.Get("depth"); v != "" {
+		if opts.Depth, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("invalid depth %q", v)
+		}
+	}
+	if v := q.Get("max_nodes"); v != "" {
+		if opts.MaxNodes, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("invalid max_nodes %q", v)
+		}
+	}
+	for _, v := range q["relation"] {
+		for _, rel := range strings.Split(v, ",") {
+			if rel = strings.TrimSpace(rel); rel != "" {
+				opts.Relations = append(opts.Relations, rel)
+			}
+		}
+	}
+	opts.Direction = GraphDirection(q.Get("direction"))
+	return opts, nil
+}
+
+// GraphFormat selects how a Subgraph is rendered
+type GraphFormat string
+
+const (
+	GraphJSON    GraphFormat = "json"
+	GraphDOT     GraphFormat = "dot"
+	GraphMermaid GraphFormat = "mermaid"
+)
+
+// ParseGraphFormat maps a user supplied name to a GraphFormat, defaulting to json
+func ParseGraphFormat(name string) (GraphFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "json":
+		return GraphJSON, nil
+	case "dot", "graphviz", "gv":
+		return GraphDOT, nil
+	case "mermaid", "mmd":
+		return GraphMermaid, nil
+	}
+	return "", fmt.Errorf("unknown graph format %q", name)
+}
+
+// DOT renders the subgraph for Graphviz, e.g. `dot -Tsvg`; the root is drawn bold and
+// resources as boxes
+func (s *Subgraph) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph minzibar {\n  rankdir=LR;\n  node [shape=ellipse];\n")
+	for _, n := range s.Nodes {
+		var attrs []string
+		if n.Resource {
+			attrs = append(attrs, "shape=box")
+		}
+		if n.ID == s.Root {
+			attrs = append(attrs, "style=bold")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "  %s [%s];\n", strconv.Quote(n.ID), strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&b, "  %s;\n", strconv.Quote(n.ID))
+		}
+	}
+	for _, e := range s.Edges {
+		fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", strconv.Quote(e.Source), strconv.Quote(e.Target), strconv.Quote(e.label()))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the subgraph as a flowchart for Markdown; nodes get generated ids since
+// object ids may hold characters Mermaid does not allow
+func (s *Subgraph) Mermaid() string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	ids := make(map[string]string, len(s.Nodes))
+	for i, n := range s.Nodes {
+		id := "n" + strconv.Itoa(i)
+		ids[n.ID] = id
+		if n.Resource {
+			fmt.Fprintf(&b, "  %s[\"%s\"]\n", id, mermaidText(n.ID))
+		} else {
+			fmt.Fprintf(&b, "  %s([\"%s\"])\n", id, mermaidText(n.ID))
+		}
+	}
+	for _, e := range s.Edges {
+		fmt.Fprintf(&b, "  %s -->|\"%s\"| %s\n", ids[e.Source], mermaidText(e.label()), ids[e.Target])
+	}
+	if id, ok := ids[s.Root]; ok {
+		fmt.Fprintf(&b, "  style %s stroke-width:3px\n", id)
+	}
+	return b.String()
+}
+
+// mermaidText escapes the characters that end a quoted Mermaid label
+func mermaidText(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "|", "#124;").Replace(s)
+}
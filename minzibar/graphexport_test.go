@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exampleGraphEngine holds the graph drawn in example_relationship_graph.md
+func exampleGraphEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("folder", "project-docs")
+	engine.CreateResource("document", "api-spec")
+	for _, line := range []string{
+		"team:engineering#member@user:alice",
+		"team:frontend#member@user:bob",
+		"team:engineering#member@team:frontend#member",
+		"folder:project-docs#viewer@user:alice",
+		"folder:project-docs#editor@user:bob",
+		"folder:project-docs#owner@user:charlie",
+		"document:api-spec#parent@folder:project-docs",
+		"document:api-spec#editor@team:engineering#member",
+	} {
+		tuple, err := ParseTuple(line)
+		require.NoError(t, err)
+		require.NoError(t, engine.writeTuple(tuple))
+	}
+	return engine
+}
+
+func TestExportGraph_Directions(t *testing.T) {
+	engine := exampleGraphEngine(t)
+
+	g, err := engine.ExportGraph(ObjectRef{Type: "document", ObjectID: "api-spec"}, GraphOptions{Direction: GraphToSubjects, Depth: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []GraphNode{
+		{ID: "document:api-spec", Type: "document", ObjectID: "api-spec", Depth: 0, Resource: true},
+		{ID: "team:engineering", Type: "team", ObjectID: "engineering", Depth: 1},
+		{ID: "folder:project-docs", Type: "folder", ObjectID: "project-docs", Depth: 1, Resource: true},
+		{ID: "team:frontend", Type: "team", ObjectID: "frontend", Depth: 2},
+		{ID: "user:alice", Type: "user", ObjectID: "alice", Depth: 2},
+		{ID: "user:bob", Type: "user", ObjectID: "bob", Depth: 2},
+		{ID: "user:charlie", Type: "user", ObjectID: "charlie", Depth: 2},
+	}, g.Nodes)
+	assert.Contains(t, g.Edges, GraphEdge{Source: "team:engineering", Target: "document:api-spec", Relation: "editor", SubjectRelation: "member"})
+	assert.Contains(t, g.Edges, GraphEdge{Source: "user:charlie", Target: "folder:project-docs", Relation: "owner"})
+	assert.Len(t, g.Edges, 7)
+	assert.False(t, g.Truncated)
+
+	// from a user up to what it can reach, through the userset grant to the team
+	g, err = engine.ExportGraph(ObjectRef{Type: "user", ObjectID: "bob"}, GraphOptions{Direction: GraphToObjects})
+	require.NoError(t, err)
+	var ids []string
+	for _, n := range g.Nodes {
+		ids = append(ids, n.ID)
+	}
+	assert.Equal(t, []string{"user:bob", "folder:project-docs", "team:frontend", "document:api-spec", "team:engineering"}, ids)
+
+	g, err = engine.ExportGraph(ObjectRef{Type: "user", ObjectID: "alice"}, GraphOptions{Depth: 1, Relations: []string{"member"}})
+	require.NoError(t, err)
+	assert.Equal(t, []GraphEdge{{Source: "user:alice", Target: "team:engineering", Relation: "member"}}, g.Edges)
+
+	g, err = engine.ExportGraph(ObjectRef{Type: "folder", ObjectID: "project-docs"}, GraphOptions{MaxNodes: 3})
+	require.NoError(t, err)
+	assert.Len(t, g.Nodes, 3)
+	assert.True(t, g.Truncated)
+
+	_, err = engine.ExportGraph(ObjectRef{Type: "user", ObjectID: "nobody"}, GraphOptions{})
+	assert.ErrorIs(t, err, ErrUnknownObject)
+	_, err = engine.ExportGraph(ObjectRef{Type: "user", ObjectID: "bob"}, GraphOptions{Depth: MaxGraphDepth + 1})
+	assert.Error(t, err)
+	_, err = engine.ExportGraph(ObjectRef{Type: "user", ObjectID: "bob"}, GraphOptions{Direction: "sideways"})
+	assert.Error(t, err)
+}
+
+func TestSubgraph_Render(t *testing.T) {
+	engine := exampleGraphEngine(t)
+	g, err := engine.ExportGraph(ObjectRef{Type: "document", ObjectID: "api-spec"}, GraphOptions{Depth: 1, Direction: GraphToSubjects})
+	require.NoError(t, err)
+
+	assert.Equal(t, `digraph minzibar {
+  rankdir=LR;
+  node [shape=ellipse];
+  "document:api-spec" [shape=box, style=bold];
+  "team:engineering";
+  "folder:project-docs" [shape=box];
+  "team:engineering" -> "document:api-spec" [label="editor via member"];
+  "folder:project-docs" -> "document:api-spec" [label="parent"];
+}
+`, g.DOT())
+
+	assert.Equal(t, `flowchart LR
+  n0["document:api-spec"]
+  n1(["team:engineering"])
+  n2["folder:project-docs"]
+  n1 -->|"editor via member"| n0
+  n2 -->|"parent"| n0
+  style n0 stroke-width:3px
+`, g.Mermaid())
+
+	assert.Equal(t, `a#quot;b#124;c`, mermaidText(`a"b|c`))
+}
+
+func TestService_Graph(t *testing.T) {
+	e := NewService(exampleGraphEngine(t)).Echo()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/graph?root=document:api-spec&depth=3&relation=editor,member")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var g Subgraph
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &g))
+	assert.Equal(t, "document:api-spec", g.Root)
+	for _, edge := range g.Edges {
+		assert.Contains(t, []string{"editor", "member"}, edge.Relation)
+	}
+	assert.Len(t, g.Nodes, 5)
+
+	rec = get("/graph?root=document:api-spec&format=dot")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/vnd.graphviz; charset=utf-8", rec.Header().Get("Content-Type"))
+	rec = get("/graph?root=document:api-spec&format=mermaid")
+	assert.Contains(t, rec.Body.String(), "flowchart LR")
+
+	assert.Equal(t, http.StatusNotFound, get("/graph?root=user:nobody").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/graph?root=nope").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/graph?root=user:bob&format=png").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/graph?root=user:bob&depth=deep").Code)
+}
+
+func TestCLI_Graph(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "graph.txt")
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"write", "-data", data, "document:x#read@group:eng#member"}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "group:eng#member@user:bob"}, nil, &out))
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"graph", "-data", data, "-format", "mermaid", "-direction", "objects", "user:bob"}, nil, &out))
+	assert.Equal(t, `flowchart LR
+  n0(["user:bob"])
+  n1(["group:eng"])
+  n2(["document:x"])
+  n0 -->|"member"| n1
+  n1 -->|"read via member"| n2
+  style n0 stroke-width:3px
+`, out.String())
+
+	srv := httptest.NewServer(NewService(exampleGraphEngine(t)).Echo())
+	defer srv.Close()
+	out.Reset()
+	require.NoError(t, runCLI([]string{"graph", "-server", srv.URL, "-depth", "1", "-relation", "owner", "folder:project-docs"}, nil, &out))
+	assert.Contains(t, out.String(), `"user:charlie" -> "folder:project-docs" [label="owner"];`)
+	assert.NotContains(t, out.String(), "user:bob")
+}
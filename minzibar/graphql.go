@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vektah/gqlparser/v2/parser"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+// GraphQLSchema describes what /graphql answers. Queries only: writes go through the
+// rest of the API. permissions checks for the caller when subject is left out.
+const GraphQLSchema = `type Query {
+  object(ref: String!): Object!
+  me: Object
+  objects(type: String): [Object!]!
+  policies: [Policy!]!
+  policy(id: String!): Policy
+  roles: [Role!]!
+}
+
+type Object {
+  type: String!
+  id: String!
+  ref: String!
+  exists: Boolean!
+  relations(relation: String): [Tuple!]!
+  memberships(relation: String): [Tuple!]!
+  permissions(actions: [String!]!, subject: String, context: Context): [Permission!]!
+  policies: [EffectivePolicy!]!
+}
+
+type Tuple {
+  ref: String!
+  object: Object!
+  relation: String!
+  subject: Subject!
+  createdAt: String
+  createdBy: String
+}
+
+type Subject {
+  ref: String!
+  object: Object!
+  relation: String
+}
+
+type Permission {
+  action: String!
+  subject: String!
+  allowed: Boolean!
+  error: String
+}
+
+type Policy {
+  id: String!
+  text: String!
+}
+
+type EffectivePolicy {
+  id: String!
+  via: String!
+  source: Object!
+  depth: Int!
+  text: String!
+}
+
+type Role {
+  name: String!
+  permissions: [String!]!
+  description: String
+}
+
+# attribute names to string values, e.g. {department: "eng"}
+scalar Context
+`
+
+const (
+	// MaxGraphQLDepth bounds how deep selections of one query nest
+	MaxGraphQLDepth = 12
+	// MaxGraphQLChecks bounds the permission checks of one query
+	MaxGraphQLChecks = 1000
+	// MaxGraphQLSelections bounds the fields and fragment spreads of one query, counted
+	// with fragments expanded where they are spread
+	MaxGraphQLSelections = 500
+	// maxGraphQLTokens bounds the tokens of one query, so a document of nothing but {
+	// cannot exhaust the stack of the parser before depth is checked
+	maxGraphQLTokens = 10000
+)
+
+// gqlSchema is GraphQLSchema parsed once, queries are validated against it
+var gqlSchema = gqlparser.MustLoadSchema(&ast.Source{Name: "schema", Input: GraphQLSchema})
+
+// GraphQLRequest is a query with its variables, as posted to /graphql
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQLError is an error of one field, or of the whole request when Path is empty
+type GraphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// GraphQLResponse holds the data of a query and the errors of the fields that failed,
+// which are null in Data
+type GraphQLResponse struct {
+	Data   interface{}    `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// GraphQL runs a query against the engine. me is the caller, the default subject of
+// permissions. The error is for a query that cannot run at all; errors of single fields
+// are in the response.
+func (e *Engine) GraphQL(ctx context.Context, req GraphQLRequest, me *ObjectRef) (*GraphQLResponse, error) {
+	return e.graphQL(ctx, req, me, nil)
+}
+
+// graphQL is GraphQL where the fields listing tuples and objects first call mayList, which
+// returns why the caller may not see them; nil mayList allows them
+func (e *Engine) graphQL(ctx context.Context, req GraphQLRequest, me *ObjectRef, mayList func() error) (*GraphQLResponse, error) {
+	doc, err := parser.ParseQueryWithTokenLimit(&ast.Source{Name: "query", Input: req.Query}, maxGraphQLTokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Operations) == 0 {
+		return nil, errors.New("no query in document")
+	}
+	// validation links each fragment spread to its definition and rejects cycles
+	if errs := validator.Validate(gqlSchema, doc); len(errs) > 0 {
+		return nil, gqlErrors(errs)
+	}
+	op, err := gqlOperation(doc, req.OperationName)
+	if err != nil {
+		return nil, err
+	}
+	// counted first: depth walks the same expansion, which fragments can make exponential
+	if gqlSelectionCount(op.SelectionSet, MaxGraphQLSelections) > MaxGraphQLSelections {
+		return nil, fmt.Errorf("query selects more than %d fields", MaxGraphQLSelections)
+	}
+	if gqlDepth(op.SelectionSet) > MaxGraphQLDepth {
+		return nil, fmt.Errorf("query nests deeper than %d", MaxGraphQLDepth)
+	}
+	vars, err := validator.VariableValues(gqlSchema, op, req.Variables)
+	if err != nil {
+		return nil, err
+	}
+	x := &gqlExec{ctx: ctx, engine: e, me: me, vars: vars, mayList: mayList}
+	data := x.selectionSet("Query", nil, op.SelectionSet, nil)
+	return &GraphQLResponse{Data: data, Errors: x.errors}, nil
+}
+
+// gqlErrors joins the errors of a query that failed validation
+func gqlErrors(list gqlerror.List) error {
+	msgs := make([]string, len(list))
+	for i, err := range list {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// gqlOperation picks the operation to run, which name may leave out when there is one
+func gqlOperation(doc *ast.QueryDocument, name string) (*ast.OperationDefinition, error) {
+	if name == "" {
+		if len(doc.Operations) != 1 {
+			return nil, errors.New("operationName is required for a document with several operations")
+		}
+		return doc.Operations[0], nil
+	}
+	if op := doc.Operations.ForName(name); op != nil {
+		return op, nil
+	}
+	return nil, fmt.Errorf("unknown operation %s", name)
+}
+
+// gqlSelectionCount counts the fields and spreads of sels, fragments expanded, stopping
+// once the count passes limit
+func gqlSelectionCount(sels ast.SelectionSet, limit int) int {
+	n := 0
+	for _, sel := range sels {
+		if n++; n > limit {
+			return n
+		}
+		switch sel := sel.(type) {
+		case *ast.Field:
+			n += gqlSelectionCount(sel.SelectionSet, limit-n)
+		case *ast.InlineFragment:
+			n += gqlSelectionCount(sel.SelectionSet, limit-n)
+		case *ast.FragmentSpread:
+			n += gqlSelectionCount(sel.Definition.SelectionSet, limit-n)
+		}
+	}
+	return n
+}
+
+// gqlDepth is how deeply sels nest, fragments included
+func gqlDepth(sels ast.SelectionSet) int {
+	max := 0
+	for _, sel := range sels {
+		n := 0
+		switch sel := sel.(type) {
+		case *ast.Field:
+			n = gqlDepth(sel.SelectionSet)
+		case *ast.InlineFragment:
+			n = gqlDepth(sel.SelectionSet) - 1
+		case *ast.FragmentSpread:
+			n = gqlDepth(sel.Definition.SelectionSet) - 1
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return max + 1
+}
+
+// gqlObject is a result object, its keys in the order they were selected
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, en := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(en.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(en.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlField resolves one field of a type. typ is the type of the result for fields with
+// selections, "" for leaves.
+type gqlField struct {
+	typ     string
+	resolve func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+// gqlPermission is one answer of Object.permissions
+type gqlPermission struct {
+	action  string
+	subject ObjectRef
+	result  VerifyResult
+}
+
+// gqlResolvers maps type and field names to resolvers, following GraphQLSchema
+var gqlResolvers map[string]map[string]gqlField
+
+func init() {
+	objectList := func(refs []ObjectRef) []interface{} {
+		sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+		out := make([]interface{}, len(refs))
+		for i, r := range refs {
+			out[i] = r
+		}
+		return out
+	}
+	tupleList := func(tuples []RelationTuple) []interface{} {
+		sort.Slice(tuples, func(i, j int) bool { return FormatTuple(tuples[i]) < FormatTuple(tuples[j]) })
+		out := make([]interface{}, len(tuples))
+		for i, t := range tuples {
+			out[i] = t
+		}
+		return out
+	}
+	leaf := func(fn func(interface{}) interface{}) gqlField {
+		return gqlField{resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return fn(parent), nil
+		}}
+	}
+
+	gqlResolvers = map[string]map[string]gqlField{
+		"Query": {
+			"object": {typ: "Object", resolve: func(_ *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				ref, err := gqlStringArg(args, "ref", true)
+				if err != nil {
+					return nil, err
+				}
+				return parseObjectRef(ref)
+			}},
+			"me": {typ: "Object", resolve: func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+				if x.me == nil {
+					return nil, nil
+				}
+				return *x.me, nil
+			}},
+			"objects": {typ: "Object", resolve: func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				if err := x.listing(); err != nil {
+					return nil, err
+				}
+				typ, err := gqlStringArg(args, "type", false)
+				if err != nil {
+					return nil, err
+				}
+				var refs []ObjectRef
+				for _, r := range x.engine.ListAllResources() {
+					if typ == "" || r.Type == typ {
+						refs = append(refs, r)
+					}
+				}
+				return objectList(refs), nil
+			}},
+			"policies": {typ: "Policy", resolve: func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+				policies := x.engine.policies()
+				ids := make([]string, 0, len(policies))
+				for id := range policies {
+					ids = append(ids, id)
+				}
+				sort.Strings(ids)
+				out := make([]interface{}, len(ids))
+				for i, id := range ids {
+					out[i] = EffectivePolicy{ID: id, Policy: policies[id]}
+				}
+				return out, nil
+			}},
+			"policy": {typ: "Policy", resolve: func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				id, err := gqlStringArg(args, "id", true)
+				if err != nil {
+					return nil, err
+				}
+				p, ok := x.engine.policy(id)
+				if !ok {
+					return nil, nil
+				}
+				return EffectivePolicy{ID: id, Policy: p}, nil
+			}},
+			"roles": {typ: "Role", resolve: func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+				roles := x.engine.Roles()
+				out := make([]interface{}, len(roles))
+				for i, r := range roles {
+					out[i] = r
+				}
+				return out, nil
+			}},
+		},
+		"Object": {
+			"type": leaf(func(p interface{}) interface{} { return p.(ObjectRef).Type }),
+			"id":   leaf(func(p interface{}) interface{} { return p.(ObjectRef).ObjectID }),
+			"ref":  leaf(func(p interface{}) interface{} { return p.(ObjectRef).String() }),
+			"exists": {resolve: func(x *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+				return x.engine.isResource(parent.(ObjectRef)), nil
+			}},
+			"relations": {typ: "Tuple", resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				if err := x.listing(); err != nil {
+					return nil, err
+				}
+				relation, err := gqlStringArg(args, "relation", false)
+				if err != nil {
+					return nil, err
+				}
+				return tupleList(x.engine.graph.ReadTuples(parent.(ObjectRef), relation)), nil
+			}},
+			"memberships": {typ: "Tuple", resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				if err := x.listing(); err != nil {
+					return nil, err
+				}
+				relation, err := gqlStringArg(args, "relation", false)
+				if err != nil {
+					return nil, err
+				}
+				return tupleList(x.engine.graph.ReadTuplesBySubject(parent.(ObjectRef), relation)), nil
+			}},
+			"permissions": {typ: "Permission", resolve: (*gqlExec).permissions},
+			"policies": {typ: "EffectivePolicy", resolve: func(x *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+				policies := x.engine.GetEffectivePolicies(parent.(ObjectRef))
+				out := make([]interface{}, len(policies))
+				for i, p := range policies {
+					out[i] = p
+				}
+				return out, nil
+			}},
+		},
+		"Tuple": {
+			"ref": leaf(func(p interface{}) interface{} { return FormatTuple(p.(RelationTuple)) }),
+			"object": {typ: "Object", resolve: func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+				return p.(RelationTuple).Object, nil
+			}},
+			"relation": leaf(func(p interface{}) interface{} { return p.(RelationTuple).Relation }),
+			"subject": {typ: "Subject", resolve: func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+				return p.(RelationTuple).Subject, nil
+			}},
+			"createdAt": {resolve: func(x *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+				if meta, ok := x.engine.graph.TupleMeta(p.(RelationTuple)); ok && !meta.CreatedAt.IsZero() {
+					return meta.CreatedAt.UTC().Format(time.RFC3339), nil
+				}
+				return nil, nil
+			}},
+			"createdBy": {resolve: func(x *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+				if err := x.listing(); err != nil {
+					return nil, err
+				}
+				if meta, ok := x.engine.graph.TupleMeta(p.(RelationTuple)); ok && meta.CreatedBy != "" {
+					return meta.CreatedBy, nil
+				}
+				return nil, nil
+			}},
+		},
+		"Subject": {
+			"ref": leaf(func(p interface{}) interface{} { return p.(SubjectRef).String() }),
+			"object": {typ: "Object", resolve: func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+				return p.(SubjectRef).Object, nil
+			}},
+			"relation": leaf(func(p interface{}) interface{} {
+				if rel := p.(SubjectRef).Relation; rel != "" {
+					return rel
+				}
+				return nil
+			}),
+		},
+		"Permission": {
+			"action":  leaf(func(p interface{}) interface{} { return p.(gqlPermission).action }),
+			"subject": leaf(func(p interface{}) interface{} { return p.(gqlPermission).subject.String() }),
+			"allowed": leaf(func(p interface{}) interface{} { return p.(gqlPermission).result.Allowed }),
+			"error": leaf(func(p interface{}) interface{} {
+				if msg := p.(gqlPermission).result.Error; msg != "" {
+					return msg
+				}
+				return nil
+			}),
+		},
+		"Policy": {
+			"id":   leaf(func(p interface{}) interface{} { return p.(EffectivePolicy).ID }),
+			"text": leaf(func(p interface{}) interface{} { return p.(EffectivePolicy).Policy.Text }),
+		},
+		"EffectivePolicy": {
+			"id":  leaf(func(p interface{}) interface{} { return p.(EffectivePolicy).ID }),
+			"via": leaf(func(p interface{}) interface{} { return string(p.(EffectivePolicy).Via) }),
+			"source": {typ: "Object", resolve: func(_ *gqlExec, p interface{}, _ map[string]interface{}) (interface{}, error) {
+				return p.(EffectivePolicy).Source, nil
+			}},
+			"depth": leaf(func(p interface{}) interface{} { return p.(EffectivePolicy).Depth }),
+			"text":  leaf(func(p interface{}) interface{} { return p.(EffectivePolicy).Policy.Text }),
+		},
+		"Role": {
+			"name":        leaf(func(p interface{}) interface{} { return p.(Role).Name }),
+			"permissions": leaf(func(p interface{}) interface{} { return p.(Role).Permissions }),
+			"description": leaf(func(p interface{}) interface{} {
+				if d := p.(Role).Description; d != "" {
+					return d
+				}
+				return nil
+			}),
+		},
+	}
+}
+
+// gqlExec is the state of one query
+type gqlExec struct {
+	ctx    context.Context
+	engine *Engine
+	me     *ObjectRef
+	vars   map[string]interface{}
+	errors []GraphQLError
+	checks int
+	// mayList, when set, says whether the caller may list tuples and objects
+	mayList func() error
+}
+
+// listing fails unless the caller may list tuples and objects, which can reveal as much
+// as an export
+func (x *gqlExec) listing() error {
+	if x.mayList == nil {
+		return nil
+	}
+	return x.mayList()
+}
+
+// permissions verifies each action for the subject, the caller by default, in one batch
+func (x *gqlExec) permissions(parent interface{}, args map[string]interface{}) (interface{}, error) {
+	resource := parent.(ObjectRef)
+	actions, err := gqlStringListArg(args, "actions")
+	if err != nil {
+		return nil, err
+	}
+	subjectArg, err := gqlStringArg(args, "subject", false)
+	if err != nil {
+		return nil, err
+	}
+	var subject ObjectRef
+	switch {
+	case subjectArg != "":
+		if subject, err = parseObjectRef(subjectArg); err != nil {
+			return nil, err
+		}
+	case x.me != nil:
+		subject = *x.me
+	default:
+		return nil, errors.New("permissions needs a subject when the caller is not authenticated")
+	}
+	attrs, err := gqlContextArg(args, "context")
+	if err != nil {
+		return nil, err
+	}
+	if x.checks += len(actions); x.checks > MaxGraphQLChecks {
+		return nil, fmt.Errorf("at most %d permission checks per query", MaxGraphQLChecks)
+	}
+	checks := make([]VerifyRequest, len(actions))
+	for i, action := range actions {
+		checks[i] = VerifyRequest{ResourceType: resource.Type, ResourceID: resource.ObjectID, SubjectType: subject.Type, SubjectID: subject.ObjectID, Action: action, Context: attrs}
+	}
+	results := verifyBatch(x.ctx, x.engine, checks)
+	out := make([]interface{}, len(results))
+	for i, r := range results {
+		out[i] = gqlPermission{action: actions[i], subject: subject, result: r}
+	}
+	return out, nil
+}
+
+func (x *gqlExec) fail(path []interface{}, err error) {
+	x.errors = append(x.errors, GraphQLError{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+// selectionSet resolves the selected fields of parent, a value of typ
+func (x *gqlExec) selectionSet(typ string, parent interface{}, sels ast.SelectionSet, path []interface{}) gqlObject {
+	fields, err := x.collect(typ, sels)
+	if err != nil {
+		x.fail(path, err)
+		return nil
+	}
+	out := make(gqlObject, 0, len(fields))
+	for _, f := range fields {
+		fieldPath := append(path[:len(path):len(path)], f.Alias)
+		out = append(out, gqlEntry{key: f.Alias, value: x.field(typ, parent, f, fieldPath)})
+	}
+	return out
+}
+
+// field resolves one selected field, null after an error. The query was validated, so
+// the field exists and has selections exactly when its type has fields.
+func (x *gqlExec) field(typ string, parent interface{}, f *ast.Field, path []interface{}) interface{} {
+	if f.Name == "__typename" {
+		return typ
+	}
+	def, ok := gqlResolvers[typ][f.Name]
+	if !ok {
+		// __schema and __type pass validation
+		x.fail(path, fmt.Errorf("type %s has no field %s", typ, f.Name))
+		return nil
+	}
+	if err := x.ctx.Err(); err != nil {
+		x.fail(path, err)
+		return nil
+	}
+	value, err := def.resolve(x, parent, f.ArgumentMap(x.vars))
+	if err != nil {
+		x.fail(path, err)
+		return nil
+	}
+	if def.typ == "" || value == nil {
+		return value
+	}
+	if list, ok := value.([]interface{}); ok {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = x.selectionSet(def.typ, item, f.SelectionSet, append(path[:len(path):len(path)], i))
+		}
+		return out
+	}
+	return x.selectionSet(def.typ, value, f.SelectionSet, path)
+}
+
+// collect flattens fragments and drops fields skipped by @skip or @include
+func (x *gqlExec) collect(typ string, sels ast.SelectionSet) ([]*ast.Field, error) {
+	var out []*ast.Field
+	for _, sel := range sels {
+		var directives ast.DirectiveList
+		var on string
+		var inner ast.SelectionSet
+		switch sel := sel.(type) {
+		case *ast.Field:
+			directives = sel.Directives
+		case *ast.InlineFragment:
+			directives, on, inner = sel.Directives, sel.TypeCondition, sel.SelectionSet
+		case *ast.FragmentSpread:
+			directives, on, inner = sel.Directives, sel.Definition.TypeCondition, sel.Definition.SelectionSet
+		}
+		include, err := x.included(directives)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+		if f, ok := sel.(*ast.Field); ok {
+			out = append(out, f)
+			continue
+		}
+		if on != "" && on != typ {
+			continue
+		}
+		fields, err := x.collect(typ, inner)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fields...)
+	}
+	return out, nil
+}
+
+func (x *gqlExec) included(directives ast.DirectiveList) (bool, error) {
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			continue
+		}
+		cond, ok := d.ArgumentMap(x.vars)["if"].(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a boolean if", d.Name)
+		}
+		if cond == (d.Name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func gqlStringArg(args map[string]interface{}, name string, required bool) (string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		if required {
+			return "", fmt.Errorf("argument %s is required", name)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %s must be a string", name)
+	}
+	return s, nil
+}
+
+func gqlStringListArg(args map[string]interface{}, name string) ([]string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return nil, fmt.Errorf("argument %s is required", name)
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		// a single value stands for a list of one, as in GraphQL input coercion
+		list = []interface{}{v}
+	}
+	out := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %s must be a list of strings", name)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func gqlContextArg(args map[string]interface{}, name string) (map[string]string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument %s must be an object of strings", name)
+	}
+	out := make(map[string]string, len(obj))
+	for k, item := range obj {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %s: %s must be a string", name, k)
+		}
+		out[k] = s
+	}
+	return out, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// graphQLEngine has a plan owned by alice and the eng group, which bob is in
+func graphQLEngine(t testing.TB) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	engine.CreateResource("group", "eng")
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->owner,read group:eng#member->read"))
+	require.NoError(t, engine.AddRelationQuery("group:eng user:bob->member"))
+	require.NoError(t, engine.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(plan, "p"))
+	return engine
+}
+
+func runGraphQL(t *testing.T, engine *Engine, query string, vars map[string]interface{}, me *ObjectRef) string {
+	resp, err := engine.GraphQL(context.Background(), GraphQLRequest{Query: query, Variables: vars}, me)
+	require.NoError(t, err)
+	out, err := json.Marshal(resp)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestGraphQL_OneRoundTrip(t *testing.T) {
+	engine := graphQLEngine(t)
+	out := runGraphQL(t, engine, `
+query Plan($doc: String!) {
+  object(ref: $doc) {
+    ref
+    owners: relations(relation: "owner") {
+      subject { ref object { groups: memberships(relation: "member") { object { ref } } } }
+    }
+    readers: relations(relation: "read") { ...subjectRef }
+    permissions(actions: ["read", "write"], context: {department: "eng"}) { action allowed }
+    policies { id via source { ref } }
+  }
+}
+fragment subjectRef on Tuple { subject { ref relation } }`, map[string]interface{}{"doc": "document:plan"}, &bob)
+
+	assert.JSONEq(t, `{"data": {"object": {
+		"ref": "document:plan",
+		"owners": [{"subject": {"ref": "user:alice", "object": {"groups": []}}}],
+		"readers": [
+			{"subject": {"ref": "group:eng#member", "relation": "member"}},
+			{"subject": {"ref": "user:alice", "relation": null}}
+		],
+		"permissions": [{"action": "read", "allowed": true}, {"action": "write", "allowed": false}],
+		"policies": [{"id": "p", "via": "direct", "source": {"ref": "document:plan"}}]
+	}}}`, out)
+
+	out = runGraphQL(t, engine, `{ object(ref: "user:bob") { memberships { ref } } me { id } }`, nil, &bob)
+	assert.JSONEq(t, `{"data": {"object": {"memberships": [{"ref": "group:eng#member@user:bob"}]}, "me": {"id": "bob"}}}`, out)
+}
+
+func TestGraphQL_Queries(t *testing.T) {
+	engine := graphQLEngine(t)
+	require.NoError(t, engine.DefineRole(Role{Name: "editor", Permissions: []string{"read", "write"}}))
+
+	out := runGraphQL(t, engine, `{ objects(type: "document") { ref exists } policy(id: "p") { text } missing: policy(id: "q") { id } roles { name permissions } }`, nil, nil)
+	assert.JSONEq(t, `{"data": {
+		"objects": [{"ref": "document:plan", "exists": true}],
+		"policy": {"text": "allow read if department == \"eng\""},
+		"missing": null,
+		"roles": [{"name": "editor", "permissions": ["read", "write"]}]
+	}}`, out)
+
+	// directives and inline fragments
+	out = runGraphQL(t, engine, `query($all: Boolean = false) { object(ref: "document:plan") { __typename ref @skip(if: true) ... on Object { id } relations @include(if: $all) { ref } } }`, nil, nil)
+	assert.JSONEq(t, `{"data": {"object": {"__typename": "Object", "id": "plan"}}}`, out)
+
+	// keys come back in the order they were selected
+	out = runGraphQL(t, engine, `{ object(ref: "document:plan") { type id } }`, nil, nil)
+	assert.Equal(t, `{"data":{"object":{"type":"document","id":"plan"}}}`, out)
+}
+
+func TestGraphQL_Errors(t *testing.T) {
+	engine := graphQLEngine(t)
+	for _, query := range []string{
+		``,
+		`{ object(ref: "document:plan") { ref }`,
+		`mutation { object(ref: "x:y") { ref } }`,
+		`query A { me { id } } query B { me { id } }`,
+		`query($doc: String!) { object(ref: $doc) { ref } }`,
+		`{ object(ref: "x") { "ref" } }`,
+		`{ object(ref: "document:plan") { ref nope } }`,
+		`{ object(ref: 5) { ref } }`,
+	} {
+		_, err := engine.GraphQL(context.Background(), GraphQLRequest{Query: query}, nil)
+		assert.Error(t, err, query)
+	}
+	_, err := engine.GraphQL(context.Background(), GraphQLRequest{Query: `{ object(ref: "document:plan") }`}, nil)
+	assert.ErrorContains(t, err, `Field "object" of type "Object!" must have a selection of subfields`)
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: `{ a: object(ref: "a:a") { ...f } } fragment f on Object { ...f }`}, nil)
+	assert.ErrorContains(t, err, `Cannot spread fragment "f" within itself`)
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: `query($n: String!) { object(ref: $n) { ref } }`, Variables: map[string]interface{}{"n": 5}}, nil)
+	assert.ErrorContains(t, err, "variable.n cannot use int as String")
+
+	// field errors null the field and leave the rest
+	out := runGraphQL(t, engine, `{ plan: object(ref: "document:plan") { ref permissions(actions: "read") { allowed } } bad: object(ref: "plan") { ref } }`, nil, nil)
+	assert.JSONEq(t, `{
+		"data": {"plan": {"ref": "document:plan", "permissions": null}, "bad": null},
+		"errors": [
+			{"message": "permissions needs a subject when the caller is not authenticated", "path": ["plan", "permissions"]},
+			{"message": "object must be in the form type:id", "path": ["bad"]}
+		]
+	}`, out)
+	out = runGraphQL(t, engine, `{ object(ref: "document:plan") { permissions(actions: ["read"], subject: "user:bob", context: 5) { allowed } } }`, nil, nil)
+	assert.Contains(t, out, "argument context must be an object of strings")
+	out = runGraphQL(t, engine, `{ __schema { types { name } } }`, nil, nil)
+	assert.Contains(t, out, "type Query has no field __schema")
+
+	deep := `{ object(ref: "user:bob") ` + strings.Repeat("{ memberships { object ", MaxGraphQLDepth/2) + "{ ref }" + strings.Repeat(" } }", MaxGraphQLDepth/2) + " }"
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: deep}, nil)
+	assert.ErrorContains(t, err, "query nests deeper than")
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: strings.Repeat("{ a ", 100000)}, nil)
+	assert.ErrorContains(t, err, "exceeded token limit")
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: `{ object(ref: ` + strings.Repeat("[", 100000) + `) { ref } }`}, nil)
+	assert.ErrorContains(t, err, "exceeded token limit")
+
+	wide := "{ " + strings.Repeat("me { id } ", MaxGraphQLSelections) + "}"
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: wide}, nil)
+	assert.ErrorContains(t, err, "query selects more than")
+	// each fragment spreads the next twice, 2^30 fields once expanded
+	var bomb strings.Builder
+	bomb.WriteString("{ me { ...f0 } }")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&bomb, " fragment f%d on Object { ...f%d ...f%d }", i, i+1, i+1)
+	}
+	bomb.WriteString(" fragment f30 on Object { id }")
+	_, err = engine.GraphQL(context.Background(), GraphQLRequest{Query: bomb.String()}, nil)
+	assert.ErrorContains(t, err, "query selects more than")
+}
+
+func FuzzGraphQL(f *testing.F) {
+	for _, seed := range []string{
+		`{ me { id } }`,
+		`query Q($ref: String! = "document:plan") { object(ref: $ref) { relations(relation: "read") { subject { ref } } } }`,
+		`{ object(ref: "document:plan") { ...f @skip(if: false) ... on Object { id } } } fragment f on Object { ref }`,
+		`{ object(ref: "x:y") { permissions(actions: ["read", "write"], context: {department: "eng"}) { allowed } } }`,
+		`{ a: me { id } } # comment`,
+	} {
+		f.Add(seed)
+	}
+	engine := graphQLEngine(f)
+	f.Fuzz(func(t *testing.T, query string) {
+		// whatever validates runs, anything else fails as a whole, without panicking
+		resp, err := engine.GraphQL(context.Background(), GraphQLRequest{Query: query}, &bob)
+		if err == nil {
+			require.NotNil(t, resp.Data)
+		}
+	})
+}
+
+func TestService_GraphQL(t *testing.T) {
+	engine := graphQLEngine(t)
+	service := NewService(engine)
+	service.Auth = NewAPIKeyAuthenticator(map[string]ObjectRef{"bob-key": bob})
+	e := service.Echo()
+
+	query := `{ object(ref: "document:plan") { permissions(actions: ["read"], context: {department: "eng"}) { subject allowed } } }`
+	payload, err := json.Marshal(GraphQLRequest{Query: query})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(APIKeyHeader, "bob-key")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"data": {"object": {"permissions": [{"subject": "user:bob", "allowed": true}]}}}`, rec.Body.String(),
+		"permissions are checked for the caller")
+
+	get := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/graphql?"+params.Encode(), nil)
+		req.Header.Set(APIKeyHeader, "bob-key")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = get(url.Values{"query": {`query($ref: String!) { object(ref: $ref) { id } }`}, "variables": {`{"ref": "group:eng"}`}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"data": {"object": {"id": "eng"}}}`, rec.Body.String())
+
+	rec = get(url.Values{"query": {`{ object`}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"errors": [{"message": "query:1:9: Expected Name, found <EOF>"}]}`, rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, get(url.Values{"query": {`{ me { id } }`}, "variables": {"{"}}).Code)
+
+	rec = get(nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "no query")
+	req = httptest.NewRequest(http.MethodGet, "/graphql/schema", nil)
+	req.Header.Set(APIKeyHeader, "bob-key")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), "type Query {")
+}
+
+func TestService_GraphQLListingNeedsExport(t *testing.T) {
+	service := NewService(graphQLEngine(t))
+	service.Auth = NewAPIKeyAuthenticator(map[string]ObjectRef{"bob-key": bob})
+	service.Admin = NewAdminEngine(ObjectRef{Type: "user", ObjectID: "root"})
+	e := service.Echo()
+	post := func(query string) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(GraphQLRequest{Query: query})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, "bob-key")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec
+	}
+
+	rec := post(`{ object(ref: "document:plan") { permissions(actions: ["read"], context: {department: "eng"}) { allowed } } }`)
+	assert.JSONEq(t, `{"data": {"object": {"permissions": [{"allowed": true}]}}}`, rec.Body.String(),
+		"checks need no export")
+
+	listing := `{ objects(type: "group") { ref } object(ref: "document:plan") { relations(relation: "owner") { subject { ref } } memberships { ref } } }`
+	rec = post(listing)
+	assert.JSONEq(t, `{"data": {"objects": null, "object": {"relations": null, "memberships": null}}, "errors": [
+		{"message": "user:bob lacks export", "path": ["objects"]},
+		{"message": "user:bob lacks export", "path": ["object", "relations"]},
+		{"message": "user:bob lacks export", "path": ["object", "memberships"]}]}`, rec.Body.String())
+
+	require.NoError(t, service.Admin.AddRelation(AdminObject, string(PermExport), SubjectRef{Object: bob}))
+	rec = post(listing)
+	assert.JSONEq(t, `{"data": {"objects": [{"ref": "group:eng"}], "object": {"relations": [{"subject": {"ref": "user:alice"}}], "memberships": []}}}`,
+		rec.Body.String())
+}
+
+func TestGraphQLSchema_MatchesResolvers(t *testing.T) {
+	for typ, fields := range gqlResolvers {
+		def := gqlSchema.Types[typ]
+		require.NotNil(t, def, typ)
+		for name := range fields {
+			assert.NotNil(t, def.Fields.ForName(name), "%s.%s", typ, name)
+		}
+		for _, f := range def.Fields {
+			if !strings.HasPrefix(f.Name, "__") {
+				assert.Contains(t, fields, f.Name, "%s.%s has no resolver", typ, f.Name)
+			}
+		}
+	}
+}
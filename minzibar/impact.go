@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DecisionFlip is a sampled request whose outcome changes under a draft policy
+type DecisionFlip struct {
+	Resource ObjectRef         `json:"resource"`
+	Subject  ObjectRef         `json:"subject"`
+	Action   string            `json:"action"`
+	Context  map[string]string `json:"context,omitempty"`
+	Before   bool              `json:"before"`
+	After    bool              `json:"after"`
+}
+
+// DecisionError is a sampled request that could not be replayed, for instance because
+// its graph walk ran out of depth
+type DecisionError struct {
+	Resource ObjectRef         `json:"resource"`
+	Subject  ObjectRef         `json:"subject"`
+	Action   string            `json:"action"`
+	Context  map[string]string `json:"context,omitempty"`
+	Error    string            `json:"error"`
+}
+
+// MaxImpactDecisions bounds the sample one PolicyImpact call replays, the size of the
+// default decision log
+const MaxImpactDecisions = defaultDecisionLogSize
+
+// PolicyImpact is the result of replaying a decision sample against a draft policy
+type PolicyImpact struct {
+	PolicyID    string         `json:"policy_id"`
+	Evaluated   int            `json:"evaluated"`
+	AllowToDeny int            `json:"allow_to_deny"`
+	DenyToAllow int            `json:"deny_to_allow"`
+	Flips       []DecisionFlip `json:"flips"`
+	// Errors lists the requests that were not evaluated, they count in neither direction
+	Errors []DecisionError `json:"errors,omitempty"`
+}
+
+// PolicyImpact replays sample against the current policies and again with policyID
+// replaced by newText, reporting every request whose decision flips. Both runs use
+// the current graph so only the policy change shows up. A nil sample uses the
+// engine's decision log. A request that fails to replay is listed in Errors; ctx bounds
+// the whole replay and its error is returned once it ends. Nothing is modified.
+func (e *Engine) PolicyImpact(ctx context.Context, policyID, newText string, sample []Decision) (*PolicyImpact, error) {
+	draft, err := ParsePolicies(newText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	if sample == nil && e.decisions != nil {
+		sample = e.decisions.Snapshot()
+	}
+	if len(sample) > MaxImpactDecisions {
+		return nil, fmt.Errorf("at most %d decisions can be replayed", MaxImpactDecisions)
+	}
+	impact := &PolicyImpact{PolicyID: policyID, Flips: []DecisionFlip{}}
+	overrides := map[string]*Policy{policyID: draft}
+	seen := make(map[string]struct{}, len(sample))
+	for _, d := range sample {
+		// the same request is usually logged many times, replay it once
+		key := decisionKey(d)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		before, err := e.verify(d.Resource, d.Subject, d.Action, copyContext(d.Context), verifyOptions{reqCtx: ctx})
+		var after bool
+		if err == nil {
+			after, err = e.verify(d.Resource, d.Subject, d.Action, copyContext(d.Context), verifyOptions{overrides: overrides, reqCtx: ctx})
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			impact.Errors = append(impact.Errors, DecisionError{
+				Resource: d.Resource,
+				Subject:  d.Subject,
+				Action:   d.Action,
+				Context:  d.Context,
+				Error:    err.Error(),
+			})
+			continue
+		}
+		impact.Evaluated++
+		if before == after {
+			continue
+		}
+		if before {
+			impact.AllowToDeny++
+		} else {
+			impact.DenyToAllow++
+		}
+		impact.Flips = append(impact.Flips, DecisionFlip{
+			Resource: d.Resource,
+			Subject:  d.Subject,
+			Action:   d.Action,
+			Context:  d.Context,
+			Before:   before,
+			After:    after,
+		})
+	}
+	return impact, nil
+}
+
+// decisionKey identifies a request independent of when or how often it was made
+func decisionKey(d Decision) string {
+	keys := make([]string, 0, len(d.Context))
+	for k := range d.Context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(d.Resource.String())
+	b.WriteByte('|')
+	b.WriteString(d.Subject.String())
+	b.WriteByte('|')
+	b.WriteString(d.Action)
+	for _, k := range keys {
+		b.WriteByte('|')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(d.Context[k])
+	}
+	return b.String()
+}
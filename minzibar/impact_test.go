@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newImpactEngine(t *testing.T) *Engine {
+	t.Helper()
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	doc := engine.CreateResource("document", "plan")
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read user:bob->read"))
+	require.NoError(t, engine.AddPolicy("p_read", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(doc, "p_read"))
+	return engine
+}
+
+func TestEngine_PolicyImpact_FromDecisionLog(t *testing.T) {
+	engine := newImpactEngine(t)
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	alice := ObjectRef{Type: "user", ObjectID: "alice"}
+	bob := ObjectRef{Type: "user", ObjectID: "bob"}
+
+	for i := 0; i < 3; i++ {
+		allowed, err := engine.Verify(doc, alice, "read", map[string]string{"department": "eng"})
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+	allowed, err := engine.Verify(doc, bob, "read", map[string]string{"department": "sales"})
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	impact, err := engine.PolicyImpact(context.Background(), "p_read", `allow read if department == "sales"`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, impact.Evaluated, "repeated requests are replayed once")
+	assert.Equal(t, 1, impact.AllowToDeny)
+	assert.Equal(t, 1, impact.DenyToAllow)
+	require.Len(t, impact.Flips, 2)
+	assert.Equal(t, alice, impact.Flips[0].Subject)
+	assert.True(t, impact.Flips[0].Before)
+	assert.False(t, impact.Flips[0].After)
+	assert.Equal(t, map[string]string{"department": "eng"}, impact.Flips[0].Context, "logged context excludes injected keys")
+
+	// the dry run must not touch the registered policy
+	allowed, err = engine.Verify(doc, alice, "read", map[string]string{"department": "eng"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	_, err = engine.PolicyImpact(context.Background(), "p_read", "permit everything", nil)
+	assert.Error(t, err)
+}
+
+func TestEngine_PolicyImpact_ErrorsPerDecision(t *testing.T) {
+	engine := telemetryEngine(t)
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	eng := map[string]string{"department": "eng"}
+	sample := []Decision{
+		// alice reaches the document through three groups, bob holds it directly
+		{Resource: doc, Subject: ObjectRef{Type: "user", ObjectID: "alice"}, Action: "viewer", Context: eng},
+		{Resource: doc, Subject: ObjectRef{Type: "user", ObjectID: "bob"}, Action: "viewer", Context: eng},
+	}
+	engine.graph.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}})
+	engine.SetCheckOptions(CheckOptions{MaxDepth: 1})
+
+	impact, err := engine.PolicyImpact(context.Background(), "p_view", `allow viewer if department == "sales"`, sample)
+	require.NoError(t, err)
+	assert.Equal(t, 1, impact.Evaluated)
+	assert.Equal(t, 1, impact.AllowToDeny)
+	require.Len(t, impact.Errors, 1)
+	assert.Equal(t, "alice", impact.Errors[0].Subject.ObjectID)
+	assert.Contains(t, impact.Errors[0].Error, ErrMaxDepthExceeded.Error())
+	assert.Equal(t, eng, impact.Errors[0].Context)
+
+	// an ended ctx fails the replay rather than every decision
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = engine.PolicyImpact(ctx, "p_view", `allow viewer if department == "sales"`, sample)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = engine.PolicyImpact(context.Background(), "p_view", `allow viewer if department == "sales"`, make([]Decision, MaxImpactDecisions+1))
+	assert.ErrorContains(t, err, "at most")
+}
+
+func TestDecisionLog_Wraps(t *testing.T) {
+	log := NewDecisionLog(3)
+	for _, action := range []string{"a", "b", "c", "d"} {
+		log.Record(Decision{Action: action})
+	}
+	var actions []string
+	for _, d := range log.Snapshot() {
+		actions = append(actions, d.Action)
+		assert.False(t, d.Time.IsZero())
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, actions)
+}
+
+func TestService_PolicyDiff(t *testing.T) {
+	service := NewService(newImpactEngine(t))
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"policy_text": `allow read if department == "eng" or department == "sales"`,
+		"decisions": []map[string]interface{}{
+			{
+				"resource": map[string]string{"Type": "document", "ObjectID": "plan"},
+				"subject":  map[string]string{"Type": "user", "ObjectID": "bob"},
+				"action":   "read",
+				"context":  map[string]string{"department": "sales"},
+			},
+		},
+	})
+	resp, err := http.Post(srv.URL+"/policy/p_read/diff", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var impact PolicyImpact
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&impact))
+	assert.Equal(t, "p_read", impact.PolicyID)
+	assert.Equal(t, 1, impact.Evaluated)
+	assert.Equal(t, 1, impact.DenyToAllow)
+
+	body, _ = json.Marshal(PolicyDiffRequest{PolicyText: `allow read if department == "sales"`, Decisions: make([]Decision, MaxImpactDecisions+1)})
+	resp, err = http.Post(srv.URL+"/policy/p_read/diff", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var msg map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&msg))
+	assert.Contains(t, msg["error"], "at most")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// TypeWildcard as an object id stands for every object of a type, e.g. document:*
+	TypeWildcard = "*"
+	// RelationParent links a child object to the object it inherits policies from,
+	// e.g. document:spec#parent@folder:eng
+	RelationParent = "parent"
+
+	relationHasPolicy = "has_policy"
+	// maxParentDepth stops runaway parent chains, cycles are caught separately
+	maxParentDepth = 32
+)
+
+// PolicyVia says how a policy reaches a resource
+type PolicyVia string
+
+const (
+	PolicyViaDirect PolicyVia = "direct" // attached to the resource itself
+	PolicyViaType   PolicyVia = "type"   // attached to every object of the resource's type
+	PolicyViaParent PolicyVia = "parent" // attached to an ancestor or an ancestor's type
+)
+
+// EffectivePolicy is a policy that applies to a resource and where it came from
+type EffectivePolicy struct {
+	ID     string    `json:"policy_id"`
+	Policy *Policy   `json:"-"`
+	Via    PolicyVia `json:"via"`
+	// Source is the object the policy is attached to, type:* for type level attachments
+	Source ObjectRef `json:"source"`
+	// Depth is the number of parent hops from the resource to Source's object
+	Depth int `json:"depth"`
+}
+
+// AddPolicyToType attaches a policy to every object of resourceType, present and future
+func (e *Engine) AddPolicyToType(resourceType, policyID string) error {
+	if resourceType == "" {
+		return fmt.Errorf("resource type is empty")
+	}
+	return e.writeTuple(RelationTuple{
+		Object:   ObjectRef{Type: resourceType, ObjectID: TypeWildcard},
+		Relation: relationHasPolicy,
+		Subject:  SubjectRef{Object: ObjectRef{Type: "policy", ObjectID: policyID}},
+	})
+}
+
+// DeletePolicyFromType detaches a type level policy
+func (e *Engine) DeletePolicyFromType(resourceType, policyID string) error {
+	return e.DeletePolicy(ObjectRef{Type: resourceType, ObjectID: TypeWildcard}, policyID)
+}
+
+// SetParent makes child inherit the policies of parent
+func (e *Engine) SetParent(child, parent ObjectRef) error {
+	if child == parent {
+		return fmt.Errorf("%s cannot be its own parent", child)
+	}
+	return e.AddRelation(child, RelationParent, SubjectRef{Object: parent})
+}
+
+// GetEffectivePolicies returns the policies that apply to resource with their provenance.
+// Order is nearest first: the resource, its type, then each parent level and its types.
+// A policy reachable several ways is listed once, at its nearest source.
+func (e *Engine) GetEffectivePolicies(resource ObjectRef) []EffectivePolicy {
+	return e.effectivePolicies(resource, nil)
+}
+
+// effectivepolicies walks the parent chain breadth first collecting attached policies.
+// overrides replace registered policies by id, which lets impact analysis try a draft.
+func (e *Engine) effectivePolicies(resource ObjectRef, overrides map[string]*Policy) []EffectivePolicy {
+	var result []EffectivePolicy
+	seenPolicy := make(map[string]struct{})
+	seenObject := map[ObjectRef]struct{}{resource: {}}
+	seenType := make(map[string]struct{})
+
+	collect := func(source ObjectRef, via PolicyVia, depth int) {
+		var ids []string
+		for _, t := range e.graph.ReadTuples(source, relationHasPolicy) {
+			ids = append(ids, t.Subject.Object.ObjectID)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if _, ok := seenPolicy[id]; ok {
+				continue
+			}
+			p, ok := overrides[id]
+			if !ok {
+				p, ok = e.policy(id)
+			}
+			if !ok {
+				// attached but never registered, nothing to evaluate
+				continue
+			}
+			seenPolicy[id] = struct{}{}
+			result = append(result, EffectivePolicy{ID: id, Policy: p, Via: via, Source: source, Depth: depth})
+		}
+	}
+
+	level := []ObjectRef{resource}
+	for depth := 0; len(level) > 0 && depth <= maxParentDepth; depth++ {
+		var next []ObjectRef
+		for _, obj := range level {
+			directVia, typeVia := PolicyViaParent, PolicyViaParent
+			if depth == 0 {
+				directVia, typeVia = PolicyViaDirect, PolicyViaType
+			}
+			collect(obj, directVia, depth)
+			if _, ok := seenType[obj.Type]; !ok {
+				seenType[obj.Type] = struct{}{}
+				collect(ObjectRef{Type: obj.Type, ObjectID: TypeWildcard}, typeVia, depth)
+			}
+			parents := e.graph.GetSubjects(obj, RelationParent)
+			sort.Slice(parents, func(i, j int) bool { return parents[i].String() < parents[j].String() })
+			for _, p := range parents {
+				if _, ok := seenObject[p.Object]; ok {
+					continue
+				}
+				seenObject[p.Object] = struct{}{}
+				next = append(next, p.Object)
+			}
+		}
+		level = next
+	}
+	return result
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_EffectivePolicies(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	for id, text := range map[string]string{
+		"p_doc":     `allow read if subject == "alice"`,
+		"p_company": `allow read if department == "eng"`,
+		"p_folder":  `allow * if role == "folder-admin"`,
+		"p_root":    `allow * if role == "root-admin"`,
+	} {
+		require.NoError(t, engine.AddPolicy(id, text))
+	}
+	doc := engine.CreateResource("document", "spec")
+	folder := engine.CreateResource("folder", "eng")
+	root := engine.CreateResource("folder", "root")
+	require.NoError(t, engine.SetParent(doc, folder))
+	require.NoError(t, engine.SetParent(folder, root))
+	require.NoError(t, engine.SetParent(root, doc), "cycles are tolerated")
+
+	require.NoError(t, engine.AddPolicyToResource(doc, "p_doc"))
+	require.NoError(t, engine.AddPolicyToResource(ObjectRef{Type: "document", ObjectID: TypeWildcard}, "p_company"))
+	require.NoError(t, engine.AddPolicyToResource(folder, "p_folder"))
+	require.NoError(t, engine.AddPolicyToResource(root, "p_root"))
+	// also reachable directly on doc, must only be listed once
+	require.NoError(t, engine.AddPolicyToResource(root, "p_doc"))
+
+	effective := engine.GetEffectivePolicies(doc)
+	type row struct {
+		ID     string
+		Via    PolicyVia
+		Source string
+		Depth  int
+	}
+	var got []row
+	for _, ep := range effective {
+		got = append(got, row{ep.ID, ep.Via, ep.Source.String(), ep.Depth})
+	}
+	assert.Equal(t, []row{
+		{"p_doc", PolicyViaDirect, "document:spec", 0},
+		{"p_company", PolicyViaType, "document:*", 0},
+		{"p_folder", PolicyViaParent, "folder:eng", 1},
+		{"p_root", PolicyViaParent, "folder:root", 2},
+	}, got)
+
+	policies, err := engine.GetPolicies(doc)
+	require.NoError(t, err)
+	assert.Len(t, policies, 4)
+
+	// a document without any direct attachment still gets the type policy
+	other := engine.CreateResource("document", "other")
+	require.NoError(t, engine.AddRelationQuery("document:other user:bob->read"))
+	allowed, err := engine.Verify(other, ObjectRef{Type: "user", ObjectID: "bob"}, "read", map[string]string{"department": "eng"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// inherited wildcard rule from the root folder
+	allowed, trace, err := engine.VerifyTrace(doc, ObjectRef{Type: "user", ObjectID: "carol"}, "delete", map[string]string{"role": "root-admin"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Contains(t, trace, "policy p_root applies via parent folder:root")
+
+	require.NoError(t, engine.DeletePolicyFromType("document", "p_company"))
+	allowed, err = engine.Verify(other, ObjectRef{Type: "user", ObjectID: "bob"}, "read", map[string]string{"department": "eng"})
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	assert.Error(t, engine.SetParent(doc, doc))
+}
+
+func TestService_EffectivePolicies(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	require.NoError(t, engine.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToType("document", "p"))
+	srv := httptest.NewServer(NewService(engine).Echo())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/policies?resource=document:x")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var got []EffectivePolicy
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "p", got[0].ID)
+	assert.Equal(t, PolicyViaType, got[0].Via)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// internTable maps strings to dense uint32 ids so the graph indexes store small
+// integers instead of repeated copies of type names, object ids and relations.
+// Ids are never reused or freed: strings of deleted tuples stay interned.
+// Id 0 is always the empty string, which marks a concrete (non userset) subject.
+type internTable struct {
+	ids  sync.Map // string -> uint32, lock free on the read path
+	mu   sync.Mutex
+	strs atomic.Pointer[[]string] // id -> string, append only
+}
+
+func newInternTable() *internTable {
+	t := &internTable{}
+	strs := []string{""}
+	t.strs.Store(&strs)
+	t.ids.Store("", uint32(0))
+	return t
+}
+
+// intern returns the id for s, assigning a new one if needed
+func (t *internTable) intern(s string) uint32 {
+	if id, ok := t.lookup(s); ok {
+		return id
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.lookup(s); ok {
+		return id
+	}
+	cur := *t.strs.Load()
+	id := uint32(len(cur))
+	// readers holding the old header never index past its length, so appending
+	// in place is safe; the new header is published atomically
+	next := append(cur, s)
+	t.strs.Store(&next)
+	t.ids.Store(s, id)
+	return id
+}
+
+// lookup returns the id for s without assigning one
+func (t *internTable) lookup(s string) (uint32, bool) {
+	if s == "" {
+		return 0, true
+	}
+	v, ok := t.ids.Load(s)
+	if !ok {
+		return 0, false
+	}
+	return v.(uint32), true
+}
+
+// str returns the string for an id handed out by intern
+func (t *internTable) str(id uint32) string {
+	return (*t.strs.Load())[id]
+}
+
+// len returns how many strings are interned
+func (t *internTable) len() int {
+	return len(*t.strs.Load())
+}
+
+// nodeID is an interned ObjectRef
+type nodeID struct {
+	typ uint32
+	id  uint32
+}
+
+// subjectKey is an interned SubjectRef, rel is 0 for concrete subjects
+type subjectKey struct {
+	node nodeID
+	rel  uint32
+}
+
+// smallSetMax is the size at which a compactSet switches from a slice to a map.
+// Most (object, relation) pairs have only a handful of subjects, and a short
+// slice costs a fraction of even an empty map.
+const smallSetMax = 16
+
+// compactSet is a set that is a slice while small and a map once it grows
+type compactSet[K comparable] struct {
+	small []K
+	large map[K]struct{}
+}
+
+func (s *compactSet[K]) has(k K) bool {
+	if s.large != nil {
+		_, ok := s.large[k]
+		return ok
+	}
+	for _, v := range s.small {
+		if v == k {
+			return true
+		}
+	}
+	return false
+}
+
+// add inserts k and reports whether it was new
+func (s *compactSet[K]) add(k K) bool {
+	if s.has(k) {
+		return false
+	}
+	if s.large != nil {
+		s.large[k] = struct{}{}
+		return true
+	}
+	if len(s.small) < smallSetMax {
+		s.small = append(s.small, k)
+		return true
+	}
+	s.large = make(map[K]struct{}, 2*smallSetMax)
+	for _, v := range s.small {
+		s.large[v] = struct{}{}
+	}
+	s.large[k] = struct{}{}
+	s.small = nil
+	return true
+}
+
+// remove deletes k and reports whether it was present
+func (s *compactSet[K]) remove(k K) bool {
+	if s.large != nil {
+		if _, ok := s.large[k]; !ok {
+			return false
+		}
+		delete(s.large, k)
+		return true
+	}
+	for i, v := range s.small {
+		if v == k {
+			last := len(s.small) - 1
+			s.small[i] = s.small[last]
+			s.small = s.small[:last]
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compactSet[K]) len() int {
+	if s.large != nil {
+		return len(s.large)
+	}
+	return len(s.small)
+}
+
+// each calls fn for every member until fn returns false
+func (s *compactSet[K]) each(fn func(K) bool) {
+	if s.large != nil {
+		for k := range s.large {
+			if !fn(k) {
+				return
+			}
+		}
+		return
+	}
+	for _, k := range s.small {
+		if !fn(k) {
+			return
+		}
+	}
+}
+
+// relationSet is the members reachable from one node through one relation
+type relationSet[K comparable] struct {
+	rel     uint32
+	members compactSet[K]
+}
+
+// adjacency holds all relations of one node; few nodes have many relations so a
+// slice with a linear scan beats a map
+type adjacency[K comparable] struct {
+	relations []relationSet[K]
+}
+
+// get returns the set for rel or nil
+func (a *adjacency[K]) get(rel uint32) *compactSet[K] {
+	for i := range a.relations {
+		if a.relations[i].rel == rel {
+			return &a.relations[i].members
+		}
+	}
+	return nil
+}
+
+// getOrCreate returns the set for rel, adding an empty one if needed
+func (a *adjacency[K]) getOrCreate(rel uint32) *compactSet[K] {
+	if s := a.get(rel); s != nil {
+		return s
+	}
+	a.relations = append(a.relations, relationSet[K]{rel: rel})
+	return &a.relations[len(a.relations)-1].members
+}
+
+// removeMember deletes k from rel, dropping the relation once empty
+func (a *adjacency[K]) removeMember(rel uint32, k K) bool {
+	for i := range a.relations {
+		if a.relations[i].rel != rel {
+			continue
+		}
+		if !a.relations[i].members.remove(k) {
+			return false
+		}
+		if a.relations[i].members.len() == 0 {
+			last := len(a.relations) - 1
+			a.relations[i] = a.relations[last]
+			a.relations = a.relations[:last]
+		}
+		return true
+	}
+	return false
+}
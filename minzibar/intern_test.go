@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternTable(t *testing.T) {
+	tbl := newInternTable()
+	id, ok := tbl.lookup("")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), id, "empty string is always id 0")
+
+	_, ok = tbl.lookup("document")
+	assert.False(t, ok, "lookup never assigns")
+
+	doc := tbl.intern("document")
+	assert.Equal(t, doc, tbl.intern("document"))
+	assert.Equal(t, "document", tbl.str(doc))
+	assert.Equal(t, 2, tbl.len())
+
+	var wg sync.WaitGroup
+	ids := make([][]uint32, 4)
+	for w := range ids {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				ids[w] = append(ids[w], tbl.intern("s"+strconv.Itoa(i)))
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 1; w < len(ids); w++ {
+		assert.Equal(t, ids[0], ids[w], "concurrent interning hands out one id per string")
+	}
+	for i, id := range ids[0] {
+		assert.Equal(t, "s"+strconv.Itoa(i), tbl.str(id))
+	}
+}
+
+func TestCompactSet_GrowsAndShrinks(t *testing.T) {
+	var s compactSet[uint32]
+	for i := uint32(0); i < smallSetMax; i++ {
+		assert.True(t, s.add(i))
+	}
+	assert.Nil(t, s.large, "stays a slice up to smallSetMax")
+	assert.False(t, s.add(3))
+
+	assert.True(t, s.add(smallSetMax))
+	assert.NotNil(t, s.large, "switches to a map past smallSetMax")
+	assert.Equal(t, smallSetMax+1, s.len())
+	for i := uint32(0); i <= smallSetMax; i++ {
+		assert.True(t, s.has(i))
+	}
+
+	assert.True(t, s.remove(0))
+	assert.False(t, s.remove(0))
+	assert.False(t, s.has(0))
+
+	seen := 0
+	s.each(func(uint32) bool { seen++; return seen < 5 })
+	assert.Equal(t, 5, seen, "each stops when fn returns false")
+}
+
+func TestAdjacency_RemoveMemberDropsEmptyRelations(t *testing.T) {
+	var a adjacency[uint32]
+	a.getOrCreate(1).add(10)
+	a.getOrCreate(2).add(20)
+	assert.Len(t, a.relations, 2)
+
+	assert.False(t, a.removeMember(1, 99))
+	assert.True(t, a.removeMember(1, 10))
+	assert.Nil(t, a.get(1))
+	assert.Len(t, a.relations, 1)
+	assert.True(t, a.get(2).has(20))
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"os"
 )
 
 func main() {
-	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
-	service := NewService(engine)
-	if err := service.Run(":8080"); err != nil {
-		log.Fatalf("server error: %v", err)
+	err := runCLI(os.Args[1:], os.Stdin, os.Stdout)
+	if errors.Is(err, errDenied) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "minzibar: %v\n", err)
+		os.Exit(1)
 	}
 }
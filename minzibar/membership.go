@@ -0,0 +1,339 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// membershipIndexes is the optional Leopard-style index of nested group membership.
+// For every indexed relation r (usually "member") it keeps the transitive closure of
+// g#r@h#r edges, so "is user u in group g" becomes: is any group u is directly in
+// g itself or one of g's descendants. The user's direct groups come from subjectIndex.
+// The indexes are updated by Write and Delete while they hold the tuple's shard locks;
+// lock order is shards first, then mu.
+type membershipIndexes struct {
+	mu    sync.RWMutex
+	byRel map[uint32]*membershipIndex // fixed once the indexes are published
+}
+
+// membershipIndex is the closure for one relation
+type membershipIndex struct {
+	rel uint32
+	// children holds the direct g#rel@h#rel edges, desc and anc their transitive closure
+	// in both directions, never containing the node itself
+	children map[nodeID]*compactSet[nodeID]
+	desc     map[nodeID]*compactSet[nodeID]
+	anc      map[nodeID]*compactSet[nodeID]
+	// escapes counts usersets of other relations under g#rel, e.g. group:x#member@team:y#lead;
+	// the index cannot answer through those, so checks walk them
+	escapes map[nodeID]int
+	// changedAt is the revision of the last change; a check reading at an older revision
+	// cannot use the index and walks instead
+	changedAt uint64
+}
+
+func newMembershipIndex(rel uint32) *membershipIndex {
+	return &membershipIndex{
+		rel:      rel,
+		children: make(map[nodeID]*compactSet[nodeID]),
+		desc:     make(map[nodeID]*compactSet[nodeID]),
+		anc:      make(map[nodeID]*compactSet[nodeID]),
+		escapes:  make(map[nodeID]int),
+	}
+}
+
+// contains reports whether h is g or nested anywhere below it
+func (mi *membershipIndex) contains(g, h nodeID) bool {
+	if g == h {
+		return true
+	}
+	d := mi.desc[g]
+	return d != nil && d.has(h)
+}
+
+func setFor(m map[nodeID]*compactSet[nodeID], n nodeID) *compactSet[nodeID] {
+	s := m[n]
+	if s == nil {
+		s = &compactSet[nodeID]{}
+		m[n] = s
+	}
+	return s
+}
+
+func removeFrom(m map[nodeID]*compactSet[nodeID], n, k nodeID) {
+	if s := m[n]; s != nil {
+		s.remove(k)
+		if s.len() == 0 {
+			delete(m, n)
+		}
+	}
+}
+
+// write records a new tuple g#rel@subject
+func (mi *membershipIndex) write(g nodeID, subject subjectKey) {
+	switch subject.rel {
+	case 0:
+		// concrete members are found through subjectIndex
+	case mi.rel:
+		mi.addEdge(g, subject.node)
+	default:
+		mi.escapes[g]++
+	}
+}
+
+// delete forgets a removed tuple g#rel@subject
+func (mi *membershipIndex) delete(g nodeID, subject subjectKey) {
+	switch subject.rel {
+	case 0:
+	case mi.rel:
+		mi.removeEdge(g, subject.node)
+	default:
+		mi.escapes[g]--
+		if mi.escapes[g] <= 0 {
+			delete(mi.escapes, g)
+		}
+	}
+}
+
+// addEdge makes h and everything below it a descendant of g and of everything above g
+func (mi *membershipIndex) addEdge(g, h nodeID) {
+	if !setFor(mi.children, g).add(h) {
+		return
+	}
+	ups := []nodeID{g}
+	if a := mi.anc[g]; a != nil {
+		a.each(func(n nodeID) bool { ups = append(ups, n); return true })
+	}
+	downs := []nodeID{h}
+	if d := mi.desc[h]; d != nil {
+		d.each(func(n nodeID) bool { downs = append(downs, n); return true })
+	}
+	for _, a := range ups {
+		for _, d := range downs {
+			if a == d {
+				continue
+			}
+			setFor(mi.desc, a).add(d)
+			setFor(mi.anc, d).add(a)
+		}
+	}
+}
+
+// removeEdge drops g -> h and recomputes the descendants of g and everything above it,
+// since another path may still connect them
+func (mi *membershipIndex) removeEdge(g, h nodeID) {
+	removeFrom(mi.children, g, h)
+	affected := []nodeID{g}
+	if a := mi.anc[g]; a != nil {
+		a.each(func(n nodeID) bool { affected = append(affected, n); return true })
+	}
+	for _, a := range affected {
+		reachable := mi.reachable(a)
+		if old := mi.desc[a]; old != nil {
+			var lost []nodeID
+			old.each(func(d nodeID) bool {
+				if _, ok := reachable[d]; !ok {
+					lost = append(lost, d)
+				}
+				return true
+			})
+			for _, d := range lost {
+				removeFrom(mi.desc, a, d)
+				removeFrom(mi.anc, d, a)
+			}
+		}
+	}
+}
+
+// reachable walks the direct edges below g, g itself excluded unless on a cycle
+func (mi *membershipIndex) reachable(g nodeID) map[nodeID]struct{} {
+	seen := make(map[nodeID]struct{})
+	stack := []nodeID{g}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if c := mi.children[n]; c != nil {
+			c.each(func(k nodeID) bool {
+				if _, ok := seen[k]; !ok {
+					seen[k] = struct{}{}
+					stack = append(stack, k)
+				}
+				return true
+			})
+		}
+	}
+	delete(seen, g)
+	return seen
+}
+
+// EnableMembershipIndex maintains a transitive membership index for the given relations
+// (e.g. "member"), so deep checks through nested usersets of those relations are answered
+// from the index instead of walking every level. Existing tuples are indexed right away;
+// calling it again replaces the set of indexed relations.
+func (g *RelationGraph) EnableMembershipIndex(relations ...string) {
+	idx := &membershipIndexes{byRel: make(map[uint32]*membershipIndex)}
+	for _, r := range relations {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		rel := g.strings.intern(r)
+		idx.byRel[rel] = newMembershipIndex(rel)
+	}
+	for i := range g.shards {
+		g.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := len(g.shards) - 1; i >= 0; i-- {
+			g.shards[i].mu.Unlock()
+		}
+	}()
+	if len(idx.byRel) == 0 {
+		g.membership.Store(nil)
+		return
+	}
+	g.indexShards(idx)
+	g.membership.Store(idx)
+}
+
+// indexShards fills idx from the current tuples, the caller holds every shard lock
+func (g *RelationGraph) indexShards(idx *membershipIndexes) {
+	for i := range g.shards {
+		for n, adj := range g.shards[i].objectIndex {
+			for _, mi := range idx.byRel {
+				if set := adj.get(mi.rel); set != nil {
+					set.each(func(k subjectKey) bool {
+						mi.write(n, k)
+						return true
+					})
+				}
+			}
+		}
+	}
+	for _, mi := range idx.byRel {
+		mi.changedAt = g.revision.Load()
+	}
+}
+
+// MembershipIndexRelations lists the indexed relations, nil when the index is off
+func (g *RelationGraph) MembershipIndexRelations() []string {
+	idx := g.membership.Load()
+	if idx == nil {
+		return nil
+	}
+	var rels []string
+	for rel := range idx.byRel {
+		rels = append(rels, g.strings.str(rel))
+	}
+	sort.Strings(rels)
+	return rels
+}
+
+// indexWrite and indexDelete keep the index in step with a tuple change and return the
+// revision the change was made at; the caller holds the shard locks of the tuple. An
+// indexed change advances the revision under the index lock, so a check that read the
+// revision finds the index up to date with it.
+func (g *RelationGraph) indexWrite(object nodeID, rel uint32, subject subjectKey) uint64 {
+	idx := g.membership.Load()
+	if idx == nil || idx.byRel[rel] == nil {
+		return g.revision.Add(1)
+	}
+	mi := idx.byRel[rel]
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	mi.write(object, subject)
+	mi.changedAt = g.revision.Add(1)
+	return mi.changedAt
+}
+
+func (g *RelationGraph) indexDelete(object nodeID, rel uint32, subject subjectKey) uint64 {
+	idx := g.membership.Load()
+	if idx == nil || idx.byRel[rel] == nil {
+		return g.revision.Add(1)
+	}
+	mi := idx.byRel[rel]
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	mi.delete(object, subject)
+	mi.changedAt = g.revision.Add(1)
+	return mi.changedAt
+}
+
+// MembershipMismatch is a membership on which the index and a plain walk disagree
+type MembershipMismatch struct {
+	Object   ObjectRef  `json:"object"`
+	Relation string     `json:"relation"`
+	Subject  SubjectRef `json:"subject"`
+	Indexed  bool       `json:"indexed"`
+	Walked   bool       `json:"walked"`
+}
+
+// CheckMembershipIndex compares the index with an unbounded walk of the raw tuples for
+// every indexed object#relation and every concrete subject that is a direct member of
+// one, and returns the disagreements. It reads a single point in time and is meant for
+// tests and debugging: the cost is objects x subjects checks.
+func (g *RelationGraph) CheckMembershipIndex() []MembershipMismatch {
+	idx := g.membership.Load()
+	if idx == nil {
+		return nil
+	}
+	g.rlockAll()
+	defer g.runlockAll()
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var mismatches []MembershipMismatch
+	for _, mi := range idx.byRel {
+		var objects []nodeID
+		subjects := make(map[subjectKey]struct{})
+		for i := range g.shards {
+			for n, adj := range g.shards[i].objectIndex {
+				set := adj.get(mi.rel)
+				if set == nil {
+					continue
+				}
+				objects = append(objects, n)
+				set.each(func(k subjectKey) bool {
+					if k.rel == 0 {
+						subjects[k] = struct{}{}
+					}
+					return true
+				})
+			}
+		}
+		for _, n := range objects {
+			at := objectRelation{object: n, rel: mi.rel}
+			for s := range subjects {
+				indexed := g.walkLocked(at, s, idx)
+				walked := g.walkLocked(at, s, nil)
+				if indexed != walked {
+					mismatches = append(mismatches, MembershipMismatch{
+						Object:   g.objectRef(n),
+						Relation: g.strings.str(mi.rel),
+						Subject:  g.subjectRef(s),
+						Indexed:  indexed,
+						Walked:   walked,
+					})
+				}
+			}
+		}
+	}
+	return mismatches
+}
+
+// walkLocked runs an unbounded single goroutine check, the caller holds every lock
+func (g *RelationGraph) walkLocked(at objectRelation, subject subjectKey, idx *membershipIndexes) bool {
+	c := &deepCheck{
+		g:        g,
+		members:  idx,
+		locked:   true,
+		rev:      math.MaxUint64,
+		subject:  subject,
+		maxDepth: math.MaxInt,
+		sem:      make(chan struct{}),
+		visited:  make(map[objectRelation]int),
+	}
+	c.walk(at, 0)
+	return c.found.Load()
+}
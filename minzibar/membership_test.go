@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func groupRef(id string) ObjectRef {
+	return ObjectRef{Type: "group", ObjectID: id}
+}
+
+func groupUserset(id string) SubjectRef {
+	return SubjectRef{Object: groupRef(id), Relation: "member"}
+}
+
+func TestMembershipIndex_NestedGroups(t *testing.T) {
+	g := NewRelationGraph()
+	g.EnableMembershipIndex("member")
+	assert.Equal(t, []string{"member"}, g.MembershipIndexRelations())
+
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	// doc#viewer@eng#member, eng > backend > db, plus a second route eng > platform > db
+	g.Write(RelationTuple{Object: doc, Relation: "viewer", Subject: groupUserset("eng")})
+	g.Write(RelationTuple{Object: groupRef("eng"), Relation: "member", Subject: groupUserset("backend")})
+	g.Write(RelationTuple{Object: groupRef("backend"), Relation: "member", Subject: groupUserset("db")})
+	g.Write(RelationTuple{Object: groupRef("eng"), Relation: "member", Subject: groupUserset("platform")})
+	g.Write(RelationTuple{Object: groupRef("platform"), Relation: "member", Subject: groupUserset("db")})
+	g.Write(RelationTuple{Object: groupRef("db"), Relation: "member", Subject: alice})
+
+	assert.True(t, g.HasDeepRelationship(groupRef("eng"), "member", alice))
+	assert.True(t, g.HasDeepRelationship(doc, "viewer", alice))
+	assert.False(t, g.HasDeepRelationship(groupRef("backend"), "owner", alice))
+
+	// one route gone, the other still connects eng to db
+	require.True(t, g.Delete(RelationTuple{Object: groupRef("backend"), Relation: "member", Subject: groupUserset("db")}))
+	assert.True(t, g.HasDeepRelationship(doc, "viewer", alice))
+	assert.False(t, g.HasDeepRelationship(groupRef("backend"), "member", alice))
+
+	require.True(t, g.Delete(RelationTuple{Object: groupRef("platform"), Relation: "member", Subject: groupUserset("db")}))
+	assert.False(t, g.HasDeepRelationship(doc, "viewer", alice))
+	assert.Empty(t, g.CheckMembershipIndex())
+}
+
+func TestMembershipIndex_OtherRelationsInsideGroups(t *testing.T) {
+	g := NewRelationGraph()
+	g.EnableMembershipIndex("member")
+	bob := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}
+	// eng#member@team:infra#lead is not covered by the closure and must still be walked
+	g.Write(RelationTuple{Object: groupRef("eng"), Relation: "member", Subject: groupUserset("backend")})
+	g.Write(RelationTuple{Object: groupRef("backend"), Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "team", ObjectID: "infra"}, Relation: "lead"}})
+	g.Write(RelationTuple{Object: ObjectRef{Type: "team", ObjectID: "infra"}, Relation: "lead", Subject: bob})
+
+	assert.True(t, g.HasDeepRelationship(groupRef("eng"), "member", bob))
+	assert.Empty(t, g.CheckMembershipIndex())
+}
+
+func TestMembershipIndex_EnableOnExistingGraphAndReload(t *testing.T) {
+	g := NewRelationGraph()
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	g.Write(RelationTuple{Object: groupRef("a"), Relation: "member", Subject: groupUserset("b")})
+	g.Write(RelationTuple{Object: groupRef("b"), Relation: "member", Subject: groupUserset("a")})
+	g.Write(RelationTuple{Object: groupRef("b"), Relation: "member", Subject: alice})
+
+	g.EnableMembershipIndex("member")
+	assert.True(t, g.HasDeepRelationship(groupRef("a"), "member", alice))
+	assert.Empty(t, g.CheckMembershipIndex())
+
+	data, err := json.Marshal(g)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, g))
+	assert.Equal(t, []string{"member"}, g.MembershipIndexRelations())
+	assert.True(t, g.HasDeepRelationship(groupRef("a"), "member", alice))
+	assert.Empty(t, g.CheckMembershipIndex())
+
+	g.EnableMembershipIndex()
+	assert.Nil(t, g.MembershipIndexRelations())
+	assert.Nil(t, g.CheckMembershipIndex())
+}
+
+// TestMembershipIndex_RandomChanges applies random writes and deletes, cycles included,
+// and compares the index with a plain walk after each one
+func TestMembershipIndex_RandomChanges(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	g := NewRelationGraph()
+	g.EnableMembershipIndex("member")
+
+	var written []RelationTuple
+	randomTuple := func() RelationTuple {
+		object := groupRef(fmt.Sprintf("g%d", rnd.Intn(8)))
+		switch rnd.Intn(6) {
+		case 0:
+			return RelationTuple{Object: object, Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: fmt.Sprintf("u%d", rnd.Intn(5))}}}
+		case 1:
+			return RelationTuple{Object: object, Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "team", ObjectID: "t"}, Relation: "lead"}}
+		case 2:
+			return RelationTuple{Object: ObjectRef{Type: "team", ObjectID: "t"}, Relation: "lead", Subject: groupUserset(fmt.Sprintf("g%d", rnd.Intn(8)))}
+		}
+		return RelationTuple{Object: object, Relation: "member", Subject: groupUserset(fmt.Sprintf("g%d", rnd.Intn(8)))}
+	}
+	for step := 0; step < 300; step++ {
+		if len(written) > 0 && rnd.Intn(3) == 0 {
+			i := rnd.Intn(len(written))
+			g.Delete(written[i])
+			written = append(written[:i], written[i+1:]...)
+		} else {
+			tuple := randomTuple()
+			g.Write(tuple)
+			written = append(written, tuple)
+		}
+		require.Empty(t, g.CheckMembershipIndex(), "step %d", step)
+	}
+}
+
+func TestService_CheckMembershipIndex(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	srv := httptest.NewServer(NewService(engine).Echo())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/index/check")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	engine.graph.EnableMembershipIndex(" member ")
+	engine.graph.Write(RelationTuple{Object: groupRef("eng"), Relation: "member", Subject: groupUserset("backend")})
+	engine.graph.Write(RelationTuple{Object: groupRef("backend"), Relation: "member", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}})
+
+	resp, err = http.Get(srv.URL + "/index/check")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var out struct {
+		Relations  []string             `json:"relations"`
+		Consistent bool                 `json:"consistent"`
+		Mismatches []MembershipMismatch `json:"mismatches"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, []string{"member"}, out.Relations)
+	assert.True(t, out.Consistent)
+	assert.Empty(t, out.Mismatches)
+}
@@ -104,10 +104,13 @@ func (e *funcExpr) Eval(ctx map[string]string) bool {
 
 type Policy struct {
 	Rules []policyRule
+	// Text is the source the policy was parsed from, kept for export
+	Text string
 }
 
 type PolicyBuilder struct {
 	rules []policyRule
+	text  string
 }
 
 func NewPolicyBuilder(input string) (*PolicyBuilder, error) {
@@ -115,11 +118,11 @@ func NewPolicyBuilder(input string) (*PolicyBuilder, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &PolicyBuilder{rules: engine.Rules}, nil
+	return &PolicyBuilder{rules: engine.Rules, text: engine.Text}, nil
 }
 
 func (b *PolicyBuilder) Build() *Policy {
-	return &Policy{Rules: b.rules}
+	return &Policy{Rules: b.rules, Text: b.text}
 }
 
 func NewPolicy(input string) *Policy {
@@ -137,7 +140,7 @@ func ParsePolicies(input string) (*Policy, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &Policy{Rules: []policyRule{rule}}, nil
+		return &Policy{Rules: []policyRule{rule}, Text: input}, nil
 	}
 	lines := strings.Split(input, "\n")
 	var rules []policyRule
@@ -152,7 +155,7 @@ func ParsePolicies(input string) (*Policy, error) {
 		}
 		rules = append(rules, rule)
 	}
-	return &Policy{Rules: rules}, nil
+	return &Policy{Rules: rules, Text: input}, nil
 }
 
 func parseRule(line string) (policyRule, error) {
@@ -344,3 +347,76 @@ func (p *Policy) Evaluate(ctx map[string]string) string {
 	}
 	return "deny"
 }
+
+// LintIssue is a problem found by LintPolicy, Line is 1-based
+type LintIssue struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// LintPolicy reports parse errors and constructs the parser accepts but never match,
+// such as unsupported operators or tokens left over after the condition
+func LintPolicy(input string) []LintIssue {
+	var issues []LintIssue
+	trimmed := strings.TrimSpace(input)
+	lower := strings.ToLower(trimmed)
+	if strings.HasPrefix(lower, "allow if ") || strings.HasPrefix(lower, "deny if ") {
+		// ParsePolicies treats this form as a single rule spanning the whole input
+		for _, msg := range lintRule(trimmed) {
+			issues = append(issues, LintIssue{Line: 1, Message: msg})
+		}
+		return issues
+	}
+	seen := make(map[string]int)
+	for i, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, msg := range lintRule(line) {
+			issues = append(issues, LintIssue{Line: i + 1, Message: msg})
+		}
+		if first, ok := seen[line]; ok {
+			issues = append(issues, LintIssue{Line: i + 1, Message: fmt.Sprintf("duplicate of rule on line %d", first)})
+		} else {
+			seen[line] = i + 1
+		}
+	}
+	return issues
+}
+
+func lintRule(line string) []string {
+	rule, err := parseRule(line)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var msgs []string
+	// parseRule ignores anything after a complete expression, so re-run it to find leftovers
+	_, condition, _ := strings.Cut(line, "if")
+	tokens := tokenize(strings.TrimSpace(condition))
+	if _, pos, err := parseExpr(tokens, 0); err == nil && pos < len(tokens) {
+		msgs = append(msgs, fmt.Sprintf("unexpected tokens after condition: %s", strings.Join(tokens[pos:], " ")))
+	}
+	walkExpr(rule.Expr, func(e expr) {
+		if c, ok := e.(*comparisonExpr); ok && c.Operator != "==" && c.Operator != "!=" {
+			msgs = append(msgs, fmt.Sprintf("unsupported operator %q in comparison on %s, it never matches", c.Operator, c.Identifier))
+		}
+	})
+	return msgs
+}
+
+// walkExpr visits e and every nested expression
+func walkExpr(e expr, fn func(expr)) {
+	fn(e)
+	switch n := e.(type) {
+	case *binaryExpr:
+		walkExpr(n.Left, fn)
+		walkExpr(n.Right, fn)
+	case *notExpr:
+		walkExpr(n.Inner, fn)
+	}
+}
@@ -217,3 +217,24 @@ func TestPolicy_AllKeyword(t *testing.T) {
 	result = engine.Evaluate(ctx)
 	assert.Equal(t, "deny", result)
 }
+
+func TestLintPolicy(t *testing.T) {
+	assert.Empty(t, LintPolicy(`
+		# engineers can read
+		allow read if user.department == "engineering"
+		deny delete if user.role == "contractor"
+	`))
+
+	issues := LintPolicy(`allow read if user.department == "engineering"
+grant read if x == "y"
+allow read if user.department == "engineering"
+allow read if a == "b" c
+allow read if hour >= "9"`)
+	var lines []int
+	for _, issue := range issues {
+		lines = append(lines, issue.Line)
+	}
+	assert.Equal(t, []int{2, 3, 4, 5}, lines)
+	assert.Contains(t, issues[1].Message, "duplicate of rule on line 1")
+	assert.Contains(t, issues[2].Message, "unexpected tokens")
+}
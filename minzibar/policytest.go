@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyTestFile is a declarative authz test: fixture tuples and policies plus expected decisions.
+//
+//	name: feature flag limited to CTO
+//	tuples:
+//	  - feature_flag:new-dashboard#enabled@user:user1
+//	policies:
+//	  p_cto_only: allow enabled if department == "CTO"
+//	attach:
+//	  feature_flag:new-dashboard: [p_cto_only]
+//	assertions:
+//	  - user:user1 can enabled feature_flag:new-dashboard => deny
+//	  - check: can user:user1 enabled feature_flag:new-dashboard
+//	    context: {department: CTO}
+//	    expect: allow
+type PolicyTestFile struct {
+	Name       string              `yaml:"name"`
+	Tuples     []string            `yaml:"tuples"`
+	Policies   map[string]string   `yaml:"policies"`
+	Attach     map[string][]string `yaml:"attach"`
+	Assertions []PolicyAssertion   `yaml:"assertions"`
+}
+
+// PolicyAssertion is one expected decision, written either as a mapping or as
+// the shorthand string "can <subject> <action> <resource> => allow"
+// (or "<subject> can <action> <resource> => allow")
+type PolicyAssertion struct {
+	Check   string            `yaml:"check"`
+	Context map[string]string `yaml:"context"`
+	Expect  string            `yaml:"expect"`
+}
+
+// UnmarshalYAML accepts both the mapping and the shorthand string form
+func (a *PolicyAssertion) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		query, expect, found := strings.Cut(node.Value, "=>")
+		if !found {
+			return fmt.Errorf("line %d: assertion must look like '<query> => allow|deny'", node.Line)
+		}
+		a.Check = normalizeCanQuery(query)
+		a.Expect = strings.TrimSpace(expect)
+		return nil
+	}
+	type plain PolicyAssertion
+	return node.Decode((*plain)(a))
+}
+
+// normalizeCanQuery rewrites "<subject> can <action> <resource>" into the engine's "can ..." form
+func normalizeCanQuery(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 4 && strings.ToLower(fields[1]) == KeyWordCan {
+		fields[0], fields[1] = fields[1], fields[0]
+	}
+	return strings.Join(fields, " ")
+}
+
+// expectAllowed maps the expect field to a decision
+func (a PolicyAssertion) expectAllowed() (bool, error) {
+	switch strings.ToLower(a.Expect) {
+	case "allow", "allowed", "true":
+		return true, nil
+	case "deny", "denied", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("expect must be allow or deny, got %q", a.Expect)
+}
+
+// PolicyTestFailure is an assertion whose decision did not match, with the engine trace
+type PolicyTestFailure struct {
+	Assertion PolicyAssertion
+	Got       bool
+	Err       error
+	Trace     []string
+}
+
+// PolicyTestResult summarises a run of one PolicyTestFile
+type PolicyTestResult struct {
+	Name     string
+	Passed   int
+	Failures []PolicyTestFailure
+}
+
+// LoadPolicyTestFile reads and decodes a yaml test file
+func LoadPolicyTestFile(path string) (*PolicyTestFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f PolicyTestFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if f.Name == "" {
+		f.Name = path
+	}
+	return &f, nil
+}
+
+// NewEngine builds a fresh engine holding the file's fixtures
+func (f *PolicyTestFile) NewEngine() (*Engine, error) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	for _, line := range f.Tuples {
+		t, err := ParseTuple(line)
+		if err != nil {
+			return nil, fmt.Errorf("tuple %q: %v", line, err)
+		}
+		engine.graph.Write(t)
+	}
+	ids := make([]string, 0, len(f.Policies))
+	for id := range f.Policies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		policy, err := ParsePolicies(f.Policies[id])
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %v", id, err)
+		}
+		engine.setPolicy(id, policy)
+	}
+	for resourceStr, policyIDs := range f.Attach {
+		resource, err := parseObjectRef(resourceStr)
+		if err != nil {
+			return nil, fmt.Errorf("attach %q: %v", resourceStr, err)
+		}
+		for _, id := range policyIDs {
+			if _, ok := engine.policy(id); !ok {
+				return nil, fmt.Errorf("attach %q: unknown policy %s", resourceStr, id)
+			}
+			if err := engine.AddPolicyToResource(resource, id); err != nil {
+				return nil, fmt.Errorf("attach %q: %v", resourceStr, err)
+			}
+		}
+	}
+	return engine, nil
+}
+
+// Run loads the fixtures and evaluates every assertion with Verify
+func (f *PolicyTestFile) Run() (PolicyTestResult, error) {
+	result := PolicyTestResult{Name: f.Name}
+	engine, err := f.NewEngine()
+	if err != nil {
+		return result, err
+	}
+	if len(f.Assertions) == 0 {
+		return result, errors.New("no assertions")
+	}
+	for _, a := range f.Assertions {
+		want, err := a.expectAllowed()
+		if err != nil {
+			return result, fmt.Errorf("assertion %q: %v", a.Check, err)
+		}
+		got, trace, err := engine.verifyQueryTrace(a.Check, a.Context)
+		if err != nil || got != want {
+			result.Failures = append(result.Failures, PolicyTestFailure{Assertion: a, Got: got, Err: err, Trace: trace})
+			continue
+		}
+		result.Passed++
+	}
+	return result, nil
+}
+
+// verifyquerytrace is VerifyQuery returning the decision trace
+func (e *Engine) verifyQueryTrace(query string, ctx map[string]string) (bool, []string, error) {
+	resource, subject, action, err := parseCanQuery(query)
+	if err != nil {
+		return false, nil, err
+	}
+	// copy so assertions sharing a context map do not see the keys Verify injects
+	return e.VerifyTrace(resource, subject, action, copyContext(ctx))
+}
+
+// String renders a failure with its trace for terminal output
+func (p PolicyTestFailure) String() string {
+	var b strings.Builder
+	if p.Err != nil {
+		fmt.Fprintf(&b, "%s: error: %v", p.Assertion.Check, p.Err)
+	} else {
+		got := "deny"
+		if p.Got {
+			got = "allow"
+		}
+		fmt.Fprintf(&b, "%s: expected %s, got %s", p.Assertion.Check, p.Assertion.Expect, got)
+	}
+	if len(p.Assertion.Context) > 0 {
+		fmt.Fprintf(&b, " (context %s)", contextFlag(p.Assertion.Context))
+	}
+	for _, step := range p.Trace {
+		b.WriteString("\n    ")
+		b.WriteString(step)
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyTestFile_Testdata(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.authz.yaml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, name := range files {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			file, err := LoadPolicyTestFile(name)
+			require.NoError(t, err)
+			result, err := file.Run()
+			require.NoError(t, err)
+			for _, f := range result.Failures {
+				t.Error(f)
+			}
+		})
+	}
+}
+
+func TestPolicyTestFile_ReportsMismatchWithTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.authz.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+tuples:
+  - document:x#read@user:alice
+policies:
+  p: allow read if department == "eng"
+attach:
+  document:x: [p]
+assertions:
+  - user:alice can read document:x => allow
+  - check: can user:alice read document:x
+    context: {department: eng}
+    expect: allow
+  - can user:alice bogus => deny
+`), 0o644))
+
+	file, err := LoadPolicyTestFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, path, file.Name, "name defaults to the file path")
+	result, err := file.Run()
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Passed)
+	require.Len(t, result.Failures, 2)
+
+	mismatch := result.Failures[0].String()
+	assert.Contains(t, mismatch, "can user:alice read document:x: expected allow, got deny")
+	assert.Contains(t, mismatch, "policy p rule 1 (allow read): condition false")
+	assert.Error(t, result.Failures[1].Err)
+}
+
+func TestPolicyTestFile_InvalidFixtures(t *testing.T) {
+	for name, body := range map[string]string{
+		"bad tuple":      "tuples: [nope]\nassertions: [can user:a read doc:x => allow]",
+		"unknown policy": "tuples: ['doc:x#r@user:a']\nattach: {doc:x: [missing]}\nassertions: [can user:a read doc:x => allow]",
+		"bad expect":     "assertions: [can user:a read doc:x => maybe]",
+		"no assertions":  "tuples: ['doc:x#r@user:a']",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(body), 0o644))
+			file, err := LoadPolicyTestFile(path)
+			require.NoError(t, err)
+			_, err = file.Run()
+			assert.Error(t, err)
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "f.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("assertions: [missing arrow]"), 0o644))
+	_, err := LoadPolicyTestFile(path)
+	assert.ErrorContains(t, err, "=>")
+}
+
+func TestCLI_PolicyTests(t *testing.T) {
+	var out strings.Builder
+	require.NoError(t, runCLI([]string{"test", "-v", "testdata/feature_flag.authz.yaml"}, nil, &out))
+	assert.Contains(t, out.String(), "ok   new-dashboard limited to CTO")
+}
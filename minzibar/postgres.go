@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultStoreChanges is the number of changes a PostgresStore keeps for servers to catch up from
+const DefaultStoreChanges = 100000
+
+// postgresChannel is notified with the revision of every change appended
+const postgresChannel = "minzibar_changes"
+
+// postgresPruneEvery is how many appends pass between deleting changes past KeepChanges
+const postgresPruneEvery = 1000
+
+// postgresSchema is created on open. minzibar_revision holds the newest revision and the
+// newest pruned one; its single row is locked by every append until commit, so changes
+// commit in revision order. minzibar_changes is the change feed, the other tables the
+// current state with the revision that last touched each row.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS minzibar_revision (
+	id       boolean PRIMARY KEY DEFAULT true CHECK (id),
+	revision bigint NOT NULL,
+	pruned   bigint NOT NULL DEFAULT 0
+);
+INSERT INTO minzibar_revision (revision) VALUES (0) ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS minzibar_changes (
+	revision bigint PRIMARY KEY,
+	change   jsonb NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS minzibar_tuples (
+	object_type      text NOT NULL,
+	object_id        text NOT NULL,
+	relation         text NOT NULL,
+	subject_type     text NOT NULL,
+	subject_id       text NOT NULL,
+	subject_relation text NOT NULL DEFAULT '',
+	revision         bigint NOT NULL,
+	created_at       timestamptz,
+	created_by       text NOT NULL DEFAULT '',
+	PRIMARY KEY (object_type, object_id, relation, subject_type, subject_id, subject_relation)
+);
+CREATE INDEX IF NOT EXISTS minzibar_tuples_subject ON minzibar_tuples (subject_type, subject_id, subject_relation, relation);
+CREATE INDEX IF NOT EXISTS minzibar_tuples_revision ON minzibar_tuples (revision);
+
+CREATE TABLE IF NOT EXISTS minzibar_policies (
+	id       text PRIMARY KEY,
+	text     text NOT NULL,
+	revision bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS minzibar_flags (
+	name     text PRIMARY KEY,
+	flag     jsonb NOT NULL,
+	revision bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS minzibar_roles (
+	name     text PRIMARY KEY,
+	role     jsonb NOT NULL,
+	revision bigint NOT NULL
+);
+`
+
+// PostgresStore is a TupleStore in PostgreSQL. Besides the change feed it keeps the
+// current tuples, policies, flags and roles in tables of their own, which snapshots are
+// read from and which can be queried directly; tuples are indexed by object and by
+// subject. Appends notify the minzibar_changes channel, which Wait listens on.
+type PostgresStore struct {
+	// KeepChanges is how many changes Changes can go back, DefaultStoreChanges when 0
+	KeepChanges int
+
+	pool   *pgxpool.Pool
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex
+	// notified is closed and replaced on every notification, and when the listener
+	// reconnects and may have missed some
+	notified chan struct{}
+}
+
+// OpenPostgresStore connects to the database at url, creates the schema if it is
+// missing and starts listening for changes
+func OpenPostgresStore(ctx context.Context, url string) (*PostgresStore, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("postgres schema: %w", err)
+	}
+	listenCtx, cancel := context.WithCancel(context.Background())
+	p := &PostgresStore{pool: pool, cancel: cancel, done: make(chan struct{}), notified: make(chan struct{})}
+	go p.listen(listenCtx)
+	return p, nil
+}
+
+// migratePostgres creates the schema; the advisory lock keeps servers starting together
+// from racing on it
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('minzibar_schema'))`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, postgresSchema); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresStore) Append(ctx context.Context, c Change) (uint64, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var rev int64
+	if err := tx.QueryRow(ctx, `UPDATE minzibar_revision SET revision = revision + 1 RETURNING revision`).Scan(&rev); err != nil {
+		return 0, err
+	}
+	c.Revision = uint64(rev)
+	body, err := json.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO minzibar_changes (revision, change) VALUES ($1, $2)`, rev, string(body)); err != nil {
+		return 0, err
+	}
+	if err := applyPostgres(ctx, tx, rev, c); err != nil {
+		return 0, err
+	}
+	if keep := int64(p.keepChanges()); rev%postgresPruneEvery == 0 && rev > keep {
+		if _, err := tx.Exec(ctx, `DELETE FROM minzibar_changes WHERE revision <= $1`, rev-keep); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE minzibar_revision SET pruned = $1`, rev-keep); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, postgresChannel, strconv.FormatInt(rev, 10)); err != nil {
+		return 0, err
+	}
+	return c.Revision, tx.Commit(ctx)
+}
+
+// applyPostgres brings the state tables up to date with c
+func applyPostgres(ctx context.Context, tx pgx.Tx, rev int64, c Change) error {
+	var err error
+	switch c.Op {
+	case ChangeWrite, ChangeDelete:
+		if c.Tuple == nil {
+			return fmt.Errorf("%s without tuple", c.Op)
+		}
+		t := c.Tuple
+		if c.Op == ChangeDelete {
+			_, err = tx.Exec(ctx, `DELETE FROM minzibar_tuples WHERE object_type = $1 AND object_id = $2 AND relation = $3
+				AND subject_type = $4 AND subject_id = $5 AND subject_relation = $6`,
+				t.Object.Type, t.Object.ObjectID, t.Relation, t.Subject.Object.Type, t.Subject.Object.ObjectID, t.Subject.Relation)
+			break
+		}
+		// a tuple written twice keeps its first metadata, as in the engine
+		_, err = tx.Exec(ctx, `INSERT INTO minzibar_tuples (object_type, object_id, relation, subject_type, subject_id,
+				subject_relation, revision, created_at, created_by) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING`,
+			t.Object.Type, t.Object.ObjectID, t.Relation, t.Subject.Object.Type, t.Subject.Object.ObjectID, t.Subject.Relation,
+			rev, c.CreatedAt, c.CreatedBy)
+	case ChangePolicy:
+		_, err = tx.Exec(ctx, `INSERT INTO minzibar_policies (id, text, revision) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO UPDATE SET text = excluded.text, revision = excluded.revision`, c.PolicyID, c.PolicyText, rev)
+	case ChangeFlag:
+		if c.Flag == nil {
+			return errors.New("flag change without flag")
+		}
+		body, jerr := json.Marshal(c.Flag)
+		if jerr != nil {
+			return jerr
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO minzibar_flags (name, flag, revision) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET flag = excluded.flag, revision = excluded.revision`, c.Flag.Name, string(body), rev)
+	case ChangeRole, ChangeRoleDelete:
+		if c.Role == nil {
+			return fmt.Errorf("%s without role", c.Op)
+		}
+		if c.Op == ChangeRoleDelete {
+			_, err = tx.Exec(ctx, `DELETE FROM minzibar_roles WHERE name = $1`, c.Role.Name)
+			break
+		}
+		body, jerr := json.Marshal(c.Role)
+		if jerr != nil {
+			return jerr
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO minzibar_roles (name, role, revision) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET role = excluded.role, revision = excluded.revision`, c.Role.Name, string(body), rev)
+	default:
+		return fmt.Errorf("unknown change %q", c.Op)
+	}
+	return err
+}
+
+func (p *PostgresStore) Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback(ctx)
+	var head, pruned int64
+	if err := tx.QueryRow(ctx, `SELECT revision, pruned FROM minzibar_revision`).Scan(&head, &pruned); err != nil {
+		return nil, 0, err
+	}
+	if after < uint64(pruned) {
+		return nil, uint64(head), fmt.Errorf("%w: revision %d, oldest kept is %d", ErrChangesTruncated, after, pruned+1)
+	}
+	if limit <= 0 {
+		limit = DefaultChangeBatch
+	}
+	rows, err := tx.Query(ctx, `SELECT change FROM minzibar_changes WHERE revision > $1 ORDER BY revision LIMIT $2`, int64(after), limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var changes []Change
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			return nil, 0, err
+		}
+		var c Change
+		if err := json.Unmarshal(body, &c); err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, uint64(head), rows.Err()
+}
+
+// Snapshot reads the state tables in one transaction, so they agree with the revision
+func (p *PostgresStore) Snapshot(ctx context.Context, fn func(Change) error) (uint64, error) {
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var rev int64
+	if err := tx.QueryRow(ctx, `SELECT revision FROM minzibar_revision`).Scan(&rev); err != nil {
+		return 0, err
+	}
+
+	var id, text string
+	rows, err := tx.Query(ctx, `SELECT id, text FROM minzibar_policies ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pgx.ForEachRow(rows, []any{&id, &text}, func() error {
+		return fn(Change{Op: ChangePolicy, PolicyID: id, PolicyText: text})
+	}); err != nil {
+		return 0, err
+	}
+
+	var name string
+	var body []byte
+	rows, err = tx.Query(ctx, `SELECT name, flag FROM minzibar_flags ORDER BY name`)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pgx.ForEachRow(rows, []any{&name, &body}, func() error {
+		var flag FeatureFlag
+		if err := json.Unmarshal(body, &flag); err != nil {
+			return fmt.Errorf("flag %s: %w", name, err)
+		}
+		return fn(Change{Op: ChangeFlag, Flag: &flag})
+	}); err != nil {
+		return 0, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT name, role FROM minzibar_roles ORDER BY name`)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pgx.ForEachRow(rows, []any{&name, &body}, func() error {
+		var role Role
+		if err := json.Unmarshal(body, &role); err != nil {
+			return fmt.Errorf("role %s: %w", name, err)
+		}
+		return fn(Change{Op: ChangeRole, Role: &role})
+	}); err != nil {
+		return 0, err
+	}
+
+	var t RelationTuple
+	var createdAt *time.Time
+	var createdBy string
+	rows, err = tx.Query(ctx, `SELECT object_type, object_id, relation, subject_type, subject_id, subject_relation,
+		created_at, created_by FROM minzibar_tuples ORDER BY revision`)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pgx.ForEachRow(rows, []any{&t.Object.Type, &t.Object.ObjectID, &t.Relation, &t.Subject.Object.Type,
+		&t.Subject.Object.ObjectID, &t.Subject.Relation, &createdAt, &createdBy}, func() error {
+		tuple := t
+		return fn(Change{Op: ChangeWrite, Tuple: &tuple, CreatedAt: createdAt, CreatedBy: createdBy})
+	}); err != nil {
+		return 0, err
+	}
+	return uint64(rev), nil
+}
+
+func (p *PostgresStore) Wait(ctx context.Context, after uint64) error {
+	// take the channel before reading the revision, so a change in between is not missed
+	p.mu.Lock()
+	notified := p.notified
+	p.mu.Unlock()
+	var head int64
+	if err := p.pool.QueryRow(ctx, `SELECT revision FROM minzibar_revision`).Scan(&head); err != nil {
+		return err
+	}
+	if uint64(head) > after {
+		return nil
+	}
+	select {
+	case <-notified:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops listening and closes the connections
+func (p *PostgresStore) Close() error {
+	p.cancel()
+	<-p.done
+	p.pool.Close()
+	return nil
+}
+
+// listen holds a connection listening on postgresChannel until ctx is done, reconnecting
+// every second after a failure
+func (p *PostgresStore) listen(ctx context.Context) {
+	defer close(p.done)
+	for {
+		err := p.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("postgres store: listen: %v", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PostgresStore) listenOnce(ctx context.Context) error {
+	pooled, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// the connection is left listening, it must not go back to the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+postgresChannel); err != nil {
+		return err
+	}
+	// changes may have been appended while no one was listening
+	p.notify()
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		p.notify()
+	}
+}
+
+func (p *PostgresStore) notify() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.notified)
+	p.notified = make(chan struct{})
+}
+
+func (p *PostgresStore) keepChanges() int {
+	if p.KeepChanges > 0 {
+		return p.KeepChanges
+	}
+	return DefaultStoreChanges
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limit bounds the requests of one client or tenant: a token bucket for all requests
+// and a quota of writes per window
+type Limit struct {
+	// Rate is the requests per second allowed on average, unlimited when 0
+	Rate float64 `yaml:"rate" json:"rate"`
+	// Burst is how many requests may come at once, Rate rounded up when 0
+	Burst int `yaml:"burst" json:"burst"`
+	// Writes is how many writes are allowed per Per, unlimited when 0
+	Writes int `yaml:"writes" json:"writes"`
+	// Per is the window of the write quota, a minute when 0
+	Per time.Duration `yaml:"per" json:"per"`
+}
+
+// DefaultWriteQuotaWindow is the Per of a write quota that does not set one
+const DefaultWriteQuotaWindow = time.Minute
+
+// maxLimiterKeys is how many buckets are kept before idle ones are dropped
+const maxLimiterKeys = 10000
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+func (l Limit) per() time.Duration {
+	if l.Per > 0 {
+		return l.Per
+	}
+	return DefaultWriteQuotaWindow
+}
+
+func (l Limit) validate() error {
+	if l.Rate < 0 || l.Burst < 0 || l.Writes < 0 || l.Per < 0 {
+		return fmt.Errorf("negative limit %+v", l)
+	}
+	return nil
+}
+
+// RateLimits throttles the callers of a Service. A client is the authenticated subject,
+// e.g. the subject of its API key, or its address when authentication is off. Every
+// request takes a token from its client's bucket and, when its tenant has a limit, from
+// the tenant's bucket shared by all of the tenant's clients.
+type RateLimits struct {
+	// Default applies to clients without their own limit
+	Default Limit `yaml:"default" json:"default"`
+	// Clients replaces Default for the named clients, e.g. service:ci
+	Clients map[string]Limit `yaml:"clients" json:"clients"`
+	// Tenants limits all callers of a tenant together, on top of their own limits
+	Tenants map[string]Limit `yaml:"tenants" json:"tenants"`
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	windows map[string]*writeWindow
+	// now is time.Now, replaced in tests
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type writeWindow struct {
+	start  time.Time
+	writes int
+}
+
+// ParseRateLimits reads limits in YAML or JSON:
+//
+//	default: {rate: 50, burst: 100, writes: 1000, per: 1h}
+//	clients:
+//	  service:ci: {rate: 500, burst: 1000}
+//	tenants:
+//	  acme: {rate: 200, writes: 10000, per: 24h}
+func ParseRateLimits(data []byte) (*RateLimits, error) {
+	var r RateLimits
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if err := r.Default.validate(); err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+	for name, l := range r.Clients {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("client %s: %v", name, err)
+		}
+	}
+	for name, l := range r.Tenants {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", name, err)
+		}
+	}
+	return &r, nil
+}
+
+// LoadRateLimits reads a limits file with ParseRateLimits
+func LoadRateLimits(path string) (*RateLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ParseRateLimits(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// limited is a limit and the key of its state
+type limited struct {
+	key   string
+	limit Limit
+}
+
+// limitsFor returns the limits a request of client in tenant is held to
+func (r *RateLimits) limitsFor(client, tenant string) []limited {
+	l, ok := r.Clients[client]
+	if !ok {
+		l = r.Default
+	}
+	out := []limited{{key: "client:" + client, limit: l}}
+	if t, ok := r.Tenants[tenant]; ok && tenant != "" {
+		out = append(out, limited{key: "tenant:" + tenant, limit: t})
+	}
+	return out
+}
+
+func (r *RateLimits) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// Allow takes a token for a request of client in tenant. When a bucket is empty nothing
+// is taken and Allow returns false with the time until a token is back.
+func (r *RateLimits) Allow(client, tenant string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*tokenBucket)
+	}
+	var wait time.Duration
+	var take []*tokenBucket
+	for _, l := range r.limitsFor(client, tenant) {
+		if l.limit.Rate == 0 {
+			continue
+		}
+		b, ok := r.buckets[l.key]
+		if !ok {
+			b = &tokenBucket{tokens: l.limit.burst(), last: now}
+			r.buckets[l.key] = b
+		}
+		b.tokens = math.Min(l.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+			continue
+		}
+		take = append(take, b)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range take {
+		b.tokens--
+	}
+	if len(r.buckets) > maxLimiterKeys {
+		r.pruneLocked(now)
+	}
+	return true, 0
+}
+
+// AllowWrite counts a write of client in tenant against the write quotas. Over quota
+// nothing is counted and AllowWrite returns false with the time until the window ends.
+func (r *RateLimits) AllowWrite(client, tenant string) (bool, time.Duration) {
+	_, ok, wait := r.reserveWrite(client, tenant)
+	return ok, wait
+}
+
+// reserveWrite is AllowWrite that also returns a release, which takes the write back out
+// of the windows it was counted in when it failed
+func (r *RateLimits) reserveWrite(client, tenant string) (func(), bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock()
+	if r.windows == nil {
+		r.windows = make(map[string]*writeWindow)
+	}
+	var wait time.Duration
+	var count []*writeWindow
+	for _, l := range r.limitsFor(client, tenant) {
+		if l.limit.Writes == 0 {
+			continue
+		}
+		w, ok := r.windows[l.key]
+		if !ok || !now.Before(w.start.Add(l.limit.per())) {
+			w = &writeWindow{start: now}
+			r.windows[l.key] = w
+		}
+		if w.writes >= l.limit.Writes {
+			if left := w.start.Add(l.limit.per()).Sub(now); left > wait {
+				wait = left
+			}
+			continue
+		}
+		count = append(count, w)
+	}
+	if wait > 0 {
+		return nil, false, wait
+	}
+	for _, w := range count {
+		w.writes++
+	}
+	if len(r.windows) > maxLimiterKeys {
+		r.pruneLocked(now)
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// a window that ended since is no longer in the map, changing it does nothing
+		for _, w := range count {
+			w.writes--
+		}
+	}, true, 0
+}
+
+// pruneLocked drops state that no longer limits anything: buckets idle long enough to
+// be full again and windows that ended. Limits are looked up by key, so a dropped entry
+// comes back as if new.
+func (r *RateLimits) pruneLocked(now time.Time) {
+	limitOf := func(key string) Limit {
+		if tenant, ok := strings.CutPrefix(key, "tenant:"); ok {
+			return r.Tenants[tenant]
+		}
+		if l, ok := r.Clients[strings.TrimPrefix(key, "client:")]; ok {
+			return l
+		}
+		return r.Default
+	}
+	for key, b := range r.buckets {
+		l := limitOf(key)
+		if l.Rate == 0 || b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.burst() {
+			delete(r.buckets, key)
+		}
+	}
+	for key, w := range r.windows {
+		if !now.Before(w.start.Add(limitOf(key).per())) {
+			delete(r.windows, key)
+		}
+	}
+}
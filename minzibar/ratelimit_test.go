@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time      { return f.t }
+func (f *fakeClock) add(d time.Duration) { f.t = f.t.Add(d) }
+
+// limitsWithClock makes r read the time from a fake clock
+func limitsWithClock(r *RateLimits) *fakeClock {
+	c := &fakeClock{t: time.Unix(1700000000, 0)}
+	r.now = c.now
+	return c
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits([]byte(`
+default: {rate: 50, burst: 100, writes: 1000, per: 1h}
+clients:
+  service:ci: {rate: 500}
+tenants:
+  acme: {writes: 10}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 50, Burst: 100, Writes: 1000, Per: time.Hour}, limits.Default)
+	assert.Equal(t, 500.0, limits.Clients["service:ci"].burst(), "burst defaults to the rate")
+	assert.Equal(t, DefaultWriteQuotaWindow, limits.Tenants["acme"].per())
+
+	_, err = ParseRateLimits([]byte(`clients: {"service:ci": {rate: -1}}`))
+	assert.Error(t, err)
+	_, err = ParseRateLimits([]byte(`default: {per: soon}`))
+	assert.Error(t, err)
+}
+
+func TestRateLimits_TokenBucket(t *testing.T) {
+	limits := &RateLimits{Default: Limit{Rate: 2, Burst: 3}, Clients: map[string]Limit{"service:ci": {}}}
+	clock := limitsWithClock(limits)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limits.Allow("user:alice", "")
+		require.True(t, ok, "request %d is within the burst", i)
+	}
+	ok, wait := limits.Allow("user:alice", "")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait, "one token comes back every 1/rate")
+
+	// clients have buckets of their own, and a limit of zero is no limit
+	ok, _ = limits.Allow("user:bob", "")
+	assert.True(t, ok)
+	for i := 0; i < 100; i++ {
+		ok, _ = limits.Allow("service:ci", "")
+		require.True(t, ok)
+	}
+
+	clock.add(500 * time.Millisecond)
+	ok, _ = limits.Allow("user:alice", "")
+	assert.True(t, ok)
+	ok, _ = limits.Allow("user:alice", "")
+	assert.False(t, ok)
+	clock.add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = limits.Allow("user:alice", "")
+		assert.True(t, ok, "the bucket refills up to the burst only")
+	}
+	ok, _ = limits.Allow("user:alice", "")
+	assert.False(t, ok)
+}
+
+func TestRateLimits_Tenant(t *testing.T) {
+	limits := &RateLimits{Default: Limit{Rate: 10}, Tenants: map[string]Limit{"acme": {Rate: 1, Burst: 2}}}
+	clock := limitsWithClock(limits)
+
+	ok, _ := limits.Allow("user:alice", "acme")
+	require.True(t, ok)
+	ok, _ = limits.Allow("user:bob", "acme")
+	require.True(t, ok)
+	ok, wait := limits.Allow("user:carol", "acme")
+	assert.False(t, ok, "the tenant's bucket is shared by its clients")
+	assert.Equal(t, time.Second, wait)
+	ok, _ = limits.Allow("user:carol", "globex")
+	assert.True(t, ok)
+
+	// a request refused by the tenant does not cost the client a token
+	clock.add(time.Second)
+	for i := 0; i < 9; i++ {
+		_, _ = limits.Allow("user:carol", "globex")
+	}
+	ok, _ = limits.Allow("user:carol", "acme")
+	assert.True(t, ok, "carol still had her tenth token")
+}
+
+func TestRateLimits_WriteQuota(t *testing.T) {
+	limits := &RateLimits{Default: Limit{Writes: 2, Per: time.Minute}, Tenants: map[string]Limit{"acme": {Writes: 3, Per: time.Hour}}}
+	clock := limitsWithClock(limits)
+
+	for i := 0; i < 2; i++ {
+		ok, _ := limits.AllowWrite("user:alice", "acme")
+		require.True(t, ok)
+	}
+	ok, wait := limits.AllowWrite("user:alice", "acme")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, wait)
+
+	ok, _ = limits.AllowWrite("user:bob", "acme")
+	require.True(t, ok)
+	ok, wait = limits.AllowWrite("user:bob", "acme")
+	assert.False(t, ok, "the tenant used up its hour")
+	assert.Equal(t, time.Hour, wait)
+
+	clock.add(time.Minute)
+	ok, _ = limits.AllowWrite("user:alice", "")
+	assert.True(t, ok, "a new window for alice")
+	ok, wait = limits.AllowWrite("user:alice", "acme")
+	assert.False(t, ok)
+	assert.Equal(t, 59*time.Minute, wait)
+}
+
+func TestRateLimits_Prune(t *testing.T) {
+	limits := &RateLimits{Default: Limit{Rate: 1, Writes: 1}}
+	clock := limitsWithClock(limits)
+	for i := 0; i <= maxLimiterKeys; i++ {
+		client := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		limits.Allow(client, "")
+		limits.AllowWrite(client, "")
+	}
+	clock.add(time.Minute)
+	limits.Allow("user:alice", "")
+	limits.AllowWrite("user:alice", "")
+	limits.Allow("user:bob", "")
+	limits.AllowWrite("user:bob", "")
+	assert.Len(t, limits.buckets, 2, "refilled buckets are dropped")
+	assert.Len(t, limits.windows, 2, "ended windows are dropped")
+}
+
+func TestService_RateLimits(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	service := NewService(engine)
+	service.Auth = NewAPIKeyAuthenticator(map[string]ObjectRef{
+		"ci-key":    {Type: "service", ObjectID: "ci"},
+		"alice-key": alice,
+	})
+	service.Telemetry = NewTelemetry(nil)
+	service.Limits = &RateLimits{
+		Default: Limit{Rate: 1, Burst: 2, Writes: 1},
+		Clients: map[string]Limit{"service:ci": {Rate: 100}},
+	}
+	limitsWithClock(service.Limits)
+	e := service.Echo()
+	call := func(key, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(APIKeyHeader, key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	verify := VerifyRequest{ResourceType: "document", ResourceID: "plan", SubjectType: "user", SubjectID: "alice", Action: "read"}
+
+	assert.Equal(t, http.StatusOK, call("alice-key", "/relation", AddRelationQueryRequest{Query: "document:plan user:alice->read"}).Code)
+	rec := call("alice-key", "/relation", AddRelationQueryRequest{Query: "document:plan user:bob->read"})
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "one write per minute")
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "write quota exceeded for user:alice")
+
+	rec = call("alice-key", "/verify", verify)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "two requests were the burst")
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	// service:ci has a limit of its own, without a write quota
+	for i := 0; i < 20; i++ {
+		require.Equal(t, http.StatusOK, call("ci-key", "/verify", verify).Code)
+	}
+	assert.Equal(t, http.StatusOK, call("ci-key", "/relation", AddRelationQueryRequest{Query: "document:plan user:bob->read"}).Code)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.Telemetry.throttled.WithLabelValues("", "rate")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.Telemetry.throttled.WithLabelValues("", "write_quota")))
+}
+
+func TestService_WriteQuotaFailedWrites(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	service := NewService(engine)
+	service.Limits = &RateLimits{Default: Limit{Writes: 1}}
+	limitsWithClock(service.Limits)
+	e := service.Echo()
+	write := func(query string) int {
+		payload, err := json.Marshal(AddRelationQueryRequest{Query: query})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/relation", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, write("document:plan"))
+	assert.Equal(t, http.StatusOK, write("document:plan user:alice->read"), "the failed write gave its slot back")
+	assert.Equal(t, http.StatusTooManyRequests, write("document:plan user:bob->read"))
+}
+
+func TestService_RateLimitsSpoofedForwardedFor(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	service := NewService(engine)
+	service.Limits = &RateLimits{Default: Limit{Rate: 1, Burst: 1}}
+	limitsWithClock(service.Limits)
+	verify := func(e http.Handler, from, forwardedFor string) int {
+		payload, err := json.Marshal(VerifyRequest{ResourceType: "document", ResourceID: "plan", SubjectType: "user", SubjectID: "alice", Action: "read"})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/verify", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.RemoteAddr = from + ":4000"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	e := service.Echo()
+	assert.Equal(t, http.StatusOK, verify(e, "203.0.113.7", "198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, verify(e, "203.0.113.7", "198.51.100.2"),
+		"a forwarded address from an untrusted caller does not get a bucket of its own")
+	assert.Equal(t, http.StatusOK, verify(e, "203.0.113.8", "198.51.100.1"))
+
+	// behind a trusted proxy the forwarded address is the client
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	service.TrustedProxies = []*net.IPNet{proxies}
+	e = service.Echo()
+	assert.Equal(t, http.StatusOK, verify(e, "10.1.2.3", "198.51.100.3"))
+	assert.Equal(t, http.StatusTooManyRequests, verify(e, "10.1.2.3", "198.51.100.3"))
+	assert.Equal(t, http.StatusOK, verify(e, "10.1.2.3", "198.51.100.4"))
+	assert.Equal(t, http.StatusTooManyRequests, verify(e, "203.0.113.8", "198.51.100.5, 198.51.100.6"),
+		"only trusted proxies are believed")
+}
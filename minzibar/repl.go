@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const replHelp = `commands:
+  can <subject> <action> <resource> [key=value ...]   verify with policies
+  has <subject> <relation> <resource>                 direct relation only
+  write <query>                                       add relations
+  expand <type:id> <relation>                         print the userset tree
+  find <field> <op> <value> [and ...] [limit N]       list matching tuples
+  set key=value | unset key | ctx                     manage session context
+  export [ndjson|text]                                print a snapshot
+  help | quit`
+
+// runREPL implements `minzibar repl`
+func runREPL(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	var bf backendFlags
+	bf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	backend, err := bf.open()
+	if err != nil {
+		return err
+	}
+	r := &repl{backend: backend, ctx: map[string]string{}, out: stdout}
+	return r.run(stdin)
+}
+
+// repl keeps the session state of an interactive shell
+type repl struct {
+	backend cliBackend
+	ctx     map[string]string
+	out     io.Writer
+}
+
+var errQuit = errors.New("quit")
+
+func (r *repl) run(in io.Reader) error {
+	interactive := in == os.Stdin
+	scanner := bufio.NewScanner(in)
+	for {
+		if interactive {
+			fmt.Fprint(r.out, "minzibar> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := r.exec(line); err != nil {
+			if errors.Is(err, errQuit) {
+				return nil
+			}
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+	}
+}
+
+// exec runs a single repl line
+func (r *repl) exec(line string) error {
+	fields := strings.Fields(line)
+	cmd := strings.ToLower(fields[0])
+	switch cmd {
+	case "quit", "exit":
+		return errQuit
+	case "help":
+		fmt.Fprintln(r.out, replHelp)
+	case KeyWordCan, "has":
+		if len(fields) < 4 {
+			return fmt.Errorf("usage: %s <subject> <action> <resource> [key=value ...]", cmd)
+		}
+		ctx := make(map[string]string, len(r.ctx))
+		for k, v := range r.ctx {
+			ctx[k] = v
+		}
+		for _, kv := range fields[4:] {
+			if err := contextFlag(ctx).Set(kv); err != nil {
+				return err
+			}
+		}
+		// both forms reuse the engine's "can ..." query parser
+		query := strings.Join(append([]string{KeyWordCan}, fields[1:4]...), " ")
+		allowed, err := r.backend.Check(query, ctx, cmd == "has")
+		if err != nil {
+			return err
+		}
+		if allowed {
+			fmt.Fprintln(r.out, "allow")
+		} else {
+			fmt.Fprintln(r.out, "deny")
+		}
+	case "write":
+		if len(fields) < 2 {
+			return errors.New("usage: write <query>")
+		}
+		if err := r.backend.Write(strings.TrimSpace(line[len(fields[0]):])); err != nil {
+			return err
+		}
+		fmt.Fprintln(r.out, "ok")
+	case KeyWordFind:
+		return printFind(r.out, r.backend, line)
+	case "expand":
+		if len(fields) != 3 {
+			return errors.New("usage: expand <type:id> <relation>")
+		}
+		object, err := parseObjectRef(fields[1])
+		if err != nil {
+			return err
+		}
+		node, err := r.backend.Expand(object, fields[2])
+		if err != nil {
+			return err
+		}
+		printExpandTree(r.out, node, "")
+	case "set":
+		for _, kv := range fields[1:] {
+			if err := contextFlag(r.ctx).Set(kv); err != nil {
+				return err
+			}
+		}
+	case "unset":
+		for _, k := range fields[1:] {
+			delete(r.ctx, k)
+		}
+	case "ctx":
+		keys := make([]string, 0, len(r.ctx))
+		for k := range r.ctx {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(r.out, "%s=%s\n", k, r.ctx[k])
+		}
+	case "export":
+		format := ""
+		if len(fields) > 1 {
+			format = fields[1]
+		}
+		sf, err := ParseSnapshotFormat(format)
+		if err != nil {
+			return err
+		}
+		return r.backend.Export(r.out, sf)
+	default:
+		return fmt.Errorf("unknown command %q, try help", fields[0])
+	}
+	return nil
+}
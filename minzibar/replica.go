@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxStaleness is how long a follower serves reads without hearing from its leader
+	DefaultMaxStaleness = 30 * time.Second
+	// DefaultPollWait is how long a follower's request for changes waits on the leader
+	DefaultPollWait = 10 * time.Second
+	// MaxPollWait bounds the wait a request to /changes may ask for
+	MaxPollWait = 30 * time.Second
+	// DefaultChangeBatch is the number of changes a follower asks for at a time
+	DefaultChangeBatch = 1000
+	// DefaultConsistencyWait is how long a follower holds a read for a revision it lacks
+	DefaultConsistencyWait = time.Second
+)
+
+// ErrReplicaNotReady is returned by a follower that has not loaded a snapshot yet
+var ErrReplicaNotReady = errors.New("replica is not ready")
+
+// ChangeBatch answers GET /changes: changes after the asked revision and the leader's
+// newest revision
+type ChangeBatch struct {
+	Revision uint64   `json:"revision"`
+	Changes  []Change `json:"changes"`
+}
+
+// ReplicationStatus answers GET /replication/status
+type ReplicationStatus struct {
+	// Role is leader, follower, standalone or store, for a server backed by a TupleStore
+	Role     string `json:"role"`
+	Revision uint64 `json:"revision"`
+	// Leader, LeaderRevision and Lag describe a follower's leader as last heard from, or
+	// the store of a server backed by one; Lag is the number of revisions it is behind
+	Leader         string `json:"leader,omitempty"`
+	LeaderRevision uint64 `json:"leader_revision,omitempty"`
+	Lag            uint64 `json:"lag"`
+	// CaughtUpAt is when a follower last knew it had everything the leader had
+	CaughtUpAt *time.Time `json:"caught_up_at,omitempty"`
+	// Staleness is how long ago that was, in seconds
+	Staleness float64 `json:"staleness_seconds,omitempty"`
+	Stale     bool    `json:"stale,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// OldestRevision is the oldest revision a leader can still send the changes after
+	OldestRevision *uint64 `json:"oldest_revision,omitempty"`
+}
+
+// Replica keeps a read-only copy of a leader's engine: it loads the leader's snapshot,
+// then tails the leader's change log. Revisions follow the leader's, so a consistency
+// token from a write to the leader holds on the follower once it caught up.
+type Replica struct {
+	// Leader is the base url of the leader, e.g. http://leader:8080 or .../tenants/acme
+	Leader string
+	// Client is http.DefaultClient when nil; set a transport adding credentials when the
+	// leader requires them
+	Client *http.Client
+	// MaxStaleness is DefaultMaxStaleness when 0; past it reads fail with 503
+	MaxStaleness time.Duration
+	// PollWait is DefaultPollWait when 0
+	PollWait time.Duration
+	// Batch is DefaultChangeBatch when 0
+	Batch int
+	// ConsistencyWait is how long a read asking for a revision not yet applied waits for
+	// it before failing with 412, DefaultConsistencyWait when 0
+	ConsistencyWait time.Duration
+	// Setup, when set, configures each engine the replica builds, as Tenants.Setup
+	Setup func(*Engine)
+
+	engine atomic.Pointer[Engine]
+
+	mu             sync.Mutex
+	leaderRevision uint64
+	caughtUpAt     time.Time
+	lastErr        error
+	// applied is closed and replaced whenever the engine moves forward
+	applied chan struct{}
+}
+
+// NewReplica returns a follower of the leader at leaderURL
+func NewReplica(leaderURL string) *Replica {
+	return &Replica{Leader: strings.TrimRight(leaderURL, "/"), applied: make(chan struct{})}
+}
+
+// Engine returns the engine serving reads, nil until the first snapshot is loaded
+func (r *Replica) Engine() *Engine {
+	return r.engine.Load()
+}
+
+// Run keeps the replica in sync until ctx is done, retrying failures every second
+func (r *Replica) Run(ctx context.Context) error {
+	for {
+		err := r.sync(ctx, r.pollWait())
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("replica: %v", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Sync loads a snapshot when needed and applies the leader's changes until caught up,
+// without waiting for new ones
+func (r *Replica) Sync(ctx context.Context) error {
+	return r.sync(ctx, 0)
+}
+
+func (r *Replica) sync(ctx context.Context, wait time.Duration) error {
+	err := r.pull(ctx, wait)
+	if errors.Is(err, ErrChangesTruncated) {
+		// too far behind for the change log, start over from a snapshot
+		r.engine.Store(nil)
+		err = r.pull(ctx, wait)
+	}
+	r.mu.Lock()
+	r.lastErr = err
+	r.mu.Unlock()
+	return err
+}
+
+// pull bootstraps when there is no engine, then applies batches until one comes back
+// without changes; wait is only used once caught up
+func (r *Replica) pull(ctx context.Context, wait time.Duration) error {
+	engine := r.Engine()
+	if engine == nil {
+		var err error
+		if engine, err = r.bootstrap(ctx); err != nil {
+			return err
+		}
+	}
+	batch := r.Batch
+	if batch <= 0 {
+		batch = DefaultChangeBatch
+	}
+	for {
+		var w time.Duration
+		if r.isCaughtUp() {
+			w = wait
+		}
+		var out ChangeBatch
+		q := url.Values{"after": {strconv.FormatUint(engine.graph.Revision(), 10)}, "limit": {strconv.Itoa(batch)}}
+		if w > 0 {
+			q.Set("wait", w.String())
+		}
+		if err := r.get(ctx, "/changes?"+q.Encode(), &out); err != nil {
+			return err
+		}
+		for _, c := range out.Changes {
+			if err := engine.applyChange(c); err != nil {
+				return err
+			}
+		}
+		caughtUp := engine.graph.Revision() >= out.Revision
+		r.noteProgress(out.Revision, caughtUp)
+		if caughtUp && (w > 0 || len(out.Changes) == 0 || wait == 0) {
+			return nil
+		}
+	}
+}
+
+// bootstrap loads the leader's snapshot into a new engine. The leader's revision is read
+// first: changes after it may already be in the snapshot, and replaying them is harmless.
+func (r *Replica) bootstrap(ctx context.Context) (*Engine, error) {
+	var status ReplicationStatus
+	if err := r.get(ctx, "/replication/status", &status); err != nil {
+		return nil, err
+	}
+	if status.Role != "leader" {
+		return nil, fmt.Errorf("%s is not a leader, it is %s", r.Leader, status.Role)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Leader+"/export?format=ndjson", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	if r.Setup != nil {
+		r.Setup(engine)
+	}
+	if _, err := engine.Import(resp.Body, SnapshotNDJSON); err != nil {
+		return nil, fmt.Errorf("snapshot of %s: %w", r.Leader, err)
+	}
+	// the import counted its own revisions, the leader's is the one tokens refer to
+	engine.graph.revision.Store(status.Revision)
+	r.engine.Store(engine)
+	r.noteProgress(status.Revision, false)
+	return engine, nil
+}
+
+func (r *Replica) noteProgress(leaderRevision uint64, caughtUp bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if leaderRevision > r.leaderRevision {
+		r.leaderRevision = leaderRevision
+	}
+	if caughtUp {
+		r.caughtUpAt = time.Now()
+	}
+	close(r.applied)
+	r.applied = make(chan struct{})
+}
+
+func (r *Replica) isCaughtUp() bool {
+	engine := r.Engine()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return engine != nil && engine.graph.Revision() >= r.leaderRevision
+}
+
+// Status reports the follower's revision and how far it trails the leader
+func (r *Replica) Status() ReplicationStatus {
+	st := ReplicationStatus{Role: "follower", Leader: r.Leader}
+	engine := r.Engine()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st.LeaderRevision = r.leaderRevision
+	if engine != nil {
+		st.Revision = engine.graph.Revision()
+	}
+	if st.LeaderRevision > st.Revision {
+		st.Lag = st.LeaderRevision - st.Revision
+	}
+	if !r.caughtUpAt.IsZero() {
+		at := r.caughtUpAt
+		st.CaughtUpAt = &at
+		st.Staleness = time.Since(at).Seconds()
+	}
+	st.Stale = r.staleLocked(engine)
+	if r.lastErr != nil {
+		st.Error = r.lastErr.Error()
+	}
+	return st
+}
+
+// Stale reports whether the replica has gone MaxStaleness without catching up
+func (r *Replica) Stale() bool {
+	engine := r.Engine()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.staleLocked(engine)
+}
+
+func (r *Replica) staleLocked(engine *Engine) bool {
+	max := r.MaxStaleness
+	if max <= 0 {
+		max = DefaultMaxStaleness
+	}
+	return engine == nil || r.caughtUpAt.IsZero() || time.Since(r.caughtUpAt) > max
+}
+
+// WaitFor blocks until the replica reached revision rev or ctx is done
+func (r *Replica) WaitFor(ctx context.Context, rev uint64) bool {
+	for {
+		r.mu.Lock()
+		applied := r.applied
+		r.mu.Unlock()
+		if engine := r.Engine(); engine != nil && engine.graph.Revision() >= rev {
+			return true
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (r *Replica) consistencyWait() time.Duration {
+	if r.ConsistencyWait > 0 {
+		return r.ConsistencyWait
+	}
+	return DefaultConsistencyWait
+}
+
+func (r *Replica) pollWait() time.Duration {
+	if r.PollWait > 0 {
+		return r.PollWait
+	}
+	return DefaultPollWait
+}
+
+func (r *Replica) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return http.DefaultClient
+}
+
+// get fetches path from the leader as JSON; 410 from /changes is ErrChangesTruncated
+func (r *Replica) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Leader+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusGone:
+		return fmt.Errorf("%w: %v", ErrChangesTruncated, responseError(resp))
+	}
+	return responseError(resp)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replicationPair runs a leader keeping logSize changes and a follower of it on localhost
+type replicationPair struct {
+	leader, follower *httptest.Server
+	engine           *Engine
+	replica          *Replica
+}
+
+func newReplicationPair(t *testing.T, logSize int) *replicationPair {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.EnableChangeLog(logSize)
+	engine.CreateResource("document", "plan")
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read"))
+	require.NoError(t, engine.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(plan, "p"))
+	leader := httptest.NewServer(NewService(engine).Echo())
+	t.Cleanup(leader.Close)
+
+	replica := NewReplica(leader.URL)
+	replica.ConsistencyWait = 200 * time.Millisecond
+	service := NewService(nil)
+	service.Replica = replica
+	follower := httptest.NewServer(service.Echo())
+	t.Cleanup(follower.Close)
+	return &replicationPair{leader: leader, follower: follower, engine: engine, replica: replica}
+}
+
+// noRedirect reports redirects instead of following them
+var noRedirect = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+func postTo(t *testing.T, url string, body interface{}, header http.Header) *http.Response {
+	payload, err := json.Marshal(body)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := noRedirect.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func verifyOn(t *testing.T, url, user string, header http.Header) (int, bool) {
+	resp := postTo(t, url+"/verify", VerifyRequest{ResourceType: "document", ResourceID: "plan", SubjectType: "user", SubjectID: user, Action: "read", Context: map[string]string{"department": "eng"}}, header)
+	var out map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	allowed, _ := out["allowed"].(bool)
+	return resp.StatusCode, allowed
+}
+
+func TestReplica_FollowsLeader(t *testing.T) {
+	p := newReplicationPair(t, 0)
+	ctx := context.Background()
+
+	// not ready before the first sync
+	code, _ := verifyOn(t, p.follower.URL, "alice", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	require.NoError(t, p.replica.Sync(ctx))
+	code, allowed := verifyOn(t, p.follower.URL, "alice", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, allowed, "the snapshot is loaded")
+
+	// writes, policies and flags made on the leader reach the follower
+	require.Equal(t, http.StatusOK, postTo(t, p.leader.URL+"/relation", AddRelationQueryRequest{Query: "document:plan user:bob->read"}, nil).StatusCode)
+	require.NoError(t, p.engine.AddPolicy("eng-only", `allow read if subject.department == "eng"`))
+	require.NoError(t, p.engine.AddPolicyToResource(plan, "eng-only"))
+	require.NoError(t, p.engine.RegisterFlag(dashboardFlag))
+
+	status := p.replica.Status()
+	assert.Equal(t, uint64(0), status.Lag, "lag is only known after asking the leader")
+	require.NoError(t, p.replica.Sync(ctx))
+	status = p.replica.Status()
+	assert.Equal(t, p.engine.graph.Revision(), status.Revision)
+	assert.Equal(t, p.engine.graph.Revision(), status.LeaderRevision)
+	assert.Zero(t, status.Lag)
+	assert.False(t, status.Stale)
+
+	follower := p.replica.Engine()
+	assert.Equal(t, p.engine.graph.ReadTuples(plan, ""), follower.graph.ReadTuples(plan, ""))
+	assert.Equal(t, p.engine.Flags(), follower.Flags())
+	ok, err := follower.Verify(plan, bob, "read", map[string]string{"subject.department": "eng"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = follower.Verify(plan, bob, "read", map[string]string{"subject.department": "sales"})
+	require.NoError(t, err)
+	assert.False(t, ok, "the leader's policy is enforced")
+
+	// status is served by both
+	var st ReplicationStatus
+	resp, err := http.Get(p.follower.URL + "/replication/status")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&st))
+	resp.Body.Close()
+	assert.Equal(t, "follower", st.Role)
+	assert.Equal(t, p.leader.URL, st.Leader)
+	resp, err = http.Get(p.leader.URL + "/replication/status")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&st))
+	resp.Body.Close()
+	assert.Equal(t, "leader", st.Role)
+	assert.Equal(t, p.engine.graph.Revision(), st.Revision)
+}
+
+func TestReplica_RedirectsWrites(t *testing.T) {
+	p := newReplicationPair(t, 0)
+	require.NoError(t, p.replica.Sync(context.Background()))
+
+	resp := postTo(t, p.follower.URL+"/relation?dry=1", AddRelationQueryRequest{Query: "document:plan user:bob->read"}, nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, p.leader.URL+"/relation?dry=1", resp.Header.Get("Location"))
+	assert.Equal(t, http.StatusTemporaryRedirect, postTo(t, p.follower.URL+"/flags", dashboardFlag, nil).StatusCode)
+
+	// a client following the redirect writes to the leader
+	payload, _ := json.Marshal(AddRelationQueryRequest{Query: "document:plan user:bob->read"})
+	resp, err := http.Post(p.follower.URL+"/relation", "application/json", bytes.NewReader(payload))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	code, allowed := verifyOn(t, p.leader.URL, "bob", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, allowed)
+}
+
+func TestReplica_ConsistencyToken(t *testing.T) {
+	p := newReplicationPair(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, p.replica.Sync(ctx))
+
+	resp := postTo(t, p.leader.URL+"/relation", AddRelationQueryRequest{Query: "document:plan user:bob->read"}, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	token := resp.Header.Get(RevisionHeader)
+	require.NotEmpty(t, token)
+	header := http.Header{ConsistencyHeader: {token}}
+
+	// without anyone pulling the follower cannot reach the token in time
+	code, _ := verifyOn(t, p.follower.URL, "bob", header)
+	assert.Equal(t, http.StatusPreconditionFailed, code)
+
+	// with the follower tailing, the read waits until the write arrived
+	p.replica.PollWait = 50 * time.Millisecond
+	go p.replica.Run(ctx)
+	code, allowed := verifyOn(t, p.follower.URL, "bob", header)
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, allowed)
+
+	rev, err := strconv.ParseUint(token, 10, 64)
+	require.NoError(t, err)
+	assert.True(t, p.replica.WaitFor(ctx, rev))
+}
+
+func TestReplica_Truncated(t *testing.T) {
+	p := newReplicationPair(t, 1)
+	ctx := context.Background()
+	require.NoError(t, p.replica.Sync(ctx))
+	first := p.replica.Engine()
+
+	for _, subject := range []string{"bob", "carol", "dave"} {
+		require.NoError(t, p.engine.AddRelationQuery("document:plan user:"+subject+"->read"))
+	}
+	resp, err := http.Get(p.leader.URL + "/changes?after=1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// too far behind: the follower loads a new snapshot
+	require.NoError(t, p.replica.Sync(ctx))
+	assert.NotSame(t, first, p.replica.Engine())
+	assert.Equal(t, p.engine.graph.ReadTuples(plan, ""), p.replica.Engine().graph.ReadTuples(plan, ""))
+	assert.Equal(t, p.engine.graph.Revision(), p.replica.Engine().graph.Revision())
+}
+
+func TestReplica_Staleness(t *testing.T) {
+	p := newReplicationPair(t, 0)
+	p.replica.MaxStaleness = 20 * time.Millisecond
+	require.NoError(t, p.replica.Sync(context.Background()))
+	code, _ := verifyOn(t, p.follower.URL, "alice", nil)
+	require.Equal(t, http.StatusOK, code)
+
+	p.leader.Close()
+	assert.Error(t, p.replica.Sync(context.Background()))
+	time.Sleep(30 * time.Millisecond)
+	code, _ = verifyOn(t, p.follower.URL, "alice", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	status := p.replica.Status()
+	assert.True(t, status.Stale)
+	assert.NotEmpty(t, status.Error)
+}
+
+func TestService_Changes(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	e := NewService(engine).Echo()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	assert.Equal(t, http.StatusNotFound, get("/changes").Code)
+	var st ReplicationStatus
+	require.NoError(t, json.Unmarshal(get("/replication/status").Body.Bytes(), &st))
+	assert.Equal(t, "standalone", st.Role)
+
+	engine.EnableChangeLog(0)
+	engine.CreateResource("document", "plan")
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read"))
+	rec := get("/changes?after=0&limit=1")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var batch ChangeBatch
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+	assert.Equal(t, uint64(2), batch.Revision)
+	require.Len(t, batch.Changes, 1)
+	assert.Equal(t, ChangeWrite, batch.Changes[0].Op)
+
+	// a long poll returns when its wait is up
+	start := time.Now()
+	rec = get("/changes?after=2&wait=20ms")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.JSONEq(t, `{"revision": 2, "changes": []}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, get("/changes?after=x").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/changes?wait=soon").Code)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Role is a named set of permissions. A role is granted like any relation, on one
+// resource (document:plan#editor@user:alice) or on every object of a type
+// (document:*#editor@group:eng#member), and its holders hold each of its permissions.
+// Redefining a role changes what its holders may do without rewriting their tuples.
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Description string   `json:"description,omitempty"`
+}
+
+// ErrUnknownRole is returned for a role that is not defined
+var ErrUnknownRole = errors.New("unknown role")
+
+func validRelationName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ":#@,> ") && name != TypeWildcard
+}
+
+// normalize checks the role and sorts its permissions
+func (r *Role) normalize() error {
+	if !validRelationName(r.Name) {
+		return fmt.Errorf("invalid role name %q", r.Name)
+	}
+	if len(r.Permissions) == 0 {
+		return fmt.Errorf("role %s grants no permissions", r.Name)
+	}
+	perms := make([]string, 0, len(r.Permissions))
+	seen := make(map[string]bool, len(r.Permissions))
+	for _, p := range r.Permissions {
+		p = strings.TrimSpace(p)
+		switch {
+		case !validRelationName(p):
+			return fmt.Errorf("role %s: invalid permission %q", r.Name, p)
+		case p == r.Name:
+			return fmt.Errorf("role %s cannot grant itself", r.Name)
+		case seen[p]:
+			continue
+		}
+		seen[p] = true
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+	r.Permissions = perms
+	return nil
+}
+
+// DefineRole adds or replaces a role; existing grants of the role take the new permissions
+func (e *Engine) DefineRole(r Role) error {
+	if err := r.normalize(); err != nil {
+		return err
+	}
+	return e.putRole(&r)
+}
+
+// putRole stores a normalized role and logs it
+func (e *Engine) putRole(r *Role) error {
+	return e.logChange(func() (*Change, error) {
+		e.setRole(r.Name, r)
+		e.graph.revision.Add(1)
+		logged := *r
+		return &Change{Op: ChangeRole, Role: &logged}, nil
+	})
+}
+
+// DeleteRole removes a role. Its grants stay as plain relations that confer nothing
+// until the role is defined again.
+func (e *Engine) DeleteRole(name string) error {
+	if !e.hasRole(name) {
+		return fmt.Errorf("%w: %s", ErrUnknownRole, name)
+	}
+	return e.logChange(func() (*Change, error) {
+		e.setRole(name, nil)
+		e.graph.revision.Add(1)
+		return &Change{Op: ChangeRoleDelete, Role: &Role{Name: name}}, nil
+	})
+}
+
+// hasRole reports whether a role is defined
+func (e *Engine) hasRole(name string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	_, ok := e.roles[name]
+	return ok
+}
+
+// role returns a copy of a defined role
+func (e *Engine) role(name string) (Role, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r, ok := e.roles[name]
+	if !ok {
+		return Role{}, false
+	}
+	return *r, true
+}
+
+// setRole defines a role, or deletes it when r is nil; a follower does so while checks
+// read them
+func (e *Engine) setRole(name string, r *Role) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if r == nil {
+		delete(e.roles, name)
+		return
+	}
+	e.roles[name] = r
+}
+
+// Roles returns the defined roles sorted by name
+func (e *Engine) Roles() []Role {
+	e.mu.RLock()
+	out := make([]Role, 0, len(e.roles))
+	for _, r := range e.roles {
+		out = append(out, *r)
+	}
+	e.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// GrantRole gives subject a role on resource, or on every object of its type when the
+// resource id is *
+func (e *Engine) GrantRole(resource ObjectRef, role string, subject SubjectRef) error {
+	if !e.hasRole(role) {
+		return fmt.Errorf("%w: %s", ErrUnknownRole, role)
+	}
+	if resource.ObjectID != TypeWildcard && !e.isResource(resource) {
+		return fmt.Errorf("resource %s does not exist in graph", resource)
+	}
+	return e.AddRelation(resource, role, subject)
+}
+
+// RevokeRole removes a grant made with GrantRole
+func (e *Engine) RevokeRole(resource ObjectRef, role string, subject SubjectRef) error {
+	return e.RemoveRelation(resource, role, subject)
+}
+
+// rolesGranting returns the roles holding permission, sorted by name
+func (e *Engine) rolesGranting(permission string) []string {
+	var names []string
+	e.mu.RLock()
+	for name, r := range e.roles {
+		i := sort.SearchStrings(r.Permissions, permission)
+		if i < len(r.Permissions) && r.Permissions[i] == permission {
+			names = append(names, name)
+		}
+	}
+	e.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// hasPermission is the relation check of Verify: subject holds permission on resource
+// directly or through usersets, or holds a role granting it on the resource or on its
+// type. via names the role grant that matched, "" for the permission itself.
+func (e *Engine) hasPermission(ctx context.Context, resource ObjectRef, permission string, subject ObjectRef) (bool, string, error) {
+	ok, err := e.graph.CheckDeep(ctx, resource, permission, SubjectRef{Object: subject}, e.checkOpts)
+	if ok || err != nil {
+		return ok, "", err
+	}
+	for _, role := range e.rolesGranting(permission) {
+		for _, on := range []ObjectRef{resource, {Type: resource.Type, ObjectID: TypeWildcard}} {
+			ok, err := e.graph.CheckDeep(ctx, on, role, SubjectRef{Object: subject}, e.checkOpts)
+			if err != nil {
+				return false, "", err
+			}
+			if ok {
+				return true, fmt.Sprintf("role %s on %s", role, on), nil
+			}
+		}
+	}
+	return false, "", nil
+}
+
+// hasDirectPermission is hasPermission without usersets, for CheckRelation
+func (e *Engine) hasDirectPermission(resource ObjectRef, permission string, subject SubjectRef) bool {
+	if e.graph.HasDirectRelation(resource, permission, subject) {
+		return true
+	}
+	for _, role := range e.rolesGranting(permission) {
+		if e.graph.HasDirectRelation(resource, role, subject) ||
+			e.graph.HasDirectRelation(ObjectRef{Type: resource.Type, ObjectID: TypeWildcard}, role, subject) {
+			return true
+		}
+	}
+	return false
+}
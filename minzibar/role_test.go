@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roleEngine has an editor role granting read and write, and a policy allowing both
+// to anyone holding them
+func roleEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.CreateResource("document", "plan")
+	engine.CreateResource("document", "roadmap")
+	require.NoError(t, engine.AddPolicy("p", "allow read if action == \"read\"\nallow write if action == \"write\""))
+	require.NoError(t, engine.AddPolicyToResource(plan, "p"))
+	require.NoError(t, engine.AddPolicyToResource(ObjectRef{Type: "document", ObjectID: "roadmap"}, "p"))
+	require.NoError(t, engine.DefineRole(Role{Name: "editor", Permissions: []string{"write", "read", "read"}}))
+	return engine
+}
+
+func TestRole_Define(t *testing.T) {
+	engine := roleEngine(t)
+	assert.Equal(t, []Role{{Name: "editor", Permissions: []string{"read", "write"}}}, engine.Roles())
+
+	for _, r := range []Role{
+		{Name: "", Permissions: []string{"read"}},
+		{Name: "viewer"},
+		{Name: "viewer", Permissions: []string{"re ad"}},
+		{Name: "viewer", Permissions: []string{"viewer"}},
+		{Name: "doc:viewer", Permissions: []string{"read"}},
+	} {
+		assert.Error(t, engine.DefineRole(r), "%+v", r)
+	}
+	assert.ErrorIs(t, engine.DeleteRole("viewer"), ErrUnknownRole)
+	assert.ErrorIs(t, engine.GrantRole(plan, "viewer", SubjectRef{Object: alice}), ErrUnknownRole)
+	assert.Error(t, engine.GrantRole(ObjectRef{Type: "document", ObjectID: "missing"}, "editor", SubjectRef{Object: alice}))
+}
+
+func TestRole_Verify(t *testing.T) {
+	engine := roleEngine(t)
+	roadmap := ObjectRef{Type: "document", ObjectID: "roadmap"}
+	require.NoError(t, engine.GrantRole(plan, "editor", SubjectRef{Object: alice}))
+
+	ok, trace, err := engine.VerifyTrace(plan, alice, "write", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, strings.Join(trace, "\n"), "role editor on document:plan")
+	ok, err = engine.Verify(roadmap, alice, "write", nil)
+	require.NoError(t, err)
+	assert.False(t, ok, "the role was granted on plan only")
+	assert.True(t, engine.CheckRelation(plan, "read", SubjectRef{Object: alice}))
+
+	// a type-wide grant through a group
+	engine.CreateResource("group", "eng")
+	require.NoError(t, engine.AddRelationQuery("group:eng user:bob->member"))
+	require.NoError(t, engine.GrantRole(ObjectRef{Type: "document", ObjectID: TypeWildcard}, "editor", SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "eng"}, Relation: "member"}))
+	for _, doc := range []ObjectRef{plan, roadmap} {
+		ok, err = engine.Verify(doc, bob, "write", nil)
+		require.NoError(t, err)
+		assert.True(t, ok, doc.String())
+	}
+
+	// redefining the role changes what its holders may do
+	rev := engine.graph.Revision()
+	require.NoError(t, engine.DefineRole(Role{Name: "editor", Permissions: []string{"read"}}))
+	assert.Greater(t, engine.graph.Revision(), rev)
+	ok, err = engine.Verify(plan, alice, "write", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = engine.Verify(plan, alice, "read", nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	require.NoError(t, engine.RevokeRole(plan, "editor", SubjectRef{Object: alice}))
+	assert.False(t, engine.CheckRelation(plan, "read", SubjectRef{Object: alice}))
+
+	// the grants of a deleted role confer nothing
+	require.NoError(t, engine.DeleteRole("editor"))
+	ok, err = engine.Verify(roadmap, bob, "read", nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRole_SnapshotAndReplay(t *testing.T) {
+	engine := roleEngine(t)
+	engine.EnableChangeLog(0)
+	start := engine.graph.Revision()
+	require.NoError(t, engine.DefineRole(Role{Name: "viewer", Permissions: []string{"read"}, Description: "read only"}))
+	require.NoError(t, engine.GrantRole(plan, "viewer", SubjectRef{Object: alice}))
+	require.NoError(t, engine.DeleteRole("editor"))
+
+	var buf bytes.Buffer
+	require.NoError(t, engine.Export(&buf, SnapshotNDJSON))
+	restored := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	stats, err := restored.Import(&buf, SnapshotNDJSON)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Roles)
+	assert.Equal(t, engine.Roles(), restored.Roles())
+
+	changes, _, err := engine.ChangeLog().Since(start, 0)
+	require.NoError(t, err)
+	var ops []ChangeOp
+	for _, c := range changes {
+		ops = append(ops, c.Op)
+	}
+	assert.Equal(t, []ChangeOp{ChangeRole, ChangeWrite, ChangeRoleDelete}, ops)
+
+	follower := roleEngine(t)
+	for _, c := range changes {
+		require.NoError(t, follower.applyChange(c))
+	}
+	assert.Equal(t, engine.Roles(), follower.Roles())
+	assert.True(t, follower.CheckRelation(plan, "read", SubjectRef{Object: alice}))
+}
+
+func TestService_Roles(t *testing.T) {
+	engine := roleEngine(t)
+	e := NewService(engine).Echo()
+	call := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/roles", Role{Name: "viewer", Permissions: []string{"read"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/roles", Role{Name: "empty"}).Code)
+
+	rec := call(http.MethodPost, "/roles/grant", RoleGrantRequest{Resource: "document:plan", Role: "viewer", Subject: "user:alice"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/roles/grant", RoleGrantRequest{Resource: "document:plan", Role: "owner", Subject: "user:alice"}).Code)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/roles/grant", RoleGrantRequest{Resource: "plan", Role: "viewer", Subject: "user:alice"}).Code)
+
+	rec = call(http.MethodPost, "/verify", VerifyRequest{ResourceType: "document", ResourceID: "plan", SubjectType: "user", SubjectID: "alice", Action: "read"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"allowed":true`)
+
+	rec = call(http.MethodGet, "/roles", nil)
+	var roles []Role
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &roles))
+	assert.Len(t, roles, 2)
+
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/roles/revoke", RoleGrantRequest{Resource: "document:plan", Role: "viewer", Subject: "user:alice"}).Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/roles/revoke", RoleGrantRequest{Resource: "document:plan", Role: "viewer", Subject: "user:alice"}).Code)
+	require.Equal(t, http.StatusOK, call(http.MethodDelete, "/roles/viewer", nil).Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/roles/viewer", nil).Code)
+}
+
+func TestCLI_Role(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "graph.ndjson")
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"role", "define", "-data", data, "-description", "may edit", "editor", "read,write"}, nil, &out))
+	require.NoError(t, runCLI([]string{"role", "grant", "-data", data, "document:*", "editor", "user:alice"}, nil, &out))
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"role", "list", "-data", data}, nil, &out))
+	assert.Equal(t, "editor\tread,write\n", out.String())
+
+	backend, err := (&backendFlags{data: data}).open()
+	require.NoError(t, err)
+	assert.True(t, backend.(*localBackend).engine.CheckRelation(plan, "write", SubjectRef{Object: alice}))
+
+	require.NoError(t, runCLI([]string{"role", "revoke", "-data", data, "document:*", "editor", "user:alice"}, nil, &out))
+	require.NoError(t, runCLI([]string{"role", "delete", "-data", data, "editor"}, nil, &out))
+	assert.Error(t, runCLI([]string{"role", "delete", "-data", data, "editor"}, nil, &out))
+	assert.Error(t, runCLI([]string{"role", "define", "-data", filepath.Join(dir, "graph.txt"), "viewer", "read"}, nil, &out))
+	err = runCLI([]string{"role", "grant", "-data", data, "document:plan"}, nil, &out)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "usage:"))
+}
@@ -1,39 +1,492 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 // Service wraps the Engine and exposes HTTP endpoints.
 type Service struct {
+	// Engine serves every request when Tenants is nil
 	Engine *Engine
+	// Tenants, when set, gives each tenant its own engine and requires a tenant on every request
+	Tenants *Tenants
+	// CheckTimeout bounds each /verify and /check evaluation, no limit beyond the request when 0
+	CheckTimeout time.Duration
+	// Auth, when set, is required to identify the caller of every request
+	Auth Authenticator
+	// Admin holds the admin permissions checked for writes and admin routes; with Auth set
+	// and Admin nil every authenticated caller may do everything
+	Admin *Engine
+	// TLS, when set, makes Run serve https, with client certificates if it asks for them
+	TLS *tls.Config
+	// Telemetry, when set, is served on /metrics with the tuple counts of every engine;
+	// engines report checks to it once given it with Engine.SetTelemetry
+	Telemetry *Telemetry
+	// Replica, when set, makes the service a read-only follower: reads are served from the
+	// replica's engine and writes are redirected to its leader. Engine and Tenants are unused.
+	Replica *Replica
+	// Store, when set, serves the engine of a TupleStore shared with other servers: writes
+	// go through the store and reads are served from memory. Engine and Tenants are unused.
+	Store *StoreSync
+	// Limits, when set, throttles callers by client and tenant with 429 responses
+	Limits *RateLimits
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For names the client of
+	// a request; without them the client is the address the request came from
+	TrustedProxies []*net.IPNet
 }
 
+// DefaultCheckTimeout is the CheckTimeout of services created by NewService
+const DefaultCheckTimeout = 5 * time.Second
+
 // NewService creates a new Service with the given Engine.
 func NewService(engine *Engine) *Service {
-	return &Service{Engine: engine}
+	return &Service{Engine: engine, CheckTimeout: DefaultCheckTimeout}
+}
+
+// checkContext derives the context a single access check runs under
+func (s *Service) checkContext(c echo.Context) (context.Context, context.CancelFunc) {
+	if s.CheckTimeout > 0 {
+		return context.WithTimeout(c.Request().Context(), s.CheckTimeout)
+	}
+	return context.WithCancel(c.Request().Context())
+}
+
+// checkErrorStatus maps an access check error to a status code: a check that ran out of
+// depth or time has no answer, which is different from a malformed request
+func checkErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrMaxDepthExceeded):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusGatewayTimeout
+	}
+	return writeErrorStatus(err)
+}
+
+// writeErrorStatus maps a failed write to a status code
+func writeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrCrossTenant), errors.Is(err, ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, ErrStoreUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// tenantEngineKey and tenantIDKey are the echo.Context keys resolveTenant stores the tenant under
+const (
+	tenantEngineKey = "minzibar.engine"
+	tenantIDKey     = "minzibar.tenant"
+)
+
+// resolveTenant picks the engine for a request from the /tenants/:tenant path or the
+// X-Tenant-ID header; a request naming two different tenants is rejected
+func (s *Service) resolveTenant(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Tenants == nil {
+			return next(c)
+		}
+		id := c.Param("tenant")
+		header := c.Request().Header.Get(TenantHeader)
+		switch {
+		case id == "":
+			id = header
+		case header != "" && header != id:
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "tenant in path and " + TenantHeader + " header differ"})
+		}
+		if id == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "missing tenant: use /tenants/:tenant or the " + TenantHeader + " header"})
+		}
+		// checked before the lookup, so outsiders cannot tell which tenants exist
+		if p := principal(c); p != nil && s.Admin != nil {
+			ok, err := s.Admin.AuthorizeTenant(c.Request().Context(), p.Subject, id)
+			if err != nil {
+				return c.JSON(checkErrorStatus(err), map[string]string{"error": err.Error()})
+			}
+			if !ok {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": fmt.Sprintf("%s is not a member of tenant %s", p.Subject, id)})
+			}
+		}
+		engine, err := s.Tenants.Get(id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		c.Set(tenantEngineKey, engine)
+		c.Set(tenantIDKey, id)
+		return next(c)
+	}
+}
+
+// RevisionHeader carries the engine revision on every engine response; after a write it
+// is a consistency token covering that write
+const RevisionHeader = "X-Minzibar-Revision"
+
+// ConsistencyHeader asks for a response from an engine at or past the given revision
+const ConsistencyHeader = "X-Minzibar-At-Least"
+
+// consistency rejects a request whose engine has not reached the revision it asks for
+// with 412, and reports the engine revision on the response. A follower first waits a
+// little for the revision, and answers 503 while it is too far behind its leader. A
+// server backed by a store catches up with it for a revision it lacks.
+func (s *Service) consistency(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Replica != nil && s.Replica.Stale() {
+			st := s.Replica.Status()
+			msg := "replica is stale"
+			if st.CaughtUpAt == nil {
+				msg = ErrReplicaNotReady.Error()
+			}
+			if st.Error != "" {
+				msg += ": " + st.Error
+			}
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": msg})
+		}
+		if s.Store != nil && s.Store.Stale() {
+			msg := "engine is behind its store"
+			if st := s.Store.Status(); st.Error != "" {
+				msg += ": " + st.Error
+			}
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": msg})
+		}
+		engine := s.engine(c)
+		if engine == nil {
+			return next(c)
+		}
+		c.Response().Before(func() {
+			c.Response().Header().Set(RevisionHeader, strconv.FormatUint(engine.graph.Revision(), 10))
+		})
+		if token := c.Request().Header.Get(ConsistencyHeader); token != "" {
+			want, err := strconv.ParseUint(token, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid " + ConsistencyHeader + " revision"})
+			}
+			if s.Replica != nil && engine.graph.Revision() < want {
+				ctx, cancel := context.WithTimeout(c.Request().Context(), s.Replica.consistencyWait())
+				s.Replica.WaitFor(ctx, want)
+				cancel()
+				// a re-bootstrap may have swapped the engine while waiting
+				engine = s.engine(c)
+			}
+			if s.Store != nil && engine.graph.Revision() < want {
+				ctx, cancel := context.WithTimeout(c.Request().Context(), DefaultConsistencyWait)
+				s.Store.Sync(ctx)
+				cancel()
+				engine = s.engine(c)
+			}
+			if have := engine.graph.Revision(); have < want {
+				return c.JSON(http.StatusPreconditionFailed, map[string]string{"error": fmt.Sprintf("revision %d not reached, at %d", want, have)})
+			}
+		}
+		return next(c)
+	}
+}
+
+// writable redirects a write sent to a follower to the same path on its leader; 307
+// keeps the method and body. A server backed by a store first catches up with it, so the
+// write is checked against what other servers wrote.
+func (s *Service) writable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Store != nil {
+			if err := s.Store.Sync(c.Request().Context()); err != nil {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			}
+			return next(c)
+		}
+		if s.Replica == nil {
+			return next(c)
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, s.Replica.Leader+c.Request().URL.RequestURI())
+	}
+}
+
+// limitKeys names the client and tenant a request counts against: the caller's subject,
+// or its address without authentication, and the tenant it names
+func (s *Service) limitKeys(c echo.Context) (string, string) {
+	client := c.RealIP()
+	if p := principal(c); p != nil {
+		client = p.Subject.String()
+	}
+	if s.Tenants == nil {
+		return client, ""
+	}
+	tenant := c.Param("tenant")
+	if tenant == "" {
+		tenant = c.Request().Header.Get(TenantHeader)
+	}
+	return client, tenant
+}
+
+// tooManyRequests answers 429 with the seconds to wait in Retry-After
+func (s *Service) tooManyRequests(c echo.Context, tenant, limit string, wait time.Duration, msg string) error {
+	if s.Telemetry != nil {
+		s.Telemetry.throttle(tenant, limit)
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.JSON(http.StatusTooManyRequests, map[string]string{"error": msg})
+}
+
+// throttle takes every request from the rate limits of its client and tenant
+func (s *Service) throttle(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Limits == nil {
+			return next(c)
+		}
+		client, tenant := s.limitKeys(c)
+		if ok, wait := s.Limits.Allow(client, tenant); !ok {
+			return s.tooManyRequests(c, tenant, "rate", wait, "rate limit exceeded for "+client)
+		}
+		return next(c)
+	}
+}
+
+// writeQuota counts a write against the write quotas of its client and tenant
+func (s *Service) writeQuota(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Limits == nil {
+			return next(c)
+		}
+		client, tenant := s.limitKeys(c)
+		release, ok, wait := s.Limits.reserveWrite(client, tenant)
+		if !ok {
+			return s.tooManyRequests(c, tenant, "write_quota", wait, "write quota exceeded for "+client)
+		}
+		err := next(c)
+		// only writes that went through use up the quota
+		if err != nil || c.Response().Status >= http.StatusBadRequest {
+			release()
+		}
+		return err
+	}
+}
+
+// principalKey is the echo.Context key authenticate stores the caller under
+const principalKey = "minzibar.principal"
+
+// authenticate identifies the caller with s.Auth and rejects requests without valid credentials
+func (s *Service) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Auth == nil {
+			return next(c)
+		}
+		p, err := s.Auth.Authenticate(c.Request())
+		if err == nil && p == nil {
+			err = fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+		}
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		}
+		c.Set(principalKey, p)
+		return next(c)
+	}
+}
+
+// principal returns the authenticated caller, nil when authentication is off
+func principal(c echo.Context) *Principal {
+	p, _ := c.Get(principalKey).(*Principal)
+	return p
+}
+
+// authorize asks the admin engine whether the caller holds perm, on the service or on the
+// request's tenant
+func (s *Service) authorize(perm AdminPermission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := principal(c)
+			if s.Admin == nil || p == nil {
+				return next(c)
+			}
+			// a tenant's own admins may not manage tenants, or they could raise their own quota
+			tenant, _ := c.Get(tenantIDKey).(string)
+			if perm == PermManageTenants {
+				tenant = ""
+			}
+			ok, err := s.Admin.AuthorizeAdmin(c.Request().Context(), p.Subject, perm, tenant)
+			if err != nil {
+				return c.JSON(checkErrorStatus(err), map[string]string{"error": err.Error()})
+			}
+			if !ok {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": fmt.Sprintf("%s lacks %s", p.Subject, perm)})
+			}
+			return next(c)
+		}
+	}
+}
+
+// engine returns the engine serving the request, recording the caller as the writer of
+// the tuples it adds
+func (s *Service) engine(c echo.Context) *Engine {
+	engine, ok := c.Get(tenantEngineKey).(*Engine)
+	switch {
+	case ok:
+	case s.Replica != nil:
+		if engine = s.Replica.Engine(); engine == nil {
+			return nil
+		}
+	case s.Store != nil:
+		if engine = s.Store.Engine(); engine == nil {
+			return nil
+		}
+	default:
+		engine = s.Engine
+	}
+	if p := principal(c); p != nil {
+		return engine.WithActor(p.Subject.String())
+	}
+	return engine
 }
 
 // Run starts the Echo server and registers routes.
 func (s *Service) Run(addr string) error {
+	if s.TLS != nil {
+		return s.Echo().StartServer(&http.Server{Addr: addr, TLSConfig: s.TLS})
+	}
+	return s.Echo().Start(addr)
+}
+
+// Echo returns an Echo instance with all service routes registered.
+// With Tenants set every route is also served under /tenants/:tenant, and the plain
+// routes take the tenant from the X-Tenant-ID header.
+func (s *Service) Echo() *echo.Echo {
 	e := echo.New()
+	e.IPExtractor = s.ipExtractor()
+	e.Use(s.authenticate, s.throttle)
+	if s.Telemetry != nil {
+		s.Telemetry.WatchGraphs(s.graphs)
+		e.GET("/metrics", echo.WrapHandler(s.Telemetry.Handler()))
+	}
+	s.registerRoutes(e, "")
+	if s.Tenants != nil {
+		// tenant administration
+		manage := s.authorize(PermManageTenants)
+		e.GET("/tenants", s.handleListTenants, manage)
+		e.POST("/tenants", s.handleCreateTenant, manage)
+		e.GET("/tenants/:tenant", s.handleTenantInfo, manage)
+		e.PUT("/tenants/:tenant/quota", s.handleSetTenantQuota, manage)
+		e.DELETE("/tenants/:tenant", s.handleDeleteTenant, manage)
+		s.registerRoutes(e, "/tenants/:tenant")
+	}
+	return e
+}
+
+// ipExtractor finds the client address that rate limits count against; headers are only
+// believed from trusted proxies, or any caller could pick a fresh bucket
+func (s *Service) ipExtractor() echo.IPExtractor {
+	if len(s.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	trust := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, n := range s.TrustedProxies {
+		trust = append(trust, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(trust...)
+}
+
+// graphs returns the graph of every engine keyed by tenant, "" without tenants
+func (s *Service) graphs() map[string]*RelationGraph {
+	graphs := make(map[string]*RelationGraph)
+	if s.Replica != nil {
+		if engine := s.Replica.Engine(); engine != nil {
+			graphs[""] = engine.graph
+		}
+		return graphs
+	}
+	if s.Store != nil {
+		if engine := s.Store.Engine(); engine != nil {
+			graphs[""] = engine.graph
+		}
+		return graphs
+	}
+	if s.Tenants == nil {
+		if s.Engine != nil {
+			graphs[""] = s.Engine.graph
+		}
+		return graphs
+	}
+	for id, engine := range s.Tenants.engineMap() {
+		graphs[id] = engine.graph
+	}
+	return graphs
+}
 
+// registerRoutes adds the engine routes below prefix; reads need an authenticated caller,
+// writes and dumps an admin permission as well
+func (s *Service) registerRoutes(e *echo.Echo, prefix string) {
 	// create resource
-	e.POST("/resource", s.handleCreateResource)
+	e.POST(prefix+"/resource", s.handleCreateResource, s.writable, s.resolveTenant, s.authorize(PermWriteRelations), s.writeQuota, s.consistency)
+	// create resource from a template, list and register templates
+	e.POST(prefix+"/resource/template", s.handleCreateFromTemplate, s.writable, s.resolveTenant, s.authorize(PermWriteRelations), s.writeQuota, s.consistency)
+	e.GET(prefix+"/resource/templates", s.handleListTemplates, s.resolveTenant, s.consistency)
+	e.POST(prefix+"/resource/templates", s.handleRegisterTemplate, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	// feature flags: list, register, kill switch and evaluation for a subject
+	e.GET(prefix+"/flags", s.handleListFlags, s.resolveTenant, s.consistency)
+	e.POST(prefix+"/flags", s.handleRegisterFlag, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	e.POST(prefix+"/flags/:name/kill", s.handleKillFlag, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	e.POST(prefix+"/flags/evaluate", s.handleEvaluateFlags, s.resolveTenant, s.consistency)
+	// roles: list, define and delete role definitions, grant and revoke roles
+	e.GET(prefix+"/roles", s.handleListRoles, s.resolveTenant, s.consistency)
+	e.POST(prefix+"/roles", s.handleDefineRole, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	e.DELETE(prefix+"/roles/:name", s.handleDeleteRole, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	e.POST(prefix+"/roles/grant", s.handleGrantRole, s.writable, s.resolveTenant, s.authorize(PermWriteRelations), s.writeQuota, s.consistency)
+	e.POST(prefix+"/roles/revoke", s.handleRevokeRole, s.writable, s.resolveTenant, s.authorize(PermWriteRelations), s.writeQuota, s.consistency)
 	// add relation via query
-	e.POST("/relation", s.handleAddRelationQuery)
+	e.POST(prefix+"/relation", s.handleAddRelationQuery, s.writable, s.resolveTenant, s.authorize(PermWriteRelations), s.writeQuota, s.consistency)
 	// add policy
-	e.POST("/policy", s.handleAddPolicy)
-	// attach policy to resource
-	e.POST("/policy/attach", s.handleAttachPolicy)
+	e.POST(prefix+"/policy", s.handleAddPolicy, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	// attach policy to resource, resource_id "*" attaches to the whole type
+	e.POST(prefix+"/policy/attach", s.handleAttachPolicy, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	// effective policies of a resource with provenance
+	e.GET(prefix+"/policies", s.handleEffectivePolicies, s.resolveTenant, s.consistency)
+	// translate Cedar policies, and apply them unless dry_run is set
+	e.POST(prefix+"/policy/import/cedar", s.handleImportCedar, s.writable, s.resolveTenant, s.authorize(PermWritePolicies), s.writeQuota, s.consistency)
+	// dry-run a policy replacement against past decisions
+	e.POST(prefix+"/policy/:id/diff", s.handlePolicyDiff, s.resolveTenant, s.authorize(PermWritePolicies), s.consistency)
 	// verify access
-	e.POST("/verify", s.handleVerify)
-	// list all resources
-	e.GET("/objects", s.handleListAllResources)
-
-	return e.Start(addr)
+	e.POST(prefix+"/verify", s.handleVerify, s.resolveTenant, s.consistency)
+	// verify up to MaxBatchChecks accesses in one request
+	e.POST(prefix+"/verify/batch", s.handleVerifyBatch, s.resolveTenant, s.consistency)
+	// check access with a "can <subject> <action> <resource>" query
+	e.POST(prefix+"/check", s.handleCheckQuery, s.resolveTenant, s.consistency)
+	// relationship queries and batched checks in one round trip, see GraphQLSchema
+	e.GET(prefix+"/graphql", s.handleGraphQL, s.resolveTenant, s.consistency)
+	e.POST(prefix+"/graphql", s.handleGraphQL, s.resolveTenant, s.consistency)
+	e.GET(prefix+"/graphql/schema", s.handleGraphQLSchema)
+	// list tuples with a "find ..." query; like /graph it can reveal as much as an export
+	e.POST(prefix+"/tuples/find", s.handleFindTuples, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// expand the userset tree for object#relation; it lists subjects as /tuples/find does
+	e.GET(prefix+"/expand", s.handleExpand, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// subgraph around ?root= as json, dot or mermaid; it can reveal as much as an export
+	e.GET(prefix+"/graph", s.handleGraph, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// list all resources, as much of the graph as an export names
+	e.GET(prefix+"/objects", s.handleListAllResources, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// bulk snapshot export and import
+	e.GET(prefix+"/export", s.handleExport, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	e.POST(prefix+"/import", s.handleImport, s.writable, s.resolveTenant, s.authorize(PermWriteRelations), s.writeQuota, s.consistency)
+	// who holds what, with when it was granted and last used, as json or ?format=csv
+	e.GET(prefix+"/reports/access", s.handleAccessReview, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// the same report with usage read from the posted decisions instead of the decision log
+	e.POST(prefix+"/reports/access", s.handleAccessReview, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// compare the membership index with a plain walk of the tuples
+	e.GET(prefix+"/index/check", s.handleCheckMembershipIndex, s.resolveTenant, s.authorize(PermExport), s.consistency)
+	// replication: a leader's changes after ?after=, and the revision and lag of this instance
+	e.GET(prefix+"/changes", s.handleChanges, s.resolveTenant, s.authorize(PermExport))
+	e.GET(prefix+"/replication/status", s.handleReplicationStatus, s.resolveTenant)
 }
 
 // --- Handlers ---
@@ -48,10 +501,198 @@ func (s *Service) handleCreateResource(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
-	obj := s.Engine.CreateResource(req.Type, req.ID)
+	obj, err := s.engine(c).AddResource(req.Type, req.ID)
+	if err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
+	}
 	return c.JSON(http.StatusOK, obj)
 }
 
+type CreateFromTemplateRequest struct {
+	Template string            `json:"template"`
+	Name     string            `json:"name"`
+	Params   map[string]string `json:"params"`
+	// Creator is a subject like "user:alice", bound to {creator} in the template
+	Creator string `json:"creator"`
+}
+
+func (s *Service) handleCreateFromTemplate(c echo.Context) error {
+	var req CreateFromTemplateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	params := map[string]string{}
+	for k, v := range req.Params {
+		params[k] = v
+	}
+	if req.Name != "" {
+		params["name"] = req.Name
+	}
+	var creator SubjectRef
+	if req.Creator != "" {
+		obj, err := parseObjectRef(req.Creator)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid creator: " + err.Error()})
+		}
+		creator = SubjectRef{Object: obj}
+	}
+	obj, err := s.engine(c).CreateFromTemplate(req.Template, params, creator)
+	if err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, obj)
+}
+
+func (s *Service) handleListTemplates(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.engine(c).Templates())
+}
+
+func (s *Service) handleRegisterTemplate(c echo.Context) error {
+	var req ResourceTemplate
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if err := s.engine(c).RegisterTemplate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "template registered"})
+}
+
+func (s *Service) handleListFlags(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.engine(c).Flags())
+}
+
+func (s *Service) handleRegisterFlag(c echo.Context) error {
+	var req FeatureFlag
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if err := s.engine(c).RegisterFlag(req); err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "flag registered"})
+}
+
+type KillFlagRequest struct {
+	Killed bool `json:"killed"`
+}
+
+func (s *Service) handleKillFlag(c echo.Context) error {
+	var req KillFlagRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if err := s.engine(c).SetFlagKilled(c.Param("name"), req.Killed); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"flag": c.Param("name"), "killed": req.Killed})
+}
+
+type EvaluateFlagsRequest struct {
+	// Subject is the subject to evaluate for, e.g. "user:alice"
+	Subject string `json:"subject"`
+	// Flags to evaluate, every registered flag when empty
+	Flags []string `json:"flags,omitempty"`
+}
+
+type EvaluateFlagsResponse struct {
+	Evaluations []FlagEvaluation `json:"evaluations"`
+}
+
+func (s *Service) handleEvaluateFlags(c echo.Context) error {
+	var req EvaluateFlagsRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	subject, err := parseObjectRef(req.Subject)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid subject: " + err.Error()})
+	}
+	checkCtx, cancel := s.checkContext(c)
+	defer cancel()
+	evals, err := s.engine(c).EvaluateFlags(checkCtx, req.Flags, subject)
+	if err != nil {
+		status := checkErrorStatus(err)
+		if errors.Is(err, ErrUnknownFlag) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, EvaluateFlagsResponse{Evaluations: evals})
+}
+
+func (s *Service) handleListRoles(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.engine(c).Roles())
+}
+
+func (s *Service) handleDefineRole(c echo.Context) error {
+	var req Role
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if err := s.engine(c).DefineRole(req); err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "role defined"})
+}
+
+func (s *Service) handleDeleteRole(c echo.Context) error {
+	if err := s.engine(c).DeleteRole(c.Param("name")); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "role deleted"})
+}
+
+type RoleGrantRequest struct {
+	// Resource is e.g. "document:plan", or "document:*" for every document
+	Resource string `json:"resource"`
+	Role     string `json:"role"`
+	// Subject is e.g. "user:alice" or "group:eng#member"
+	Subject string `json:"subject"`
+}
+
+// tuple returns the grant as the tuple it is stored as
+func (r RoleGrantRequest) tuple() (RelationTuple, error) {
+	if !validRelationName(r.Role) {
+		return RelationTuple{}, fmt.Errorf("invalid role name %q", r.Role)
+	}
+	return ParseTuple(r.Resource + "#" + r.Role + "@" + r.Subject)
+}
+
+func (s *Service) handleGrantRole(c echo.Context) error {
+	var req RoleGrantRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	t, err := req.tuple()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := s.engine(c).GrantRole(t.Object, t.Relation, t.Subject); err != nil {
+		status := writeErrorStatus(err)
+		if errors.Is(err, ErrUnknownRole) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "role granted"})
+}
+
+func (s *Service) handleRevokeRole(c echo.Context) error {
+	var req RoleGrantRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	t, err := req.tuple()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := s.engine(c).RevokeRole(t.Object, t.Relation, t.Subject); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "role revoked"})
+}
+
 type CreateSubjectRequest struct {
 	Type     string `json:"type"`
 	ID       string `json:"id"`
@@ -67,8 +708,8 @@ func (s *Service) handleAddRelationQuery(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
-	if err := s.Engine.AddRelationQuery(req.Query); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	if err := s.engine(c).AddRelationQuery(req.Query); err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
 	}
 	return c.JSON(http.StatusOK, map[string]string{"status": "relation(s) added"})
 }
@@ -83,12 +724,43 @@ func (s *Service) handleAddPolicy(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
-	if err := s.Engine.AddPolicy(req.PolicyID, req.PolicyText); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	if err := s.engine(c).AddPolicy(req.PolicyID, req.PolicyText); err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
 	}
 	return c.JSON(http.StatusOK, map[string]string{"status": "policy added"})
 }
 
+type ImportCedarRequest struct {
+	Source  string       `json:"source"`
+	Options CedarOptions `json:"options"`
+	// DryRun only translates, nothing is written
+	DryRun bool `json:"dry_run"`
+}
+
+// ImportCedarResponse is the translation with what applying it wrote
+type ImportCedarResponse struct {
+	Translation *CedarTranslation `json:"translation"`
+	Imported    CedarImportStats  `json:"imported"`
+}
+
+func (s *Service) handleImportCedar(c echo.Context) error {
+	var req ImportCedarRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	translation, err := TranslateCedar(req.Source, req.Options)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	resp := ImportCedarResponse{Translation: translation}
+	if !req.DryRun {
+		if resp.Imported, err = s.engine(c).ApplyCedar(translation); err != nil {
+			return c.JSON(writeErrorStatus(err), map[string]interface{}{"error": err.Error(), "imported": resp.Imported})
+		}
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
 type AttachPolicyRequest struct {
 	ResourceType string `json:"resource_type"`
 	ResourceID   string `json:"resource_id"`
@@ -101,12 +773,48 @@ func (s *Service) handleAttachPolicy(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
 	}
 	resource := ObjectRef{Type: req.ResourceType, ObjectID: req.ResourceID}
-	if err := s.Engine.AddPolicyToResource(resource, req.PolicyID); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	if err := s.engine(c).AddPolicyToResource(resource, req.PolicyID); err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
 	}
 	return c.JSON(http.StatusOK, map[string]string{"status": "policy attached"})
 }
 
+func (s *Service) handleEffectivePolicies(c echo.Context) error {
+	resource, err := parseObjectRef(c.QueryParam("resource"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid resource: " + err.Error()})
+	}
+	policies := s.engine(c).GetEffectivePolicies(resource)
+	if policies == nil {
+		policies = []EffectivePolicy{}
+	}
+	return c.JSON(http.StatusOK, policies)
+}
+
+type PolicyDiffRequest struct {
+	PolicyText string `json:"policy_text"`
+	// Decisions to replay, at most MaxImpactDecisions; the engine's decision log is used
+	// when omitted
+	Decisions []Decision `json:"decisions"`
+}
+
+func (s *Service) handlePolicyDiff(c echo.Context) error {
+	var req PolicyDiffRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	ctx, cancel := s.checkContext(c)
+	defer cancel()
+	impact, err := s.engine(c).PolicyImpact(ctx, c.Param("id"), req.PolicyText, req.Decisions)
+	if err != nil {
+		if ctx.Err() != nil {
+			return c.JSON(checkErrorStatus(err), map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, impact)
+}
+
 type VerifyRequest struct {
 	ResourceType string            `json:"resource_type"`
 	ResourceID   string            `json:"resource_id"`
@@ -123,14 +831,393 @@ func (s *Service) handleVerify(c echo.Context) error {
 	}
 	resource := ObjectRef{Type: req.ResourceType, ObjectID: req.ResourceID}
 	subject := ObjectRef{Type: req.SubjectType, ObjectID: req.SubjectID}
-	allowed, err := s.Engine.Verify(resource, subject, req.Action, req.Context)
+	checkCtx, cancel := s.checkContext(c)
+	defer cancel()
+	allowed, err := s.engine(c).VerifyContext(checkCtx, resource, subject, req.Action, req.Context)
+	if err != nil {
+		status := checkErrorStatus(err)
+		if status == http.StatusBadRequest {
+			status = http.StatusInternalServerError
+		}
+		return c.JSON(status, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"allowed": allowed})
+}
+
+// MaxBatchChecks bounds the checks of one /verify/batch request
+const MaxBatchChecks = 100
+
+type VerifyBatchRequest struct {
+	Checks []VerifyRequest `json:"checks"`
+}
+
+// VerifyResult is the answer to one check of a batch, Error is set when it has none
+type VerifyResult struct {
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleVerifyBatch answers each check on its own; one failing check does not fail the batch
+func (s *Service) handleVerifyBatch(c echo.Context) error {
+	var req VerifyBatchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if len(req.Checks) > MaxBatchChecks {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("at most %d checks per batch", MaxBatchChecks)})
+	}
+	checkCtx, cancel := s.checkContext(c)
+	defer cancel()
+	return c.JSON(http.StatusOK, map[string]interface{}{"results": verifyBatch(checkCtx, s.engine(c), req.Checks)})
+}
+
+// verifyBatch answers each check on its own
+func verifyBatch(ctx context.Context, engine *Engine, checks []VerifyRequest) []VerifyResult {
+	results := make([]VerifyResult, len(checks))
+	for i, check := range checks {
+		resource := ObjectRef{Type: check.ResourceType, ObjectID: check.ResourceID}
+		subject := ObjectRef{Type: check.SubjectType, ObjectID: check.SubjectID}
+		allowed, err := engine.VerifyContext(ctx, resource, subject, check.Action, check.Context)
+		results[i].Allowed = allowed
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return results
+}
+
+type CheckQueryRequest struct {
+	Query   string            `json:"query"`
+	Context map[string]string `json:"context"`
+	// Direct skips policies and only checks for the relation tuple
+	Direct bool `json:"direct"`
+}
+
+func (s *Service) handleCheckQuery(c echo.Context) error {
+	var req CheckQueryRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	var allowed bool
+	var err error
+	if req.Direct {
+		allowed, err = s.engine(c).CheckRelationQuery(req.Query)
+	} else {
+		checkCtx, cancel := s.checkContext(c)
+		defer cancel()
+		allowed, err = s.engine(c).VerifyQueryContext(checkCtx, req.Query, req.Context)
+	}
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return c.JSON(checkErrorStatus(err), map[string]string{"error": err.Error()})
 	}
 	return c.JSON(http.StatusOK, map[string]interface{}{"allowed": allowed})
 }
 
+// handleGraphQL answers a query posted as json, or given in ?query= and ?variables=
+func (s *Service) handleGraphQL(c echo.Context) error {
+	var req GraphQLRequest
+	if c.Request().Method == http.MethodGet {
+		req.Query = c.QueryParam("query")
+		req.OperationName = c.QueryParam("operationName")
+		if vars := c.QueryParam("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				return c.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "invalid variables: " + err.Error()}}})
+			}
+		}
+	} else if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "invalid request"}}})
+	}
+	var me *ObjectRef
+	var mayList func() error
+	if p := principal(c); p != nil {
+		me = &p.Subject
+		if s.Admin != nil {
+			// listing tuples and objects needs export, as /tuples/find does; checks do not
+			tenant, _ := c.Get(tenantIDKey).(string)
+			var checked bool
+			var listErr error
+			mayList = func() error {
+				if !checked {
+					checked = true
+					ok, err := s.Admin.AuthorizeAdmin(c.Request().Context(), p.Subject, PermExport, tenant)
+					if err == nil && !ok {
+						err = fmt.Errorf("%s lacks %s", p.Subject, PermExport)
+					}
+					listErr = err
+				}
+				return listErr
+			}
+		}
+	}
+	checkCtx, cancel := s.checkContext(c)
+	defer cancel()
+	resp, err := s.engine(c).graphQL(checkCtx, req, me, mayList)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *Service) handleGraphQLSchema(c echo.Context) error {
+	return c.String(http.StatusOK, GraphQLSchema)
+}
+
+type FindTuplesRequest struct {
+	Query string `json:"query"`
+}
+
+// FindTuplesResponse lists the matching tuples in the text form; Truncated is set when
+// more matched than the query's limit
+type FindTuplesResponse struct {
+	Tuples    []string `json:"tuples"`
+	Truncated bool     `json:"truncated"`
+}
+
+func (s *Service) handleFindTuples(c echo.Context) error {
+	var req FindTuplesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	q, err := ParseTupleQuery(req.Query)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	checkCtx, cancel := s.checkContext(c)
+	defer cancel()
+	tuples, truncated, err := s.engine(c).FindTuples(checkCtx, q)
+	if err != nil {
+		return c.JSON(checkErrorStatus(err), map[string]string{"error": err.Error()})
+	}
+	resp := FindTuplesResponse{Tuples: make([]string, len(tuples)), Truncated: truncated}
+	for i, t := range tuples {
+		resp.Tuples[i] = FormatTuple(t)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *Service) handleExpand(c echo.Context) error {
+	object, err := parseObjectRef(c.QueryParam("object"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid object: " + err.Error()})
+	}
+	relation := c.QueryParam("relation")
+	if relation == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "relation is required"})
+	}
+	return c.JSON(http.StatusOK, s.engine(c).Expand(object, relation))
+}
+
+func (s *Service) handleGraph(c echo.Context) error {
+	root, err := parseObjectRef(c.QueryParam("root"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid root: " + err.Error()})
+	}
+	format, err := ParseGraphFormat(c.QueryParam("format"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	opts, err := ParseGraphOptions(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	graph, err := s.engine(c).ExportGraph(root, opts)
+	switch {
+	case errors.Is(err, ErrUnknownObject):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case err != nil:
+		return c.JSON(writeErrorStatus(err), map[string]string{"error": err.Error()})
+	}
+	switch format {
+	case GraphDOT:
+		return c.Blob(http.StatusOK, "text/vnd.graphviz; charset=utf-8", []byte(graph.DOT()))
+	case GraphMermaid:
+		return c.String(http.StatusOK, graph.Mermaid())
+	}
+	return c.JSON(http.StatusOK, graph)
+}
+
 func (s *Service) handleListAllResources(c echo.Context) error {
-	objects := s.Engine.ListAllResources()
+	objects := s.engine(c).ListAllResources()
 	return c.JSON(http.StatusOK, objects)
 }
+
+func (s *Service) handleExport(c echo.Context) error {
+	format, err := ParseSnapshotFormat(c.QueryParam("format"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	contentType := "application/x-ndjson"
+	if format == SnapshotText {
+		contentType = echo.MIMETextPlainCharsetUTF8
+	}
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().WriteHeader(http.StatusOK)
+	// headers are already sent, so a failure here can only abort the stream
+	return s.engine(c).Export(c.Response(), format)
+}
+
+func (s *Service) handleImport(c echo.Context) error {
+	format, err := ParseSnapshotFormat(c.QueryParam("format"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	stats, err := s.engine(c).Import(c.Request().Body, format)
+	if err != nil {
+		return c.JSON(writeErrorStatus(err), map[string]interface{}{"error": err.Error(), "imported": stats})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": "import complete", "imported": stats})
+}
+
+type AccessReviewRequest struct {
+	// Decisions to read usage from, the engine's decision log is used when omitted
+	Decisions []Decision `json:"decisions"`
+}
+
+func (s *Service) handleAccessReview(c echo.Context) error {
+	opts, err := ParseAccessReviewOptions(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if c.Request().Method == http.MethodPost {
+		var req AccessReviewRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+		}
+		opts.Decisions = req.Decisions
+	}
+	review := s.engine(c).AccessReview(opts)
+	switch c.QueryParam("format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, review)
+	case "csv":
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		c.Response().WriteHeader(http.StatusOK)
+		return review.WriteCSV(c.Response())
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown report format %q", c.QueryParam("format"))})
+}
+
+func (s *Service) handleCheckMembershipIndex(c echo.Context) error {
+	relations := s.engine(c).graph.MembershipIndexRelations()
+	if relations == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "membership index is not enabled"})
+	}
+	mismatches := s.engine(c).graph.CheckMembershipIndex()
+	if mismatches == nil {
+		mismatches = []MembershipMismatch{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"relations":  relations,
+		"consistent": len(mismatches) == 0,
+		"mismatches": mismatches,
+	})
+}
+
+func (s *Service) handleChanges(c echo.Context) error {
+	engine := s.engine(c)
+	if engine == nil || engine.ChangeLog() == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": ErrNoChangeLog.Error()})
+	}
+	var after uint64
+	limit := DefaultChangeBatch
+	var wait time.Duration
+	var err error
+	if v := c.QueryParam("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid after revision"})
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+		}
+	}
+	if v := c.QueryParam("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid wait duration"})
+		}
+		if wait > MaxPollWait {
+			wait = MaxPollWait
+		}
+	}
+	log := engine.ChangeLog()
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), wait)
+		log.Wait(ctx, after)
+		cancel()
+	}
+	changes, head, err := log.Since(after, limit)
+	if err != nil {
+		return c.JSON(http.StatusGone, map[string]string{"error": err.Error()})
+	}
+	if changes == nil {
+		changes = []Change{}
+	}
+	return c.JSON(http.StatusOK, ChangeBatch{Revision: head, Changes: changes})
+}
+
+func (s *Service) handleReplicationStatus(c echo.Context) error {
+	if s.Replica != nil {
+		return c.JSON(http.StatusOK, s.Replica.Status())
+	}
+	if s.Store != nil {
+		return c.JSON(http.StatusOK, s.Store.Status())
+	}
+	engine := s.engine(c)
+	st := ReplicationStatus{Role: "standalone", Revision: engine.graph.Revision()}
+	if log := engine.ChangeLog(); log != nil {
+		st.Role = "leader"
+		oldest := log.Oldest()
+		st.Revision = log.Head()
+		st.OldestRevision = &oldest
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
+type CreateTenantRequest struct {
+	ID string `json:"id"`
+	// Quota defaults to the registry's DefaultQuota when omitted
+	Quota *TenantQuota `json:"quota"`
+}
+
+func (s *Service) handleCreateTenant(c echo.Context) error {
+	var req CreateTenantRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	engine, err := s.Tenants.Create(req.ID, req.Quota)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, engine.TenantInfo())
+}
+
+func (s *Service) handleListTenants(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Tenants.List())
+}
+
+func (s *Service) handleTenantInfo(c echo.Context) error {
+	engine, err := s.Tenants.Get(c.Param("tenant"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, engine.TenantInfo())
+}
+
+func (s *Service) handleSetTenantQuota(c echo.Context) error {
+	var quota TenantQuota
+	if err := c.Bind(&quota); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request"})
+	}
+	if err := s.Tenants.SetQuota(c.Param("tenant"), quota); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "quota updated"})
+}
+
+func (s *Service) handleDeleteTenant(c echo.Context) error {
+	if !s.Tenants.Delete(c.Param("tenant")) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "unknown tenant " + c.Param("tenant")})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "tenant deleted"})
+}
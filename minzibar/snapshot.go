@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Deep checks read the graph as of the revision they started at without holding its
+// locks for the whole walk. While any check runs, writers keep the changes they make in
+// the shard's history; a check looks a pair up under the shard lock and reverts the
+// changes made after its revision. When no check runs, nothing is kept.
+
+// minHistoryTrim is the number of kept changes in a shard at which it first drops the
+// ones no running check needs
+const minHistoryTrim = 1024
+
+// pairChange is one member added to or removed from a pair at rev
+type pairChange[K comparable] struct {
+	rev    uint64
+	member K
+	added  bool
+}
+
+// shardHistory holds the changes to a shard's pairs that running checks may need to revert
+type shardHistory struct {
+	// objects are changes to objectIndex, subjects changes to subjectIndex keyed by
+	// (subject, relation)
+	objects  map[objectRelation][]pairChange[subjectKey]
+	subjects map[objectRelation][]pairChange[nodeID]
+	// size is the number of changes kept, trimAt the size at which the next trim runs
+	size, trimAt int
+}
+
+func (h *shardHistory) clear() {
+	*h = shardHistory{}
+}
+
+// trim drops the changes made at or before rev
+func (h *shardHistory) trim(rev uint64) {
+	h.size = trimChanges(h.objects, rev) + trimChanges(h.subjects, rev)
+	h.trimAt = max(minHistoryTrim, 2*h.size)
+}
+
+func trimChanges[K comparable](m map[objectRelation][]pairChange[K], rev uint64) int {
+	size := 0
+	for at, changes := range m {
+		i := 0
+		for i < len(changes) && changes[i].rev <= rev {
+			i++
+		}
+		if i == len(changes) {
+			delete(m, at)
+			continue
+		}
+		m[at] = changes[i:]
+		size += len(changes) - i
+	}
+	return size
+}
+
+// snapshotSet counts the running checks by the revision they read at
+type snapshotSet struct {
+	mu sync.Mutex
+	// running is read without mu by writers deciding whether to keep history
+	running atomic.Int64
+	revs    map[uint64]int
+}
+
+// beginSnapshot registers a check and returns the revision it reads at. A writer that
+// does not see the check running advanced the revision before the check read it.
+func (g *RelationGraph) beginSnapshot() uint64 {
+	s := &g.snapshots
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running.Add(1)
+	rev := g.revision.Load()
+	if s.revs == nil {
+		s.revs = make(map[uint64]int)
+	}
+	s.revs[rev]++
+	return rev
+}
+
+func (g *RelationGraph) endSnapshot(rev uint64) {
+	s := &g.snapshots
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revs[rev]--; s.revs[rev] == 0 {
+		delete(s.revs, rev)
+	}
+	s.running.Add(-1)
+}
+
+// oldestSnapshot returns the lowest revision a running check reads at
+func (g *RelationGraph) oldestSnapshot() (uint64, bool) {
+	s := &g.snapshots
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var oldest uint64
+	found := false
+	for rev := range s.revs {
+		if !found || rev < oldest {
+			oldest, found = rev, true
+		}
+	}
+	return oldest, found
+}
+
+// remember keeps a tuple change made at rev for the running checks, the caller holds the
+// shard locks of the tuple
+func (g *RelationGraph) remember(object nodeID, rel uint32, subject subjectKey, added bool, rev uint64) {
+	objShard := g.shardFor(object)
+	subShard := g.shardFor(subject.node)
+	if g.snapshots.running.Load() == 0 {
+		objShard.history.clear()
+		subShard.history.clear()
+		return
+	}
+	h := &objShard.history
+	if h.objects == nil {
+		h.objects = make(map[objectRelation][]pairChange[subjectKey])
+	}
+	at := objectRelation{object: object, rel: rel}
+	h.objects[at] = append(h.objects[at], pairChange[subjectKey]{rev: rev, member: subject, added: added})
+	g.grew(h)
+	if subject.rel == 0 {
+		h := &subShard.history
+		if h.subjects == nil {
+			h.subjects = make(map[objectRelation][]pairChange[nodeID])
+		}
+		at := objectRelation{object: subject.node, rel: rel}
+		h.subjects[at] = append(h.subjects[at], pairChange[nodeID]{rev: rev, member: object, added: added})
+		g.grew(h)
+	}
+}
+
+// grew counts a kept change and trims the history once it doubled since the last trim
+func (g *RelationGraph) grew(h *shardHistory) {
+	if h.size++; h.size < max(h.trimAt, minHistoryTrim) {
+		return
+	}
+	if oldest, ok := g.oldestSnapshot(); ok {
+		h.trim(oldest)
+	} else {
+		h.clear()
+	}
+}
+
+// revertedAt returns, for each member changed after rev, whether it was in the pair at rev:
+// the opposite of what its first later change did
+func revertedAt[K comparable](changes []pairChange[K], rev uint64) map[K]bool {
+	var was map[K]bool
+	for _, ch := range changes {
+		if ch.rev <= rev {
+			continue
+		}
+		if was == nil {
+			was = make(map[K]bool)
+		}
+		if _, seen := was[ch.member]; !seen {
+			was[ch.member] = !ch.added
+		}
+	}
+	return was
+}
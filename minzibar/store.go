@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStoreTimeout bounds the round trips to the store of a single write
+const DefaultStoreTimeout = 10 * time.Second
+
+// ErrStoreUnavailable wraps failures of the store behind an engine. A write that failed
+// with it may or may not be in the store; the engine is reloaded before it takes more.
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// TupleStore keeps an engine's changes outside the process, so that several servers can
+// serve the same tuples, policies, flags and roles. The store numbers the changes: the
+// revisions Append hands out are the revisions of every engine backed by the store, and
+// consistency tokens from one server hold on the others.
+type TupleStore interface {
+	// Append records c as the store's next change and returns its revision
+	Append(ctx context.Context, c Change) (uint64, error)
+	// Changes returns up to limit changes after revision after, oldest first, and the
+	// newest revision. An after older than the changes kept is ErrChangesTruncated.
+	Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error)
+	// Snapshot calls fn with changes that rebuild the store's current state in an empty
+	// engine, and returns the revision of that state
+	Snapshot(ctx context.Context, fn func(Change) error) (uint64, error)
+	// Wait blocks until the store may have a change after revision after or ctx is done
+	Wait(ctx context.Context, after uint64) error
+	Close() error
+}
+
+// OpenStore opens the store at url; postgres:// and postgresql:// urls open a PostgresStore
+func OpenStore(ctx context.Context, url string) (TupleStore, error) {
+	switch {
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return OpenPostgresStore(ctx, url)
+	}
+	scheme, _, _ := strings.Cut(url, ":")
+	return nil, fmt.Errorf("unknown store %q, expected a postgres:// url", scheme)
+}
+
+// MemoryStore is a TupleStore in process memory that keeps every change. It stands in
+// for a database in tests, and lets several engines in one process share their writes.
+type MemoryStore struct {
+	mu      sync.Mutex
+	changes []Change
+	// appended is closed and replaced whenever a change is added
+	appended chan struct{}
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{appended: make(chan struct{})}
+}
+
+func (m *MemoryStore) Append(ctx context.Context, c Change) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.Revision = uint64(len(m.changes)) + 1
+	m.changes = append(m.changes, c)
+	close(m.appended)
+	m.appended = make(chan struct{})
+	return c.Revision, nil
+}
+
+func (m *MemoryStore) Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	head := uint64(len(m.changes))
+	if after >= head {
+		return nil, head, nil
+	}
+	end := head
+	if limit > 0 && end-after > uint64(limit) {
+		end = after + uint64(limit)
+	}
+	return append([]Change(nil), m.changes[after:end]...), head, nil
+}
+
+// Snapshot replays the whole history, there is no separate state to read
+func (m *MemoryStore) Snapshot(ctx context.Context, fn func(Change) error) (uint64, error) {
+	m.mu.Lock()
+	changes := append([]Change(nil), m.changes...)
+	m.mu.Unlock()
+	for _, c := range changes {
+		if err := fn(c); err != nil {
+			return 0, err
+		}
+	}
+	return uint64(len(changes)), nil
+}
+
+func (m *MemoryStore) Wait(ctx context.Context, after uint64) error {
+	m.mu.Lock()
+	head, appended := uint64(len(m.changes)), m.appended
+	m.mu.Unlock()
+	if head > after {
+		return nil
+	}
+	select {
+	case <-appended:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// storeLink ties an engine to its store. Writes and catching up hold mu, so the engine
+// applies changes in the store's order.
+type storeLink struct {
+	mu    sync.Mutex
+	store TupleStore
+	// failed is closed once the engine may differ from the store, err says why
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+}
+
+func newStoreLink(store TupleStore) *storeLink {
+	return &storeLink{store: store, failed: make(chan struct{})}
+}
+
+// fail marks the engine as no longer matching the store and returns err as ErrStoreUnavailable
+func (l *storeLink) fail(err error) error {
+	l.failOnce.Do(func() {
+		l.err = err
+		close(l.failed)
+	})
+	return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+}
+
+// failure returns why the engine no longer matches the store, nil while it does
+func (l *storeLink) failure() error {
+	select {
+	case <-l.failed:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// storeChange is logChange for an engine backed by a store. The engine catches up, then
+// applies the change and appends it. When other servers appended in between, their
+// changes are replayed and then this one again, which leaves every tuple, policy, flag
+// and role the way the store's order has it.
+func (e *Engine) storeChange(apply func() (*Change, error)) error {
+	l := e.store
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultStoreTimeout)
+	defer cancel()
+	if _, err := e.catchUpStoreLocked(ctx); err != nil {
+		return err
+	}
+	before := e.graph.Revision()
+	c, err := apply()
+	if err != nil || c == nil {
+		return err
+	}
+	rev, err := l.store.Append(ctx, *c)
+	if err != nil {
+		// the engine has the change, the store may not
+		return l.fail(err)
+	}
+	c.Revision = rev
+	if rev > before+1 {
+		missed, _, err := l.store.Changes(ctx, before, int(rev-before-1))
+		if err != nil {
+			return l.fail(err)
+		}
+		for _, m := range append(missed, *c) {
+			if err := e.replayChange(m); err != nil {
+				return l.fail(err)
+			}
+		}
+	}
+	e.graph.revision.Store(rev)
+	return nil
+}
+
+// catchUpStore applies the changes the store has past the engine's revision and returns
+// the store's newest revision
+func (e *Engine) catchUpStore(ctx context.Context) (uint64, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	return e.catchUpStoreLocked(ctx)
+}
+
+func (e *Engine) catchUpStoreLocked(ctx context.Context) (uint64, error) {
+	l := e.store
+	for {
+		if err := l.failure(); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+		}
+		changes, head, err := l.store.Changes(ctx, e.graph.Revision(), DefaultChangeBatch)
+		if errors.Is(err, ErrChangesTruncated) {
+			return 0, l.fail(err)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+		}
+		for _, c := range changes {
+			if err := e.applyChange(c); err != nil {
+				return 0, l.fail(err)
+			}
+		}
+		if len(changes) == 0 || e.graph.Revision() >= head {
+			return head, nil
+		}
+	}
+}
+
+// StoreSync serves an engine backed by a TupleStore: it loads the store's snapshot, then
+// follows the changes other servers append. Writes to the engine go through the store,
+// so any number of servers can share one and each answers reads from memory.
+type StoreSync struct {
+	Store TupleStore
+	// MaxStaleness is DefaultMaxStaleness when 0; past it without reaching the store, reads
+	// fail with 503
+	MaxStaleness time.Duration
+	// PollWait is how long Run waits on the store for a change, DefaultPollWait when 0
+	PollWait time.Duration
+	// Setup, when set, configures each engine loaded, as Tenants.Setup
+	Setup func(*Engine)
+
+	engine atomic.Pointer[Engine]
+
+	mu            sync.Mutex
+	storeRevision uint64
+	syncedAt      time.Time
+	lastErr       error
+}
+
+// NewStoreSync returns a StoreSync of store; nothing is loaded until Sync or Run
+func NewStoreSync(store TupleStore) *StoreSync {
+	return &StoreSync{Store: store}
+}
+
+// Engine returns the engine serving requests, nil until the first snapshot is loaded
+func (s *StoreSync) Engine() *Engine {
+	return s.engine.Load()
+}
+
+// Run keeps the engine in sync until ctx is done, retrying failures every second
+func (s *StoreSync) Run(ctx context.Context) error {
+	for {
+		err := s.sync(ctx, s.pollWait())
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("store: %v", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Sync loads a snapshot when needed and applies the store's changes until caught up,
+// without waiting for new ones
+func (s *StoreSync) Sync(ctx context.Context) error {
+	return s.sync(ctx, 0)
+}
+
+func (s *StoreSync) sync(ctx context.Context, wait time.Duration) error {
+	err := s.pull(ctx, wait)
+	if engine := s.Engine(); err != nil && engine != nil && engine.store.failure() != nil {
+		// missed changes or a write the store may not have, start over from a snapshot
+		err = s.pull(ctx, wait)
+	}
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+	return err
+}
+
+// pull loads a snapshot when there is no usable engine, catches up and then waits for
+// the next change for up to wait
+func (s *StoreSync) pull(ctx context.Context, wait time.Duration) error {
+	engine := s.Engine()
+	if engine == nil || engine.store.failure() != nil {
+		var err error
+		if engine, err = s.load(ctx); err != nil {
+			return err
+		}
+	}
+	for {
+		head, err := engine.catchUpStore(ctx)
+		if err != nil {
+			return err
+		}
+		s.noteProgress(head)
+		if wait <= 0 {
+			return nil
+		}
+		if err := s.wait(ctx, engine, wait); err != nil {
+			return err
+		}
+		wait = 0
+	}
+}
+
+// wait waits up to wait for a change past the engine's revision; a write failing on the
+// engine ends the wait early, so the engine is reloaded right away
+func (s *StoreSync) wait(ctx context.Context, engine *Engine, wait time.Duration) error {
+	wctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	go func() {
+		select {
+		case <-engine.store.failed:
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+	err := s.Store.Wait(wctx, engine.graph.Revision())
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if wctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// load builds an engine from the store's snapshot and puts it in place of the current one
+func (s *StoreSync) load(ctx context.Context) (*Engine, error) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	if s.Setup != nil {
+		s.Setup(engine)
+	}
+	rev, err := s.Store.Snapshot(ctx, engine.replayChange)
+	if err != nil {
+		return nil, fmt.Errorf("%w: snapshot: %w", ErrStoreUnavailable, err)
+	}
+	// replaying counted its own revisions, the store's is the one tokens refer to
+	engine.graph.revision.Store(rev)
+	engine.store = newStoreLink(s.Store)
+	s.engine.Store(engine)
+	s.noteProgress(rev)
+	return engine, nil
+}
+
+func (s *StoreSync) noteProgress(storeRevision uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if storeRevision > s.storeRevision {
+		s.storeRevision = storeRevision
+	}
+	s.syncedAt = time.Now()
+}
+
+// Status reports the engine's revision and how far it trails the store, with the store
+// in place of a leader
+func (s *StoreSync) Status() ReplicationStatus {
+	st := ReplicationStatus{Role: "store"}
+	engine := s.Engine()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.LeaderRevision = s.storeRevision
+	if engine != nil {
+		st.Revision = engine.graph.Revision()
+	}
+	if st.LeaderRevision > st.Revision {
+		st.Lag = st.LeaderRevision - st.Revision
+	}
+	if !s.syncedAt.IsZero() {
+		at := s.syncedAt
+		st.CaughtUpAt = &at
+		st.Staleness = time.Since(at).Seconds()
+	}
+	st.Stale = s.staleLocked(engine)
+	if s.lastErr != nil {
+		st.Error = s.lastErr.Error()
+	}
+	return st
+}
+
+// Stale reports whether the engine has gone MaxStaleness without catching up with the store
+func (s *StoreSync) Stale() bool {
+	engine := s.Engine()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.staleLocked(engine)
+}
+
+func (s *StoreSync) staleLocked(engine *Engine) bool {
+	max := s.MaxStaleness
+	if max <= 0 {
+		max = DefaultMaxStaleness
+	}
+	return engine == nil || s.syncedAt.IsZero() || time.Since(s.syncedAt) > max
+}
+
+func (s *StoreSync) pollWait() time.Duration {
+	if s.PollWait > 0 {
+		return s.PollWait
+	}
+	return DefaultPollWait
+}
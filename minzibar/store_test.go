@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// syncedEngine loads the store into a new StoreSync and returns it
+func syncedEngine(t *testing.T, store TupleStore) *StoreSync {
+	s := NewStoreSync(store)
+	require.NoError(t, s.Sync(context.Background()))
+	return s
+}
+
+// engineState lists an engine's tuples, policies, flags and roles for comparison
+func engineState(e *Engine) []string {
+	var state []string
+	_ = e.graph.ForEachTuple(func(t RelationTuple) error {
+		state = append(state, FormatTuple(t))
+		return nil
+	})
+	for id, policy := range e.policies() {
+		state = append(state, "policy "+id+": "+policy.Text)
+	}
+	for _, flag := range e.Flags() {
+		state = append(state, fmt.Sprintf("flag %s killed=%v", flag.Name, flag.Killed))
+	}
+	for _, role := range e.Roles() {
+		state = append(state, fmt.Sprintf("role %s %v", role.Name, role.Permissions))
+	}
+	sort.Strings(state)
+	return state
+}
+
+// testSharedStore writes through one engine and reads through another; any TupleStore
+// has to pass it
+func testSharedStore(t *testing.T, store TupleStore) {
+	ctx := context.Background()
+	a, b := syncedEngine(t, store), syncedEngine(t, store)
+
+	writer := a.Engine()
+	writer.CreateResource("document", "plan")
+	require.NoError(t, writer.AddRelationQuery("document:plan user:alice->read user:bob->read"))
+	require.NoError(t, writer.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, writer.AddPolicyToResource(plan, "p"))
+	require.NoError(t, writer.RegisterFlag(dashboardFlag))
+	require.NoError(t, writer.SetFlagKilled(dashboardFlag.Name, true))
+	require.NoError(t, writer.DefineRole(Role{Name: "editor", Permissions: []string{"read", "write"}}))
+	require.True(t, writer.deleteTuple(RelationTuple{Object: plan, Relation: "read", Subject: SubjectRef{Object: bob}}))
+
+	// b writes without having seen a's changes, it catches up first
+	b.Engine().CreateResource("document", "roadmap")
+	require.NoError(t, b.Engine().AddRelationQuery("document:plan user:carol->read"))
+	require.NoError(t, a.Sync(ctx))
+	assert.Equal(t, engineState(a.Engine()), engineState(b.Engine()))
+	assert.Equal(t, a.Engine().graph.Revision(), b.Engine().graph.Revision())
+
+	allowed, err := b.Engine().Verify(plan, ObjectRef{Type: "user", ObjectID: "alice"}, "read", map[string]string{"department": "eng"})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// a new server loads the same state from the snapshot
+	c := syncedEngine(t, store)
+	assert.Equal(t, engineState(a.Engine()), engineState(c.Engine()))
+	assert.Equal(t, a.Engine().graph.Revision(), c.Engine().graph.Revision())
+	assert.Equal(t, "store", c.Status().Role)
+	assert.Zero(t, c.Status().Lag)
+
+	// Wait returns once another server appends
+	rev := c.Engine().graph.Revision()
+	done := make(chan error, 1)
+	go func() {
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		done <- store.Wait(wctx, rev)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, a.Engine().AddRelationQuery("document:plan user:dave->read"))
+	require.NoError(t, <-done)
+	changes, head, err := store.Changes(ctx, rev, 10)
+	require.NoError(t, err)
+	assert.Equal(t, rev+1, head)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "document:plan#read@user:dave", FormatTuple(*changes[0].Tuple))
+}
+
+func TestMemoryStore_Shared(t *testing.T) {
+	testSharedStore(t, NewMemoryStore())
+}
+
+// StoreSync replays another server's changes while this one answers verifies
+func TestStoreSync_ConcurrentReads(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	writer, follower := syncedEngine(t, store).Engine(), syncedEngine(t, store)
+	writer.CreateResource("document", "plan")
+	require.NoError(t, writer.AddRelationQuery("document:plan user:alice->read"))
+	require.NoError(t, writer.AddPolicy("p", `allow read if department == "eng"`))
+	require.NoError(t, writer.AddPolicyToResource(plan, "p"))
+	require.NoError(t, writer.RegisterFlag(dashboardFlag))
+	require.NoError(t, follower.Sync(ctx))
+
+	var stop atomic.Bool
+	var reads atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ; !stop.Load(); reads.Add(1) {
+			engine := follower.Engine()
+			_, err := engine.Verify(plan, alice, "read", map[string]string{"department": "eng"})
+			assert.NoError(t, err)
+			_, err = engine.EvaluateFlag(ctx, dashboardFlag.Name, alice)
+			assert.NoError(t, err)
+			engine.Roles()
+			engine.Flags()
+		}
+	}()
+	for i := 0; i < 100 || reads.Load() < 50; i++ {
+		require.NoError(t, writer.AddPolicy("p", fmt.Sprintf(`allow read if department == "eng%d"`, i%2)))
+		require.NoError(t, writer.SetFlagKilled(dashboardFlag.Name, i%2 == 0))
+		require.NoError(t, writer.DefineRole(Role{Name: "editor", Permissions: []string{"read"}}))
+		require.NoError(t, writer.DeleteRole("editor"))
+		require.NoError(t, follower.Sync(ctx))
+	}
+	stop.Store(true)
+	<-done
+	assert.Equal(t, engineState(writer), engineState(follower.Engine()))
+}
+
+// racingStore appends others' changes right before each Append, as if other servers
+// wrote in between
+type racingStore struct {
+	TupleStore
+	others []Change
+	fail   error
+}
+
+func (r *racingStore) Append(ctx context.Context, c Change) (uint64, error) {
+	if r.fail != nil {
+		return 0, r.fail
+	}
+	for _, other := range r.others {
+		if _, err := r.TupleStore.Append(ctx, other); err != nil {
+			return 0, err
+		}
+	}
+	r.others = nil
+	return r.TupleStore.Append(ctx, c)
+}
+
+func TestStoreSync_InterleavedWrites(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{TupleStore: NewMemoryStore()}
+	s := syncedEngine(t, store)
+	engine := s.Engine()
+
+	read := func(user string) RelationTuple {
+		return RelationTuple{Object: plan, Relation: "read", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: user}}}
+	}
+	bobRead, carolRead := read("bob"), read("carol")
+	// another server deletes bob, which is not there yet, and writes carol first
+	store.others = []Change{{Op: ChangeDelete, Tuple: &bobRead}, {Op: ChangeWrite, Tuple: &carolRead}}
+	require.NoError(t, engine.writeTuple(bobRead))
+
+	_, head, err := store.Changes(ctx, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), head)
+	assert.Equal(t, head, engine.graph.Revision(), "the engine is at the store's revision")
+	assert.True(t, engine.graph.HasDirectRelation(plan, "read", bobRead.Subject), "the write came last")
+	assert.True(t, engine.graph.HasDirectRelation(plan, "read", carolRead.Subject))
+	assert.Equal(t, engineState(engine), engineState(syncedEngine(t, store).Engine()))
+}
+
+func TestStoreSync_FailedAppend(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{TupleStore: NewMemoryStore()}
+	s := syncedEngine(t, store)
+	first := s.Engine()
+	first.CreateResource("document", "plan")
+	before := engineState(first)
+
+	store.fail = errors.New("connection reset")
+	err := first.AddRelationQuery("document:plan user:alice->read")
+	assert.ErrorIs(t, err, ErrStoreUnavailable)
+	assert.Equal(t, http.StatusServiceUnavailable, writeErrorStatus(err))
+	assert.ErrorIs(t, first.AddRelationQuery("document:plan user:bob->read"), ErrStoreUnavailable,
+		"no more writes until the engine is reloaded")
+
+	// the engine holds a write the store does not have, it is replaced
+	store.fail = nil
+	require.NoError(t, s.Sync(ctx))
+	assert.NotSame(t, first, s.Engine())
+	assert.Equal(t, before, engineState(s.Engine()))
+	require.NoError(t, s.Engine().AddRelationQuery("document:plan user:bob->read"))
+}
+
+func TestService_Store(t *testing.T) {
+	store := NewMemoryStore()
+	servers := make([]*httptest.Server, 2)
+	syncs := make([]*StoreSync, 2)
+	for i := range servers {
+		syncs[i] = NewStoreSync(store)
+		service := NewService(nil)
+		service.Store = syncs[i]
+		servers[i] = httptest.NewServer(service.Echo())
+		t.Cleanup(servers[i].Close)
+	}
+	code, _ := verifyOn(t, servers[0].URL, "alice", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not loaded yet")
+	for _, s := range syncs {
+		require.NoError(t, s.Sync(context.Background()))
+	}
+
+	// both servers take writes, each catches up before checking one
+	syncs[1].Engine().CreateResource("document", "plan")
+	resp := postTo(t, servers[0].URL+"/policy", AddPolicyRequest{PolicyID: "p", PolicyText: `allow read if department == "eng"`}, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = postTo(t, servers[1].URL+"/policy/attach", AttachPolicyRequest{ResourceType: "document", ResourceID: "plan", PolicyID: "p"}, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = postTo(t, servers[1].URL+"/relation", AddRelationQueryRequest{Query: "document:plan user:alice->read"}, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	token := resp.Header.Get(RevisionHeader)
+
+	// the other server catches up for the token
+	code, allowed := verifyOn(t, servers[0].URL, "alice", http.Header{ConsistencyHeader: {token}})
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, allowed)
+
+	status, err := http.Get(servers[0].URL + "/replication/status")
+	require.NoError(t, err)
+	defer status.Body.Close()
+	var st ReplicationStatus
+	require.NoError(t, json.NewDecoder(status.Body).Decode(&st))
+	assert.Equal(t, "store", st.Role)
+	assert.Equal(t, token, fmt.Sprint(st.Revision))
+}
+
+func TestOpenStore_Unknown(t *testing.T) {
+	_, err := OpenStore(context.Background(), "mysql://user:secret@db/minzibar")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+// setupPostgres returns the url of an empty database: MINZIBAR_POSTGRES_URL when set,
+// otherwise a container
+func setupPostgres(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	if url := os.Getenv("MINZIBAR_POSTGRES_URL"); url != "" {
+		store, err := OpenPostgresStore(ctx, url)
+		require.NoError(t, err)
+		_, err = store.pool.Exec(ctx, `DROP TABLE IF EXISTS minzibar_revision, minzibar_changes, minzibar_tuples,
+			minzibar_policies, minzibar_flags, minzibar_roles`)
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		return url
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	req := testcontainers.ContainerRequest{
+		Image:        "postgres:16",
+		ExposedPorts: []string{"5432/tcp"},
+		Env:          map[string]string{"POSTGRES_PASSWORD": "minzibar", "POSTGRES_DB": "minzibar"},
+		WaitingFor:   wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(60 * time.Second),
+	}
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatalf("failed to start postgres container: %v", err)
+	}
+	t.Cleanup(func() { container.Terminate(context.Background()) })
+
+	host, err := container.Host(ctx)
+	require.NoError(t, err)
+	port, err := container.MappedPort(ctx, "5432")
+	require.NoError(t, err)
+	return fmt.Sprintf("postgres://postgres:minzibar@%s:%s/minzibar?sslmode=disable", host, port.Port())
+}
+
+func openTestPostgres(t *testing.T) *PostgresStore {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	ctx := context.Background()
+	store, err := OpenPostgresStore(ctx, setupPostgres(t, ctx))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestPostgresStore_Shared(t *testing.T) {
+	testSharedStore(t, openTestPostgres(t))
+}
+
+func TestPostgresStore_Tables(t *testing.T) {
+	ctx := context.Background()
+	store := openTestPostgres(t)
+	engine := syncedEngine(t, store).Engine()
+	require.NoError(t, engine.AddRelationQuery("document:plan user:alice->read group:eng#member->read"))
+	require.True(t, engine.deleteTuple(RelationTuple{Object: plan, Relation: "read", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}}))
+
+	// the state tables can be queried by subject
+	var object string
+	var rev int64
+	require.NoError(t, store.pool.QueryRow(ctx, `SELECT object_type || ':' || object_id, revision FROM minzibar_tuples
+		WHERE subject_type = 'group' AND subject_id = 'eng' AND subject_relation = 'member'`).Scan(&object, &rev))
+	assert.Equal(t, "document:plan", object)
+	assert.Positive(t, rev)
+
+	// a second open of the same database keeps the schema and data
+	again, err := OpenPostgresStore(ctx, store.pool.Config().ConnString())
+	require.NoError(t, err)
+	defer again.Close()
+	assert.Equal(t, engineState(engine), engineState(syncedEngine(t, again).Engine()))
+
+	_, err = store.pool.Exec(ctx, `UPDATE minzibar_revision SET pruned = revision`)
+	require.NoError(t, err)
+	_, _, err = store.Changes(ctx, 0, 10)
+	assert.ErrorIs(t, err, ErrChangesTruncated)
+}
+
+func TestCLI_ServeStore(t *testing.T) {
+	var out bytes.Buffer
+	err := runCLI([]string{"serve", "-store", "postgres://localhost/minzibar", "-tenants"}, nil, &out)
+	assert.ErrorContains(t, err, "-store cannot be combined")
+	err = runCLI([]string{"serve", "-store", "mysql://localhost/minzibar"}, nil, &out)
+	assert.ErrorContains(t, err, "unknown store")
+}
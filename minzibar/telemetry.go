@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracerName is the instrumentation name of minzibar spans
+const TracerName = "minzibar"
+
+// outcome labels of decision and check metrics
+const (
+	outcomeAllow = "allow"
+	outcomeDeny  = "deny"
+	outcomeError = "error"
+)
+
+// Telemetry measures access checks with Prometheus metrics and, given a tracer provider,
+// wraps them in OpenTelemetry spans. One Telemetry is shared by every engine of a
+// service, see Engine.SetTelemetry.
+type Telemetry struct {
+	// Registry holds the minzibar metrics and the Go runtime collectors
+	Registry *prometheus.Registry
+	tracer   trace.Tracer
+
+	verifyDuration *prometheus.HistogramVec
+	decisions      *prometheus.CounterVec
+	checkDepth     prometheus.Histogram
+	indexLookups   *prometheus.CounterVec
+	policyDuration prometheus.Histogram
+	throttled      *prometheus.CounterVec
+
+	mu sync.Mutex
+	// graphs lists the graphs to report sizes for, keyed by tenant
+	graphs func() map[string]*RelationGraph
+}
+
+// NewTelemetry registers the minzibar metrics in a new registry. Spans go to tp, a nil
+// tp disables tracing.
+func NewTelemetry(tp trace.TracerProvider) *Telemetry {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	t := &Telemetry{
+		Registry: prometheus.NewRegistry(),
+		tracer:   tp.Tracer(TracerName),
+		verifyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "minzibar_verify_duration_seconds",
+			Help:    "Time to answer one access check, policies and relation checks included.",
+			Buckets: []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"tenant", "outcome"}),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "minzibar_decisions_total",
+			Help: "Access checks by outcome: allow, deny or error.",
+		}, []string{"tenant", "outcome"}),
+		checkDepth: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minzibar_check_depth",
+			Help:    "Deepest userset hop expanded by a deep relation check.",
+			Buckets: []float64{0, 1, 2, 3, 4, 6, 8, 12, 16, 24, 32},
+		}),
+		indexLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "minzibar_membership_index_lookups_total",
+			Help: "Pairs of deep checks answered from the membership index (hit) or walked by hand (miss).",
+		}, []string{"result"}),
+		policyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minzibar_policy_evaluation_seconds",
+			Help:    "Time to evaluate the rules of one policy, relation checks included.",
+			Buckets: []float64{.000001, .000005, .00001, .00005, .0001, .0005, .001, .005, .01, .1, 1},
+		}),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "minzibar_throttled_requests_total",
+			Help: "Requests rejected with 429, by tenant and the limit hit: rate or write_quota.",
+		}, []string{"tenant", "limit"}),
+	}
+	t.Registry.MustRegister(t.verifyDuration, t.decisions, t.checkDepth, t.indexLookups, t.policyDuration, t.throttled,
+		tupleCollector{t},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return t
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (t *Telemetry) Handler() http.Handler {
+	return promhttp.HandlerFor(t.Registry, promhttp.HandlerOpts{})
+}
+
+// WatchGraphs sets the graphs whose tuple counts are reported, keyed by tenant
+func (t *Telemetry) WatchGraphs(graphs func() map[string]*RelationGraph) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.graphs = graphs
+}
+
+// SetTelemetry measures and traces the engine's checks with t, nil turns it off
+func (e *Engine) SetTelemetry(t *Telemetry) {
+	e.telemetry = t
+	e.graph.telemetry.Store(t)
+}
+
+// startVerify opens the span of one access check
+func (t *Telemetry) startVerify(ctx context.Context, tenant string, resource, subject ObjectRef, action string) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, "minzibar.Verify")
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("minzibar.tenant", tenant),
+			attribute.String("minzibar.resource", resource.String()),
+			attribute.String("minzibar.subject", subject.String()),
+			attribute.String("minzibar.action", action),
+		)
+	}
+	return ctx, span
+}
+
+// endVerify records the outcome of a check started at start and ends its span
+func (t *Telemetry) endVerify(span trace.Span, tenant string, start time.Time, allowed bool, err error) {
+	outcome := decisionOutcome(allowed, err)
+	t.verifyDuration.WithLabelValues(tenant, outcome).Observe(time.Since(start).Seconds())
+	t.decisions.WithLabelValues(tenant, outcome).Inc()
+	span.SetAttributes(attribute.String("minzibar.outcome", outcome))
+	endSpan(span, err)
+}
+
+// startCheck opens the span of one deep relation check
+func (t *Telemetry) startCheck(ctx context.Context, object ObjectRef, relation string, subject SubjectRef) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, "minzibar.CheckDeep")
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("minzibar.object", object.String()),
+			attribute.String("minzibar.relation", relation),
+			attribute.String("minzibar.subject", subject.String()),
+		)
+	}
+	return ctx, span
+}
+
+// endCheck records how far a deep check walked and ends its span
+func (t *Telemetry) endCheck(span trace.Span, found bool, stats checkStats, err error) {
+	t.checkDepth.Observe(float64(stats.depth))
+	if stats.indexHits > 0 {
+		t.indexLookups.WithLabelValues("hit").Add(float64(stats.indexHits))
+	}
+	if stats.indexMisses > 0 {
+		t.indexLookups.WithLabelValues("miss").Add(float64(stats.indexMisses))
+	}
+	span.SetAttributes(
+		attribute.Bool("minzibar.found", found),
+		attribute.Int("minzibar.depth", stats.depth),
+	)
+	endSpan(span, err)
+}
+
+// startPolicy opens the span of one policy evaluation
+func (t *Telemetry) startPolicy(ctx context.Context, ep EffectivePolicy) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, "minzibar.EvaluatePolicy")
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("minzibar.policy", ep.ID),
+			attribute.String("minzibar.policy.via", string(ep.Via)),
+		)
+	}
+	return ctx, span
+}
+
+// endPolicy records a policy evaluation started at start and ends its span
+func (t *Telemetry) endPolicy(span trace.Span, start time.Time, allowed bool, err error) {
+	t.policyDuration.Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Bool("minzibar.allowed", allowed))
+	endSpan(span, err)
+}
+
+// throttle counts a request rejected by a limit
+func (t *Telemetry) throttle(tenant, limit string) {
+	t.throttled.WithLabelValues(tenant, limit).Inc()
+}
+
+func decisionOutcome(allowed bool, err error) string {
+	switch {
+	case err != nil:
+		return outcomeError
+	case allowed:
+		return outcomeAllow
+	}
+	return outcomeDeny
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tupleCollector reports the tuples stored per tenant and object type at scrape time
+type tupleCollector struct {
+	t *Telemetry
+}
+
+var tuplesDesc = prometheus.NewDesc("minzibar_tuples", "Relation tuples stored, by tenant and object type.", []string{"tenant", "type"}, nil)
+
+func (c tupleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tuplesDesc
+}
+
+func (c tupleCollector) Collect(ch chan<- prometheus.Metric) {
+	c.t.mu.Lock()
+	graphs := c.t.graphs
+	c.t.mu.Unlock()
+	if graphs == nil {
+		return
+	}
+	for tenant, g := range graphs() {
+		for typ, count := range g.CountByType() {
+			ch <- prometheus.MustNewConstMetric(tuplesDesc, prometheus.GaugeValue, float64(count), tenant, typ)
+		}
+	}
+}
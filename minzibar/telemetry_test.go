@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// telemetryEngine has document:plan viewable by group:g1#member, with alice three groups down
+func telemetryEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	doc := engine.CreateResource("document", "plan")
+	groupChain(engine.graph, doc, SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}, 3)
+	require.NoError(t, engine.AddPolicy("p_view", `allow viewer if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(doc, "p_view"))
+	return engine
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTelemetry_Spans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	engine := telemetryEngine(t)
+	engine.SetTelemetry(NewTelemetry(tp))
+
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	ok, err := engine.Verify(doc, ObjectRef{Type: "user", ObjectID: "alice"}, "viewer", map[string]string{"department": "eng"})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	spans := exporter.GetSpans().Snapshots()
+	require.Len(t, spans, 3)
+	// spans end innermost first
+	check, policy, verify := spans[0], spans[1], spans[2]
+	assert.Equal(t, "minzibar.CheckDeep", check.Name())
+	assert.Equal(t, "minzibar.EvaluatePolicy", policy.Name())
+	assert.Equal(t, "minzibar.Verify", verify.Name())
+	assert.Equal(t, verify.SpanContext().SpanID(), policy.Parent().SpanID())
+	assert.Equal(t, policy.SpanContext().SpanID(), check.Parent().SpanID())
+	assert.Equal(t, "allow", spanAttr(verify, "minzibar.outcome").AsString())
+	assert.Equal(t, "p_view", spanAttr(policy, "minzibar.policy").AsString())
+	assert.Equal(t, int64(3), spanAttr(check, "minzibar.depth").AsInt64())
+
+	// graph checks outside Verify are traced too, and failures carry an error status
+	engine.graph.Write(RelationTuple{Object: doc, Relation: "owner", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}})
+	exporter.Reset()
+	assert.True(t, engine.graph.HasDeepRelationship(doc, "viewer", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}))
+	_, err = engine.graph.CheckDeep(context.Background(), doc, "viewer", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}, CheckOptions{MaxDepth: 1})
+	assert.ErrorIs(t, err, ErrMaxDepthExceeded)
+	spans = exporter.GetSpans().Snapshots()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "minzibar.CheckDeep", spans[0].Name())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+func TestTelemetry_Metrics(t *testing.T) {
+	telemetry := NewTelemetry(nil)
+	engine := telemetryEngine(t)
+	engine.SetTelemetry(telemetry)
+
+	doc := ObjectRef{Type: "document", ObjectID: "plan"}
+	eng := func() map[string]string { return map[string]string{"department": "eng"} }
+	for _, user := range []string{"alice", "alice", "bob"} {
+		_, err := engine.Verify(doc, ObjectRef{Type: "user", ObjectID: user}, "viewer", eng())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(telemetry.decisions.WithLabelValues("", "allow")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.decisions.WithLabelValues("", "deny")))
+
+	engine.SetCheckOptions(CheckOptions{MaxDepth: 1})
+	_, err := engine.Verify(doc, ObjectRef{Type: "user", ObjectID: "alice"}, "viewer", eng())
+	assert.ErrorIs(t, err, ErrMaxDepthExceeded)
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.decisions.WithLabelValues("", "error")))
+	engine.SetCheckOptions(CheckOptions{})
+
+	// with the index on, every pair of the chain is a hit
+	assert.Equal(t, 0, testutil.CollectAndCount(telemetry.indexLookups))
+	engine.graph.EnableMembershipIndex("member")
+	_, err = engine.Verify(doc, ObjectRef{Type: "user", ObjectID: "alice"}, "viewer", eng())
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.indexLookups.WithLabelValues("hit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.indexLookups.WithLabelValues("miss")), "document#viewer is not indexed")
+
+	families, err := telemetry.Registry.Gather()
+	require.NoError(t, err)
+	samples := map[string]uint64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if h := m.GetHistogram(); h != nil {
+				samples[f.GetName()] += h.GetSampleCount()
+			}
+		}
+	}
+	assert.Equal(t, uint64(5), samples["minzibar_verify_duration_seconds"])
+	assert.Equal(t, uint64(5), samples["minzibar_check_depth"])
+	assert.Equal(t, uint64(5), samples["minzibar_policy_evaluation_seconds"])
+}
+
+func TestService_Metrics(t *testing.T) {
+	telemetry := NewTelemetry(nil)
+	service := NewService(nil)
+	service.Telemetry = telemetry
+	service.Tenants = NewTenants(TenantQuota{})
+	service.Tenants.Setup = func(e *Engine) { e.SetTelemetry(telemetry) }
+	acme, err := service.Tenants.Create("acme", nil)
+	require.NoError(t, err)
+	for _, query := range []string{"document:plan user:alice->read", "document:memo user:alice,bob->read", "folder:root user:alice->read"} {
+		object, err := parseObjectRef(strings.Fields(query)[0])
+		require.NoError(t, err)
+		acme.CreateResource(object.Type, object.ObjectID)
+		require.NoError(t, acme.AddRelationQuery(query))
+	}
+	require.NoError(t, acme.AddPolicy("p_read", `allow read if department == "eng"`))
+	require.NoError(t, acme.AddPolicyToResource(ObjectRef{Type: "document", ObjectID: "plan"}, "p_read"))
+	_, err = service.Tenants.Create("globex", nil)
+	require.NoError(t, err)
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusOK, authRequest(t, http.DefaultClient, srv.URL+"/tenants/acme/check",
+		"", CheckQueryRequest{Query: "can user:alice read document:plan", Context: map[string]string{"department": "eng"}}))
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `minzibar_decisions_total{outcome="allow",tenant="acme"} 1`)
+	counts := acme.graph.CountByType()
+	assert.Equal(t, map[string]int{"document": 5, "folder": 2}, counts, "markers and reads")
+	assert.Contains(t, string(body), `minzibar_tuples{tenant="acme",type="document"} 5`)
+	assert.Contains(t, string(body), `minzibar_tuples{tenant="acme",type="folder"} 2`)
+	assert.NotContains(t, string(body), `tenant="globex"`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ResourceTemplate describes how a common kind of resource is created: its type, how its
+// id is built and which tuples and policies every new instance starts with.
+//
+// IDPattern, Tuples and Policies may use {placeholders}. {name} and any parameter passed to
+// CreateFromTemplate are available, plus {resource} (type:id of the new object) and
+// {creator} (the creating subject, e.g. user:alice).
+type ResourceTemplate struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	IDPattern string `json:"id_pattern"`
+	// Tuples are written in object#relation@subject form, e.g. "{resource}#owner@{creator}"
+	Tuples []string `json:"tuples,omitempty"`
+	// Policies are attached to every new instance
+	Policies []TemplatePolicy `json:"policies,omitempty"`
+}
+
+// TemplatePolicy is a policy attached by a template. When Text is set and no policy with
+// ID is registered yet, it is registered on first use.
+type TemplatePolicy struct {
+	ID   string `json:"id"`
+	Text string `json:"text,omitempty"`
+}
+
+// defaultTemplates are registered on every new engine
+var defaultTemplates = []ResourceTemplate{
+	{Name: "user", Type: "user", IDPattern: "{name}"},
+	{Name: "group", Type: "group", IDPattern: "{name}", Tuples: []string{
+		"{resource}#owner@{creator}",
+		"{resource}#member@{creator}",
+	}},
+	{Name: "org", Type: "org", IDPattern: "{name}", Tuples: []string{
+		"{resource}#owner@{creator}",
+		"{resource}#admin@{creator}",
+	}},
+	{Name: "feature_flag", Type: "feature_flag", IDPattern: "{name}", Tuples: []string{
+		"{resource}#owner@{creator}",
+	}},
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[A-Za-z0-9_]+\}`)
+
+// RegisterTemplate adds or replaces a resource template after checking it is well formed
+func (e *Engine) RegisterTemplate(t ResourceTemplate) error {
+	if t.Name == "" || t.Type == "" || t.IDPattern == "" {
+		return errors.New("template needs name, type and id_pattern")
+	}
+	for _, p := range t.Policies {
+		if p.ID == "" {
+			return fmt.Errorf("template %s: policy without id", t.Name)
+		}
+		if p.Text != "" {
+			if _, err := ParsePolicies(p.Text); err != nil {
+				return fmt.Errorf("template %s: policy %s: %v", t.Name, p.ID, err)
+			}
+		}
+	}
+	tmpl := t
+	e.mu.Lock()
+	e.templates[t.Name] = &tmpl
+	e.mu.Unlock()
+	return nil
+}
+
+// Templates returns the registered templates sorted by name
+func (e *Engine) Templates() []ResourceTemplate {
+	e.mu.RLock()
+	out := make([]ResourceTemplate, 0, len(e.templates))
+	for _, t := range e.templates {
+		out = append(out, *t)
+	}
+	e.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// CreateFromTemplate creates a resource from a registered template. Everything is expanded
+// and validated before anything is written, so a bad parameter leaves the graph untouched.
+func (e *Engine) CreateFromTemplate(templateName string, params map[string]string, creator SubjectRef) (ObjectRef, error) {
+	e.mu.RLock()
+	t, ok := e.templates[templateName]
+	e.mu.RUnlock()
+	if !ok {
+		return ObjectRef{}, fmt.Errorf("unknown template %q", templateName)
+	}
+	vars := make(map[string]string, len(params)+2)
+	for k, v := range params {
+		vars[k] = v
+	}
+	id, err := expandPlaceholders(t.IDPattern, vars)
+	if err != nil {
+		return ObjectRef{}, fmt.Errorf("id: %v", err)
+	}
+	resource := ObjectRef{Type: t.Type, ObjectID: id}
+	if strings.ContainsAny(id, ":#@ ") || id == TypeWildcard {
+		return ObjectRef{}, fmt.Errorf("invalid resource id %q", id)
+	}
+	if len(e.graph.ReadTuples(resource, "")) > 0 {
+		return ObjectRef{}, fmt.Errorf("resource %s already exists", resource)
+	}
+	vars["resource"] = resource.String()
+	if creator.Object.Type != "" {
+		vars["creator"] = creator.String()
+	}
+
+	tuples := make([]RelationTuple, 0, len(t.Tuples))
+	for _, pattern := range t.Tuples {
+		line, err := expandPlaceholders(pattern, vars)
+		if err != nil {
+			return ObjectRef{}, fmt.Errorf("tuple %q: %v", pattern, err)
+		}
+		tuple, err := ParseTuple(line)
+		if err != nil {
+			return ObjectRef{}, fmt.Errorf("tuple %q: %v", line, err)
+		}
+		tuples = append(tuples, tuple)
+	}
+	policyIDs := make([]string, 0, len(t.Policies))
+	for _, p := range t.Policies {
+		pid, err := expandPlaceholders(p.ID, vars)
+		if err != nil {
+			return ObjectRef{}, fmt.Errorf("policy %q: %v", p.ID, err)
+		}
+		if _, ok := e.policy(pid); !ok && p.Text == "" {
+			return ObjectRef{}, fmt.Errorf("policy %s is not registered", pid)
+		}
+		policyIDs = append(policyIDs, pid)
+	}
+
+	for i, tuple := range tuples {
+		if tuples[i], err = e.localTuple(tuple); err != nil {
+			return ObjectRef{}, fmt.Errorf("tuple %s: %v", FormatTuple(tuple), err)
+		}
+	}
+	newPolicies := 0
+	for _, pid := range policyIDs {
+		if _, ok := e.policy(pid); !ok {
+			newPolicies++
+		}
+	}
+	// marker, tuples and one attachment per policy
+	if err := e.checkQuota(1+len(tuples)+len(policyIDs), newPolicies); err != nil {
+		return ObjectRef{}, err
+	}
+
+	if _, err := e.AddResource(resource.Type, resource.ObjectID); err != nil {
+		return resource, err
+	}
+	for _, tuple := range tuples {
+		if err := e.writeTuple(tuple); err != nil {
+			return resource, err
+		}
+	}
+	for i, pid := range policyIDs {
+		if _, ok := e.policy(pid); !ok {
+			// validated in RegisterTemplate
+			if err := e.putPolicy(pid, NewPolicy(t.Policies[i].Text)); err != nil {
+				return resource, err
+			}
+		}
+		if err := e.AddPolicyToResource(resource, pid); err != nil {
+			return resource, err
+		}
+	}
+	return resource, nil
+}
+
+// expandPlaceholders substitutes {key} with vars[key] and fails on any unknown key
+func expandPlaceholders(pattern string, vars map[string]string) (string, error) {
+	var missing []string
+	out := placeholderPattern.ReplaceAllStringFunc(pattern, func(m string) string {
+		key := m[1 : len(m)-1]
+		v, ok := vars[key]
+		if !ok || v == "" {
+			missing = append(missing, key)
+			return m
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing value for %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
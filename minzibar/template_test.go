@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_CreateFromTemplate_Default(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+
+	flag, err := engine.CreateFromTemplate("feature_flag", map[string]string{"name": "new-dashboard"}, alice)
+	require.NoError(t, err)
+	assert.Equal(t, ObjectRef{Type: "feature_flag", ObjectID: "new-dashboard"}, flag)
+	assert.True(t, engine.CheckRelation(flag, "owner", alice))
+
+	_, err = engine.CreateFromTemplate("feature_flag", map[string]string{"name": "new-dashboard"}, alice)
+	assert.ErrorContains(t, err, "already exists")
+
+	_, err = engine.CreateFromTemplate("feature_flag", map[string]string{"name": "other"}, SubjectRef{})
+	assert.ErrorContains(t, err, "missing value for creator")
+	assert.Empty(t, engine.graph.ReadTuples(ObjectRef{Type: "feature_flag", ObjectID: "other"}, ""), "nothing is written on error")
+
+	_, err = engine.CreateFromTemplate("spaceship", nil, alice)
+	assert.Error(t, err)
+
+	names := []string{}
+	for _, tmpl := range engine.Templates() {
+		names = append(names, tmpl.Name)
+	}
+	assert.Equal(t, []string{"feature_flag", "group", "org", "user"}, names)
+}
+
+func TestEngine_CreateFromTemplate_Custom(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	require.NoError(t, engine.RegisterTemplate(ResourceTemplate{
+		Name:      "team_doc",
+		Type:      "document",
+		IDPattern: "{team}-{name}",
+		Tuples: []string{
+			"{resource}#owner@{creator}",
+			"{resource}#read@group:{team}#member",
+		},
+		Policies: []TemplatePolicy{{ID: "p_{team}_docs", Text: `allow read if department == "eng"`}},
+	}))
+	assert.Error(t, engine.RegisterTemplate(ResourceTemplate{Name: "broken"}))
+	assert.Error(t, engine.RegisterTemplate(ResourceTemplate{Name: "b", Type: "t", IDPattern: "{name}", Policies: []TemplatePolicy{{ID: "p", Text: "nope"}}}))
+
+	bob := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}
+	doc, err := engine.CreateFromTemplate("team_doc", map[string]string{"team": "eng", "name": "roadmap"}, bob)
+	require.NoError(t, err)
+	assert.Equal(t, "document:eng-roadmap", doc.String())
+	assert.True(t, engine.CheckRelation(doc, "read", SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "eng"}, Relation: "member"}))
+
+	effective := engine.GetEffectivePolicies(doc)
+	require.Len(t, effective, 1)
+	assert.Equal(t, "p_eng_docs", effective[0].ID)
+
+	_, err = engine.CreateFromTemplate("team_doc", map[string]string{"name": "x"}, bob)
+	assert.ErrorContains(t, err, "missing value for team")
+}
+
+// run with -race: templates are registered while other requests list and use them
+func TestEngine_RegisterTemplate_Concurrent(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			engine.Templates()
+			_, err := engine.CreateFromTemplate("group", map[string]string{"name": fmt.Sprintf("g%d", i)}, alice)
+			assert.NoError(t, err)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		require.NoError(t, engine.RegisterTemplate(ResourceTemplate{Name: fmt.Sprintf("t%d", i%10), Type: "document", IDPattern: "{name}"}))
+	}
+	<-done
+	assert.Len(t, engine.Templates(), 14)
+}
+
+func TestService_CreateFromTemplate(t *testing.T) {
+	service := NewService(NewEngine(NewRelationGraph(), map[string]*Policy{}))
+	e := echo.New()
+
+	body, _ := json.Marshal(map[string]string{"template": "group", "name": "eng", "creator": "user:alice"})
+	req := httptest.NewRequest(http.MethodPost, "/resource/template", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	require.NoError(t, service.handleCreateFromTemplate(e.NewContext(req, rec)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var obj ObjectRef
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &obj))
+	assert.Equal(t, ObjectRef{Type: "group", ObjectID: "eng"}, obj)
+	assert.True(t, service.Engine.CheckRelation(obj, "member", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}))
+
+	body, _ = json.Marshal(map[string]string{"template": "group", "name": "ops", "creator": "alice"})
+	req = httptest.NewRequest(http.MethodPost, "/resource/template", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	require.NoError(t, service.handleCreateFromTemplate(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
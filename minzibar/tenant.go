@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantHeader carries the tenant of a request that does not use a /tenants/:tenant path
+const TenantHeader = "X-Tenant-ID"
+
+var (
+	// ErrCrossTenant is returned (wrapped) for a reference qualified with another tenant
+	ErrCrossTenant = errors.New("cross-tenant reference")
+	// ErrQuotaExceeded is returned (wrapped) when a write would go over a tenant quota
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+	// ErrUnknownTenant is returned by Tenants.Get for a tenant that was never created
+	ErrUnknownTenant = errors.New("unknown tenant")
+)
+
+// tenantIDPattern keeps tenant ids usable in paths and as type qualifiers
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// TenantQuota caps what one tenant may store, zero means unlimited
+type TenantQuota struct {
+	MaxTuples   int `json:"max_tuples"`
+	MaxPolicies int `json:"max_policies"`
+}
+
+// TenantUsage is what a tenant stores today
+type TenantUsage struct {
+	Tuples   int `json:"tuples"`
+	Policies int `json:"policies"`
+}
+
+// TenantInfo describes one tenant for the admin API
+type TenantInfo struct {
+	ID    string      `json:"id"`
+	Quota TenantQuota `json:"quota"`
+	Usage TenantUsage `json:"usage"`
+}
+
+// Tenants holds one Engine per tenant, so tuples, policies, templates and decision
+// logs never mix. Every engine is scoped to its tenant: references qualified with
+// another tenant ("other/user:alice") are rejected and writes are held to the quota.
+type Tenants struct {
+	mu      sync.RWMutex
+	engines map[string]*Engine
+	// DefaultQuota applies to tenants created without one
+	DefaultQuota TenantQuota
+	// Setup, when set, configures each new tenant's engine
+	Setup func(*Engine)
+}
+
+// NewTenants returns an empty registry
+func NewTenants(defaultQuota TenantQuota) *Tenants {
+	return &Tenants{engines: make(map[string]*Engine), DefaultQuota: defaultQuota}
+}
+
+// Create adds a tenant with an empty engine, quota nil means DefaultQuota
+func (t *Tenants) Create(id string, quota *TenantQuota) (*Engine, error) {
+	if !tenantIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid tenant id %q: lowercase letters, digits, '-' and '_' only", id)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.engines[id]; ok {
+		return nil, fmt.Errorf("tenant %s already exists", id)
+	}
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	engine.tenant = id
+	engine.quota.limits = t.DefaultQuota
+	if quota != nil {
+		engine.quota.limits = *quota
+	}
+	if t.Setup != nil {
+		t.Setup(engine)
+	}
+	t.engines[id] = engine
+	return engine, nil
+}
+
+// Get returns the engine of a tenant
+func (t *Tenants) Get(id string) (*Engine, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	engine, ok := t.engines[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTenant, id)
+	}
+	return engine, nil
+}
+
+// Delete drops a tenant and everything it stored
+func (t *Tenants) Delete(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.engines[id]; !ok {
+		return false
+	}
+	delete(t.engines, id)
+	return true
+}
+
+// SetQuota replaces a tenant's quota; data already over the new quota is kept
+func (t *Tenants) SetQuota(id string, quota TenantQuota) error {
+	engine, err := t.Get(id)
+	if err != nil {
+		return err
+	}
+	engine.SetQuota(quota)
+	return nil
+}
+
+// List describes every tenant, sorted by id
+func (t *Tenants) List() []TenantInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	infos := make([]TenantInfo, 0, len(t.engines))
+	for _, engine := range t.engines {
+		infos = append(infos, engine.TenantInfo())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// engineMap returns a copy of the tenant engines keyed by id
+func (t *Tenants) engineMap() map[string]*Engine {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	engines := make(map[string]*Engine, len(t.engines))
+	for id, engine := range t.engines {
+		engines[id] = engine
+	}
+	return engines
+}
+
+// SetQuota replaces the engine's quota
+func (e *Engine) SetQuota(quota TenantQuota) {
+	e.quota.mu.Lock()
+	defer e.quota.mu.Unlock()
+	e.quota.limits = quota
+}
+
+// Quota returns the engine's quota
+func (e *Engine) Quota() TenantQuota {
+	e.quota.mu.Lock()
+	defer e.quota.mu.Unlock()
+	return e.quota.limits
+}
+
+// TenantInfo reports the engine's tenant, quota and usage
+func (e *Engine) TenantInfo() TenantInfo {
+	return TenantInfo{
+		ID:    e.tenant,
+		Quota: e.Quota(),
+		Usage: TenantUsage{Tuples: e.graph.Len(), Policies: e.policyCount()},
+	}
+}
+
+// localRef resolves a tenant qualified reference, "acme/user:alice" in tenant acme is
+// user:alice. A qualifier naming another tenant is rejected. Engines without a tenant
+// treat '/' as part of the type.
+func (e *Engine) localRef(o ObjectRef) (ObjectRef, error) {
+	if e.tenant == "" {
+		return o, nil
+	}
+	qualifier, typ, found := strings.Cut(o.Type, "/")
+	if !found {
+		return o, nil
+	}
+	if qualifier != e.tenant {
+		return o, fmt.Errorf("%w: %s/%s:%s from tenant %s", ErrCrossTenant, qualifier, typ, o.ObjectID, e.tenant)
+	}
+	return ObjectRef{Type: typ, ObjectID: o.ObjectID}, nil
+}
+
+// localTuple resolves both ends of a tuple with localRef
+func (e *Engine) localTuple(t RelationTuple) (RelationTuple, error) {
+	object, err := e.localRef(t.Object)
+	if err != nil {
+		return t, err
+	}
+	subject, err := e.localRef(t.Subject.Object)
+	if err != nil {
+		return t, err
+	}
+	t.Object = object
+	t.Subject.Object = subject
+	return t, nil
+}
+
+// tenantQuota is an engine's quota and the tuples and policies of writes in progress,
+// which are not stored yet but already hold their part of it
+type tenantQuota struct {
+	mu       sync.Mutex
+	limits   TenantQuota
+	tuples   int
+	policies int
+}
+
+// checkQuota fails when adding tuples and policies would go over the quota
+func (e *Engine) checkQuota(tuples, policies int) error {
+	e.quota.mu.Lock()
+	defer e.quota.mu.Unlock()
+	return e.checkQuotaLocked(tuples, policies)
+}
+
+func (e *Engine) checkQuotaLocked(tuples, policies int) error {
+	q := e.quota
+	if max := q.limits.MaxTuples; max > 0 && tuples > 0 && e.graph.Len()+q.tuples+tuples > max {
+		return fmt.Errorf("%w: tenant %s may store %d tuples", ErrQuotaExceeded, e.tenant, max)
+	}
+	if max := q.limits.MaxPolicies; max > 0 && policies > 0 && e.policyCount()+q.policies+policies > max {
+		return fmt.Errorf("%w: tenant %s may store %d policies", ErrQuotaExceeded, e.tenant, max)
+	}
+	return nil
+}
+
+// reserveQuota checks and takes room for tuples and policies in one step, so concurrent
+// writers cannot all pass the check for the last slot. The writer calls release once the
+// write is stored, when it counts by itself, or has failed.
+func (e *Engine) reserveQuota(tuples, policies int) (release func(), err error) {
+	q := e.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := e.checkQuotaLocked(tuples, policies); err != nil {
+		return nil, err
+	}
+	q.tuples += tuples
+	q.policies += policies
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.tuples -= tuples
+		q.policies -= policies
+	}, nil
+}
+
+// writeTuple is the single way the engine stores a tuple: references are scoped to the
+// tenant and a new tuple must fit in the quota
+func (e *Engine) writeTuple(t RelationTuple) error {
+	return e.writeTupleMeta(t, TupleMeta{})
+}
+
+// writeTupleMeta is writeTuple keeping metadata read from a snapshot; without a writer
+// the engine's actor is recorded
+func (e *Engine) writeTupleMeta(t RelationTuple, meta TupleMeta) error {
+	t, err := e.localTuple(t)
+	if err != nil {
+		return err
+	}
+	if e.Quota().MaxTuples > 0 && !e.graph.HasDirectRelation(t.Object, t.Relation, t.Subject) {
+		release, err := e.reserveQuota(1, 0)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if meta.CreatedBy == "" {
+		meta.CreatedBy = e.actor
+	}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now()
+	}
+	return e.logChange(func() (*Change, error) {
+		if !e.graph.WriteWithMeta(t, meta) {
+			return nil, nil
+		}
+		return &Change{Op: ChangeWrite, Tuple: &t, CreatedAt: &meta.CreatedAt, CreatedBy: meta.CreatedBy}, nil
+	})
+}
+
+// putPolicy registers or replaces a policy, a new id must fit in the quota
+func (e *Engine) putPolicy(id string, policy *Policy) error {
+	if _, ok := e.policy(id); !ok && e.Quota().MaxPolicies > 0 {
+		release, err := e.reserveQuota(0, 1)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	return e.logChange(func() (*Change, error) {
+		e.setPolicy(id, policy)
+		// a changed policy changes decisions as much as a changed tuple
+		e.graph.revision.Add(1)
+		return &Change{Op: ChangePolicy, PolicyID: id, PolicyText: policy.Text}, nil
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants_Isolation(t *testing.T) {
+	tenants := NewTenants(TenantQuota{})
+	acme, err := tenants.Create("acme", nil)
+	require.NoError(t, err)
+	globex, err := tenants.Create("globex", nil)
+	require.NoError(t, err)
+	_, err = tenants.Create("acme", nil)
+	assert.Error(t, err, "duplicate tenant")
+	_, err = tenants.Create("Bad Tenant", nil)
+	assert.Error(t, err)
+
+	doc := acme.CreateResource("document", "plan")
+	require.NoError(t, acme.AddRelation(doc, "read", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}))
+	require.NoError(t, acme.AddPolicy("p_read", `allow read if department == "eng"`))
+	require.NoError(t, acme.AddPolicyToResource(doc, "p_read"))
+
+	ctx := map[string]string{"department": "eng"}
+	ok, err := acme.Verify(doc, ObjectRef{Type: "user", ObjectID: "alice"}, "read", ctx)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the same names in another tenant see nothing
+	ok, err = globex.Verify(doc, ObjectRef{Type: "user", ObjectID: "alice"}, "read", ctx)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, globex.ListAllResources())
+	assert.Equal(t, TenantUsage{}, globex.TenantInfo().Usage)
+
+	// qualified references resolve in their own tenant and are rejected elsewhere
+	ok, err = acme.Verify(ObjectRef{Type: "acme/document", ObjectID: "plan"}, ObjectRef{Type: "acme/user", ObjectID: "alice"}, "read", ctx)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, err = globex.Verify(ObjectRef{Type: "acme/document", ObjectID: "plan"}, ObjectRef{Type: "user", ObjectID: "alice"}, "read", ctx)
+	assert.ErrorIs(t, err, ErrCrossTenant)
+	err = globex.AddRelation(ObjectRef{Type: "document", ObjectID: "x"}, "read", SubjectRef{Object: ObjectRef{Type: "acme/user", ObjectID: "alice"}})
+	assert.ErrorIs(t, err, ErrCrossTenant)
+	err = globex.AddRelationQuery("acme/document:plan user:mallory->read")
+	assert.ErrorIs(t, err, ErrCrossTenant)
+
+	// single tenant engines keep treating '/' as part of the type
+	single := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	assert.NoError(t, single.AddRelation(ObjectRef{Type: "acme/document", ObjectID: "x"}, "read", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}))
+}
+
+func TestTenants_Quota(t *testing.T) {
+	tenants := NewTenants(TenantQuota{MaxTuples: 3, MaxPolicies: 1})
+	acme, err := tenants.Create("acme", nil)
+	require.NoError(t, err)
+
+	doc, err := acme.AddResource("document", "plan")
+	require.NoError(t, err)
+	alice := SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}
+	require.NoError(t, acme.AddRelation(doc, "read", alice))
+	require.NoError(t, acme.AddRelation(doc, "read", alice), "rewriting a stored tuple costs nothing")
+	require.NoError(t, acme.AddRelation(doc, "write", alice))
+	assert.ErrorIs(t, acme.AddRelation(doc, "share", alice), ErrQuotaExceeded)
+
+	require.NoError(t, acme.AddPolicy("p1", `allow read if department == "eng"`))
+	require.NoError(t, acme.AddPolicy("p1", `allow read if department == "sales"`), "replacing a policy costs nothing")
+	assert.ErrorIs(t, acme.AddPolicy("p2", `allow read if department == "eng"`), ErrQuotaExceeded)
+
+	_, err = acme.Import(strings.NewReader("document:plan#share@user:bob\n"), SnapshotText)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	_, err = acme.CreateFromTemplate("feature_flag", map[string]string{"name": "beta"}, alice)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Empty(t, acme.graph.ReadTuples(ObjectRef{Type: "feature_flag", ObjectID: "beta"}, ""), "template is all or nothing")
+
+	require.NoError(t, tenants.SetQuota("acme", TenantQuota{}))
+	assert.NoError(t, acme.AddRelation(doc, "share", alice))
+	assert.Equal(t, TenantUsage{Tuples: 4, Policies: 1}, acme.TenantInfo().Usage)
+}
+
+func TestTenants_QuotaConcurrentWrites(t *testing.T) {
+	tenants := NewTenants(TenantQuota{MaxTuples: 20, MaxPolicies: 5})
+	acme, err := tenants.Create("acme", nil)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var written, policies atomic.Int32
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tuple := RelationTuple{Object: plan, Relation: "read", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: fmt.Sprint(i)}}}
+			if err := acme.writeTuple(tuple); err == nil {
+				written.Add(1)
+			} else {
+				assert.ErrorIs(t, err, ErrQuotaExceeded)
+			}
+			if err := acme.AddPolicy(fmt.Sprintf("p%d", i), `allow read if department == "eng"`); err == nil {
+				policies.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(20), written.Load(), "every slot is taken once")
+	assert.Equal(t, int32(5), policies.Load())
+	assert.Equal(t, TenantUsage{Tuples: 20, Policies: 5}, acme.TenantInfo().Usage)
+	assert.Zero(t, acme.quota.tuples, "nothing is left reserved")
+	assert.Zero(t, acme.quota.policies)
+}
+
+// run with -race: the quota changes while views of the engine write
+func TestTenants_SetQuotaConcurrentWrites(t *testing.T) {
+	tenants := NewTenants(TenantQuota{})
+	acme, err := tenants.Create("acme", nil)
+	require.NoError(t, err)
+	view := acme.WithActor("user:alice")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			view.CreateResource("document", fmt.Sprint(i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, tenants.SetQuota("acme", TenantQuota{MaxTuples: 1000 + i}))
+	}
+	<-done
+
+	require.NoError(t, tenants.SetQuota("acme", TenantQuota{MaxTuples: 100}))
+	assert.Equal(t, TenantQuota{MaxTuples: 100}, view.Quota(), "views share the quota")
+	assert.ErrorIs(t, view.writeTuple(RelationTuple{Object: plan, Relation: "read", Subject: SubjectRef{Object: alice}}), ErrQuotaExceeded)
+}
+
+func TestService_Tenants(t *testing.T) {
+	service := NewService(nil)
+	service.Tenants = NewTenants(TenantQuota{MaxTuples: 10})
+	srv := httptest.NewServer(service.Echo())
+	defer srv.Close()
+
+	do := func(method, path, tenantHeader string, body interface{}) (*http.Response, string) {
+		var r io.Reader
+		if body != nil {
+			payload, _ := json.Marshal(body)
+			r = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequest(method, srv.URL+path, r)
+		require.NoError(t, err)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if tenantHeader != "" {
+			req.Header.Set(TenantHeader, tenantHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp, string(out)
+	}
+
+	resp, _ := do(http.MethodPost, "/tenants", "", CreateTenantRequest{ID: "acme"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/tenants", "", CreateTenantRequest{ID: "globex", Quota: &TenantQuota{MaxTuples: 1}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = do(http.MethodPost, "/resource", "", CreateResourceRequest{Type: "document", ID: "plan"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "tenant is required")
+	resp, _ = do(http.MethodPost, "/resource", "initech", CreateResourceRequest{Type: "document", ID: "plan"})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/tenants/acme/resource", "globex", CreateResourceRequest{Type: "document", ID: "plan"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "path and header disagree")
+
+	// by path and by header
+	resp, _ = do(http.MethodPost, "/tenants/acme/resource", "", CreateResourceRequest{Type: "document", ID: "plan"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/relation", "acme", AddRelationQueryRequest{Query: "document:plan user:alice->read"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/relation", "acme", AddRelationQueryRequest{Query: "globex/document:plan user:alice->read"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// per tenant export
+	resp, body := do(http.MethodGet, "/tenants/acme/export?format=text", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "document:plan#read@user:alice")
+	resp, body = do(http.MethodGet, "/tenants/globex/export?format=text", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+
+	// quota
+	resp, _ = do(http.MethodPost, "/tenants/globex/resource", "", CreateResourceRequest{Type: "document", ID: "a"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/tenants/globex/resource", "", CreateResourceRequest{Type: "document", ID: "b"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(http.MethodPut, "/tenants/globex/quota", "", TenantQuota{MaxTuples: 5})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/tenants/globex/resource", "", CreateResourceRequest{Type: "document", ID: "b"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/tenants", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var infos []TenantInfo
+	require.NoError(t, json.Unmarshal([]byte(body), &infos))
+	require.Len(t, infos, 2)
+	assert.Equal(t, TenantInfo{ID: "acme", Quota: TenantQuota{MaxTuples: 10}, Usage: TenantUsage{Tuples: 2}}, infos[0])
+	assert.Equal(t, TenantInfo{ID: "globex", Quota: TenantQuota{MaxTuples: 5}, Usage: TenantUsage{Tuples: 2}}, infos[1])
+
+	resp, _ = do(http.MethodDelete, "/tenants/globex", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodGet, "/tenants/globex/objects", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotFormat selects the wire format used by Export and Import
+type SnapshotFormat string
+
+const (
+	// SnapshotNDJSON writes one JSON record per line, tuples, policies, roles and flags
+	SnapshotNDJSON SnapshotFormat = "ndjson"
+	// SnapshotText writes one object#relation@subject tuple per line, tuples only
+	SnapshotText SnapshotFormat = "text"
+)
+
+// ParseSnapshotFormat maps a user supplied name to a SnapshotFormat, defaulting to ndjson
+func ParseSnapshotFormat(name string) (SnapshotFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "ndjson", "jsonl":
+		return SnapshotNDJSON, nil
+	case "text", "txt", "zanzibar":
+		return SnapshotText, nil
+	}
+	return "", fmt.Errorf("unknown snapshot format %q", name)
+}
+
+const (
+	recordKindTuple  = "tuple"
+	recordKindPolicy = "policy"
+	recordKindFlag   = "flag"
+	recordKindRole   = "role"
+)
+
+// snapshotRecord is a single ndjson line
+type snapshotRecord struct {
+	Kind       string         `json:"kind"`
+	Tuple      *RelationTuple `json:"tuple,omitempty"`
+	PolicyID   string         `json:"policy_id,omitempty"`
+	PolicyText string         `json:"policy_text,omitempty"`
+	Flag       *FeatureFlag   `json:"flag,omitempty"`
+	Role       *Role          `json:"role,omitempty"`
+	// CreatedAt and CreatedBy carry a tuple's TupleMeta
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+}
+
+// ImportStats reports how many records an Import applied
+type ImportStats struct {
+	Tuples   int `json:"tuples"`
+	Policies int `json:"policies"`
+	Flags    int `json:"flags,omitempty"`
+	Roles    int `json:"roles,omitempty"`
+}
+
+// maxSnapshotLine bounds a single import line so a corrupt file cannot exhaust memory
+const maxSnapshotLine = 1 << 20
+
+// FormatTuple renders a tuple in the zanzibar text form object#relation@subject
+func FormatTuple(t RelationTuple) string {
+	return t.Object.String() + "#" + t.Relation + "@" + t.Subject.String()
+}
+
+// ParseTuple parses the zanzibar text form, e.g. "document:x#viewer@group:eng#member"
+func ParseTuple(input string) (RelationTuple, error) {
+	input = strings.TrimSpace(input)
+	objectPart, rest, found := strings.Cut(input, "#")
+	if !found {
+		return RelationTuple{}, errors.New("missing '#' between object and relation")
+	}
+	relation, subjectPart, found := strings.Cut(rest, "@")
+	if !found {
+		return RelationTuple{}, errors.New("missing '@' between relation and subject")
+	}
+	relation = strings.TrimSpace(relation)
+	if relation == "" {
+		return RelationTuple{}, errors.New("relation is empty")
+	}
+	object, err := parseObjectRef(objectPart)
+	if err != nil {
+		return RelationTuple{}, fmt.Errorf("invalid object: %v", err)
+	}
+	subjectObj, subjectRel, hasRel := strings.Cut(subjectPart, "#")
+	subject, err := parseObjectRef(subjectObj)
+	if err != nil {
+		return RelationTuple{}, fmt.Errorf("invalid subject: %v", err)
+	}
+	subjectRel = strings.TrimSpace(subjectRel)
+	if hasRel && subjectRel == "" {
+		return RelationTuple{}, errors.New("relation is empty in userset")
+	}
+	return RelationTuple{
+		Object:   object,
+		Relation: relation,
+		Subject:  SubjectRef{Object: subject, Relation: subjectRel},
+	}, nil
+}
+
+// Export streams every tuple, and for ndjson every registered policy, role and flag, to w
+func (e *Engine) Export(w io.Writer, format SnapshotFormat) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case SnapshotNDJSON:
+		enc := json.NewEncoder(bw)
+		policies := e.policies()
+		ids := make([]string, 0, len(policies))
+		for id := range policies {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			rec := snapshotRecord{Kind: recordKindPolicy, PolicyID: id, PolicyText: policies[id].Text}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		// roles come before the tuples granting them
+		for _, r := range e.Roles() {
+			r := r
+			if err := enc.Encode(snapshotRecord{Kind: recordKindRole, Role: &r}); err != nil {
+				return err
+			}
+		}
+		err := e.graph.ForEachTupleMeta(func(t RelationTuple, meta TupleMeta) error {
+			rec := snapshotRecord{Kind: recordKindTuple, Tuple: &t, CreatedBy: meta.CreatedBy}
+			if !meta.CreatedAt.IsZero() {
+				rec.CreatedAt = &meta.CreatedAt
+			}
+			return enc.Encode(rec)
+		})
+		if err != nil {
+			return err
+		}
+		// flags follow the tuples so their feature_flag objects keep the exported metadata
+		for _, f := range e.Flags() {
+			f := f
+			if err := enc.Encode(snapshotRecord{Kind: recordKindFlag, Flag: &f}); err != nil {
+				return err
+			}
+		}
+	case SnapshotText:
+		err := e.graph.ForEachTuple(func(t RelationTuple) error {
+			_, err := bw.WriteString(FormatTuple(t) + "\n")
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown snapshot format %q", format)
+	}
+	return bw.Flush()
+}
+
+// Import reads records from r and writes them into the engine as they are parsed.
+// Records before a malformed line stay applied; the error names the offending line.
+func (e *Engine) Import(r io.Reader, format SnapshotFormat) (ImportStats, error) {
+	var stats ImportStats
+	if format != SnapshotNDJSON && format != SnapshotText {
+		return stats, fmt.Errorf("unknown snapshot format %q", format)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSnapshotLine)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if format == SnapshotText {
+			t, err := ParseTuple(line)
+			if err != nil {
+				return stats, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			if err := e.writeTuple(t); err != nil {
+				return stats, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			stats.Tuples++
+			continue
+		}
+		var rec snapshotRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return stats, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		switch rec.Kind {
+		case recordKindTuple:
+			if rec.Tuple == nil {
+				return stats, fmt.Errorf("line %d: tuple record without tuple", lineNo)
+			}
+			meta := TupleMeta{CreatedBy: rec.CreatedBy}
+			if rec.CreatedAt != nil {
+				meta.CreatedAt = *rec.CreatedAt
+			}
+			if err := e.writeTupleMeta(*rec.Tuple, meta); err != nil {
+				return stats, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			stats.Tuples++
+		case recordKindPolicy:
+			if rec.PolicyID == "" {
+				return stats, fmt.Errorf("line %d: policy record without policy_id", lineNo)
+			}
+			policy, err := ParsePolicies(rec.PolicyText)
+			if err != nil {
+				return stats, fmt.Errorf("line %d: policy %s: %v", lineNo, rec.PolicyID, err)
+			}
+			if err := e.putPolicy(rec.PolicyID, policy); err != nil {
+				return stats, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			stats.Policies++
+		case recordKindFlag:
+			if rec.Flag == nil {
+				return stats, fmt.Errorf("line %d: flag record without flag", lineNo)
+			}
+			if err := e.RegisterFlag(*rec.Flag); err != nil {
+				return stats, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if err := e.SetFlagKilled(rec.Flag.Name, rec.Flag.Killed); err != nil {
+				return stats, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			stats.Flags++
+		case recordKindRole:
+			if rec.Role == nil {
+				return stats, fmt.Errorf("line %d: role record without role", lineNo)
+			}
+			if err := e.DefineRole(*rec.Role); err != nil {
+				return stats, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			stats.Roles++
+		default:
+			return stats, fmt.Errorf("line %d: unknown record kind %q", lineNo, rec.Kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("line %d: %v", lineNo+1, err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTuple(t *testing.T) {
+	tuple, err := ParseTuple("document:readme#viewer@user:alice")
+	require.NoError(t, err)
+	assert.Equal(t, RelationTuple{
+		Object:   ObjectRef{Type: "document", ObjectID: "readme"},
+		Relation: "viewer",
+		Subject:  SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}},
+	}, tuple)
+
+	tuple, err = ParseTuple("  document:readme#editor@group:eng#member ")
+	require.NoError(t, err)
+	assert.Equal(t, SubjectRef{Object: ObjectRef{Type: "group", ObjectID: "eng"}, Relation: "member"}, tuple.Subject)
+	assert.Equal(t, "document:readme#editor@group:eng#member", FormatTuple(tuple))
+
+	for _, bad := range []string{
+		"",
+		"document:readme",
+		"document:readme#viewer",
+		"document:readme#@user:alice",
+		"readme#viewer@user:alice",
+		"document:readme#viewer@alice",
+		"document:readme#viewer@group:eng#",
+	} {
+		_, err := ParseTuple(bad)
+		assert.Error(t, err, "expected error for %q", bad)
+	}
+}
+
+func newSnapshotEngine(t *testing.T) *Engine {
+	t.Helper()
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	doc := engine.CreateResource("document", "readme")
+	require.NoError(t, engine.AddRelationQuery("document:readme user:alice->read,write group:eng#member->read"))
+	engine.AddRelation(ObjectRef{Type: "group", ObjectID: "eng"}, "member", SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}})
+	require.NoError(t, engine.AddPolicy("p_read", `allow read if department == "eng"`))
+	require.NoError(t, engine.AddPolicyToResource(doc, "p_read"))
+	return engine
+}
+
+func TestEngine_ExportImport_NDJSON(t *testing.T) {
+	src := newSnapshotEngine(t)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(&buf, SnapshotNDJSON))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// 1 policy + marker + 3 relations + group member + has_policy
+	assert.Len(t, lines, 7)
+	assert.Contains(t, lines[0], `"kind":"policy"`, "policies are exported before tuples")
+
+	dst := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	stats, err := dst.Import(&buf, SnapshotNDJSON)
+	require.NoError(t, err)
+	assert.Equal(t, ImportStats{Tuples: 6, Policies: 1}, stats)
+
+	doc := ObjectRef{Type: "document", ObjectID: "readme"}
+	alice := ObjectRef{Type: "user", ObjectID: "alice"}
+	assert.True(t, dst.CheckRelation(doc, "write", SubjectRef{Object: alice}))
+	allowed, err := dst.Verify(doc, alice, "read", map[string]string{"department": "eng"})
+	require.NoError(t, err)
+	assert.True(t, allowed, "imported policy should be attached and evaluated")
+}
+
+func TestEngine_ExportImport_KeepsTupleMeta(t *testing.T) {
+	src := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	tuple := RelationTuple{Object: ObjectRef{Type: "document", ObjectID: "readme"}, Relation: "read", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "alice"}}}
+	require.NoError(t, src.WithActor("user:root").writeTuple(tuple))
+	want, ok := src.graph.TupleMeta(tuple)
+	require.True(t, ok)
+	assert.Equal(t, "user:root", want.CreatedBy)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(&buf, SnapshotNDJSON))
+	assert.Contains(t, buf.String(), `"created_by":"user:root"`)
+
+	dst := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	_, err := dst.WithActor("user:importer").Import(&buf, SnapshotNDJSON)
+	require.NoError(t, err)
+	got, ok := dst.graph.TupleMeta(tuple)
+	require.True(t, ok)
+	assert.True(t, want.CreatedAt.Equal(got.CreatedAt))
+	assert.Equal(t, "user:root", got.CreatedBy)
+
+	// the text format has no metadata, the importer is recorded
+	_, err = dst.WithActor("user:importer").Import(strings.NewReader("document:readme#read@user:bob\n"), SnapshotText)
+	require.NoError(t, err)
+	got, _ = dst.graph.TupleMeta(RelationTuple{Object: tuple.Object, Relation: "read", Subject: SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}})
+	assert.Equal(t, "user:importer", got.CreatedBy)
+}
+
+func TestEngine_ExportImport_Text(t *testing.T) {
+	src := newSnapshotEngine(t)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(&buf, SnapshotText))
+	assert.Contains(t, buf.String(), "document:readme#read@group:eng#member\n")
+
+	dst := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	stats, err := dst.Import(&buf, SnapshotText)
+	require.NoError(t, err)
+	assert.Equal(t, ImportStats{Tuples: 6}, stats)
+	assert.True(t, dst.graph.HasDeepRelationship(
+		ObjectRef{Type: "document", ObjectID: "readme"}, "read",
+		SubjectRef{Object: ObjectRef{Type: "user", ObjectID: "bob"}}))
+}
+
+func TestEngine_Import_Errors(t *testing.T) {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+
+	input := "# comment\ndocument:a#viewer@user:alice\n\nnot-a-tuple\n"
+	stats, err := engine.Import(strings.NewReader(input), SnapshotText)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 4")
+	assert.Equal(t, 1, stats.Tuples, "lines before the error stay applied")
+
+	_, err = engine.Import(strings.NewReader(`{"kind":"policy","policy_id":"p","policy_text":"permit everything"}`), SnapshotNDJSON)
+	assert.Error(t, err)
+	_, err = engine.Import(strings.NewReader(`{"kind":"banana"}`), SnapshotNDJSON)
+	assert.Error(t, err)
+	_, err = engine.Import(strings.NewReader(""), SnapshotFormat("xml"))
+	assert.Error(t, err)
+}
+
+func TestService_ExportImport(t *testing.T) {
+	src := NewService(newSnapshotEngine(t))
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/export?format=text", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, src.handleExport(e.NewContext(req, rec)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	dst := NewService(NewEngine(NewRelationGraph(), map[string]*Policy{}))
+	req = httptest.NewRequest(http.MethodPost, "/import?format=text", bytes.NewReader(rec.Body.Bytes()))
+	rec = httptest.NewRecorder()
+	require.NoError(t, dst.handleImport(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, dst.Engine.ListAllResources(), 2)
+
+	req = httptest.NewRequest(http.MethodGet, "/export?format=yaml", nil)
+	rec = httptest.NewRecorder()
+	require.NoError(t, src.handleExport(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyWordFind starts a tuple query, the listing counterpart of "can ..."
+const KeyWordFind = "find"
+
+const (
+	// DefaultTupleQueryLimit is how many tuples a query returns without a limit clause
+	DefaultTupleQueryLimit = 1000
+	// MaxTupleQueryLimit bounds the limit clause
+	MaxTupleQueryLimit = 10000
+)
+
+// tupleQueryFields are the parts of a tuple a filter can look at
+var tupleQueryFields = map[string]func(RelationTuple) string{
+	"object":           func(t RelationTuple) string { return t.Object.String() },
+	"object.type":      func(t RelationTuple) string { return t.Object.Type },
+	"object.id":        func(t RelationTuple) string { return t.Object.ObjectID },
+	"relation":         func(t RelationTuple) string { return t.Relation },
+	"subject":          func(t RelationTuple) string { return t.Subject.String() },
+	"subject.type":     func(t RelationTuple) string { return t.Subject.Object.Type },
+	"subject.id":       func(t RelationTuple) string { return t.Subject.Object.ObjectID },
+	"subject.relation": func(t RelationTuple) string { return t.Subject.Relation },
+	"subject.kind": func(t RelationTuple) string {
+		if t.Subject.Relation != "" {
+			return "userset"
+		}
+		return "concrete"
+	},
+}
+
+// TupleFilter is one condition of a tuple query. Op is =, !=, ^= (prefix) or in. An in
+// with a userset instead of a list is a join: the object or subject of the tuple must
+// hold the userset, directly or through nested usersets.
+type TupleFilter struct {
+	Field  string
+	Op     string
+	Values []string
+	Join   *RelationTuple
+}
+
+// TupleQuery lists the tuples matching every filter
+type TupleQuery struct {
+	Filters []TupleFilter
+	Limit   int
+}
+
+// ParseTupleQuery parses
+//
+//	find <field> <op> <value> [and ...] [limit N]
+//
+// for example "find object.type = document and relation in (owner, editor) and subject
+// in group:eng#member", the owners and editors of documents who are in group:eng.
+// "find" alone lists every tuple.
+func ParseTupleQuery(query string) (*TupleQuery, error) {
+	toks, err := lexTupleQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 || strings.ToLower(toks[0]) != KeyWordFind {
+		return nil, errors.New(`tuple query must start with "find"`)
+	}
+	toks = toks[1:]
+	q := &TupleQuery{Limit: DefaultTupleQueryLimit}
+	for len(toks) > 0 {
+		if strings.ToLower(toks[0]) == "limit" {
+			if len(toks) != 2 {
+				return nil, errors.New("limit must end the query and take a number")
+			}
+			n, err := strconv.Atoi(toks[1])
+			if err != nil || n < 1 || n > MaxTupleQueryLimit {
+				return nil, fmt.Errorf("limit must be between 1 and %d", MaxTupleQueryLimit)
+			}
+			q.Limit = n
+			break
+		}
+		var f TupleFilter
+		if f, toks, err = parseTupleFilter(toks); err != nil {
+			return nil, err
+		}
+		q.Filters = append(q.Filters, f)
+		if len(toks) > 0 && strings.ToLower(toks[0]) == "and" {
+			if toks = toks[1:]; len(toks) == 0 {
+				return nil, errors.New("condition expected after and")
+			}
+		} else if len(toks) > 0 && strings.ToLower(toks[0]) != "limit" {
+			return nil, fmt.Errorf("expected and or limit, got %q", toks[0])
+		}
+	}
+	return q, nil
+}
+
+// parseTupleFilter reads one condition off the front of toks
+func parseTupleFilter(toks []string) (TupleFilter, []string, error) {
+	if len(toks) < 3 {
+		return TupleFilter{}, nil, errors.New("condition must be <field> <op> <value>")
+	}
+	f := TupleFilter{Field: strings.ToLower(toks[0]), Op: strings.ToLower(toks[1])}
+	if _, ok := tupleQueryFields[f.Field]; !ok {
+		return f, nil, fmt.Errorf("unknown field %q", toks[0])
+	}
+	switch f.Op {
+	case "=", "!=", "^=":
+		f.Values = []string{toks[2]}
+		return f, toks[3:], nil
+	case "in":
+	default:
+		return f, nil, fmt.Errorf("unknown operator %q", toks[1])
+	}
+	if toks[2] != "(" {
+		if f.Field != "object" && f.Field != "subject" {
+			return f, nil, fmt.Errorf("only object and subject can be joined, %s in needs a list", f.Field)
+		}
+		object, relation, ok := strings.Cut(toks[2], "#")
+		ref, err := parseObjectRef(object)
+		if !ok || relation == "" || err != nil {
+			return f, nil, fmt.Errorf("%s in needs a list or a userset like group:eng#member, got %q", f.Field, toks[2])
+		}
+		f.Join = &RelationTuple{Object: ref, Relation: relation}
+		return f, toks[3:], nil
+	}
+	rest := toks[3:]
+	for {
+		if len(rest) < 2 {
+			return f, nil, errors.New("unterminated list")
+		}
+		f.Values = append(f.Values, rest[0])
+		sep := rest[1]
+		rest = rest[2:]
+		if sep == ")" {
+			return f, rest, nil
+		}
+		if sep != "," {
+			return f, nil, fmt.Errorf("expected , or ) in list, got %q", sep)
+		}
+	}
+}
+
+// lexTupleQuery splits a query into words, operators, parentheses and commas. Values
+// with spaces can be double quoted.
+func lexTupleQuery(query string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			toks = append(toks, string(c))
+			i++
+		case c == '=':
+			toks = append(toks, "=")
+			i++
+		case (c == '!' || c == '^') && i+1 < len(query) && query[i+1] == '=':
+			toks = append(toks, query[i:i+2])
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted value")
+			}
+			toks = append(toks, query[i+1:i+1+end])
+			i += end + 2
+		default:
+			start := i
+			for i < len(query) && !strings.ContainsRune(" \t\n\r(),=\"", rune(query[i])) &&
+				!((query[i] == '!' || query[i] == '^') && i+1 < len(query) && query[i+1] == '=') {
+				i++
+			}
+			toks = append(toks, query[start:i])
+		}
+	}
+	return toks, nil
+}
+
+// match applies the filter to t; joins are left to the caller
+func (f TupleFilter) match(t RelationTuple) bool {
+	value := tupleQueryFields[f.Field](t)
+	switch f.Op {
+	case "=":
+		return value == f.Values[0]
+	case "!=":
+		return value != f.Values[0]
+	case "^=":
+		return strings.HasPrefix(value, f.Values[0])
+	}
+	for _, v := range f.Values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// FindTuples returns the tuples matching q sorted in the text form, and whether more
+// matched than its limit. An exact object or concrete subject filter reads that
+// object's or subject's index, anything else scans the graph. Resource markers are
+// left out.
+func (e *Engine) FindTuples(ctx context.Context, q *TupleQuery) ([]RelationTuple, bool, error) {
+	var filters, joins []TupleFilter
+	var object, subject *ObjectRef
+	relation := ""
+	for _, f := range q.Filters {
+		if f.Join != nil {
+			joins = append(joins, f)
+			continue
+		}
+		filters = append(filters, f)
+		if f.Op != "=" {
+			continue
+		}
+		switch f.Field {
+		case "object":
+			if ref, err := parseObjectRef(f.Values[0]); err == nil {
+				object = &ref
+			}
+		case "subject":
+			if ref, err := parseObjectRef(f.Values[0]); err == nil && !strings.Contains(f.Values[0], "#") {
+				subject = &ref
+			}
+		case "relation":
+			relation = f.Values[0]
+		}
+	}
+
+	// joins run after the scan: a deep check must not run under the scan's shard lock
+	var candidates []RelationTuple
+	consider := func(t RelationTuple) {
+		if t.Relation == "resource" && t.Subject == resourceMarker {
+			return
+		}
+		for _, f := range filters {
+			if !f.match(t) {
+				return
+			}
+		}
+		candidates = append(candidates, t)
+	}
+	switch {
+	case object != nil:
+		for _, t := range e.graph.ReadTuples(*object, relation) {
+			consider(t)
+		}
+	case subject != nil:
+		for _, t := range e.graph.ReadTuplesBySubject(*subject, relation) {
+			consider(t)
+		}
+	default:
+		if err := e.graph.ForEachTuple(func(t RelationTuple) error {
+			consider(t)
+			return ctx.Err()
+		}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	matched := candidates[:0]
+	memberOf := make(map[RelationTuple]bool)
+	for _, t := range candidates {
+		ok := true
+		for _, f := range joins {
+			who := t.Subject
+			if f.Field == "object" {
+				who = SubjectRef{Object: t.Object}
+			}
+			key := RelationTuple{Object: f.Join.Object, Relation: f.Join.Relation, Subject: who}
+			held, seen := memberOf[key]
+			if !seen {
+				var err error
+				if held, err = e.graph.CheckDeep(ctx, f.Join.Object, f.Join.Relation, who, e.checkOpts); err != nil {
+					return nil, false, err
+				}
+				memberOf[key] = held
+			}
+			if ok = held; !ok {
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, t)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return FormatTuple(matched[i]) < FormatTuple(matched[j]) })
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultTupleQueryLimit
+	}
+	if len(matched) > limit {
+		return matched[:limit], true, nil
+	}
+	return matched, false, nil
+}
+
+// FindTuplesQuery parses a "find ..." query and runs it, see ParseTupleQuery
+func (e *Engine) FindTuplesQuery(ctx context.Context, query string) ([]RelationTuple, bool, error) {
+	q, err := ParseTupleQuery(query)
+	if err != nil {
+		return nil, false, err
+	}
+	return e.FindTuples(ctx, q)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findEngine has two documents and a folder; bob is in eng through the platform team
+func findEngine(t *testing.T) *Engine {
+	engine := NewEngine(NewRelationGraph(), map[string]*Policy{})
+	for _, line := range []string{
+		"document:plan#owner@user:alice",
+		"document:plan#owner@user:bob",
+		"document:plan#read@group:eng#member",
+		"document:roadmap#owner@user:carol",
+		"document:roadmap#editor@user:bob",
+		"folder:eng#owner@user:bob",
+		"group:eng#member@team:platform#member",
+		"team:platform#member@user:bob",
+	} {
+		tuple, err := ParseTuple(line)
+		require.NoError(t, err)
+		require.NoError(t, engine.writeTuple(tuple))
+	}
+	engine.CreateResource("document", "plan")
+	return engine
+}
+
+func findLines(t *testing.T, engine *Engine, query string) []string {
+	tuples, _, err := engine.FindTuplesQuery(context.Background(), query)
+	require.NoError(t, err)
+	lines := []string{}
+	for _, tuple := range tuples {
+		lines = append(lines, FormatTuple(tuple))
+	}
+	return lines
+}
+
+func TestFindTuples_Filters(t *testing.T) {
+	engine := findEngine(t)
+
+	assert.Equal(t, []string{
+		"document:plan#owner@user:alice",
+		"document:plan#owner@user:bob",
+		"document:plan#read@group:eng#member",
+	}, findLines(t, engine, "find object = document:plan"), "resource markers are left out")
+	assert.Equal(t, []string{
+		"document:plan#owner@user:alice",
+		"document:plan#owner@user:bob",
+		"document:roadmap#editor@user:bob",
+		"document:roadmap#owner@user:carol",
+	}, findLines(t, engine, "find object.type ^= doc and relation in (owner, editor)"))
+	assert.Equal(t, []string{
+		"document:roadmap#editor@user:bob",
+		"folder:eng#owner@user:bob",
+		"team:platform#member@user:bob",
+	}, findLines(t, engine, `find subject = user:bob and object != "document:plan"`))
+	assert.Equal(t, []string{
+		"document:plan#read@group:eng#member",
+		"group:eng#member@team:platform#member",
+	}, findLines(t, engine, "FIND subject.kind = userset"))
+	assert.Equal(t, []string{"group:eng#member@team:platform#member"},
+		findLines(t, engine, "find subject = team:platform#member and subject.relation = member"))
+	assert.Len(t, findLines(t, engine, "find"), 8)
+}
+
+func TestFindTuples_Join(t *testing.T) {
+	engine := findEngine(t)
+
+	// documents whose owner is a member of group:eng, through the platform team
+	assert.Equal(t, []string{"document:plan#owner@user:bob"},
+		findLines(t, engine, "find object.type = document and relation = owner and subject in group:eng#member"))
+
+	require.NoError(t, engine.writeTuple(RelationTuple{Object: ObjectRef{Type: "project", ObjectID: "apollo"}, Relation: "doc", Subject: SubjectRef{Object: ObjectRef{Type: "document", ObjectID: "roadmap"}}}))
+	assert.Equal(t, []string{
+		"document:roadmap#editor@user:bob",
+		"document:roadmap#owner@user:carol",
+	}, findLines(t, engine, "find object in project:apollo#doc"))
+}
+
+func TestFindTuples_Limit(t *testing.T) {
+	engine := findEngine(t)
+	tuples, truncated, err := engine.FindTuplesQuery(context.Background(), "find object.type = document limit 2")
+	require.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, "document:plan#owner@user:alice", FormatTuple(tuples[0]))
+	assert.Len(t, tuples, 2)
+
+	_, truncated, err = engine.FindTuplesQuery(context.Background(), "find object.type = document limit 5")
+	require.NoError(t, err)
+	assert.False(t, truncated)
+}
+
+func TestParseTupleQuery_Errors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"can user:alice read document:plan",
+		"find owner = user:alice",
+		"find relation ~ owner",
+		"find relation =",
+		"find relation = owner or relation = editor",
+		"find relation = owner and",
+		"find relation in (owner, editor",
+		"find relation in (owner editor)",
+		"find relation in group:eng#member",
+		"find subject in group:eng",
+		"find limit 0",
+		"find limit 5 and relation = owner",
+		`find object = "document:plan`,
+	} {
+		_, err := ParseTupleQuery(query)
+		assert.Error(t, err, query)
+	}
+	q, err := ParseTupleQuery(`find object ^= "document:" and subject in group:eng#member limit 10`)
+	require.NoError(t, err)
+	assert.Equal(t, 10, q.Limit)
+	require.Len(t, q.Filters, 2)
+	assert.Equal(t, TupleFilter{Field: "object", Op: "^=", Values: []string{"document:"}}, q.Filters[0])
+	assert.Equal(t, &RelationTuple{Object: ObjectRef{Type: "group", ObjectID: "eng"}, Relation: "member"}, q.Filters[1].Join)
+}
+
+func TestService_FindTuples(t *testing.T) {
+	engine := findEngine(t)
+	e := NewService(engine).Echo()
+	find := func(query string) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(FindTuplesRequest{Query: query})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/tuples/find", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := find("find relation = editor")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"tuples": ["document:roadmap#editor@user:bob"], "truncated": false}`, rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, find("find relation").Code)
+}
+
+func TestCLI_Find(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "graph.txt")
+	var out bytes.Buffer
+	require.NoError(t, runCLI([]string{"write", "-data", data, "document:x#owner@user:alice"}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "document:y#owner@user:bob"}, nil, &out))
+	require.NoError(t, runCLI([]string{"write", "-data", data, "group:eng#member@user:bob"}, nil, &out))
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"find", "-data", data, "relation", "=", "owner", "and", "subject", "in", "group:eng#member"}, nil, &out))
+	assert.Equal(t, "document:y#owner@user:bob\n", out.String())
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"find", "-data", data, "subject.type = user limit 1"}, nil, &out))
+	assert.Equal(t, "document:x#owner@user:alice\n# truncated at 1 tuples, raise the limit to see more\n", out.String())
+
+	// the same query against a server, and from the repl
+	srv := httptest.NewServer(NewService(findEngine(t)).Echo())
+	defer srv.Close()
+	out.Reset()
+	require.NoError(t, runCLI([]string{"find", "-server", srv.URL, "relation = editor"}, nil, &out))
+	assert.Equal(t, "document:roadmap#editor@user:bob\n", out.String())
+
+	out.Reset()
+	require.NoError(t, runCLI([]string{"repl", "-data", data}, strings.NewReader("find object = document:x\nfind object\n"), &out))
+	assert.Equal(t, "document:x#owner@user:alice\nerror: condition must be <field> <op> <value>\n", out.String())
+}